@@ -2,24 +2,91 @@ package cmd
 
 import (
 	"fmt"
+	"strconv"
 
 	"github.com/net2share/go-corelib/osdetect"
 	"github.com/net2share/go-corelib/tui"
+	"github.com/net2share/sshtun-user/internal/menu"
+	"github.com/net2share/sshtun-user/pkg/container"
 	"github.com/net2share/sshtun-user/pkg/fail2ban"
+	"github.com/net2share/sshtun-user/pkg/firewall"
 	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
-var configureNoFail2ban bool
+var (
+	configureOpts    = sshdconfig.DefaultOptions()
+	configureF2bOpts = fail2ban.DefaultOptions()
+	configureF2b     bool
+	configureAllow   []string
+	configureForce   bool
+)
 
 var configureCmd = &cobra.Command{
 	Use:   "configure",
 	Short: "Apply sshd hardening configuration",
-	RunE:  runConfigure,
+	Long: `Write the sshd drop-ins that restrict tunnel users to port forwarding,
+create the tunnel groups, reload sshd and optionally set up fail2ban.
+Once configured, running it again needs --force, which rewrites the
+drop-ins from the current template, e.g. after upgrading sshtun-user, and
+prints what changed. The previous drop-ins are saved as
+*.sshtun-user.bak and restored if sshd -t rejects the new ones; an
+AuthorizedKeysFile directive for key users is kept.
+
+Without --fail2ban or --skip-fail2ban-setup, configure asks whether to install
+fail2ban when run in a terminal and installs it otherwise, so unattended
+runs always get brute-force protection unless explicitly disabled. An
+existing jail file not written by sshtun-user is only replaced after
+confirmation in a terminal, and never otherwise.
+
+Where configuration management (Puppet, Chef, ...) owns /etc/cron.deny and
+/etc/at.deny, run every command with --skip-deny-files (or set
+SSHTUN_SKIP_DENY_FILES) so sshtun-user never edits them; they must then
+block tunnel users themselves.`,
+	Example: `  sshtun-user configure
+  sshtun-user configure --sshd-port 2222 --skip-fail2ban-setup
+  sshtun-user configure --force
+  sshtun-user configure --fail2ban --fail2ban-maxretry 3 --fail2ban-bantime 1d --fail2ban-ignoreip 10.0.0.0/8
+  sshtun-user configure --client-alive-interval 60 --max-auth-tries 5
+  sshtun-user configure --banner-text "Authorized use only. Activity is logged."
+  sshtun-user configure --allow-from 203.0.113.0/24 --allow-from 2001:db8::/32`,
+	RunE: runConfigure,
 }
 
 func init() {
-	configureCmd.Flags().BoolVar(&configureNoFail2ban, "no-fail2ban", false, "Skip fail2ban installation")
+	flags := configureCmd.Flags()
+	flags.BoolVar(&configureOpts.NoFail2ban, "skip-fail2ban-setup", false, "Skip fail2ban installation and configuration")
+	flags.BoolVar(&configureOpts.NoFail2ban, "no-fail2ban", false, "Skip fail2ban installation")
+	flags.MarkDeprecated("no-fail2ban", "use --skip-fail2ban-setup instead")
+	flags.BoolVar(&configureF2b, "fail2ban", false, "Install and configure fail2ban without prompting")
+	flags.IntVar(&configureF2bOpts.MaxRetry, "fail2ban-maxretry", configureF2bOpts.MaxRetry, "Failed attempts within 10 minutes before a ban")
+	flags.StringVar(&configureF2bOpts.BanTime, "fail2ban-bantime", configureF2bOpts.BanTime, "Initial ban duration (e.g. 30m, 1h, 1d; -1 bans permanently)")
+	flags.StringSliceVar(&configureF2bOpts.IgnoreIPs, "fail2ban-ignoreip", nil, "Addresses or CIDR ranges that are never banned (comma-separated or repeatable)")
+	flags.SetNormalizeFunc(func(f *pflag.FlagSet, name string) pflag.NormalizedName {
+		// Accept the plural spelling used elsewhere for address lists
+		if name == "fail2ban-ignore-ips" {
+			name = "fail2ban-ignoreip"
+		}
+		return pflag.NormalizedName(name)
+	})
+	flags.StringVar(&configureF2bOpts.Backend, "fail2ban-backend", "", "fail2ban log backend: auto, systemd, polling or pyinotify (default: systemd when sshd only logs to the journal)")
+	configureCmd.MarkFlagsMutuallyExclusive("fail2ban", "skip-fail2ban-setup")
+	configureCmd.MarkFlagsMutuallyExclusive("fail2ban", "no-fail2ban")
+	flags.IntVar(&configureOpts.Port, "sshd-port", 0, "Additional port for sshd to listen on, next to the Port settings in sshd_config or the default 22")
+	flags.IntVar(&configureOpts.ClientAliveInterval, "client-alive-interval", configureOpts.ClientAliveInterval, "Seconds between keepalive probes")
+	flags.IntVar(&configureOpts.ClientAliveCountMax, "client-alive-count-max", configureOpts.ClientAliveCountMax, "Unanswered keepalive probes before disconnect")
+	flags.IntVar(&configureOpts.LoginGraceTime, "login-grace-time", configureOpts.LoginGraceTime, "Seconds allowed to complete authentication")
+	flags.IntVar(&configureOpts.MaxAuthTries, "max-auth-tries", configureOpts.MaxAuthTries, "Authentication attempts allowed per connection")
+	flags.StringVar(&configureOpts.MaxStartups, "max-startups", configureOpts.MaxStartups, "Unauthenticated connection limit as start:rate:full: above start drop rate% of new connections, refuse all at full")
+	flags.BoolVar(&configureOpts.DisablePasswordAuth, "no-password-auth", false, "Disable password auth globally, except for password tunnel users (make sure you can log in with a key)")
+	flags.StringVar(&configureOpts.BannerText, "banner-text", "", "Login banner shown before authentication, e.g. \"Unauthorized access prohibited\"")
+	flags.StringVar(&configureOpts.BannerFile, "banner-file", "", "File whose content is used as the login banner")
+	configureCmd.MarkFlagsMutuallyExclusive("banner-text", "banner-file")
+	flags.StringSliceVar(&configureAllow, "allow-from", nil, "Only accept SSH connections from these addresses or CIDR ranges (nftables/iptables; repeatable)")
+	flags.BoolVar(&configureForce, "force", false, "Rewrite an existing configuration from the current template and show the changes")
+	flags.BoolVar(&configureOpts.GatewayPorts, "gateway-ports", false, "Allow remote (-R) forwards reachable from other hosts (exposes services to the network)")
 }
 
 func runConfigure(cmd *cobra.Command, args []string) error {
@@ -27,28 +94,109 @@ func runConfigure(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	if sshdconfig.IsConfigured() {
-		return fmt.Errorf("sshd is already configured. Use 'sshtun-user uninstall config' to remove configuration first")
+	reconfigure := sshdconfig.IsConfigured()
+	if reconfigure && !configureForce {
+		return fmt.Errorf("sshd is already configured. Use --force to rewrite it from the current template, or 'sshtun-user uninstall config' to remove it first")
+	}
+
+	if err := configureF2bOpts.Validate(); err != nil {
+		return err
+	}
+	if len(configureAllow) > 0 {
+		if err := (firewall.Options{Sources: configureAllow}).Validate(); err != nil {
+			return err
+		}
+		if err := firewall.CheckLockout(configureAllow); err != nil {
+			return err
+		}
+	}
+
+	osInfo := detectOS()
+
+	if configureOpts.GatewayPorts {
+		tui.PrintWarning("--gateway-ports lets tunnel users publish services from their machines on this server's public interfaces")
+	}
+
+	if configureOpts.DisablePasswordAuth {
+		tui.PrintWarning("--no-password-auth disables password login for every account except password tunnel users, including admins. Make sure you can log in with a key.")
+	}
+
+	if err := tunneluser.CheckEntropyAvailable(); err != nil {
+		tui.PrintWarning(fmt.Sprintf("%v: %s", err, tunneluser.EntropyAdvice))
 	}
 
-	osInfo, err := osdetect.Detect()
-	if err != nil {
-		tui.PrintWarning("Could not detect OS: " + err.Error())
-	} else {
-		fmt.Printf("Detected OS: %s (package manager: %s)\n", osInfo.ID, osInfo.PackageManager)
+	if !container.IsContainer() {
+		menu.WarnFirewallBlocksSSH(configureOpts.Port)
 	}
 
-	if err := sshdconfig.Configure(); err != nil {
+	configureOpts.DropInDir = sshdconfig.DropInDir
+	configureOpts.PasswordGroup = tunneluser.GroupPasswordAuth
+	configureOpts.KeyGroup = tunneluser.GroupKeyAuth
+	configureOpts.SFTPGroup = tunneluser.GroupSFTP
+	configureOpts.SkipDenyFiles = skipDenyFiles
+	if reconfigure {
+		diff, err := sshdconfig.Reconfigure(configureOpts)
+		if err != nil {
+			return err
+		}
+		if len(diff) > 0 {
+			tui.PrintBox("Configuration changes", diff)
+		} else {
+			tui.PrintInfo("sshd drop-ins already match the current template")
+		}
+	} else if err := sshdconfig.Configure(configureOpts); err != nil {
+		return err
+	}
+	if err := tunneluser.EnsureGroups(); err != nil {
 		return err
 	}
 
-	if !configureNoFail2ban {
-		if err := fail2ban.SetupWithFeedback(osInfo); err != nil {
-			tui.PrintWarning("fail2ban setup warning: " + err.Error())
+	if container.IsContainer() {
+		tui.PrintWarning("Running in a container: sshd is reloaded with SIGHUP and fail2ban is skipped. Protect the published SSH port on the host instead.")
+	} else if !configureOpts.NoFail2ban {
+		enable := true
+		if !configureF2b && stdinIsTerminal() && !fail2ban.IsInstalled() {
+			var err error
+			enable, err = menu.RunConfirm(tui.ConfirmConfig{
+				Title:       "Enable fail2ban brute-force protection?",
+				Description: fmt.Sprintf("Bans IPs after %d failed login attempts", configureF2bOpts.MaxRetry),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if enable && stdinIsTerminal() && !cmd.Flags().Changed("fail2ban-ignoreip") {
+			ips, err := menu.PromptIgnoreIPs()
+			if err != nil {
+				return err
+			}
+			configureF2bOpts.IgnoreIPs = ips
+		}
+		if enable {
+			if configureOpts.Port != 0 {
+				// The jail must also cover the port added by --sshd-port
+				configureF2bOpts.Ports = append(fail2ban.DetectPorts(), strconv.Itoa(configureOpts.Port))
+			}
+			if err := menu.SetupFail2ban(osInfo, configureF2bOpts, stdinIsTerminal()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(configureAllow) > 0 {
+		ports := firewall.DetectPorts()
+		if configureOpts.Port != 0 {
+			ports = append(ports, configureOpts.Port)
+		}
+		if err := firewall.AllowSSHFromWithOptions(firewall.Options{Sources: configureAllow, Ports: ports}); err != nil {
+			return err
 		}
 	}
 
 	fmt.Println()
 	fmt.Println("Configuration complete!")
+	if !quiet {
+		menu.PrintSetupSummary()
+	}
 	return nil
 }
@@ -1,13 +1,18 @@
 package cmd
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"os"
 
 	"github.com/net2share/go-corelib/osdetect"
 	"github.com/net2share/go-corelib/tui"
 	"github.com/net2share/sshtun-user/internal/menu"
+	"github.com/net2share/sshtun-user/pkg/container"
 	"github.com/net2share/sshtun-user/pkg/fail2ban"
+	"github.com/net2share/sshtun-user/pkg/operations"
 	"github.com/net2share/sshtun-user/pkg/sshdconfig"
 	"github.com/net2share/sshtun-user/pkg/tunneluser"
 	"github.com/spf13/cobra"
@@ -16,104 +21,251 @@ import (
 var (
 	createPassword  string
 	createPubkey    string
+	createKeyLabel  string
 	createNoFail2bn bool
+	createShell     string
+	createServer    string
+	createJSON      bool
+	createTunnel    string
+	createPermit    []string
+	createSFTP      bool
+	createHomeDir   string
+	createHome      bool
+	createTOTP      bool
+	createExpirePw  bool
+	createQR        bool
+	createQRCode    bool
+	createNote      string
+	createSFTPOnly  bool
+	createNoBlock   bool
+	createVerbose   bool
+	createAdvanced  bool
 )
 
 var createCmd = &cobra.Command{
 	Use:   "create [username]",
 	Short: "Create a new tunnel user",
-	RunE:  runCreate,
+	Long: `Create a tunnel user that can only forward ports. Without credentials
+on the command line the user is created interactively. With --json (or
+--output json) and no password, a random password is generated and printed.`,
+	Example: `  sshtun-user create alice --pubkey "ssh-ed25519 AAAA..." --key-label alice-laptop
+  SSHTUN_PASSWORD=secret sshtun-user create bob
+  sshtun-user create carol --tunnel-type forward --permit-open db.internal:5432 --json
+  sshtun-user create dave --sftp-only --password-stdin < password.txt`,
+	RunE: runCreate,
 }
 
 func init() {
 	createCmd.Flags().StringVar(&createPassword, "insecure-password", "", "Set password (WARNING: visible in process list)")
 	createCmd.Flags().StringVar(&createPubkey, "pubkey", "", "Set public key for key-based auth")
+	createCmd.Flags().StringVar(&createKeyLabel, "key-label", "", "Label stored as the public key's comment (e.g. alice-laptop)")
 	createCmd.Flags().BoolVar(&createNoFail2bn, "no-fail2ban", false, "Skip fail2ban installation")
+	createCmd.Flags().StringVar(&createShell, "shell", "", "Login shell for the user (default: detected nologin shell)")
+	createCmd.Flags().StringVar(&createServer, "server-host", "", "Server hostname or IP substituted into the printed SSH commands (default: detected public IP)")
+	createCmd.Flags().StringVar(&createServer, "server", "", "Server hostname or IP")
+	createCmd.Flags().MarkDeprecated("server", "use --server-host instead")
+	createCmd.Flags().StringVar(&createTunnel, "tunnel-type", "", "Allowed forwarding: any, socks, forward or both (default: any)")
+	createCmd.Flags().StringSliceVar(&createPermit, "permit-open", nil, "Forwarding destinations as host:port (required for --tunnel-type forward)")
+	createCmd.Flags().BoolVar(&createSFTP, "sftp", false, "Also allow chrooted SFTP access to a home directory")
+	createCmd.Flags().BoolVar(&createSFTPOnly, "sftp-only", false, "Create an SFTP-only user: password auth, file transfer without tunnels")
+	createCmd.Flags().StringVar(&createHomeDir, "home-dir", "", "Home directory (default: "+tunneluser.DefaultHomeDir+")")
+	createCmd.Flags().BoolVar(&createHome, "create-home", false, "Create the home directory, owned by the user (requires --home-dir)")
+	createCmd.Flags().BoolVar(&createAdvanced, "advanced", false, "Also ask for advanced settings (home directory) in interactive mode")
+	createCmd.Flags().BoolVar(&createTOTP, "totp", false, "Require a TOTP code after the password (needs pam_google_authenticator)")
+	createCmd.Flags().BoolVar(&createExpirePw, "force-password-change", false, "Expire the password so the user must change it at the first (terminal) login")
+	createCmd.Flags().BoolVar(&createNoBlock, "no-block-cron", false, "Let the user schedule cron and at jobs (blocked by default)")
+	createCmd.Flags().BoolVar(&createVerbose, "verbose-logging", false, "Log this user's connections at LogLevel VERBOSE (key fingerprints, forwarding requests); the global log level is unchanged")
+	createCmd.Flags().StringVar(&createNote, "note", "", "Description stored in the account comment, e.g. who the account is for")
+	createCmd.Flags().BoolVar(&createQR, "qr", false, "Also show a generated password or TOTP secret as a QR code (terminal only)")
+	createCmd.Flags().BoolVar(&createQRCode, "qr-code", false, "Show a QR code of the connection details for mobile SSH clients, and the password as a separate one (terminal only)")
+	addPasswordFlags(createCmd)
+	createCmd.Flags().BoolVar(&createJSON, "json", false, "Print the created user as JSON (shorthand for --output json)")
 }
 
 func runCreate(cmd *cobra.Command, args []string) error {
 	if err := osdetect.RequireRoot(); err != nil {
 		return err
 	}
+	if err := preparePassword(cmd); err != nil {
+		return err
+	}
+
+	if createJSON {
+		outputFormat = "json"
+	}
+	if outputJSON() || quiet {
+		tunneluser.SetOutput(io.Discard)
+		sshdconfig.SetOutput(io.Discard)
+	}
 
 	if !sshdconfig.IsConfigured() {
 		return fmt.Errorf("sshd not configured. Run 'sshtun-user configure' first")
 	}
 
-	osInfo, err := osdetect.Detect()
+	if createShell != "" {
+		if err := tunneluser.ValidateShell(createShell); err != nil {
+			return err
+		}
+	}
+
+	tunnelType, err := tunneluser.ParseTunnelType(createTunnel)
 	if err != nil {
-		tui.PrintWarning("Could not detect OS: " + err.Error())
-	} else {
-		fmt.Printf("Detected OS: %s (package manager: %s)\n", osInfo.ID, osInfo.PackageManager)
+		return err
+	}
+	if err := tunneluser.ValidatePermitOpen(createPermit); err != nil {
+		return err
+	}
+	if err := tunneluser.ValidateKeyLabel(createKeyLabel); err != nil {
+		return err
+	}
+	if err := tunneluser.ValidateNote(createNote); err != nil {
+		return fmt.Errorf("invalid --note: %w", err)
 	}
 
-	// Determine CLI vs interactive mode
-	cliMode := cmd.Flags().Changed("insecure-password") || cmd.Flags().Changed("pubkey")
+	menu.ShowQR = createQR || createQRCode
+
+	var osInfo *osdetect.OSInfo
+	if !outputJSON() {
+		osInfo = detectOS()
+	}
+
+	// Determine CLI vs interactive mode. JSON output can't drive the TUI.
+	cliMode := cmd.Flags().Changed("insecure-password") || cmd.Flags().Changed("pubkey") || outputJSON()
+	if createSFTPOnly {
+		if err := checkSFTPOnlyFlags(cmd); err != nil {
+			return err
+		}
+	}
 
+	var info *tunneluser.CreatedUserInfo
 	if cliMode {
-		return runCreateCLI(args)
+		info, err = runCreateCLI(args, tunnelType)
+	} else {
+		info, err = runCreateInteractive(cmd, args, tunnelType, osInfo)
 	}
-	return runCreateInteractive(args, osInfo)
+	if err != nil {
+		return err
+	}
+
+	return printCreatedUser(info)
 }
 
-func runCreateCLI(args []string) error {
+// printCreatedUser reports the created user in the requested output format.
+func printCreatedUser(info *tunneluser.CreatedUserInfo) error {
+	if outputJSON() {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+	for _, w := range info.Warnings {
+		tui.PrintWarning(w)
+	}
+	if quiet {
+		return nil
+	}
+
+	fmt.Println()
+	tui.PrintSuccess(fmt.Sprintf("User '%s' created successfully!", info.Username))
+	menu.PrintClientUsage(info)
+	if createQRCode {
+		menu.PrintConnectionQR(info)
+	}
+	return nil
+}
+
+func runCreateCLI(args []string, tunnelType tunneluser.TunnelType) (*tunneluser.CreatedUserInfo, error) {
 	if len(args) == 0 {
-		return fmt.Errorf("username required when using --insecure-password or --pubkey")
+		return nil, fmt.Errorf("username required when using --insecure-password, --pubkey or JSON output")
 	}
 	username := args[0]
 
 	if createPassword != "" && createPubkey != "" {
-		return fmt.Errorf("cannot specify both --insecure-password and --pubkey")
+		return nil, fmt.Errorf("cannot specify both --insecure-password and --pubkey")
+	}
+	if createSFTPOnly && createPubkey != "" {
+		return nil, fmt.Errorf("SFTP-only users authenticate with a password; --pubkey can't be combined with --sftp-only")
+	}
+	if createTOTP && createPubkey != "" {
+		return nil, fmt.Errorf("--totp only applies to password users")
+	}
+	if createExpirePw && createPubkey != "" {
+		return nil, fmt.Errorf("--force-password-change only applies to password users")
 	}
 
 	if tunneluser.Exists(username) {
-		return fmt.Errorf("user '%s' already exists. Use 'sshtun-user update %s' to modify", username, username)
+		return nil, fmt.Errorf("user '%s' already exists. Use 'sshtun-user update %s' to modify", username, username)
 	}
 
-	cfg := &tunneluser.Config{
-		Username: username,
-	}
+	in := operations.CreateInput{
+		Username:   username,
+		Shell:      createShell,
+		Server:     createServer,
+		TunnelType: tunnelType,
+		PermitOpen: createPermit,
+		EnableSFTP: createSFTP,
+		HomeDir:    createHomeDir,
+		CreateHome: createHome,
+		Note:       createNote,
 
-	if createPubkey != "" {
-		cfg.AuthMode = tunneluser.AuthModeKey
-		cfg.PublicKey = createPubkey
-	} else {
-		cfg.AuthMode = tunneluser.AuthModePassword
-		cfg.Password = createPassword
+		VerboseLogging:      createVerbose,
+		AllowScheduledTasks: createNoBlock,
 	}
-
-	if err := tunneluser.Create(cfg); err != nil {
-		return err
+	switch {
+	case createPubkey != "":
+		in.AuthMode = tunneluser.AuthModeKey
+		in.PublicKey = createPubkey
+		in.KeyLabel = createKeyLabel
+	case createSFTPOnly:
+		in.AuthMode = tunneluser.AuthModeSFTP
+		in.Password = createPassword
+	default:
+		in.AuthMode = tunneluser.AuthModePassword
+		in.Password = createPassword
+		in.EnableTOTP = createTOTP
+		in.ForcePasswordChange = createExpirePw
 	}
 
-	if cfg.AuthMode == tunneluser.AuthModeKey {
-		if err := sshdconfig.AddAuthorizedKeysDirective(); err != nil {
-			tui.PrintWarning("Could not add AuthorizedKeysFile directive: " + err.Error())
+	info, err := operations.CreateUser(in)
+	if err != nil {
+		return nil, err
+	}
+	if in.AuthMode != tunneluser.AuthModeKey && in.Password == "" && !outputJSON() {
+		menu.PrintGeneratedPassword(info.Password)
+	}
+	if info.Server == "" && !outputJSON() && !quiet {
+		if ip := menu.DetectServerIP(info.TunnelType); ip != "" {
+			fmt.Printf("Detected server IP: %s (use --server-host to override)\n", ip)
+			info.Server = ip
 		}
 	}
-
-	menu.PrintClientUsage(username, cfg.AuthMode)
-	return nil
+	return info, nil
 }
 
-func runCreateInteractive(args []string, osInfo *osdetect.OSInfo) error {
+func runCreateInteractive(cmd *cobra.Command, args []string, tunnelType tunneluser.TunnelType, osInfo *osdetect.OSInfo) (*tunneluser.CreatedUserInfo, error) {
+	if err := menu.RequireTerminal(); err != nil {
+		return nil, err
+	}
+
 	var username string
 	if len(args) > 0 {
 		username = args[0]
 		if tunneluser.Exists(username) {
-			return fmt.Errorf("user '%s' already exists. Use 'sshtun-user update %s' to modify", username, username)
+			return nil, fmt.Errorf("user '%s' already exists. Use 'sshtun-user update %s' to modify", username, username)
 		}
 	} else {
 		for {
-			value, ok, err := tui.RunInput(tui.InputConfig{
+			value, err := menu.RunInput(tui.InputConfig{
 				Title:       "Username",
 				Description: "Enter username for tunnel user",
 			})
+			if errors.Is(err, menu.ErrCancelled) {
+				return nil, cancelled("username input")
+			}
 			if err != nil {
-				return err
+				return nil, err
 			}
-			if !ok || value == "" {
-				return fmt.Errorf("username required")
+			if value == "" {
+				return nil, fmt.Errorf("username required")
 			}
 
 			// Validate
@@ -126,75 +278,172 @@ func runCreateInteractive(args []string, osInfo *osdetect.OSInfo) error {
 		}
 	}
 
-	authMode, err := tui.RunMenu(tui.MenuConfig{
-		Title: "Authentication Method",
-		Options: []tui.MenuOption{
-			{Label: "Password - simpler, suitable for shared access", Value: "password"},
-			{Label: "SSH Key - more secure, user provides public key", Value: "key"},
-		},
-	})
-	if err != nil {
-		return err
-	}
-	if authMode == "" {
-		return fmt.Errorf("authentication method required")
+	authMode := "sftp"
+	var err error
+	if !createSFTPOnly {
+		authMode, err = menu.RunMenu(tui.MenuConfig{
+			Title: "Authentication Method",
+			Options: []tui.MenuOption{
+				{Label: "Password - simpler, suitable for shared access", Value: "password"},
+				{Label: "SSH Key - more secure, user provides public key", Value: "key"},
+				{Label: "SFTP only - password, file transfer without tunnels", Value: "sftp"},
+			},
+		})
+		if errors.Is(err, menu.ErrCancelled) {
+			return nil, cancelled("authentication method selection")
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	cfg := &tunneluser.Config{
+	in := operations.CreateInput{
 		Username: username,
+		Shell:    createShell,
+		Note:     createNote,
+
+		VerboseLogging:      createVerbose,
+		AllowScheduledTasks: createNoBlock,
 	}
 
-	if authMode == "key" {
-		cfg.AuthMode = tunneluser.AuthModeKey
+	switch authMode {
+	case "key":
+		in.AuthMode = tunneluser.AuthModeKey
 		publicKey, err := menu.PromptPubkey(username)
 		if errors.Is(err, menu.ErrCancelled) {
-			return fmt.Errorf("public key input cancelled")
+			return nil, cancelled("public key input")
 		}
 		if err != nil {
-			return err
+			return nil, err
 		}
-		cfg.PublicKey = publicKey
-	} else {
-		cfg.AuthMode = tunneluser.AuthModePassword
+		in.PublicKey = publicKey
+		in.KeyLabel = createKeyLabel
+	case "sftp":
+		in.AuthMode = tunneluser.AuthModeSFTP
 		password, err := menu.PromptPassword(username)
 		if errors.Is(err, menu.ErrCancelled) {
-			return fmt.Errorf("password input cancelled")
+			return nil, cancelled("password input")
 		}
 		if err != nil {
-			return err
+			return nil, err
+		}
+		in.Password = password
+	default:
+		in.AuthMode = tunneluser.AuthModePassword
+		password, err := menu.PromptPassword(username)
+		if errors.Is(err, menu.ErrCancelled) {
+			return nil, cancelled("password input")
+		}
+		if err != nil {
+			return nil, err
+		}
+		in.Password = password
+		in.ForcePasswordChange = createExpirePw
+
+		in.EnableTOTP = createTOTP
+		if !cmd.Flags().Changed("totp") {
+			in.EnableTOTP, err = menu.PromptTOTP()
+			if err != nil {
+				return nil, err
+			}
 		}
-		cfg.Password = password
 	}
 
 	// Only prompt for fail2ban if not explicitly disabled and not already installed
-	if !createNoFail2bn && !fail2ban.IsInstalled() {
-		enableFail2ban, err := tui.RunConfirm(tui.ConfirmConfig{
+	if !createNoFail2bn && !container.IsContainer() && !fail2ban.IsInstalled() {
+		enableFail2ban, err := menu.RunConfirm(tui.ConfirmConfig{
 			Title:       "Enable fail2ban brute-force protection?",
 			Description: "Bans IPs after 5 failed login attempts",
 		})
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if enableFail2ban {
-			if err := fail2ban.SetupWithFeedback(osInfo); err != nil {
-				tui.PrintWarning("fail2ban setup warning: " + err.Error())
+			if err := menu.SetupFail2ban(osInfo, fail2ban.DefaultOptions(), true); err != nil {
+				return nil, err
 			}
 		}
 	}
 
-	if err := tunneluser.Create(cfg); err != nil {
-		return err
+	// SFTP-only users have no tunnels and a fixed chroot home
+	if in.AuthMode != tunneluser.AuthModeSFTP {
+		if err := promptTunnelAccess(cmd, &in, tunnelType); err != nil {
+			return nil, err
+		}
 	}
 
-	if cfg.AuthMode == tunneluser.AuthModeKey {
-		if err := sshdconfig.AddAuthorizedKeysDirective(); err != nil {
-			tui.PrintWarning("Could not add AuthorizedKeysFile directive: " + err.Error())
+	in.Server = createServer
+	if in.Server == "" {
+		in.Server, err = menu.PromptServer(menu.DetectServerIP(in.TunnelType))
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	fmt.Println()
-	tui.PrintSuccess(fmt.Sprintf("User '%s' created successfully!", username))
-	menu.PrintClientUsage(username, cfg.AuthMode)
+	return operations.CreateUser(in)
+}
+
+// promptTunnelAccess fills in the tunnel type, destinations, SFTP access and
+// home directory of a new tunnel user, asking for those not set by flags.
+func promptTunnelAccess(cmd *cobra.Command, in *operations.CreateInput, tunnelType tunneluser.TunnelType) error {
+	var err error
+	in.TunnelType = tunnelType
+	in.PermitOpen = createPermit
+	if !cmd.Flags().Changed("tunnel-type") {
+		in.TunnelType, err = menu.PromptTunnelType()
+		if errors.Is(err, menu.ErrCancelled) {
+			return cancelled("tunnel type selection")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	needsDestinations := in.TunnelType == tunneluser.TunnelTypeForward || in.TunnelType == tunneluser.TunnelTypeBoth
+	if needsDestinations && len(in.PermitOpen) == 0 {
+		in.PermitOpen, err = menu.PromptPermitOpen(in.TunnelType)
+		if errors.Is(err, menu.ErrCancelled) {
+			return cancelled("destination input")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	in.EnableSFTP = createSFTP
+	if !cmd.Flags().Changed("sftp") {
+		in.EnableSFTP, err = menu.RunConfirm(tui.ConfirmConfig{
+			Title:       "Enable SFTP access?",
+			Description: "Adds a chrooted home directory for file transfer (tunnels still work)",
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	in.HomeDir = createHomeDir
+	in.CreateHome = createHome
+	// Without --advanced the user gets the default home, see
+	// tunneluser.DefaultHomeDir
+	if createAdvanced && !in.EnableSFTP && !cmd.Flags().Changed("home-dir") && !cmd.Flags().Changed("create-home") {
+		in.HomeDir, err = menu.PromptHomeDir(in.Username)
+		if errors.Is(err, menu.ErrCancelled) {
+			return cancelled("home directory input")
+		}
+		if err != nil {
+			return err
+		}
+		in.CreateHome = in.HomeDir != ""
+	}
 	return nil
 }
 
+// checkSFTPOnlyFlags rejects create flags that don't apply to SFTP-only
+// users.
+func checkSFTPOnlyFlags(cmd *cobra.Command) error {
+	for _, name := range []string{"pubkey", "key-label", "totp", "force-password-change", "tunnel-type", "permit-open", "sftp", "home-dir", "create-home"} {
+		if cmd.Flags().Changed(name) {
+			return fmt.Errorf("--%s can't be combined with --sftp-only", name)
+		}
+	}
+	return nil
+}
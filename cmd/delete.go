@@ -1,9 +1,13 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 
 	"github.com/net2share/go-corelib/osdetect"
+	"github.com/net2share/sshtun-user/internal/menu"
+	"github.com/net2share/sshtun-user/pkg/operations"
 	"github.com/net2share/sshtun-user/pkg/sshdconfig"
 	"github.com/net2share/sshtun-user/pkg/tunneluser"
 	"github.com/spf13/cobra"
@@ -12,8 +16,19 @@ import (
 var deleteCmd = &cobra.Command{
 	Use:   "delete <username>",
 	Short: "Delete a tunnel user",
-	Args:  cobra.ExactArgs(1),
-	RunE:  runDelete,
+	Long: `Delete a tunnel user together with their key file, per-user sshd
+restrictions and cron/at deny entries, ending any active sessions. Only
+tunnel users can be deleted. --dry-run shows what would be removed.`,
+	Example: `  sshtun-user delete alice
+  sshtun-user delete --dry-run alice`,
+	Args: cobra.ExactArgs(1),
+	RunE: runDelete,
+}
+
+var deleteDryRun bool
+
+func init() {
+	deleteCmd.Flags().BoolVar(&deleteDryRun, "dry-run", false, "Show what would be removed without deleting anything")
 }
 
 func runDelete(cmd *cobra.Command, args []string) error {
@@ -27,12 +42,25 @@ func runDelete(cmd *cobra.Command, args []string) error {
 
 	username := args[0]
 
-	if !tunneluser.IsTunnelUser(username) {
-		return fmt.Errorf("user '%s' is not a tunnel user", username)
+	if deleteDryRun {
+		plan, err := tunneluser.DeletePlan(username)
+		if err != nil {
+			return err
+		}
+		if outputJSON() {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(plan)
+		}
+		fmt.Printf("Deleting '%s' would remove:\n", username)
+		for _, line := range menu.FormatDeletePlan(plan) {
+			fmt.Println("  " + line)
+		}
+		return nil
 	}
 
-	if err := tunneluser.Delete(username); err != nil {
-		return fmt.Errorf("failed to delete user: %w", err)
+	if err := operations.DeleteUser(username); err != nil {
+		return err
 	}
 
 	fmt.Printf("User '%s' deleted successfully.\n", username)
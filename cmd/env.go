@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// defaultConfigFile is read when present and --config is not given.
+const defaultConfigFile = "/etc/sshtun-user/config.yaml"
+
+// envAliases maps flags to environment variables that don't follow the
+// SSHTUN_<FLAG_NAME> convention.
+var envAliases = map[string]string{
+	"insecure-password": "SSHTUN_PASSWORD",
+}
+
+// legacyKeys maps renamed flags to their old name, which is still read from
+// the environment and config file (e.g. SSHTUN_NO_FAIL2BAN).
+var legacyKeys = map[string]string{
+	"skip-fail2ban-setup": "no-fail2ban",
+}
+
+// commandLineOnly are the persistent flags never filled from the environment
+// or the config file: --config names the file itself, and a stray
+// SSHTUN_CONFIG_DIR or config-dir key must not silently re-root every system
+// path.
+var commandLineOnly = map[string]bool{
+	"config":     true,
+	"config-dir": true,
+}
+
+// envLocalFlags are the command-local flags that are also filled from the
+// environment and the config file. Other local flags, such as --force,
+// --i-know-what-im-doing or --dry-run, confirm or shape a single invocation
+// and are only read from the command line; a config key meant for one
+// command would otherwise also apply to every other command with a flag of
+// that name.
+var envLocalFlags = map[string]bool{
+	"insecure-password":   true,
+	"no-fail2ban":         true,
+	"skip-fail2ban-setup": true,
+	"sshd-port":           true,
+}
+
+// envSettable reports whether cmd's flag f may be filled from the
+// environment or the config file: the persistent flags other than
+// commandLineOnly, and envLocalFlags.
+func envSettable(cmd *cobra.Command, f *pflag.Flag) bool {
+	if commandLineOnly[f.Name] {
+		return false
+	}
+	persistent := cmd.PersistentFlags().Lookup(f.Name) == f || cmd.InheritedFlags().Lookup(f.Name) == f
+	return persistent || envLocalFlags[f.Name]
+}
+
+// envFilled holds the flags the last applyEnvAndConfig call set from the
+// environment or the config file.
+var envFilled = map[string]bool{}
+
+// flagOnCommandLine reports whether the named flag was given on the command
+// line rather than filled from the environment or the config file.
+func flagOnCommandLine(cmd *cobra.Command, name string) bool {
+	f := cmd.Flags().Lookup(name)
+	return f != nil && f.Changed && !envFilled[f.Name]
+}
+
+// newViper returns a viper instance reading SSHTUN_* environment variables
+// and, when present, the config file.
+func newViper(cmd *cobra.Command) (*viper.Viper, error) {
+	v := viper.New()
+	v.SetEnvPrefix("SSHTUN")
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.AutomaticEnv()
+	for flag, env := range envAliases {
+		if err := v.BindEnv(flag, env); err != nil {
+			return nil, err
+		}
+	}
+
+	v.SetConfigFile(configFile)
+	if err := v.ReadInConfig(); err != nil {
+		// A missing default config file is fine; an explicit one must exist.
+		var notFound viper.ConfigFileNotFoundError
+		if cmd.Flags().Changed("config") || !(errors.As(err, &notFound) || os.IsNotExist(err)) {
+			return nil, fmt.Errorf("failed to read config file %s: %w", configFile, err)
+		}
+	}
+	return v, nil
+}
+
+// exclusiveFlagChanged reports whether a flag that is mutually exclusive with
+// f was set on the command line, which overrides f's environment or config
+// file value instead of conflicting with it.
+func exclusiveFlagChanged(cmd *cobra.Command, f *pflag.Flag) bool {
+	for _, group := range f.Annotations["cobra_annotation_mutually_exclusive"] {
+		for _, name := range strings.Fields(group) {
+			if other := cmd.Flags().Lookup(name); other != nil && other != f && other.Changed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyEnvAndConfig fills the envSettable flags not set on the command line
+// from the environment or the config file, in that order of precedence.
+func applyEnvAndConfig(cmd *cobra.Command) error {
+	v, err := newViper(cmd)
+	if err != nil {
+		return err
+	}
+
+	envFilled = map[string]bool{}
+	var firstErr error
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		// Deprecated aliases are filled through their replacement's legacy key
+		if f.Changed || f.Deprecated != "" || !envSettable(cmd, f) {
+			return
+		}
+		if exclusiveFlagChanged(cmd, f) {
+			return
+		}
+		key := f.Name
+		if !v.IsSet(key) {
+			key = legacyKeys[f.Name]
+			if key == "" || !v.IsSet(key) {
+				return
+			}
+		}
+		value := v.Get(key)
+		var s string
+		switch val := value.(type) {
+		case []interface{}:
+			parts := make([]string, len(val))
+			for i, p := range val {
+				parts[i] = fmt.Sprint(p)
+			}
+			s = strings.Join(parts, ",")
+		default:
+			s = fmt.Sprint(val)
+		}
+		if err := cmd.Flags().Set(f.Name, s); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("invalid value for %s: %w", f.Name, err)
+		}
+		envFilled[f.Name] = true
+	})
+	return firstErr
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// parseRootFlags returns a command carrying the root's persistent flags,
+// parsed from args, and resets the flags when the test ends.
+func parseRootFlags(t *testing.T, args ...string) *cobra.Command {
+	t.Helper()
+	cmd := &cobra.Command{Use: "test"}
+	cmd.PersistentFlags().AddFlagSet(rootCmd.PersistentFlags())
+	t.Cleanup(func() {
+		cmd.Flags().VisitAll(func(f *pflag.Flag) {
+			if f.Changed {
+				f.Value.Set(f.DefValue)
+				f.Changed = false
+			}
+		})
+		envFilled = map[string]bool{}
+	})
+	if err := cmd.ParseFlags(args); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func TestConfigDirNotFilledFromEnvOrConfig(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config.yaml")
+	content := "config-dir: " + filepath.Join(dir, "from-config") + "\nkey-group: tunnel-keys\n"
+	if err := os.WriteFile(config, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SSHTUN_CONFIG_DIR", filepath.Join(dir, "from-env"))
+	t.Setenv("SSHTUN_CONFIG", filepath.Join(dir, "missing.yaml"))
+
+	cmd := parseRootFlags(t, "--config", config)
+	if err := applyEnvAndConfig(cmd); err != nil {
+		t.Fatalf("applyEnvAndConfig: %v", err)
+	}
+	if configDir != "" {
+		t.Errorf("config-dir = %q, want it only settable on the command line", configDir)
+	}
+	if configFile != config {
+		t.Errorf("config = %q, want %q", configFile, config)
+	}
+	// Other keys of the same file still apply
+	if keyGroup != "tunnel-keys" {
+		t.Errorf("key-group = %q, want the config file's value", keyGroup)
+	}
+}
+
+func TestLocalFlagsFilledOnlyWhenAllowed(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config.yaml")
+	content := "force: true\ndry-run: true\nsshd-port: 2222\nkey-group: from-config\n"
+	if err := os.WriteFile(config, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SSHTUN_I_KNOW_WHAT_IM_DOING", "1")
+
+	root := parseRootFlags(t, "--config", config)
+	cmd := &cobra.Command{Use: "sub"}
+	root.AddCommand(cmd)
+	force := cmd.Flags().Bool("force", false, "")
+	ack := cmd.Flags().Bool("i-know-what-im-doing", false, "")
+	dryRun := cmd.Flags().Bool("dry-run", false, "")
+	port := cmd.Flags().Int("sshd-port", 0, "")
+	if err := cmd.ParseFlags(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := applyEnvAndConfig(cmd); err != nil {
+		t.Fatalf("applyEnvAndConfig: %v", err)
+	}
+	if *force || *ack || *dryRun {
+		t.Errorf("force, i-know-what-im-doing, dry-run = %v, %v, %v; want them only settable on the command line", *force, *ack, *dryRun)
+	}
+	if *port != 2222 {
+		t.Errorf("sshd-port = %d, want the config file's value", *port)
+	}
+	if keyGroup != "from-config" {
+		t.Errorf("key-group = %q, want the config file's value", keyGroup)
+	}
+}
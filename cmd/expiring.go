@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/net2share/go-corelib/osdetect"
+	"github.com/net2share/go-corelib/tui"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+	"github.com/spf13/cobra"
+)
+
+var expiringWithin string
+
+var expiringCmd = &cobra.Command{
+	Use:   "expiring",
+	Short: "List tunnel users whose accounts expire soon",
+	Long: `List tunnel users whose accounts expire within the given window,
+including accounts that have already expired. Users without an expiry
+date never expire and are not listed.`,
+	RunE: runExpiring,
+}
+
+func init() {
+	expiringCmd.Flags().StringVar(&expiringWithin, "within", "7d", "Time window, in days (e.g. 7d) or as a Go duration (e.g. 36h)")
+}
+
+func runExpiring(cmd *cobra.Command, args []string) error {
+	if err := osdetect.RequireRoot(); err != nil {
+		return err
+	}
+
+	within, err := parseDuration(expiringWithin)
+	if err != nil {
+		return err
+	}
+
+	users, err := tunneluser.ExpiringWithin(within)
+	if err != nil {
+		return fmt.Errorf("failed to check expiry: %w", err)
+	}
+
+	if outputJSON() {
+		if users == nil {
+			users = []tunneluser.UserInfo{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(users)
+	}
+
+	if len(users) == 0 {
+		if !quiet {
+			tui.PrintInfo(fmt.Sprintf("No tunnel users expire within %s.", expiringWithin))
+		}
+		return nil
+	}
+
+	now := time.Now()
+	for _, u := range users {
+		status := "expires"
+		if u.ExpiresAt.Before(now) {
+			status = "expired"
+		}
+		fmt.Printf("%s (%s auth) %s %s\n", u.Username, u.AuthMode, status, u.ExpiresAt.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// parseDuration parses a Go duration, additionally accepting whole days
+// with a "d" suffix.
+func parseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/cobra/doc"
+)
+
+var (
+	gendocsFormat string
+	gendocsDir    string
+)
+
+var gendocsCmd = &cobra.Command{
+	Use:   "gendocs",
+	Short: "Generate man pages or markdown/reST reference docs",
+	Long: `Generate reference documentation for every command: man pages
+(sshtun-user.1, sshtun-user-create.1, ...), markdown for the GitHub wiki or
+reStructuredText for Sphinx. Used at build time; root is not required.`,
+	Example: `  sshtun-user gendocs --format man --dir /usr/share/man/man1/
+  sshtun-user gendocs --format markdown --dir docs/`,
+	Hidden: true,
+	Args:   cobra.NoArgs,
+	RunE:   runGendocs,
+}
+
+func init() {
+	gendocsCmd.Flags().StringVar(&gendocsFormat, "format", "man", "Output format: man, markdown or rst")
+	gendocsCmd.Flags().StringVar(&gendocsDir, "dir", ".", "Directory to write the documentation to")
+}
+
+func runGendocs(cmd *cobra.Command, args []string) error {
+	if err := os.MkdirAll(gendocsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	// Leave out the generation date so rebuilt docs are reproducible
+	root := cmd.Root()
+	root.DisableAutoGenTag = true
+
+	var err error
+	switch gendocsFormat {
+	case "man":
+		err = doc.GenManTree(root, &doc.GenManHeader{
+			Title:   "SSHTUN-USER",
+			Section: "1",
+			Source:  "sshtun-user " + Version,
+			Manual:  "sshtun-user Manual",
+		}, gendocsDir)
+	case "markdown":
+		err = doc.GenMarkdownTree(root, gendocsDir)
+	case "rst":
+		err = doc.GenReSTTree(root, gendocsDir)
+	default:
+		return fmt.Errorf("invalid format %q: must be man, markdown or rst", gendocsFormat)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to generate %s docs: %w", gendocsFormat, err)
+	}
+
+	if !quiet {
+		fmt.Printf("Documentation written to %s\n", gendocsDir)
+	}
+	return nil
+}
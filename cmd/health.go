@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/net2share/go-corelib/osdetect"
+	"github.com/net2share/sshtun-user/pkg/operations"
+	"github.com/spf13/cobra"
+)
+
+// exitUnhealthy is the exit status of health-check when a required check
+// fails, CRITICAL in Nagios terms. Errors running the checks exit with 1.
+const exitUnhealthy = 2
+
+var healthCheckFailFast bool
+
+var healthCheckCmd = &cobra.Command{
+	Use:   "health-check",
+	Short: "Check that tunnel users can log in",
+	Long: `Check that tunnel users can log in. The checks are:
+  - sshd is configured and running
+  - its config is valid, sshd actually reads the managed drop-in and the
+    drop-ins are unchanged
+  - the tunnel groups exist
+  - the AuthorizedKeysFile directive is in place once there are key users,
+    and sshd -T confirms key users get it
+  - the key directory and key files are root:root with mode 0755/0644
+  - key users have a key and password users an unlocked password
+  - fail2ban is running if its jail is installed
+
+Exits 0 when healthy, 2 when a required check fails and 1 when the checks
+couldn't run, for use as a Kubernetes probe or a Nagios check.`,
+	Example: `  sshtun-user health-check
+  sshtun-user health-check --fail-fast -o json`,
+	Args: cobra.NoArgs,
+	RunE: runHealthCheck,
+}
+
+func init() {
+	healthCheckCmd.Flags().BoolVar(&healthCheckFailFast, "fail-fast", false, "Stop at the first failed check")
+}
+
+func runHealthCheck(cmd *cobra.Command, args []string) error {
+	if err := osdetect.RequireRoot(); err != nil {
+		return err
+	}
+
+	report, err := operations.HealthCheckWithOptions(operations.HealthCheckOptions{FailFast: healthCheckFailFast})
+
+	if outputJSON() {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if encErr := enc.Encode(report); encErr != nil {
+			return encErr
+		}
+		return err
+	}
+	if !quiet {
+		for _, c := range report.Checks {
+			status := "ok"
+			switch {
+			case !c.OK && c.Required:
+				status = "FAIL"
+			case !c.OK:
+				status = "warn"
+			}
+			line := fmt.Sprintf("%-4s  %s", status, c.Name)
+			if c.Detail != "" {
+				line += ": " + c.Detail
+			}
+			fmt.Println(line)
+		}
+	}
+	return err
+}
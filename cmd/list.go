@@ -1,19 +1,69 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"time"
 
 	"github.com/net2share/go-corelib/osdetect"
 	"github.com/net2share/go-corelib/tui"
+	"github.com/net2share/sshtun-user/internal/menu"
 	"github.com/net2share/sshtun-user/pkg/sshdconfig"
 	"github.com/net2share/sshtun-user/pkg/tunneluser"
 	"github.com/spf13/cobra"
 )
 
+var (
+	listPlain    bool
+	listAuthMode string
+	listFilter   string
+	listWarnDays int
+)
+
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List all tunnel users",
-	RunE:  runList,
+	Long: `List tunnel users with their auth mode, status, expiry date and number
+of public keys. --auth-mode and --filter can be combined, e.g. to list the
+key users whose name matches a pattern.
+
+--expiry-warning-days n warns, below the list, about the listed users whose
+accounts expire within n days or have already expired. With -o json it
+prints only those users, e.g. for a cron job that mails an alert.`,
+	Example: `  sshtun-user list
+  sshtun-user list --plain
+  sshtun-user list --auth-mode key -o json
+  sshtun-user list --auth-mode key --filter '^team-'
+  sshtun-user list --auth-mode password -o json | jq -r '.[].username'
+  sshtun-user list --expiry-warning-days 7
+  sshtun-user list --expiry-warning-days 7 -o json | mail -s "Expiring tunnel accounts" admin@example.com`,
+	RunE: runList,
+}
+
+func init() {
+	listCmd.Flags().BoolVar(&listPlain, "plain", false, "Print one 'name (mode auth)' line per user for scripts")
+	listCmd.Flags().StringVar(&listAuthMode, "auth-mode", "", "Only list users with this auth mode: key, password or sftp")
+	listCmd.Flags().StringVar(&listFilter, "filter", "", "Only list users whose name matches this regular expression")
+	listCmd.Flags().IntVar(&listWarnDays, "expiry-warning-days", 0, "Warn about users whose accounts expire within this many days")
+	listCmd.MarkFlagsMutuallyExclusive("plain", "expiry-warning-days")
+}
+
+// filterByName returns the users whose name, as returned by name, matches
+// pattern. A nil pattern keeps every user.
+func filterByName[T any](users []T, pattern *regexp.Regexp, name func(T) string) []T {
+	if pattern == nil || users == nil {
+		return users
+	}
+	filtered := []T{}
+	for _, u := range users {
+		if pattern.MatchString(name(u)) {
+			filtered = append(filtered, u)
+		}
+	}
+	return filtered
 }
 
 func runList(cmd *cobra.Command, args []string) error {
@@ -21,26 +71,104 @@ func runList(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	mode := tunneluser.AuthMode(listAuthMode)
+	if mode != "" && mode != tunneluser.AuthModeKey && mode != tunneluser.AuthModePassword && mode != tunneluser.AuthModeSFTP {
+		return fmt.Errorf("invalid auth mode %q: must be key, password or sftp", listAuthMode)
+	}
+	var pattern *regexp.Regexp
+	if listFilter != "" {
+		var err error
+		if pattern, err = regexp.Compile(listFilter); err != nil {
+			return fmt.Errorf("invalid --filter: %w", err)
+		}
+	}
+
 	if !sshdconfig.IsConfigured() {
 		return fmt.Errorf("sshd not configured. Run 'sshtun-user configure' first")
 	}
 
-	users, err := tunneluser.List()
+	warnExpiry := cmd.Flags().Changed("expiry-warning-days")
+	var expiring []tunneluser.UserInfo
+	if warnExpiry {
+		var err error
+		if expiring, err = tunneluser.GetExpiringUsers(listWarnDays); err != nil {
+			return fmt.Errorf("failed to check expiry: %w", err)
+		}
+		expiring = filterByName(expiring, pattern, func(u tunneluser.UserInfo) string { return u.Username })
+		if mode != "" {
+			expiring = slices.DeleteFunc(expiring, func(u tunneluser.UserInfo) bool { return u.AuthMode != mode })
+		}
+	}
+
+	if listPlain {
+		users, err := tunneluser.ListByAuthMode(mode)
+		if err != nil {
+			return fmt.Errorf("failed to list users: %w", err)
+		}
+		users = filterByName(users, pattern, func(u tunneluser.UserInfo) string { return u.Username })
+		for _, user := range users {
+			fmt.Printf("%s (%s auth)\n", user.Username, user.AuthMode)
+		}
+		return nil
+	}
+
+	users, err := tunneluser.ListDetailedByAuthMode(mode)
 	if err != nil {
 		return fmt.Errorf("failed to list users: %w", err)
 	}
+	users = filterByName(users, pattern, func(u tunneluser.UserDetails) string { return u.Username })
 
-	items := make([]string, len(users))
-	for i, user := range users {
-		items[i] = fmt.Sprintf("%s (%s auth)", user.Username, user.AuthMode)
+	if outputJSON() {
+		var v any = users
+		if warnExpiry {
+			if expiring == nil {
+				expiring = []tunneluser.UserInfo{}
+			}
+			v = expiring
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	var items []string
+	if len(users) > 0 {
+		items = menu.FormatUserTable(users)
 	}
 
 	// Set app info for fullscreen footer
 	tui.SetAppInfo("sshtun-user", Version, BuildTime)
 
-	return tui.ShowList(tui.ListConfig{
-		Title:     "Tunnel Users",
+	title := "Tunnel Users"
+	switch {
+	case mode != "":
+		title = fmt.Sprintf("Tunnel Users (%s auth)", mode)
+	case tunneluser.MaxUsers > 0:
+		title = fmt.Sprintf("Tunnel Users (%d of %d)", len(users), tunneluser.MaxUsers)
+	}
+
+	if err := tui.ShowList(tui.ListConfig{
+		Title:     title,
 		Items:     items,
 		EmptyText: "No tunnel users found.",
-	})
+	}); err != nil {
+		return err
+	}
+	// The list runs on the alternate screen, so the warnings come after it
+	warnExpiring(expiring)
+	return nil
+}
+
+// warnExpiring prints a warning for each user in expiring, as returned by
+// tunneluser.GetExpiringUsers.
+func warnExpiring(expiring []tunneluser.UserInfo) {
+	now := time.Now()
+	for _, u := range expiring {
+		if u.ExpiresAt.Before(now) {
+			tui.PrintWarning(fmt.Sprintf("%s (%s auth) expired on %s", u.Username, u.AuthMode, u.ExpiresAt.Format("2006-01-02")))
+			continue
+		}
+		days := int(time.Until(*u.ExpiresAt).Hours() / 24)
+		tui.PrintWarning(fmt.Sprintf("%s (%s auth) expires on %s (in %d days)", u.Username, u.AuthMode, u.ExpiresAt.Format("2006-01-02"), days))
+	}
 }
@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"regexp"
+	"slices"
+	"testing"
+)
+
+func TestFilterByName(t *testing.T) {
+	users := []string{"tunnel-alice", "tunnel-bob", "tunnel-alfred"}
+	name := func(u string) string { return u }
+
+	if got := filterByName(users, nil, name); !slices.Equal(got, users) {
+		t.Errorf("filterByName(nil pattern) = %v, want every user", got)
+	}
+	if got := filterByName(users, regexp.MustCompile("-al"), name); !slices.Equal(got, []string{"tunnel-alice", "tunnel-alfred"}) {
+		t.Errorf("filterByName(-al) = %v", got)
+	}
+	if got := filterByName(users, regexp.MustCompile("^carol$"), name); got == nil || len(got) != 0 {
+		t.Errorf("filterByName(no match) = %#v, want an empty list", got)
+	}
+}
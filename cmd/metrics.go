@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/net2share/sshtun-user/pkg/metrics"
+	"github.com/spf13/cobra"
+)
+
+var metricsListen string
+
+var metricsCmd = &cobra.Command{
+	Use:   "metrics",
+	Short: "Serve Prometheus metrics over HTTP",
+	Long: `Serve Prometheus metrics on /metrics.
+
+Metrics are refreshed on every scrape and the server never modifies any
+state. Root is not required, but without it the locked-user count,
+expiring-user count and fail2ban ban count cannot be read and are omitted.`,
+	RunE: runMetrics,
+}
+
+func init() {
+	metricsCmd.Flags().StringVar(&metricsListen, "listen", ":9100", "Address to listen on")
+}
+
+func runMetrics(cmd *cobra.Command, args []string) error {
+	fmt.Printf("Serving metrics on %s/metrics\n", metricsListen)
+	return metrics.ListenAndServe(metricsListen)
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/net2share/go-corelib/osdetect"
+	"github.com/net2share/go-corelib/tui"
+	"github.com/net2share/sshtun-user/pkg/operations"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+	"github.com/spf13/cobra"
+)
+
+var migrateDryRun bool
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Bring users created by older versions up to current conventions",
+	Long: `Re-apply the current conventions to every tunnel user: key files are
+rewritten with the current --key-options in the --key-storage layout, and
+the account comment records the auth mode of the user's tunnel group and
+the running sshtun-user version. health-check lists users created by an
+older version. A user in more than one tunnel group is reported; fix it
+with 'sshtun-user repair'. --dry-run shows what would change. Running
+migrate again changes nothing.`,
+	Example: `  sshtun-user migrate --dry-run
+  sshtun-user migrate`,
+	Args: cobra.NoArgs,
+	RunE: runMigrate,
+}
+
+func init() {
+	migrateCmd.Flags().BoolVar(&migrateDryRun, "dry-run", false, "Show what would change without changing anything")
+}
+
+func runMigrate(cmd *cobra.Command, args []string) error {
+	if err := osdetect.RequireRoot(); err != nil {
+		return err
+	}
+	tunneluser.SetOutput(io.Discard)
+
+	results, err := operations.MigrateUsers(migrateDryRun)
+	if outputJSON() {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if encErr := enc.Encode(struct {
+			DryRun bool                       `json:"dry_run"`
+			Users  []tunneluser.MigrateResult `json:"users"`
+		}{migrateDryRun, append([]tunneluser.MigrateResult{}, results...)}); encErr != nil {
+			return encErr
+		}
+		return err
+	}
+	if !quiet {
+		verb := "Migrated"
+		if migrateDryRun {
+			verb = "Would migrate"
+		}
+		for _, r := range results {
+			if len(r.Changes) > 0 {
+				tui.PrintSuccess(fmt.Sprintf("%s %s: %s", verb, r.Username, strings.Join(r.Changes, "; ")))
+			}
+			for _, w := range r.Warnings {
+				tui.PrintWarning(fmt.Sprintf("%s: %s", r.Username, w))
+			}
+		}
+		if err == nil && len(results) == 0 {
+			tui.PrintInfo("All users follow the current conventions, nothing to migrate")
+		}
+	}
+	return err
+}
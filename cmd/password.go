@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// insecurePasswordWarning is printed to stderr when --insecure-password is
+// given on the command line.
+const insecurePasswordWarning = `WARNING: --insecure-password exposes the password.
+  While sshtun-user runs, any local user can read it from /proc/<pid>/cmdline
+  or with process monitors such as ps and top, and your shell saves it in its
+  history file. Use one of these instead:
+    --password-stdin           read the password from standard input
+    SSHTUN_PASSWORD=<password> pass it in the environment
+    (no password flag)         enter it at the interactive prompt
+  Pass --i-understand-insecure-password to silence this warning.
+`
+
+// addPasswordFlags adds --password-stdin and --i-understand-insecure-password
+// to a command that also has --insecure-password.
+func addPasswordFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("password-stdin", false, "Read the password from standard input")
+	cmd.Flags().Bool("i-understand-insecure-password", false, "Don't warn about --insecure-password")
+	cmd.MarkFlagsMutuallyExclusive("insecure-password", "password-stdin")
+}
+
+// preparePassword warns about a password given on the command line and,
+// with --password-stdin, reads the password from stdin into
+// --insecure-password so the rest of the command handles both alike.
+func preparePassword(cmd *cobra.Command) error {
+	flags := cmd.Flags()
+	if flagOnCommandLine(cmd, "insecure-password") {
+		if ack, _ := flags.GetBool("i-understand-insecure-password"); !ack {
+			fmt.Fprint(os.Stderr, insecurePasswordWarning)
+		}
+	}
+
+	fromStdin, _ := flags.GetBool("password-stdin")
+	if !fromStdin {
+		return nil
+	}
+	password, err := readPasswordStdin(os.Stdin)
+	if err != nil {
+		return err
+	}
+	return flags.Set("insecure-password", password)
+}
+
+// readPasswordStdin returns the first line of r without its line ending.
+func readPasswordStdin(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("failed to read password from stdin: %w", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("--password-stdin: no password on stdin")
+	}
+	return password, nil
+}
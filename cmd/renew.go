@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/net2share/go-corelib/osdetect"
+	"github.com/net2share/go-corelib/tui"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+	"github.com/spf13/cobra"
+)
+
+var (
+	renewUntil string
+	renewFor   string
+)
+
+var renewCmd = &cobra.Command{
+	Use:   "renew <username>",
+	Short: "Extend a tunnel user's account expiry",
+	Long: `Extend a tunnel user's account expiry, either to an absolute date
+(--until 2026-01-01) or by a duration (--for 30d). --for counts from the
+current expiry date if it is still in the future, otherwise from now.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runRenew,
+}
+
+func init() {
+	renewCmd.Flags().StringVar(&renewUntil, "until", "", "New expiry date (YYYY-MM-DD)")
+	renewCmd.Flags().StringVar(&renewFor, "for", "", "Extend by a duration, in days (e.g. 30d) or as a Go duration")
+	renewCmd.MarkFlagsMutuallyExclusive("until", "for")
+	renewCmd.MarkFlagsOneRequired("until", "for")
+}
+
+func runRenew(cmd *cobra.Command, args []string) error {
+	if err := osdetect.RequireRoot(); err != nil {
+		return err
+	}
+
+	username := args[0]
+	if !tunneluser.IsTunnelUser(username) {
+		return fmt.Errorf("user '%s' is not a tunnel user", username)
+	}
+
+	var expires time.Time
+	if renewUntil != "" {
+		until, err := time.ParseInLocation("2006-01-02", renewUntil, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid date %q: expected YYYY-MM-DD", renewUntil)
+		}
+		if err := tunneluser.SetExpiry(username, until); err != nil {
+			return err
+		}
+		expires = until
+	} else {
+		d, err := parseDuration(renewFor)
+		if err != nil {
+			return err
+		}
+		if expires, err = tunneluser.ExtendExpiry(username, d); err != nil {
+			return err
+		}
+	}
+
+	tui.PrintSuccess(fmt.Sprintf("'%s' now expires on %s", username, expires.Format("2006-01-02")))
+	return nil
+}
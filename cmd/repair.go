@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/net2share/go-corelib/osdetect"
+	"github.com/net2share/go-corelib/tui"
+	"github.com/net2share/sshtun-user/pkg/operations"
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+	"github.com/spf13/cobra"
+)
+
+var repairCmd = &cobra.Command{
+	Use:   "repair",
+	Short: "Restore the AuthorizedKeysFile directive and key file permissions",
+	Long: `Restore the AuthorizedKeysFile directive in the managed drop-in and
+reload sshd, and reset the key directory and key files to root:root with
+mode 0755 and 0644. Key users can't log in when the directive was removed
+or changed by hand, or when a script or backup restore changed the
+ownership or mode of their key file. Key files of accounts that no longer
+exist, e.g. after a manual userdel, are removed. A user in more than one
+tunnel group, e.g. after a manual gpasswd -a, is kept only in the group
+matching their credentials: the key group with a key file and no usable
+password, the password group for the reverse. Users whose credentials
+don't decide it are reported and left alone. A user created with
+--force-password-change keeps PermitTTY yes in their Match block after
+changing the password; repair removes it. Running repair again changes
+nothing.
+
+With --key-storage peruser, repair removes the directive instead, so sshd
+reads ~/.ssh/authorized_keys.`,
+	Args: cobra.NoArgs,
+	RunE: runRepair,
+}
+
+func runRepair(cmd *cobra.Command, args []string) error {
+	if err := osdetect.RequireRoot(); err != nil {
+		return err
+	}
+	if outputJSON() || quiet {
+		sshdconfig.SetOutput(io.Discard)
+	}
+
+	changed, err := operations.RepairKeyDirective()
+	if err != nil {
+		return err
+	}
+	fixed, err := operations.RepairKeyFilePermissions()
+	if err != nil {
+		return err
+	}
+	removed, err := operations.RemoveOrphanedKeyFiles()
+	if err != nil {
+		return err
+	}
+	regrouped, unresolved, err := operations.FixAuthModeConflicts()
+	if err != nil {
+		return err
+	}
+	revoked, err := operations.RevokeStaleTTYGrants()
+	if err != nil {
+		return err
+	}
+
+	if outputJSON() {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Changed          bool                  `json:"changed"`
+			FixedPermissions []string              `json:"fixed_permissions"`
+			RemovedKeyFiles  []string              `json:"removed_key_files"`
+			FixedGroups      []string              `json:"fixed_groups"`
+			Unresolved       []tunneluser.Conflict `json:"unresolved_conflicts"`
+			RevokedTTY       []string              `json:"revoked_tty"`
+		}{
+			changed || len(fixed) > 0 || len(removed) > 0 || len(regrouped) > 0 || len(revoked) > 0,
+			append([]string{}, fixed...),
+			append([]string{}, removed...),
+			append([]string{}, regrouped...),
+			append([]tunneluser.Conflict{}, unresolved...),
+			append([]string{}, revoked...),
+		})
+	}
+	if quiet {
+		return nil
+	}
+	if changed {
+		tui.PrintSuccess("AuthorizedKeysFile directive repaired and sshd reloaded")
+	} else {
+		tui.PrintInfo("AuthorizedKeysFile directive is in place, nothing to repair")
+	}
+	for _, f := range fixed {
+		tui.PrintSuccess("Fixed " + f)
+	}
+	if len(fixed) == 0 {
+		tui.PrintInfo("Key file permissions are correct")
+	}
+	for _, f := range removed {
+		tui.PrintSuccess("Removed orphaned key file " + f)
+	}
+	for _, f := range regrouped {
+		tui.PrintSuccess("Fixed tunnel groups of " + f)
+	}
+	for _, u := range revoked {
+		tui.PrintSuccess("Removed the first-login terminal of " + u)
+	}
+	for _, c := range unresolved {
+		tui.PrintWarning("Left " + c.String() + " in several tunnel groups: its credentials match none or more than one; fix it with 'sshtun-user update'")
+	}
+	return nil
+}
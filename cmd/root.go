@@ -2,23 +2,137 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
 	"os"
 
 	"github.com/net2share/go-corelib/osdetect"
+	"github.com/net2share/go-corelib/tui"
 	"github.com/net2share/sshtun-user/internal/menu"
+	"github.com/net2share/sshtun-user/pkg/container"
+	"github.com/net2share/sshtun-user/pkg/operations"
+	"github.com/net2share/sshtun-user/pkg/paths"
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
 	"github.com/spf13/cobra"
 )
 
-// Version and BuildTime are set at build time.
+// Version, BuildTime and Commit are set at build time.
 var (
 	Version   = "dev"
 	BuildTime = "unknown"
+	Commit    = "unknown"
+)
+
+// Global flags shared by all commands.
+var (
+	configFile        string
+	configDir         string
+	sshdBinary        string
+	authorizedKeysDir string
+	passwordGroup     string
+	keyGroup          string
+	maxUsers          int
+	userPrefix        string
+	keyOptions        string
+	keyStorage        string
+	outputFormat      string
+	quiet             bool
+	verbose           bool
+	stateFile         string
+	allowedKeyTypes   []string
+	minRSABits        int
+	skipDenyFiles     bool
 )
 
 var rootCmd = &cobra.Command{
 	Use:   "sshtun-user",
 	Short: "SSH Tunnel User Manager",
-	Long:  "SSH Tunnel User Setup - https://github.com/net2share/sshtun-user",
+	Long: `SSH Tunnel User Setup - https://github.com/net2share/sshtun-user
+
+Configuration:
+  The global flags and the settings listed below can also be set in the
+  config file (default ` + defaultConfigFile + `) using the flag name as key, or
+  through an SSHTUN_-prefixed environment variable with dashes replaced by
+  underscores (e.g. --no-fail2ban is SSHTUN_NO_FAIL2BAN). Explicit flags take
+  precedence over environment variables, which take precedence over the
+  config file. --config, --config-dir and confirmation flags such as --force
+  or --dry-run are only read from the command line.
+
+Environment Variables:
+  SSHTUN_PASSWORD_GROUP        Same as --password-group
+  SSHTUN_KEY_GROUP             Same as --key-group
+  SSHTUN_AUTHORIZED_KEYS_DIR   Same as --authorized-keys-dir
+  SSHTUN_KEY_OPTIONS           Same as --key-options
+  SSHTUN_KEY_STORAGE           Same as --key-storage
+  SSHTUN_ALLOWED_KEY_TYPES     Same as --allowed-key-types
+  SSHTUN_MIN_RSA_BITS          Same as --min-rsa-bits
+  SSHTUN_SSHD_BINARY           Same as --sshd-binary
+  SSHTUN_MAX_USERS             Same as --max-users
+  SSHTUN_USER_PREFIX           Same as --user-prefix
+  SSHTUN_SKIP_DENY_FILES       Same as --skip-deny-files
+  SSHTUN_NO_FAIL2BAN           Same as --no-fail2ban / --skip-fail2ban-setup
+  SSHTUN_OUTPUT                Same as --output
+  SSHTUN_QUIET                 Same as --quiet
+  SSHTUN_STATE_FILE            Same as --state-file
+  SSHTUN_SSHD_PORT             Same as configure --sshd-port
+  SSHTUN_PASSWORD              Same as --insecure-password, without exposing
+                               the password in the process list
+
+Exit Codes:
+  0  Success
+  1  Any error (message printed to stderr)
+  2  health-check found a failed required check
+
+Files:
+  ` + defaultConfigFile + `                       Optional configuration file
+  /etc/ssh/sshd_config.d/99-tunnel.conf            Tunnel hardening drop-in
+  /etc/ssh/sshd_config.d/99-sshtunnel-user-*.conf  Per-user restrictions
+  /etc/ssh/authorized_keys.d/<user>                Public keys of key auth users
+  /etc/fail2ban/jail.d/sshtunnel.conf              fail2ban jail for sshd`,
+	SilenceUsage: true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := applyEnvAndConfig(cmd); err != nil {
+			return err
+		}
+		if outputFormat != "text" && outputFormat != "json" {
+			return fmt.Errorf("invalid output format %q: must be text or json", outputFormat)
+		}
+		if err := paths.SetRootDir(configDir); err != nil {
+			return err
+		}
+		if err := sshdconfig.SetSSHDBinary(sshdBinary); err != nil {
+			return err
+		}
+		if err := tunneluser.SetGroupNames(passwordGroup, keyGroup); err != nil {
+			return err
+		}
+		if err := tunneluser.SetMaxUsers(maxUsers); err != nil {
+			return err
+		}
+		if err := tunneluser.SetUserPrefix(userPrefix); err != nil {
+			return err
+		}
+		tunneluser.SetSkipDenyFiles(skipDenyFiles)
+		if err := tunneluser.SetKeyOptions(keyOptions); err != nil {
+			return err
+		}
+		if err := tunneluser.SetKeyStorage(keyStorage); err != nil {
+			return err
+		}
+		if err := tunneluser.SetKeyPolicy(tunneluser.KeyPolicy{AllowedTypes: allowedKeyTypes, MinRSABits: minRSABits}); err != nil {
+			return err
+		}
+		return tunneluser.SetAuthorizedKeysDir(authorizedKeysDir)
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		if stateFile == "" || !mutates(cmd) {
+			return
+		}
+		if err := operations.WriteStateFile(stateFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not update state file: %v\n", err)
+		}
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if err := osdetect.RequireRoot(); err != nil {
 			return err
@@ -32,24 +146,106 @@ var rootCmd = &cobra.Command{
 func init() {
 	rootCmd.Version = Version
 
+	flags := rootCmd.PersistentFlags()
+	flags.StringVar(&configFile, "config", defaultConfigFile, "Config file")
+	flags.StringVar(&configDir, "config-dir", "", "Prefix for all system paths (testing only, never use in production)")
+	flags.StringVar(&sshdBinary, "sshd-binary", "", "Path of the sshd binary (default: detected from $PATH and /usr/sbin, /usr/bin, /sbin)")
+	flags.StringVar(&authorizedKeysDir, "authorized-keys-dir", tunneluser.AuthorizedKeysDir, "Directory holding tunnel user public keys")
+	flags.StringVar(&keyStorage, "key-storage", string(tunneluser.KeyStorageCentral), "Where key users' public keys are stored: central (--authorized-keys-dir) or peruser (~/.ssh/authorized_keys)")
+	flags.StringVar(&keyOptions, "key-options", tunneluser.DefaultKeyOptions, "authorized_keys options written in front of tunnel user keys")
+	flags.StringSliceVar(&allowedKeyTypes, "allowed-key-types", tunneluser.DefaultAllowedKeyTypes, "Public key types accepted for key users")
+	flags.IntVar(&minRSABits, "min-rsa-bits", tunneluser.DefaultMinRSABits, "Minimum size of ssh-rsa keys in bits")
+	flags.StringVar(&passwordGroup, "password-group", tunneluser.GroupPasswordAuth, "Group for password-authenticated tunnel users")
+	flags.StringVar(&keyGroup, "key-group", tunneluser.GroupKeyAuth, "Group for key-authenticated tunnel users")
+	flags.StringVar(&userPrefix, "user-prefix", "", "Prefix added to tunnel usernames, ending in - or _; only users with it are managed (e.g. team-a-)")
+	flags.BoolVar(&skipDenyFiles, "skip-deny-files", false, "Never change cron/at allow and deny files, e.g. when configuration management owns them")
+	flags.IntVar(&maxUsers, "max-users", 0, "Maximum number of tunnel users create allows (0 = unlimited)")
+	flags.StringVarP(&outputFormat, "output", "o", "text", "Output format: text or json")
+	flags.BoolVarP(&quiet, "quiet", "q", false, "Suppress informational output")
+	flags.BoolVar(&verbose, "verbose", false, "Show more detail (e.g. with --version)")
+	flags.StringVar(&stateFile, "state-file", operations.DefaultStateFile, "State file updated after every change (empty disables it)")
+
+	cobra.AddTemplateFunc("versionInfo", versionText)
+	rootCmd.SetVersionTemplate(`{{versionInfo}}`)
+
+	for _, c := range []*cobra.Command{rootCmd, createCmd, updateCmd, deleteCmd, configureCmd, uninstallCmd, renewCmd, repairCmd, rotatePasswordsCmd, migrateCmd} {
+		c.Annotations = map[string]string{annotationMutates: "true"}
+	}
+
 	rootCmd.AddCommand(createCmd)
 	rootCmd.AddCommand(updateCmd)
 	rootCmd.AddCommand(listCmd)
 	rootCmd.AddCommand(deleteCmd)
 	rootCmd.AddCommand(configureCmd)
 	rootCmd.AddCommand(uninstallCmd)
+	rootCmd.AddCommand(metricsCmd)
+	rootCmd.AddCommand(expiringCmd)
+	rootCmd.AddCommand(renewCmd)
+	rootCmd.AddCommand(rotatePasswordsCmd)
+	rootCmd.AddCommand(repairCmd)
+	rootCmd.AddCommand(migrateCmd)
+	rootCmd.AddCommand(healthCheckCmd)
+	rootCmd.AddCommand(stateCmd)
+	rootCmd.AddCommand(shellCmd)
+	rootCmd.AddCommand(gendocsCmd)
+	rootCmd.AddCommand(versionCmd)
 }
 
-// Execute runs the root command.
+// Execute runs the root command. This is the only place the process exits;
+// library packages under pkg/ and internal/ must return errors instead.
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
+		if errors.Is(err, operations.ErrUnhealthy) {
+			os.Exit(exitUnhealthy)
+		}
 		os.Exit(1)
 	}
 }
 
 // SetVersionInfo sets version information for the CLI.
-func SetVersionInfo(version, buildTime string) {
+func SetVersionInfo(version, buildTime, commit string) {
 	Version = version
+	sshdconfig.ToolVersion = version
 	BuildTime = buildTime
-	rootCmd.Version = version + " (built " + buildTime + ")"
+	Commit = commit
+	rootCmd.Version = version
+}
+
+// annotationMutates marks commands that change the system, so the state
+// file is rewritten after they succeed.
+const annotationMutates = "sshtun-user/mutates"
+
+// mutates reports whether cmd carries annotationMutates.
+func mutates(cmd *cobra.Command) bool {
+	return cmd.Annotations[annotationMutates] == "true"
+}
+
+// outputJSON reports whether JSON output was requested.
+func outputJSON() bool {
+	return outputFormat == "json"
+}
+
+// stdinIsTerminal reports whether standard input is an interactive terminal.
+func stdinIsTerminal() bool {
+	return menu.RequireTerminal() == nil
+}
+
+// cancelled reports that the operator cancelled a prompt. The error wraps
+// menu.ErrCancelled.
+func cancelled(what string) error {
+	return fmt.Errorf("%s %w", what, menu.ErrCancelled)
+}
+
+// detectOS detects the OS and prints it unless quiet output was requested.
+func detectOS() *osdetect.OSInfo {
+	osInfo, err := osdetect.Detect()
+	if err != nil {
+		tui.PrintWarning("Could not detect OS: " + err.Error())
+	} else if !quiet {
+		fmt.Printf("Detected OS: %s (package manager: %s)\n", osInfo.ID, osInfo.PackageManager)
+		if container.IsContainer() {
+			fmt.Println("Running inside a container")
+		}
+	}
+	return osInfo
 }
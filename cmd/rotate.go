@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/net2share/go-corelib/osdetect"
+	"github.com/net2share/go-corelib/tui"
+	"github.com/net2share/sshtun-user/internal/menu"
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+	"github.com/spf13/cobra"
+)
+
+var rotateJSON bool
+
+var rotatePasswordsCmd = &cobra.Command{
+	Use:   "rotate-passwords",
+	Short: "Set new generated passwords for all password users",
+	Long: `Set a new generated password for every password auth tunnel user, for
+periodic credential rotation. Key users are skipped. The new passwords are
+printed once, in a box or as JSON, and can't be shown again: save them
+before closing the terminal. In a terminal the command asks for
+confirmation first.`,
+	Example: `  sshtun-user rotate-passwords
+  sshtun-user rotate-passwords --json > passwords.json`,
+	Args: cobra.NoArgs,
+	RunE: runRotatePasswords,
+}
+
+func init() {
+	rotatePasswordsCmd.Flags().BoolVar(&rotateJSON, "json", false, "Print the new passwords as JSON (shorthand for --output json)")
+}
+
+func runRotatePasswords(cmd *cobra.Command, args []string) error {
+	if err := osdetect.RequireRoot(); err != nil {
+		return err
+	}
+	if rotateJSON {
+		outputFormat = "json"
+	}
+	tunneluser.SetOutput(io.Discard)
+	if outputJSON() || quiet {
+		sshdconfig.SetOutput(io.Discard)
+	}
+
+	users, err := tunneluser.ListByAuthMode(tunneluser.AuthModePassword)
+	if err != nil {
+		return fmt.Errorf("failed to list users: %w", err)
+	}
+	if len(users) == 0 {
+		return fmt.Errorf("no password users to rotate")
+	}
+	if stdinIsTerminal() {
+		confirm, err := menu.RunConfirm(tui.ConfirmConfig{
+			Title:       fmt.Sprintf("Rotate the passwords of %d password users?", len(users)),
+			Description: "Their current passwords stop working immediately",
+		})
+		if err != nil {
+			return err
+		}
+		if !confirm {
+			return cancelled("rotation")
+		}
+	}
+
+	rotated, rotateErr := tunneluser.RotateAllPasswords()
+	names := make([]string, 0, len(rotated))
+	for name := range rotated {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Print whatever was rotated even on error: the passwords are set and
+	// this is the only time they are available
+	if outputJSON() {
+		type rotatedUser struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		out := make([]rotatedUser, 0, len(names))
+		for _, name := range names {
+			out = append(out, rotatedUser{name, rotated[name]})
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			return err
+		}
+	} else if len(names) > 0 {
+		lines := make([]string, 0, len(names))
+		for _, name := range names {
+			lines = append(lines, fmt.Sprintf("%s  %s", name, tui.Code(rotated[name])))
+		}
+		tui.PrintBox("New Passwords (save them now, they are not shown again)", lines)
+	}
+	return rotateErr
+}
@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var shellCmd = &cobra.Command{
+	Use:   "shell",
+	Short: "Run commands in an interactive session",
+	Long: `Start an interactive session that reads one command per line, e.g.
+"list", "create alice --pubkey '...'" or "delete --dry-run bob", and runs it
+as if given on the command line. Global flags passed to shell apply to every
+command. Type "help" for the available commands and "exit" (or Ctrl-D) to
+leave.`,
+	Args: cobra.NoArgs,
+	RunE: runShell,
+}
+
+func runShell(cmd *cobra.Command, args []string) error {
+	root := cmd.Root()
+
+	// Global flags given to shell itself are re-applied before every command
+	globals := map[string]string{}
+	root.PersistentFlags().VisitAll(func(f *pflag.Flag) {
+		if f.Changed {
+			globals[f.Name] = f.Value.String()
+		}
+	})
+
+	// Commands such as migrate or create --json silence progress output;
+	// the next command gets the writers the session started with
+	userOut, sshdOut := tunneluser.Output(), sshdconfig.Output()
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Print("sshtun> ")
+		line, err := reader.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		eof := errors.Is(err, io.EOF)
+
+		fields, splitErr := splitShellArgs(line)
+		switch {
+		case splitErr != nil:
+			fmt.Fprintln(os.Stderr, "Error:", splitErr)
+		case len(fields) == 0:
+		case fields[0] == "exit" || fields[0] == "quit":
+			return nil
+		case fields[0] == "shell":
+			fmt.Fprintln(os.Stderr, "Error: already in a shell session")
+		default:
+			resetFlags(root)
+			tunneluser.SetOutput(userOut)
+			sshdconfig.SetOutput(sshdOut)
+			for name, value := range globals {
+				root.PersistentFlags().Set(name, value)
+			}
+			root.SetArgs(fields)
+			// Errors are printed by cobra; the session continues
+			root.Execute()
+		}
+
+		if eof {
+			fmt.Println()
+			return nil
+		}
+	}
+}
+
+// resetFlags restores every flag of cmd and its subcommands to its default,
+// so options from one shell command don't leak into the next.
+func resetFlags(cmd *cobra.Command) {
+	reset := func(f *pflag.Flag) {
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			sv.Replace(nil)
+		} else {
+			f.Value.Set(f.DefValue)
+		}
+		f.Changed = false
+	}
+	cmd.Flags().VisitAll(reset)
+	cmd.PersistentFlags().VisitAll(reset)
+	for _, sub := range cmd.Commands() {
+		resetFlags(sub)
+	}
+}
+
+// splitShellArgs splits a command line on whitespace, honouring single and
+// double quotes (e.g. for public keys).
+func splitShellArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/net2share/go-corelib/tui"
+	"github.com/net2share/sshtun-user/pkg/operations"
+	"github.com/net2share/sshtun-user/pkg/report"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+	"github.com/spf13/cobra"
+)
+
+var (
+	stateCheck   bool
+	stateSummary bool
+)
+
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Show the recorded state or check it for drift",
+	Long: `Print the state file written after every change (see --state-file).
+It records when sshd was configured, a hash of the managed sshd drop-ins,
+the tunnel users and whether the fail2ban jail is installed, so
+orchestration tools can tell whether sshtun-user needs to run again.
+
+With --check, compare the recorded state with the system and exit with
+status 1 if anything changed since the last run.
+
+With --summary, print an overview of the setup as it is now, the same
+one configure ends with: sshd hardening, fail2ban, users by auth mode,
+where keys are stored, the sshd ports and suggested next steps, followed by
+a warning for each account that expires within 7 days. It doesn't need
+the state file.`,
+	Example: `  sshtun-user state
+  sshtun-user state --check
+  sshtun-user state --summary`,
+	Args: cobra.NoArgs,
+	RunE: runState,
+}
+
+func init() {
+	stateCmd.Flags().BoolVar(&stateCheck, "check", false, "Exit with status 1 if the system drifted from the recorded state")
+	stateCmd.Flags().BoolVar(&stateSummary, "summary", false, "Print an overview of the current setup and next steps")
+	stateCmd.MarkFlagsMutuallyExclusive("check", "summary")
+}
+
+func runState(cmd *cobra.Command, args []string) error {
+	if stateSummary {
+		return runStateSummary()
+	}
+	if stateFile == "" {
+		return fmt.Errorf("no state file: --state-file is empty")
+	}
+	state, err := operations.ReadStateFile(stateFile)
+	if err != nil {
+		return err
+	}
+	if !stateCheck {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(state)
+	}
+
+	current, err := operations.CurrentState()
+	if err != nil {
+		return err
+	}
+	drift := state.Drift(current)
+	if outputJSON() {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(struct {
+			Drift []string `json:"drift"`
+		}{append([]string{}, drift...)}); err != nil {
+			return err
+		}
+	} else if !quiet && len(drift) == 0 {
+		tui.PrintSuccess("No drift since " + state.UpdatedAt.Local().Format("2006-01-02 15:04:05"))
+	}
+	if len(drift) > 0 {
+		return fmt.Errorf("drift since last run: %s", strings.Join(drift, "; "))
+	}
+	return nil
+}
+
+// runStateSummary prints report.GenerateSummary for the current state, or
+// its lines as JSON, and warns about accounts expiring within
+// tunneluser.DefaultExpiryWarningDays.
+func runStateSummary() error {
+	current, err := operations.CurrentState()
+	if err != nil {
+		return err
+	}
+	// Reading expiry requires root; without it the summary goes without
+	expiring, _ := tunneluser.GetExpiringUsers(tunneluser.DefaultExpiryWarningDays)
+	if outputJSON() {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Summary  []string              `json:"summary"`
+			Expiring []tunneluser.UserInfo `json:"expiring,omitempty"`
+		}{report.SummaryLines(current), expiring})
+	}
+	fmt.Println(report.GenerateSummary(current))
+	warnExpiring(expiring)
+	return nil
+}
@@ -2,8 +2,12 @@ package cmd
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/net2share/go-corelib/osdetect"
+	"github.com/net2share/go-corelib/tui"
+	"github.com/net2share/sshtun-user/internal/menu"
+	"github.com/net2share/sshtun-user/pkg/operations"
 	"github.com/net2share/sshtun-user/pkg/sshdconfig"
 	"github.com/net2share/sshtun-user/pkg/tunneluser"
 	"github.com/spf13/cobra"
@@ -22,10 +26,31 @@ Subcommands:
 Examples:
   sshtun-user uninstall users    # Delete all tunnel users
   sshtun-user uninstall config   # Remove configuration only
-  sshtun-user uninstall all      # Complete uninstall`,
+  sshtun-user uninstall all      # Complete uninstall
+  sshtun-user uninstall users --filter '^ci-'   # Only users matching a regex
+
+Disaster recovery:
+  When accounts were removed by hand and the tunnel groups still list
+  members, 'uninstall config' refuses to run. --force removes those members
+  from the groups (their accounts are kept) and deletes the groups anyway.
+  It must be confirmed with --i-know-what-im-doing:
+
+  sshtun-user uninstall config --force --i-know-what-im-doing`,
 	RunE: runUninstall,
 }
 
+var (
+	uninstallForce  bool
+	uninstallAck    bool
+	uninstallFilter string
+)
+
+func init() {
+	uninstallCmd.Flags().BoolVar(&uninstallForce, "force", false, "With config: remove tunnel groups even if they still have members")
+	uninstallCmd.Flags().BoolVar(&uninstallAck, "i-know-what-im-doing", false, "Confirm --force")
+	uninstallCmd.Flags().StringVar(&uninstallFilter, "filter", "", "With users: only delete users whose name matches this regular expression")
+}
+
 func runUninstall(cmd *cobra.Command, args []string) error {
 	if err := osdetect.RequireRoot(); err != nil {
 		return err
@@ -35,10 +60,26 @@ func runUninstall(cmd *cobra.Command, args []string) error {
 		return cmd.Help()
 	}
 
+	if (uninstallForce || uninstallAck) && args[0] != "config" {
+		return fmt.Errorf("--force only applies to 'sshtun-user uninstall config'")
+	}
+	if uninstallFilter != "" && args[0] != "users" {
+		return fmt.Errorf("--filter only applies to 'sshtun-user uninstall users'")
+	}
+	if uninstallAck && !uninstallForce {
+		return fmt.Errorf("--i-know-what-im-doing only confirms --force")
+	}
+
 	switch args[0] {
 	case "users":
+		if uninstallFilter != "" {
+			return uninstallMatchingUsersCLI(uninstallFilter)
+		}
 		return uninstallUsersCLI()
 	case "config":
+		if uninstallForce {
+			return forceUninstallConfigCLI()
+		}
 		return uninstallConfigCLI()
 	case "all":
 		return uninstallAllCLI()
@@ -53,14 +94,40 @@ func uninstallUsersCLI() error {
 		return fmt.Errorf("no tunnel users to delete")
 	}
 
-	deleted, err := tunneluser.DeleteAllUsers()
-	if len(deleted) > 0 {
-		fmt.Printf("Deleted users: %v\n", deleted)
+	result, err := operations.UninstallUsers(tunneluser.PrintDeleteProgress)
+	printUninstallResult(result)
+	return err
+}
+
+// uninstallMatchingUsersCLI deletes the users matching pattern after listing
+// them, asking for confirmation when run in a terminal.
+func uninstallMatchingUsersCLI(pattern string) error {
+	users, err := tunneluser.MatchingUsers(pattern)
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return fmt.Errorf("no tunnel users match %q", pattern)
 	}
 
-	tunneluser.CleanupAuthorizedKeysDir()
-	tunneluser.CleanupDenyFiles()
+	fmt.Printf("Users matching %q:\n", pattern)
+	for _, u := range users {
+		fmt.Printf("  - %s (%s)\n", u.Username, u.AuthMode)
+	}
+	if stdinIsTerminal() {
+		confirm, err := menu.RunConfirm(tui.ConfirmConfig{
+			Title: fmt.Sprintf("Delete these %d tunnel users?", len(users)),
+		})
+		if err != nil {
+			return err
+		}
+		if !confirm {
+			return cancelled("uninstall")
+		}
+	}
 
+	result, err := operations.UninstallMatchingUsers(pattern, tunneluser.PrintDeleteProgress)
+	printUninstallResult(result)
 	return err
 }
 
@@ -74,22 +141,53 @@ func uninstallConfigCLI() error {
 		return fmt.Errorf("cannot remove configuration: tunnel users still exist. Run 'sshtun-user uninstall users' first")
 	}
 
-	fmt.Println("Removing sshd configuration...")
-	if err := sshdconfig.RemoveAndReload(); err != nil {
-		fmt.Printf("Warning: %v\n", err)
-	} else {
-		fmt.Println("  sshd configuration removed")
+	fmt.Println("Removing sshd configuration and tunnel groups...")
+	result, err := operations.UninstallConfig()
+	if err != nil {
+		return err
+	}
+	printUninstallResult(result)
+
+	fmt.Println("Configuration removed.")
+	return nil
+}
+
+// forceUninstallConfigCLI removes the configuration while the tunnel groups
+// may still have members, after listing every member that loses its group.
+func forceUninstallConfigCLI() error {
+	members, err := tunneluser.GroupMembers()
+	if err != nil {
+		return err
 	}
 
-	fmt.Println("Removing tunnel groups...")
-	if err := tunneluser.DeleteGroups(); err != nil {
-		fmt.Printf("Warning: %v\n", err)
+	tui.PrintWarning("--force deletes the tunnel groups even though they may still have members.")
+	listed := false
+	for _, group := range []string{tunneluser.GroupPasswordAuth, tunneluser.GroupKeyAuth, tunneluser.GroupSFTP} {
+		list, ok := members[group]
+		if !ok || len(list) == 0 {
+			continue
+		}
+		listed = true
+		fmt.Printf("  %s: %s\n", group, strings.Join(list, ", "))
+	}
+	if listed {
+		fmt.Println("These accounts are removed from the groups but not deleted; they lose the")
+		fmt.Println("tunnel restrictions of the sshd Match blocks. groupdel fails for a group")
+		fmt.Println("that is still the primary group of an account marked (primary).")
 	} else {
-		fmt.Println("  Tunnel groups removed")
+		fmt.Println("  The tunnel groups have no members.")
 	}
 
-	tunneluser.CleanupAuthorizedKeysDir()
-	tunneluser.CleanupDenyFiles()
+	if !uninstallAck {
+		return fmt.Errorf("refusing to force: add --i-know-what-im-doing to confirm")
+	}
+
+	fmt.Println("Removing sshd configuration and tunnel groups...")
+	result, err := operations.UninstallConfigWithOptions(operations.UninstallConfigOptions{Force: true})
+	if err != nil {
+		return err
+	}
+	printUninstallResult(result)
 
 	fmt.Println("Configuration removed.")
 	return nil
@@ -114,39 +212,31 @@ func uninstallAllCLI() error {
 		return fmt.Errorf("sshd is not configured. Use 'sshtun-user uninstall users' instead")
 	}
 
-	// Delete all users
-	if hasUsers {
-		fmt.Println("Deleting tunnel users...")
-		deleted, err := tunneluser.DeleteAllUsers()
-		if len(deleted) > 0 {
-			fmt.Printf("Deleted: %v\n", deleted)
-		}
-		if err != nil {
-			fmt.Printf("Warning: %v\n", err)
-		}
-	}
-
-	// Remove sshd config
-	if configured {
-		fmt.Println("Removing sshd configuration...")
-		if err := sshdconfig.RemoveAndReload(); err != nil {
-			fmt.Printf("Warning: %v\n", err)
-		} else {
-			fmt.Println("  sshd configuration removed")
-		}
-
-		fmt.Println("Removing tunnel groups...")
-		if err := tunneluser.DeleteGroups(); err != nil {
-			fmt.Printf("Warning: %v\n", err)
-		} else {
-			fmt.Println("  Tunnel groups removed")
-		}
+	fmt.Println("Deleting tunnel users and removing configuration...")
+	result, err := operations.UninstallAll(tunneluser.PrintDeleteProgress)
+	if err != nil {
+		return err
 	}
-
-	// Cleanup
-	tunneluser.CleanupAuthorizedKeysDir()
-	tunneluser.CleanupDenyFiles()
+	printUninstallResult(result)
 
 	fmt.Println("Uninstall complete.")
 	return nil
 }
+
+func printUninstallResult(result *operations.UninstallResult) {
+	if result == nil {
+		return
+	}
+	if len(result.DeletedUsers) > 0 {
+		fmt.Printf("Deleted users: %v\n", result.DeletedUsers)
+	}
+	if result.ConfigRemoved {
+		fmt.Println("  sshd configuration removed")
+	}
+	if result.GroupsRemoved {
+		fmt.Println("  Tunnel groups removed")
+	}
+	for _, w := range result.Warnings {
+		fmt.Printf("Warning: %s\n", w)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/net2share/go-corelib/osdetect"
 	"github.com/net2share/go-corelib/tui"
 	"github.com/net2share/sshtun-user/internal/menu"
+	"github.com/net2share/sshtun-user/pkg/operations"
 	"github.com/net2share/sshtun-user/pkg/sshdconfig"
 	"github.com/net2share/sshtun-user/pkg/tunneluser"
 	"github.com/spf13/cobra"
@@ -15,30 +16,60 @@ import (
 var (
 	updatePassword string
 	updatePubkey   string
+	updateKeyLabel string
+	updateQR       bool
+	updateKeepOld  bool
+	updateNote     string
+	updateVerbose  bool
 )
 
 var updateCmd = &cobra.Command{
 	Use:   "update <username>",
 	Short: "Update an existing tunnel user",
-	Args:  cobra.ExactArgs(1),
-	RunE:  runUpdate,
+	Long: `Change a tunnel user's password or public key. Setting a password on a
+key auth user (or a key on a password user) switches their auth mode and
+revokes the previous credential: the key file is removed or the password
+locked. --keep-old-credential keeps it as a fallback.
+
+--note replaces the description stored in the account comment; it can be
+given on its own or together with a new credential. --note "" removes it.
+
+--verbose-logging turns LogLevel VERBOSE on for this user only, e.g. for
+forensics on one account; --verbose-logging=false turns it off again. The
+global log level is unchanged.`,
+	Example: `  sshtun-user update alice --pubkey "ssh-ed25519 AAAA..."
+  sshtun-user update alice --note "laptop, expires with contract"
+  sshtun-user update alice --verbose-logging
+  SSHTUN_PASSWORD=newsecret sshtun-user update bob`,
+	Args: cobra.ExactArgs(1),
+	RunE: runUpdate,
 }
 
 func init() {
 	updateCmd.Flags().StringVar(&updatePassword, "insecure-password", "", "Set new password")
 	updateCmd.Flags().StringVar(&updatePubkey, "pubkey", "", "Set new public key")
+	updateCmd.Flags().StringVar(&updateKeyLabel, "key-label", "", "Label stored as the new public key's comment")
+	addPasswordFlags(updateCmd)
+	updateCmd.Flags().BoolVar(&updateKeepOld, "keep-old-credential", false, "When switching auth mode, keep the previous key file or password as a fallback")
+	updateCmd.Flags().StringVar(&updateNote, "note", "", "Replace the description stored in the account comment")
+	updateCmd.Flags().BoolVar(&updateVerbose, "verbose-logging", false, "Log this user's connections at LogLevel VERBOSE (=false turns it off)")
+	updateCmd.Flags().BoolVar(&updateQR, "qr", false, "Also show a generated password as a QR code (terminal only)")
 }
 
 func runUpdate(cmd *cobra.Command, args []string) error {
 	if err := osdetect.RequireRoot(); err != nil {
 		return err
 	}
+	if err := preparePassword(cmd); err != nil {
+		return err
+	}
 
 	if !sshdconfig.IsConfigured() {
 		return fmt.Errorf("sshd not configured. Run 'sshtun-user configure' first")
 	}
 
 	username := args[0]
+	menu.ShowQR = updateQR
 
 	if !tunneluser.Exists(username) {
 		return fmt.Errorf("user '%s' does not exist", username)
@@ -50,32 +81,52 @@ func runUpdate(cmd *cobra.Command, args []string) error {
 
 	currentMode, _ := tunneluser.GetAuthMode(username)
 
+	if cmd.Flags().Changed("key-label") && !cmd.Flags().Changed("pubkey") {
+		return fmt.Errorf("--key-label requires --pubkey")
+	}
+
+	if cmd.Flags().Changed("note") {
+		if err := tunneluser.SetNote(username, updateNote); err != nil {
+			return err
+		}
+		fmt.Printf("Note updated for '%s'\n", username)
+	}
+	if cmd.Flags().Changed("verbose-logging") {
+		if _, err := tunneluser.SetVerboseLogging(username, updateVerbose); err != nil {
+			return err
+		}
+		state := "off"
+		if updateVerbose {
+			state = "on"
+		}
+		fmt.Printf("Verbose logging %s for '%s'\n", state, username)
+	}
+	if (cmd.Flags().Changed("note") || cmd.Flags().Changed("verbose-logging")) &&
+		!cmd.Flags().Changed("insecure-password") && !cmd.Flags().Changed("pubkey") {
+		return nil
+	}
+
 	// CLI mode if flags are provided
 	if cmd.Flags().Changed("insecure-password") {
-		if err := tunneluser.SetPassword(username, updatePassword); err != nil {
-			return fmt.Errorf("failed to set password: %w", err)
-		}
-		if currentMode != tunneluser.AuthModePassword {
-			if err := tunneluser.SwitchAuthMode(username, tunneluser.AuthModePassword); err != nil {
-				return fmt.Errorf("failed to switch auth mode: %w", err)
-			}
+		result, err := operations.SetUserPasswordWithOptions(username, updatePassword, switchOptions())
+		if err != nil {
+			return err
 		}
+		printUpdateWarnings(result)
 		fmt.Printf("Password updated for '%s'\n", username)
 		return nil
 	}
 
 	if cmd.Flags().Changed("pubkey") {
-		if err := tunneluser.SetupSSHKey(username, updatePubkey); err != nil {
-			return fmt.Errorf("failed to set SSH key: %w", err)
-		}
-		if currentMode != tunneluser.AuthModeKey {
-			if err := tunneluser.SwitchAuthMode(username, tunneluser.AuthModeKey); err != nil {
-				return fmt.Errorf("failed to switch auth mode: %w", err)
-			}
+		publicKey, err := tunneluser.WithKeyLabel(updatePubkey, updateKeyLabel)
+		if err != nil {
+			return fmt.Errorf("invalid public key format: %w", err)
 		}
-		if err := sshdconfig.AddAuthorizedKeysDirective(); err != nil {
-			tui.PrintWarning("Could not add AuthorizedKeysFile directive: " + err.Error())
+		result, err := operations.SetUserKeyWithOptions(username, publicKey, switchOptions())
+		if err != nil {
+			return err
 		}
+		printUpdateWarnings(result)
 		fmt.Printf("SSH key updated for '%s'\n", username)
 		return nil
 	}
@@ -84,10 +135,18 @@ func runUpdate(cmd *cobra.Command, args []string) error {
 	return runUpdateInteractive(username, currentMode)
 }
 
+// switchOptions returns the credentials --keep-old-credential preserves.
+func switchOptions() tunneluser.SwitchOptions {
+	return tunneluser.SwitchOptions{PreserveOldKeyFile: updateKeepOld, PreserveOldPassword: updateKeepOld}
+}
+
 func runUpdateInteractive(username string, currentMode tunneluser.AuthMode) error {
+	if err := menu.RequireTerminal(); err != nil {
+		return err
+	}
 	fmt.Printf("\nUpdating user '%s' (current auth: %s)\n", username, currentMode)
 
-	choice, err := tui.RunMenu(tui.MenuConfig{
+	choice, err := menu.RunMenu(tui.MenuConfig{
 		Title: "What would you like to update?",
 		Options: []tui.MenuOption{
 			{Label: "Change password (switch to password auth if needed)", Value: "password"},
@@ -95,56 +154,59 @@ func runUpdateInteractive(username string, currentMode tunneluser.AuthMode) erro
 			{Label: "Cancel", Value: "cancel"},
 		},
 	})
+	if errors.Is(err, menu.ErrCancelled) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
+	var result *operations.UpdateResult
 	switch choice {
 	case "password":
 		password, err := menu.PromptPassword(username)
 		if errors.Is(err, menu.ErrCancelled) {
-			return fmt.Errorf("password input cancelled")
+			return cancelled("password input")
 		}
 		if err != nil {
 			return err
 		}
-		if err := tunneluser.SetPassword(username, password); err != nil {
-			return fmt.Errorf("failed to set password: %w", err)
-		}
-		if currentMode != tunneluser.AuthModePassword {
-			if err := tunneluser.SwitchAuthMode(username, tunneluser.AuthModePassword); err != nil {
-				return fmt.Errorf("failed to switch auth mode: %w", err)
-			}
-			fmt.Printf("Switched '%s' from %s to password authentication\n", username, currentMode)
+		if result, err = operations.SetUserPasswordWithOptions(username, password, switchOptions()); err != nil {
+			return err
 		}
-		fmt.Println()
-		tui.PrintSuccess(fmt.Sprintf("Password updated for '%s'!", username))
-		menu.PrintClientUsage(username, tunneluser.AuthModePassword)
 
 	case "key":
 		publicKey, err := menu.PromptPubkey(username)
 		if errors.Is(err, menu.ErrCancelled) {
-			return fmt.Errorf("public key input cancelled")
+			return cancelled("public key input")
 		}
 		if err != nil {
 			return err
 		}
-		if err := tunneluser.SetupSSHKey(username, publicKey); err != nil {
-			return fmt.Errorf("failed to set SSH key: %w", err)
-		}
-		if currentMode != tunneluser.AuthModeKey {
-			if err := tunneluser.SwitchAuthMode(username, tunneluser.AuthModeKey); err != nil {
-				return fmt.Errorf("failed to switch auth mode: %w", err)
-			}
-			fmt.Printf("Switched '%s' from %s to key authentication\n", username, currentMode)
-		}
-		if err := sshdconfig.AddAuthorizedKeysDirective(); err != nil {
-			tui.PrintWarning("Could not add AuthorizedKeysFile directive: " + err.Error())
+		if result, err = operations.SetUserKeyWithOptions(username, publicKey, switchOptions()); err != nil {
+			return err
 		}
-		fmt.Println()
-		tui.PrintSuccess(fmt.Sprintf("SSH key updated for '%s'!", username))
-		menu.PrintClientUsage(username, tunneluser.AuthModeKey)
+
+	default:
+		return nil
 	}
 
+	if result.Switched() {
+		fmt.Printf("Switched '%s' from %s to %s authentication\n", username, result.PreviousMode, result.AuthMode)
+	}
+	printUpdateWarnings(result)
+	fmt.Println()
+	if result.AuthMode == tunneluser.AuthModeKey {
+		tui.PrintSuccess(fmt.Sprintf("SSH key updated for '%s'!", username))
+	} else {
+		tui.PrintSuccess(fmt.Sprintf("Password updated for '%s'!", username))
+	}
+	menu.PrintClientUsage(menu.UsageInfo(username, result.AuthMode))
 	return nil
 }
+
+func printUpdateWarnings(result *operations.UpdateResult) {
+	for _, w := range result.Warnings {
+		tui.PrintWarning(w)
+	}
+}
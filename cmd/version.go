@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/net2share/go-corelib/osdetect"
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+	"github.com/spf13/cobra"
+)
+
+var versionJSON bool
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Show version and build information",
+	Long: `Print the version, build time, commit, Go version, OS/arch and
+distribution, as --version does. With --json (or --output json) the same
+fields are printed as a JSON object, e.g. for fleet inventories. Add
+--verbose for the effective configuration.`,
+	Example: `  sshtun-user version
+  sshtun-user version --json | jq -r .version`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if versionJSON {
+			outputFormat = "json"
+		}
+		fmt.Print(versionText())
+		return nil
+	},
+}
+
+func init() {
+	versionCmd.Flags().BoolVar(&versionJSON, "json", false, "Print the version information as JSON (shorthand for --output json)")
+}
+
+// versionInfo is the --version and version command output.
+type versionInfo struct {
+	Version   string `json:"version"`
+	BuildTime string `json:"build_time"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"go_version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	Distro    string `json:"distro,omitempty"`
+
+	// Set with --verbose
+	ConfigFile        string `json:"config_file,omitempty"`
+	ConfigFileFound   *bool  `json:"config_file_found,omitempty"`
+	AuthorizedKeysDir string `json:"authorized_keys_dir,omitempty"`
+	KeyStorage        string `json:"key_storage,omitempty"`
+	PasswordGroup     string `json:"password_group,omitempty"`
+	KeyGroup          string `json:"key_group,omitempty"`
+	DropInDir         string `json:"drop_in_dir,omitempty"`
+	SSHDBinary        string `json:"sshd_binary,omitempty"`
+	MaxStartups       string `json:"max_startups,omitempty"` // From the installed drop-in
+	Banner            string `json:"banner,omitempty"`
+}
+
+func collectVersionInfo() versionInfo {
+	info := versionInfo{
+		Version:   Version,
+		BuildTime: BuildTime,
+		Commit:    Commit,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+	}
+	if osInfo, err := osdetect.Detect(); err == nil {
+		info.Distro = osInfo.PrettyName
+		if info.Distro == "" {
+			info.Distro = strings.TrimSpace(osInfo.ID + " " + osInfo.VersionID)
+		}
+	}
+
+	if verbose {
+		_, err := os.Stat(configFile)
+		found := err == nil
+		info.ConfigFile = configFile
+		info.ConfigFileFound = &found
+		info.AuthorizedKeysDir = authorizedKeysDir
+		info.KeyStorage = keyStorage
+		info.PasswordGroup = passwordGroup
+		info.KeyGroup = keyGroup
+		info.DropInDir = sshdconfig.DropInDir
+		info.SSHDBinary = sshdBinary
+		if info.SSHDBinary == "" {
+			info.SSHDBinary, _ = sshdconfig.FindSSHD()
+		}
+		info.MaxStartups = sshdconfig.InstalledDirectives()["MaxStartups"]
+		if sshdconfig.BannerConfigured() {
+			info.Banner, _ = sshdconfig.ReadBanner()
+		}
+	}
+	return info
+}
+
+// versionText renders the --version output. Cobra handles --version before
+// PersistentPreRunE, so environment and config file settings are applied
+// here to report the effective values.
+func versionText() string {
+	applyEnvAndConfig(rootCmd)
+	info := collectVersionInfo()
+
+	if outputJSON() {
+		data, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return fmt.Sprintf("{\"error\": %q}\n", err.Error())
+		}
+		return string(data) + "\n"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "sshtun-user %s (built %s, commit %s)\n", info.Version, info.BuildTime, info.Commit)
+	fmt.Fprintf(&b, "%s %s/%s\n", info.GoVersion, info.OS, info.Arch)
+	if info.Distro != "" {
+		fmt.Fprintf(&b, "Distribution: %s\n", info.Distro)
+	}
+	if verbose {
+		status := "found"
+		if !*info.ConfigFileFound {
+			status = "not found"
+		}
+		fmt.Fprintf(&b, "Config file: %s (%s)\n", info.ConfigFile, status)
+		fmt.Fprintf(&b, "Authorized keys dir: %s\n", info.AuthorizedKeysDir)
+		fmt.Fprintf(&b, "Key storage: %s\n", info.KeyStorage)
+		fmt.Fprintf(&b, "Groups: %s (password), %s (key)\n", info.PasswordGroup, info.KeyGroup)
+		fmt.Fprintf(&b, "sshd drop-in dir: %s\n", info.DropInDir)
+		if info.SSHDBinary != "" {
+			fmt.Fprintf(&b, "sshd binary: %s\n", info.SSHDBinary)
+		} else {
+			fmt.Fprintln(&b, "sshd binary: not found")
+		}
+		if info.MaxStartups != "" {
+			fmt.Fprintf(&b, "MaxStartups: %s\n", info.MaxStartups)
+		} else {
+			fmt.Fprintln(&b, "MaxStartups: not configured")
+		}
+		if info.Banner != "" {
+			fmt.Fprintf(&b, "Login banner (%s):\n", sshdconfig.BannerPath)
+			for _, line := range strings.Split(strings.TrimRight(info.Banner, "\n"), "\n") {
+				fmt.Fprintf(&b, "  %s\n", line)
+			}
+		}
+	}
+	return b.String()
+}
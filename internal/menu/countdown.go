@@ -0,0 +1,92 @@
+package menu
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// ConfirmDelay is the countdown, in seconds, shown after confirming
+// "Delete all users" or "Complete uninstall". 0 disables it.
+var ConfirmDelay = 5
+
+// DeleteConfirmDelay is the countdown, in seconds, shown after confirming
+// the deletion of a single user. 0 (the default) disables it.
+var DeleteConfirmDelay = 0
+
+// CountdownConfirm prints message and counts down seconds before returning
+// true, giving the operator a last chance to back out of a destructive
+// choice. Ctrl-C cancels and returns false; Enter proceeds immediately.
+func CountdownConfirm(message string, seconds int) bool {
+	if seconds <= 0 {
+		return true
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	enter := waitForEnter()
+	if enter != nil {
+		defer enter.Close()
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	fmt.Println(message)
+	for remaining := seconds; remaining > 0; remaining-- {
+		fmt.Printf("\rProceeding in %d seconds... press Enter to continue now, Ctrl-C to cancel ", remaining)
+		select {
+		case <-ctx.Done():
+			fmt.Println("\nCancelled.")
+			return false
+		case <-enter.done():
+			fmt.Println()
+			return true
+		case <-ticker.C:
+		}
+	}
+	fmt.Println()
+	return true
+}
+
+// enterWaiter reports a line typed on the controlling terminal.
+type enterWaiter struct {
+	tty *os.File
+	ch  chan struct{}
+}
+
+// waitForEnter starts reading a line from /dev/tty. The terminal is opened
+// separately from stdin so Close can stop the pending read without leaving
+// a goroutine that would swallow input meant for the next prompt. It
+// returns nil when there is no terminal.
+func waitForEnter() *enterWaiter {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return nil
+	}
+	w := &enterWaiter{tty: tty, ch: make(chan struct{})}
+	go func() {
+		if _, err := bufio.NewReader(tty).ReadString('\n'); err == nil {
+			close(w.ch)
+		}
+	}()
+	return w
+}
+
+// done returns a channel closed when Enter is pressed. A nil waiter never
+// fires.
+func (w *enterWaiter) done() <-chan struct{} {
+	if w == nil {
+		return nil
+	}
+	return w.ch
+}
+
+func (w *enterWaiter) Close() {
+	w.tty.Close()
+}
@@ -0,0 +1,70 @@
+package menu
+
+import (
+	"github.com/net2share/go-corelib/tui"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+)
+
+// defaultTitle is the title of the main menu.
+const defaultTitle = "SSH Tunnel User Manager"
+
+// EmbedOptions customizes the menu for programs that embed it, such as
+// dnstm. The callbacks run after the change succeeded.
+type EmbedOptions struct {
+	Title          string // Main menu title (default "SSH Tunnel User Manager")
+	AllowConfigure bool   // Offer "Configure sshd hardening"
+	AllowUninstall bool   // Offer "Uninstall"
+
+	OnUserCreated func(tunneluser.UserInfo)
+	OnUserDeleted func(username string)
+	OnConfigured  func()
+}
+
+// standaloneOptions are used by Run and RunEmbedded.
+var standaloneOptions = EmbedOptions{AllowConfigure: true, AllowUninstall: true}
+
+// menuOpts holds the options of the running menu.
+var menuOpts = standaloneOptions
+
+// RunEmbedded runs the menu inside another program with every entry
+// enabled. It is RunEmbeddedWithOptions with the standalone defaults.
+func RunEmbedded() error {
+	return RunEmbeddedWithOptions(standaloneOptions)
+}
+
+// RunEmbeddedWithOptions runs the menu inside another program. Unlike Run it
+// doesn't print the detected OS, leaving the screen to the host program.
+func RunEmbeddedWithOptions(opts EmbedOptions) error {
+	tui.SetAppInfo("sshtun-user", Version, BuildTime)
+	menuOpts = opts
+	defer func() { menuOpts = standaloneOptions }()
+	return runMenuLoop(detectOSQuietly())
+}
+
+func menuTitle() string {
+	if menuOpts.Title != "" {
+		return menuOpts.Title
+	}
+	return defaultTitle
+}
+
+func notifyUserCreated(info *tunneluser.CreatedUserInfo) {
+	if menuOpts.OnUserCreated != nil {
+		menuOpts.OnUserCreated(tunneluser.UserInfo{Username: info.Username, AuthMode: info.AuthMode})
+	}
+}
+
+func notifyUsersDeleted(usernames ...string) {
+	if menuOpts.OnUserDeleted == nil {
+		return
+	}
+	for _, username := range usernames {
+		menuOpts.OnUserDeleted(username)
+	}
+}
+
+func notifyConfigured() {
+	if menuOpts.OnConfigured != nil {
+		menuOpts.OnConfigured()
+	}
+}
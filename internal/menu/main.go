@@ -4,10 +4,18 @@ package menu
 import (
 	"errors"
 	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/net2share/go-corelib/osdetect"
 	"github.com/net2share/go-corelib/tui"
+	"github.com/net2share/sshtun-user/pkg/container"
 	"github.com/net2share/sshtun-user/pkg/fail2ban"
+	"github.com/net2share/sshtun-user/pkg/firewall"
+	"github.com/net2share/sshtun-user/pkg/operations"
+	"github.com/net2share/sshtun-user/pkg/report"
 	"github.com/net2share/sshtun-user/pkg/sshdconfig"
 	"github.com/net2share/sshtun-user/pkg/tunneluser"
 )
@@ -16,6 +24,14 @@ import (
 // In menu context, this skips WaitForEnter. In CLI context, this can be handled as an error.
 var ErrCancelled = errors.New("cancelled")
 
+// listMaxAge is how long the menu reuses tunneluser.DefaultCache results.
+// Changes made through the menu invalidate the cache right away.
+const listMaxAge = 5 * time.Second
+
+// selectMenuMaxUsers is the most users selectUser lists at once, so the
+// menu still fits a 24-line terminal.
+const selectMenuMaxUsers = 10
+
 // Version and BuildTime are set by cmd package.
 var (
 	Version   = "dev"
@@ -31,27 +47,41 @@ func Run() error {
 		tui.PrintWarning("Could not detect OS: " + err.Error())
 	} else {
 		fmt.Printf("Detected OS: %s (package manager: %s)\n", osInfo.ID, osInfo.PackageManager)
+		if container.IsContainer() {
+			fmt.Println("Running inside a container")
+		}
 	}
 
 	return runMenuLoop(osInfo)
 }
 
+// detectOSQuietly detects the OS without printing it. Failures leave osInfo
+// nil, as in Run.
+func detectOSQuietly() *osdetect.OSInfo {
+	osInfo, err := osdetect.Detect()
+	if err != nil {
+		return nil
+	}
+	return osInfo
+}
+
 func runMenuLoop(osInfo *osdetect.OSInfo) error {
 	for {
 		fmt.Println()
 		configured := sshdconfig.IsConfigured()
-		hasUsers, _ := tunneluser.GroupsHaveUsers()
+		users, _ := tunneluser.DefaultCache.List(listMaxAge)
+		hasUsers := len(users) > 0
 
 		options := buildMenuOptions(configured, hasUsers)
-		choice, err := tui.RunMenu(tui.MenuConfig{
-			Title:   "SSH Tunnel User Manager",
+		choice, err := RunMenu(tui.MenuConfig{
+			Title:   menuTitle(),
 			Options: options,
 		})
-		if err != nil {
+		if err != nil && !errors.Is(err, ErrCancelled) {
 			return err
 		}
 
-		if choice == "" || choice == "exit" {
+		if err != nil || choice == "exit" {
 			tui.PrintInfo("Goodbye!")
 			return nil
 		}
@@ -71,7 +101,7 @@ func buildMenuOptions(configured, hasUsers bool) []tui.MenuOption {
 	var options []tui.MenuOption
 
 	// Configure - only show when NOT configured
-	if !configured {
+	if !configured && menuOpts.AllowConfigure {
 		options = append(options, tui.MenuOption{Label: "Configure sshd hardening", Value: "configure"})
 	}
 
@@ -86,7 +116,7 @@ func buildMenuOptions(configured, hasUsers bool) []tui.MenuOption {
 	}
 
 	// Uninstall - only show when configured OR users exist
-	if configured || hasUsers {
+	if (configured || hasUsers) && menuOpts.AllowUninstall {
 		options = append(options, tui.MenuOption{Label: "Uninstall", Value: "uninstall"})
 	}
 
@@ -102,7 +132,7 @@ func handleChoice(choice string, osInfo *osdetect.OSInfo) error {
 	case "update":
 		return updateUserInteractive()
 	case "list":
-		return listUsersFullscreen()
+		return listUsersFullscreen("")
 	case "delete":
 		return deleteUserInteractive()
 	case "configure":
@@ -116,14 +146,14 @@ func handleChoice(choice string, osInfo *osdetect.OSInfo) error {
 func createUserInteractive() error {
 	var username string
 	for {
-		value, ok, err := tui.RunInput(tui.InputConfig{
+		value, err := RunInput(tui.InputConfig{
 			Title:       "Username",
 			Description: "Enter username for tunnel user",
 		})
 		if err != nil {
 			return err
 		}
-		if !ok || value == "" {
+		if value == "" {
 			return ErrCancelled
 		}
 
@@ -135,58 +165,118 @@ func createUserInteractive() error {
 		break
 	}
 
-	authMode, err := tui.RunMenu(tui.MenuConfig{
+	authMode, err := RunMenu(tui.MenuConfig{
 		Title: "Authentication Method",
 		Options: []tui.MenuOption{
 			{Label: "Password - simpler, suitable for shared access", Value: "password"},
 			{Label: "SSH Key - more secure, user provides public key", Value: "key"},
+			{Label: "SFTP only - password, file transfer without tunnels", Value: "sftp"},
 		},
 	})
 	if err != nil {
 		return err
 	}
-	if authMode == "" {
-		return ErrCancelled
-	}
 
-	cfg := &tunneluser.Config{
+	in := operations.CreateInput{
 		Username: username,
 	}
 
-	if authMode == "key" {
-		cfg.AuthMode = tunneluser.AuthModeKey
+	switch authMode {
+	case "key":
+		in.AuthMode = tunneluser.AuthModeKey
 		publicKey, err := PromptPubkey(username)
 		if err != nil {
 			return err
 		}
-		cfg.PublicKey = publicKey
-	} else {
-		cfg.AuthMode = tunneluser.AuthModePassword
+		in.PublicKey = publicKey
+	case "sftp":
+		in.AuthMode = tunneluser.AuthModeSFTP
 		password, err := PromptPassword(username)
 		if err != nil {
 			return err
 		}
-		cfg.Password = password
+		in.Password = password
+	default:
+		in.AuthMode = tunneluser.AuthModePassword
+		password, err := PromptPassword(username)
+		if err != nil {
+			return err
+		}
+		in.Password = password
+		in.EnableTOTP, err = PromptTOTP()
+		if err != nil {
+			return err
+		}
 	}
 
-	if err := tunneluser.Create(cfg); err != nil {
-		return fmt.Errorf("failed to create user: %w", err)
+	// SFTP-only users have no tunnels and a fixed chroot home
+	if in.AuthMode != tunneluser.AuthModeSFTP {
+		if err := promptTunnelAccess(&in, username); err != nil {
+			return err
+		}
 	}
 
-	if cfg.AuthMode == tunneluser.AuthModeKey {
-		if err := sshdconfig.AddAuthorizedKeysDirective(); err != nil {
-			tui.PrintWarning("Could not add AuthorizedKeysFile directive: " + err.Error())
-		}
+	in.Server, err = PromptServer(DetectServerIP(in.TunnelType))
+	if err != nil {
+		return err
+	}
+
+	info, err := operations.CreateUser(in)
+	if err != nil {
+		return fmt.Errorf("failed to create user: %w", err)
 	}
+	printWarnings(info.Warnings)
 
 	fmt.Println()
 	tui.PrintSuccess(fmt.Sprintf("User '%s' created successfully!", username))
-	PrintClientUsage(username, cfg.AuthMode)
+	PrintClientUsage(info)
+	notifyUserCreated(info)
+	return nil
+}
+
+// promptTunnelAccess asks for the tunnel type, its destinations, SFTP
+// access and a home directory of a new tunnel user.
+func promptTunnelAccess(in *operations.CreateInput, username string) error {
+	var err error
+	in.TunnelType, err = PromptTunnelType()
+	if err != nil {
+		return err
+	}
+	if in.TunnelType == tunneluser.TunnelTypeForward || in.TunnelType == tunneluser.TunnelTypeBoth {
+		in.PermitOpen, err = PromptPermitOpen(in.TunnelType)
+		if err != nil {
+			return err
+		}
+	}
+
+	in.EnableSFTP, err = RunConfirm(tui.ConfirmConfig{
+		Title:       "Enable SFTP access?",
+		Description: "Adds a chrooted home directory for file transfer (tunnels still work)",
+	})
+	if err != nil {
+		return err
+	}
+
+	if in.EnableSFTP {
+		return nil
+	}
+	advanced, err := RunConfirm(tui.ConfirmConfig{
+		Title:       "Show advanced options?",
+		Description: "Home directory (default: " + tunneluser.DefaultHomeDir + ")",
+	})
+	if err != nil || !advanced {
+		return err
+	}
+	in.HomeDir, err = PromptHomeDir(username)
+	if err != nil {
+		return err
+	}
+	in.CreateHome = in.HomeDir != ""
 	return nil
 }
 
 func updateUserInteractive() error {
-	users, err := tunneluser.List()
+	users, err := tunneluser.DefaultCache.List(listMaxAge)
 	if err != nil {
 		return fmt.Errorf("failed to list users: %w", err)
 	}
@@ -196,34 +286,71 @@ func updateUserInteractive() error {
 		return nil
 	}
 
+	username, err := selectUser("Select user to update", users)
+	if err != nil {
+		return err
+	}
+
+	currentMode, _ := tunneluser.GetAuthMode(username)
+	return showUpdateUserMenu(username, currentMode)
+}
+
+// selectUser shows a menu of users, with "Back" first, and returns the
+// chosen username. The menu doesn't scroll, so with more than
+// selectMenuMaxUsers users it first asks for part of the name and lists
+// only the users matching it, asking again while too many or none match.
+func selectUser(title string, users []tunneluser.UserInfo) (string, error) {
+	matching := users
+	description := fmt.Sprintf("%d tunnel users; type part of a name to narrow the list", len(users))
+	for len(matching) > selectMenuMaxUsers {
+		filter, err := RunInput(tui.InputConfig{
+			Title:       title,
+			Description: description,
+		})
+		if err != nil {
+			return "", err
+		}
+		matching = filterUsers(users, filter)
+		switch {
+		case strings.TrimSpace(filter) == "":
+			// Keep asking with the original description
+		case len(matching) == 0:
+			description = fmt.Sprintf("No users match %q; try another part of the name", filter)
+			matching = users
+		case len(matching) > selectMenuMaxUsers:
+			description = fmt.Sprintf("%d users match %q; type more of the name", len(matching), filter)
+		}
+	}
+
 	options := []tui.MenuOption{
 		{Label: "Back", Value: ""},
 	}
-	for _, user := range users {
+	for _, user := range matching {
 		label := fmt.Sprintf("%s (%s)", user.Username, user.AuthMode)
 		options = append(options, tui.MenuOption{Label: label, Value: user.Username})
 	}
-
-	username, err := tui.RunMenu(tui.MenuConfig{
-		Title:   "Select user to update",
+	return RunMenu(tui.MenuConfig{
+		Title:   title,
 		Options: options,
 	})
-	if err != nil {
-		return err
-	}
+}
 
-	if username == "" {
-		return ErrCancelled
+// filterUsers returns the users whose name contains filter, ignoring case.
+func filterUsers(users []tunneluser.UserInfo, filter string) []tunneluser.UserInfo {
+	filter = strings.ToLower(strings.TrimSpace(filter))
+	var matching []tunneluser.UserInfo
+	for _, user := range users {
+		if strings.Contains(strings.ToLower(user.Username), filter) {
+			matching = append(matching, user)
+		}
 	}
-
-	currentMode, _ := tunneluser.GetAuthMode(username)
-	return showUpdateUserMenu(username, currentMode)
+	return matching
 }
 
 func showUpdateUserMenu(username string, currentMode tunneluser.AuthMode) error {
 	fmt.Printf("\nUpdating user '%s' (current auth: %s)\n", username, currentMode)
 
-	choice, err := tui.RunMenu(tui.MenuConfig{
+	choice, err := RunMenu(tui.MenuConfig{
 		Title: "What would you like to update?",
 		Options: []tui.MenuOption{
 			{Label: "Back", Value: "back"},
@@ -251,20 +378,17 @@ func updateUserPassword(username string, currentMode tunneluser.AuthMode) error
 		return err
 	}
 
-	if err := tunneluser.SetPassword(username, password); err != nil {
-		return fmt.Errorf("failed to set password: %w", err)
+	result, err := operations.SetUserPassword(username, password)
+	if err != nil {
+		return err
 	}
-
-	if currentMode != tunneluser.AuthModePassword {
-		if err := tunneluser.SwitchAuthMode(username, tunneluser.AuthModePassword); err != nil {
-			return fmt.Errorf("failed to switch auth mode: %w", err)
-		}
+	if result.Switched() {
 		fmt.Printf("Switched '%s' from %s to password authentication\n", username, currentMode)
 	}
 
 	fmt.Println()
 	tui.PrintSuccess(fmt.Sprintf("Password updated for '%s'!", username))
-	PrintClientUsage(username, tunneluser.AuthModePassword)
+	PrintClientUsage(UsageInfo(username, tunneluser.AuthModePassword))
 	return nil
 }
 
@@ -274,40 +398,40 @@ func updateUserKey(username string, currentMode tunneluser.AuthMode) error {
 		return err
 	}
 
-	if err := tunneluser.SetupSSHKey(username, publicKey); err != nil {
-		return fmt.Errorf("failed to set SSH key: %w", err)
+	result, err := operations.SetUserKey(username, publicKey)
+	if err != nil {
+		return err
 	}
-
-	if currentMode != tunneluser.AuthModeKey {
-		if err := tunneluser.SwitchAuthMode(username, tunneluser.AuthModeKey); err != nil {
-			return fmt.Errorf("failed to switch auth mode: %w", err)
-		}
+	if result.Switched() {
 		fmt.Printf("Switched '%s' from %s to key authentication\n", username, currentMode)
 	}
-
-	if err := sshdconfig.AddAuthorizedKeysDirective(); err != nil {
-		tui.PrintWarning("Could not add AuthorizedKeysFile directive: " + err.Error())
-	}
+	printWarnings(result.Warnings)
 
 	fmt.Println()
 	tui.PrintSuccess(fmt.Sprintf("SSH key updated for '%s'!", username))
-	PrintClientUsage(username, tunneluser.AuthModeKey)
+	PrintClientUsage(UsageInfo(username, tunneluser.AuthModeKey))
 	return nil
 }
 
-func listUsersFullscreen() error {
-	users, err := tunneluser.List()
+// listUsersFullscreen shows the tunnel users with the given auth mode, or
+// every user if mode is empty.
+func listUsersFullscreen(mode tunneluser.AuthMode) error {
+	users, err := tunneluser.ListDetailedByAuthMode(mode)
 	if err != nil {
 		return fmt.Errorf("failed to list users: %w", err)
 	}
 
-	items := make([]string, len(users))
-	for i, user := range users {
-		items[i] = fmt.Sprintf("%s (%s auth)", user.Username, user.AuthMode)
+	var items []string
+	if len(users) > 0 {
+		items = FormatUserTable(users)
 	}
 
+	title := "Tunnel Users"
+	if mode != "" {
+		title = fmt.Sprintf("Tunnel Users (%s auth)", mode)
+	}
 	if err := tui.ShowList(tui.ListConfig{
-		Title:     "Tunnel Users",
+		Title:     title,
 		Items:     items,
 		EmptyText: "No tunnel users found.",
 	}); err != nil {
@@ -318,7 +442,7 @@ func listUsersFullscreen() error {
 }
 
 func deleteUserInteractive() error {
-	users, err := tunneluser.List()
+	users, err := tunneluser.DefaultCache.List(listMaxAge)
 	if err != nil {
 		return fmt.Errorf("failed to list users: %w", err)
 	}
@@ -328,55 +452,87 @@ func deleteUserInteractive() error {
 		return nil
 	}
 
-	options := []tui.MenuOption{
-		{Label: "Back", Value: ""},
-	}
-	for _, user := range users {
-		label := fmt.Sprintf("%s (%s)", user.Username, user.AuthMode)
-		options = append(options, tui.MenuOption{Label: label, Value: user.Username})
-	}
-
-	username, err := tui.RunMenu(tui.MenuConfig{
-		Title:   "Select user to delete",
-		Options: options,
-	})
+	username, err := selectUser("Select user to delete", users)
 	if err != nil {
 		return err
 	}
 
-	if username == "" {
-		return ErrCancelled
+	plan, err := tunneluser.DeletePlan(username)
+	if err != nil {
+		return err
 	}
+	tui.PrintBox("Will be removed", FormatDeletePlan(plan))
 
-	confirm, err := tui.RunConfirm(tui.ConfirmConfig{
+	confirm, err := RunConfirm(tui.ConfirmConfig{
 		Title: fmt.Sprintf("Delete user '%s'?", username),
 	})
 	if err != nil {
 		return err
 	}
 
-	if !confirm {
+	if !confirm || !CountdownConfirm(fmt.Sprintf("Deleting user '%s'.", username), DeleteConfirmDelay) {
 		return ErrCancelled
 	}
 
-	if err := tunneluser.Delete(username); err != nil {
-		return fmt.Errorf("failed to delete user: %w", err)
+	if err := operations.DeleteUser(username); err != nil {
+		return err
 	}
 
 	tui.PrintSuccess(fmt.Sprintf("User '%s' deleted successfully!", username))
+	notifyUsersDeleted(tunneluser.SystemName(username))
 	return nil
 }
 
 func configureInteractive(osInfo *osdetect.OSInfo) error {
+	opts := sshdconfig.DefaultOptions()
+	opts.PasswordGroup = tunneluser.GroupPasswordAuth
+	opts.KeyGroup = tunneluser.GroupKeyAuth
+	opts.SFTPGroup = tunneluser.GroupSFTP
+
+	for {
+		choice, err := RunMenu(tui.MenuConfig{
+			Title: "Configure sshd hardening",
+			Options: []tui.MenuOption{
+				{Label: "Apply configuration", Value: "apply"},
+				{Label: "Advanced settings", Value: "advanced"},
+				{Label: "Back", Value: "back"},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if choice == "apply" {
+			break
+		}
+		if choice != "advanced" {
+			return ErrCancelled
+		}
+		if err := advancedSettings(&opts); err != nil {
+			return err
+		}
+	}
+
 	fmt.Println()
+	if err := tunneluser.CheckEntropyAvailable(); err != nil {
+		tui.PrintWarning(fmt.Sprintf("%v: %s", err, tunneluser.EntropyAdvice))
+	}
+	if !container.IsContainer() {
+		WarnFirewallBlocksSSH(opts.Port)
+	}
 	tui.PrintInfo("Applying sshd hardening configuration...")
 
-	if err := sshdconfig.Configure(); err != nil {
+	if err := sshdconfig.Configure(opts); err != nil {
 		return err
 	}
+	if err := tunneluser.EnsureGroups(); err != nil {
+		return err
+	}
+	notifyConfigured()
 
-	if !fail2ban.IsInstalled() {
-		enableFail2ban, err := tui.RunConfirm(tui.ConfirmConfig{
+	if container.IsContainer() {
+		tui.PrintWarning("Running in a container: sshd is reloaded with SIGHUP and fail2ban is skipped. Protect the published SSH port on the host instead.")
+	} else if !fail2ban.IsInstalled() {
+		enableFail2ban, err := RunConfirm(tui.ConfirmConfig{
 			Title:       "Enable fail2ban brute-force protection?",
 			Description: "Bans IPs after 5 failed login attempts",
 		})
@@ -385,25 +541,141 @@ func configureInteractive(osInfo *osdetect.OSInfo) error {
 		}
 
 		if enableFail2ban {
-			if err := fail2ban.SetupWithFeedback(osInfo); err != nil {
-				tui.PrintWarning("fail2ban setup warning: " + err.Error())
+			if err := setupFail2banInteractive(osInfo); err != nil {
+				return err
 			}
 		}
 	} else {
-		if err := fail2ban.SetupWithFeedback(osInfo); err != nil {
-			tui.PrintWarning("fail2ban setup warning: " + err.Error())
+		if err := setupFail2banInteractive(osInfo); err != nil {
+			return err
 		}
 	}
 
 	fmt.Println()
 	tui.PrintSuccess("Configuration complete!")
+	PrintSetupSummary()
+	return nil
+}
+
+// WarnFirewallBlocksSSH warns about each sshd port, and extraPort if it is
+// not 0, that the local firewall appears to block, with the command that
+// opens it. The firewall is left alone.
+func WarnFirewallBlocksSSH(extraPort int) {
+	ports := firewall.DetectPorts()
+	if extraPort != 0 && !slices.Contains(ports, extraPort) {
+		ports = append(ports, extraPort)
+	}
+	for _, port := range ports {
+		status, err := sshdconfig.CheckFirewallRules(port)
+		if err != nil {
+			tui.PrintWarning(fmt.Sprintf("Could not check the firewall for port %d: %v", port, err))
+			continue
+		}
+		if !status.PortOpen {
+			tui.PrintWarning(fmt.Sprintf("%s appears to block SSH port %d, so clients can't connect. To open it, run: %s", status.Tool, port, status.SuggestedCommand))
+		}
+	}
+}
+
+// PrintSetupSummary prints report.GenerateSummary for the current state. A
+// state that can't be collected is reported as a warning, since the setup
+// itself succeeded.
+func PrintSetupSummary() {
+	state, err := operations.CurrentState()
+	if err != nil {
+		tui.PrintWarning("Could not collect the setup summary: " + err.Error())
+		return
+	}
+	fmt.Println()
+	fmt.Println(report.GenerateSummary(state))
+}
+
+// setupFail2banInteractive asks for the addresses never to ban and sets up
+// fail2ban with the default policy.
+func setupFail2banInteractive(osInfo *osdetect.OSInfo) error {
+	opts := fail2ban.DefaultOptions()
+	ips, err := PromptIgnoreIPs()
+	if err != nil {
+		return err
+	}
+	opts.IgnoreIPs = ips
+	return SetupFail2ban(osInfo, opts, true)
+}
+
+// SetupFail2ban sets up fail2ban with the given policy. A jail file that
+// sshtun-user didn't write is only replaced if the operator agrees, which is
+// asked only when interactive is set. Setup problems are printed as warnings
+// since sshd is already configured by then; only prompt errors are returned.
+func SetupFail2ban(osInfo *osdetect.OSInfo, opts fail2ban.Options, interactive bool) error {
+	err := fail2ban.SetupWithOptions(osInfo, opts)
+	if errors.Is(err, fail2ban.ErrCustomJail) {
+		overwrite := false
+		if interactive {
+			if content, err := fail2ban.GetJailConfig(); err == nil {
+				tui.PrintBox("Existing "+fail2ban.JailConfigPath, strings.Split(strings.TrimRight(content, "\n"), "\n"))
+			}
+			overwrite, err = RunConfirm(tui.ConfirmConfig{
+				Title:       "Replace the existing fail2ban jail?",
+				Description: "It was not written by sshtun-user and may contain custom settings",
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if !overwrite {
+			tui.PrintWarning("Keeping the existing fail2ban jail at " + fail2ban.JailConfigPath)
+			if len(opts.IgnoreIPs) > 0 {
+				// Still honour the whitelist, without touching the rest
+				if err := fail2ban.AppendIgnoreIPs(opts.IgnoreIPs); err != nil {
+					tui.PrintWarning("fail2ban whitelist not updated: " + err.Error())
+				} else if err := fail2ban.Reload(); err != nil {
+					tui.PrintWarning("fail2ban setup warning: " + err.Error())
+				} else {
+					tui.PrintInfo("Added to the existing jail's ignoreip: " + strings.Join(opts.IgnoreIPs, ", "))
+				}
+			}
+			return nil
+		}
+		opts.Overwrite = true
+		err = fail2ban.SetupWithOptions(osInfo, opts)
+	}
+	if err != nil {
+		tui.PrintWarning("fail2ban setup warning: " + err.Error())
+	}
+	return nil
+}
+
+// advancedSettings lets the operator change options that weaken or extend
+// the default hardening.
+func advancedSettings(opts *sshdconfig.Options) error {
+	fmt.Println()
+	tui.PrintWarning("GatewayPorts lets tunnel users publish services from their machines on this server's public interfaces using remote (-R) forwards.")
+	enable, err := RunConfirm(tui.ConfirmConfig{
+		Title:       "Enable GatewayPorts?",
+		Description: "Allows remote forwards reachable from other hosts (not recommended)",
+	})
+	if err != nil {
+		return err
+	}
+	opts.GatewayPorts = enable
+
+	fmt.Println()
+	tui.PrintWarning("Disabling password auth globally also applies to admin accounts. Make sure you can log in with a key.")
+	disable, err := RunConfirm(tui.ConfirmConfig{
+		Title:       "Disable password auth for non-tunnel users?",
+		Description: "Only password tunnel users keep password login",
+	})
+	if err != nil {
+		return err
+	}
+	opts.DisablePasswordAuth = disable
 	return nil
 }
 
 func uninstallInteractive() error {
 	for {
 		configured := sshdconfig.IsConfigured()
-		users, _ := tunneluser.List()
+		users, _ := tunneluser.DefaultCache.List(listMaxAge)
 		hasUsers := len(users) > 0
 
 		options := buildUninstallOptions(configured, hasUsers)
@@ -412,7 +684,7 @@ func uninstallInteractive() error {
 			return ErrCancelled
 		}
 
-		choice, err := tui.RunMenu(tui.MenuConfig{
+		choice, err := RunMenu(tui.MenuConfig{
 			Title:   "Uninstall Options",
 			Options: options,
 		})
@@ -420,7 +692,7 @@ func uninstallInteractive() error {
 			return err
 		}
 
-		if choice == "" || choice == "back" {
+		if choice == "back" {
 			return ErrCancelled
 		}
 
@@ -428,6 +700,8 @@ func uninstallInteractive() error {
 		switch choice {
 		case "users":
 			err2 = uninstallUsers()
+		case "users-filter":
+			err2 = uninstallMatchingUsers()
 		case "config":
 			err2 = uninstallConfig()
 		case "all":
@@ -448,6 +722,7 @@ func buildUninstallOptions(configured, hasUsers bool) []tui.MenuOption {
 
 	if hasUsers {
 		options = append(options, tui.MenuOption{Label: "Delete all tunnel users", Value: "users"})
+		options = append(options, tui.MenuOption{Label: "Delete users matching pattern", Value: "users-filter"})
 	}
 
 	if configured && !hasUsers {
@@ -464,7 +739,7 @@ func buildUninstallOptions(configured, hasUsers bool) []tui.MenuOption {
 }
 
 func uninstallUsers() error {
-	users, err := tunneluser.List()
+	users, err := tunneluser.DefaultCache.List(listMaxAge)
 	if err != nil {
 		return fmt.Errorf("failed to list users: %w", err)
 	}
@@ -479,35 +754,97 @@ func uninstallUsers() error {
 		fmt.Printf("  - %s (%s)\n", user.Username, user.AuthMode)
 	}
 
-	confirm, err := tui.RunConfirm(tui.ConfirmConfig{
+	confirm, err := RunConfirm(tui.ConfirmConfig{
 		Title: fmt.Sprintf("Delete all %d tunnel users?", len(users)),
 	})
 	if err != nil {
 		return err
 	}
 
-	if !confirm {
+	if !confirm || !CountdownConfirm(fmt.Sprintf("Deleting all %d tunnel users.", len(users)), ConfirmDelay) {
 		return ErrCancelled
 	}
 
 	fmt.Println()
-	deleted, err := tunneluser.DeleteAllUsers()
-	if len(deleted) > 0 {
-		fmt.Printf("Deleted users: %v\n", deleted)
+	result, err := operations.UninstallUsers(tunneluser.PrintDeleteProgress)
+	if len(result.DeletedUsers) > 0 {
+		fmt.Printf("Deleted users: %v\n", result.DeletedUsers)
 	}
+	notifyUsersDeleted(result.DeletedUsers...)
+	printWarnings(result.Warnings)
 
 	if err != nil {
 		return err
 	}
 
-	tunneluser.CleanupAuthorizedKeysDir()
-	tunneluser.CleanupDenyFiles()
-
 	fmt.Println()
 	tui.PrintSuccess("All tunnel users deleted!")
 	return nil
 }
 
+// uninstallMatchingUsers asks for a regular expression and deletes the
+// tunnel users whose name matches it, after showing them for confirmation.
+func uninstallMatchingUsers() error {
+	var pattern string
+	var users []tunneluser.UserInfo
+	for {
+		var err error
+		pattern, err = RunInput(tui.InputConfig{
+			Title:       "Username Pattern",
+			Description: "Regular expression, e.g. ^ci- for users created by automation",
+		})
+		if err != nil {
+			return err
+		}
+		if pattern == "" {
+			return ErrCancelled
+		}
+		users, err = tunneluser.MatchingUsers(pattern)
+		if err != nil {
+			tui.PrintError(err.Error())
+			continue
+		}
+		break
+	}
+
+	if len(users) == 0 {
+		tui.PrintInfo(fmt.Sprintf("No tunnel users match %q.", pattern))
+		return nil
+	}
+
+	fmt.Println("\nThe following users will be deleted:")
+	for _, user := range users {
+		fmt.Printf("  - %s (%s)\n", user.Username, user.AuthMode)
+	}
+
+	confirm, err := RunConfirm(tui.ConfirmConfig{
+		Title: fmt.Sprintf("Delete these %d tunnel users?", len(users)),
+	})
+	if err != nil {
+		return err
+	}
+
+	if !confirm || !CountdownConfirm(fmt.Sprintf("Deleting %d tunnel users.", len(users)), ConfirmDelay) {
+		return ErrCancelled
+	}
+
+	fmt.Println()
+	result, err := operations.UninstallMatchingUsers(pattern, tunneluser.PrintDeleteProgress)
+	if len(result.DeletedUsers) > 0 {
+		fmt.Printf("Deleted users: %v\n", result.DeletedUsers)
+	}
+	notifyUsersDeleted(result.DeletedUsers...)
+	printWarnings(result.Warnings)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Println()
+	tui.PrintSuccess(fmt.Sprintf("%d tunnel users deleted!", len(result.DeletedUsers)))
+	return nil
+}
+
 func uninstallConfig() error {
 	hasUsers, _ := tunneluser.GroupsHaveUsers()
 	if hasUsers {
@@ -515,11 +852,11 @@ func uninstallConfig() error {
 	}
 
 	fmt.Println("\nThis will remove:")
-	fmt.Println("  - Tunnel groups (sshtunnel-password, sshtunnel-key)")
+	fmt.Printf("  - Tunnel groups (%s, %s, %s)\n", tunneluser.GroupPasswordAuth, tunneluser.GroupKeyAuth, tunneluser.GroupSFTP)
 	fmt.Println("  - sshd hardening configuration files")
 	fmt.Println("  - Authorized keys directory (if empty)")
 
-	confirm, err := tui.RunConfirm(tui.ConfirmConfig{
+	confirm, err := RunConfirm(tui.ConfirmConfig{
 		Title: "Remove all configuration?",
 	})
 	if err != nil {
@@ -531,28 +868,12 @@ func uninstallConfig() error {
 	}
 
 	fmt.Println()
-
-	if sshdconfig.IsConfigured() {
-		fmt.Println("Removing sshd configuration...")
-		if err := sshdconfig.RemoveAndReload(); err != nil {
-			tui.PrintWarning("sshd config removal warning: " + err.Error())
-		} else {
-			fmt.Println("  sshd configuration removed")
-		}
-	}
-
-	fmt.Println("Removing tunnel groups...")
-	if err := tunneluser.DeleteGroups(); err != nil {
-		tui.PrintWarning("Group removal warning: " + err.Error())
-	} else {
-		fmt.Println("  Tunnel groups removed")
+	fmt.Println("Removing sshd configuration, tunnel groups and leftover files...")
+	result, err := operations.UninstallConfig()
+	if err != nil {
+		return err
 	}
-
-	fmt.Println("Cleaning up authorized_keys.d...")
-	tunneluser.CleanupAuthorizedKeysDir()
-
-	fmt.Println("Cleaning up cron.deny and at.deny...")
-	tunneluser.CleanupDenyFiles()
+	printUninstallResult(result)
 
 	fmt.Println()
 	tui.PrintSuccess("Configuration removed!")
@@ -560,7 +881,7 @@ func uninstallConfig() error {
 }
 
 func uninstallAll() error {
-	users, _ := tunneluser.List()
+	users, _ := tunneluser.DefaultCache.List(listMaxAge)
 	configured := sshdconfig.IsConfigured()
 
 	fmt.Println()
@@ -574,68 +895,80 @@ func uninstallAll() error {
 	}
 	fmt.Println("  - Clean up authorized keys and deny files")
 
-	confirm, err := tui.RunConfirm(tui.ConfirmConfig{
+	confirm, err := RunConfirm(tui.ConfirmConfig{
 		Title: "Proceed with complete uninstall?",
 	})
 	if err != nil {
 		return err
 	}
 
-	if !confirm {
+	if !confirm || !CountdownConfirm("Starting complete uninstall.", ConfirmDelay) {
 		return ErrCancelled
 	}
 
 	fmt.Println()
-
-	if len(users) > 0 {
-		fmt.Println("Deleting tunnel users...")
-		deleted, err := tunneluser.DeleteAllUsers()
-		if len(deleted) > 0 {
-			for _, u := range deleted {
-				fmt.Printf("  Deleted: %s\n", u)
-			}
-		}
-		if err != nil {
-			tui.PrintWarning("Some users could not be deleted: " + err.Error())
-		}
+	fmt.Println("Deleting tunnel users and removing configuration...")
+	result, err := operations.UninstallAll(tunneluser.PrintDeleteProgress)
+	if result != nil {
+		notifyUsersDeleted(result.DeletedUsers...)
+	}
+	if err != nil {
+		return err
 	}
+	printUninstallResult(result)
 
-	if configured {
-		fmt.Println("Removing sshd configuration...")
-		if err := sshdconfig.RemoveAndReload(); err != nil {
-			tui.PrintWarning("sshd config removal warning: " + err.Error())
-		} else {
-			fmt.Println("  sshd configuration removed")
-		}
+	fmt.Println()
+	tui.PrintSuccess("Complete uninstall finished!")
+	return nil
+}
 
-		fmt.Println("Removing tunnel groups...")
-		if err := tunneluser.DeleteGroups(); err != nil {
-			tui.PrintWarning("Group removal warning: " + err.Error())
-		} else {
-			fmt.Println("  Tunnel groups removed")
+// UsageInfo describes an existing user for PrintClientUsage, restoring
+// forward-only restrictions and SFTP access from their sshd settings and a
+// pending password change from /etc/shadow.
+func UsageInfo(username string, authMode tunneluser.AuthMode) *tunneluser.CreatedUserInfo {
+	account := tunneluser.SystemName(username)
+	info := &tunneluser.CreatedUserInfo{Username: account, AuthMode: authMode}
+	if opts, err := sshdconfig.ReadUserConfig(account); err == nil {
+		if len(opts.PermitOpen) > 0 {
+			info.TunnelType = tunneluser.TunnelTypeForward
+			info.PermitOpen = opts.PermitOpen
 		}
+		info.SFTP = opts.SFTP
+	}
+	if authMode == tunneluser.AuthModeSFTP {
+		info.SFTP = true
 	}
+	info.PasswordChangeRequired = authMode == tunneluser.AuthModePassword && tunneluser.PasswordChangePending(username)
+	return info
+}
 
-	fmt.Println("Cleaning up...")
-	tunneluser.CleanupAuthorizedKeysDir()
-	tunneluser.CleanupDenyFiles()
+func printUninstallResult(result *operations.UninstallResult) {
+	for _, u := range result.DeletedUsers {
+		fmt.Printf("  Deleted: %s\n", u)
+	}
+	if result.ConfigRemoved {
+		fmt.Println("  sshd configuration removed")
+	}
+	if result.GroupsRemoved {
+		fmt.Println("  Tunnel groups removed")
+	}
+	printWarnings(result.Warnings)
+}
 
-	fmt.Println()
-	tui.PrintSuccess("Complete uninstall finished!")
-	return nil
+func printWarnings(warnings []string) {
+	for _, w := range warnings {
+		tui.PrintWarning(w)
+	}
 }
 
 func PromptPassword(username string) (string, error) {
-	password, ok, err := tui.RunInput(tui.InputConfig{
+	password, err := RunInput(tui.InputConfig{
 		Title:       "Password",
 		Description: fmt.Sprintf("Enter password for '%s' (leave empty to auto-generate)", username),
 	})
 	if err != nil {
 		return "", err
 	}
-	if !ok {
-		return "", ErrCancelled
-	}
 
 	if password == "" {
 		generated, err := tunneluser.GeneratePassword()
@@ -643,7 +976,7 @@ func PromptPassword(username string) (string, error) {
 			return "", fmt.Errorf("failed to generate password: %w", err)
 		}
 		password = generated
-		tui.PrintBox("Generated Password (save this now!)", []string{tui.Code(password)})
+		PrintGeneratedPassword(password)
 	}
 
 	return password, nil
@@ -651,37 +984,258 @@ func PromptPassword(username string) (string, error) {
 
 func PromptPubkey(username string) (string, error) {
 	for {
-		key, ok, err := tui.RunInput(tui.InputConfig{
+		key, err := RunInput(tui.InputConfig{
 			Title:       "SSH Public Key",
 			Description: fmt.Sprintf("Enter public key for '%s' (from ~/.ssh/id_ed25519.pub)", username),
 		})
 		if err != nil {
 			return "", err
 		}
-		if !ok {
-			return "", ErrCancelled
-		}
 
 		if key == "" {
 			tui.PrintError("public key is required for key-based auth")
 			continue
 		}
-		if err := tunneluser.ValidatePublicKey(key); err != nil {
-			tui.PrintError(fmt.Sprintf("invalid public key format: %v", err))
+		if err := tunneluser.ValidatePublicKeyStrict(key); err != nil {
+			tui.PrintError(fmt.Sprintf("invalid public key: %v", err))
+			continue
+		}
+		if err := tunneluser.CheckKeyPolicy(key); err != nil {
+			tui.PrintError(err.Error())
 			continue
 		}
 		return key, nil
 	}
 }
 
-func PrintClientUsage(username string, authMode tunneluser.AuthMode) {
+// PromptTunnelType asks which kinds of forwarding the user needs.
+func PromptTunnelType() (tunneluser.TunnelType, error) {
+	choice, err := RunMenu(tui.MenuConfig{
+		Title: "Allowed Tunnel Types",
+		Options: []tui.MenuOption{
+			{Label: "Any forwarding (default)", Value: string(tunneluser.TunnelTypeAny)},
+			{Label: "SOCKS proxy only (DynamicForward)", Value: string(tunneluser.TunnelTypeSOCKS)},
+			{Label: "Specific port forward only (LocalForward)", Value: string(tunneluser.TunnelTypeForward)},
+			{Label: "Both SOCKS and specific ports", Value: string(tunneluser.TunnelTypeBoth)},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return tunneluser.TunnelType(choice), nil
+}
+
+// PromptPermitOpen asks for the port forward destinations of a user.
+func PromptPermitOpen(tunnelType tunneluser.TunnelType) ([]string, error) {
+	description := "Comma-separated host:port list shown in the client examples"
+	if tunnelType.RestrictsDestinations() {
+		description = "Comma-separated host:port list the user may forward to (port may be *)"
+	}
+	for {
+		value, err := RunInput(tui.InputConfig{
+			Title:       "Forwarding Destinations",
+			Description: description,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var destinations []string
+		for _, d := range strings.Split(value, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				destinations = append(destinations, d)
+			}
+		}
+		if len(destinations) == 0 && tunnelType.RestrictsDestinations() {
+			tui.PrintError("at least one destination is required")
+			continue
+		}
+		if err := tunneluser.ValidatePermitOpen(destinations); err != nil {
+			tui.PrintError(err.Error())
+			continue
+		}
+		return destinations, nil
+	}
+}
+
+// PromptIgnoreIPs asks for addresses fail2ban must never ban, pre-filled
+// with those of the installed jail. An empty answer skips the prompt.
+func PromptIgnoreIPs() ([]string, error) {
+	for {
+		value, err := RunInput(tui.InputConfig{
+			Title:       "fail2ban Whitelist",
+			Description: "Enter IPs to whitelist from banning (comma-separated, press Enter to skip)",
+			Placeholder: "203.0.113.10, 10.0.0.0/8",
+			Value:       strings.Join(fail2ban.IgnoreIPs(), ", "),
+		})
+		if err != nil {
+			return nil, err
+		}
+		ips, err := fail2ban.ParseIgnoreIPs(value)
+		if err != nil {
+			tui.PrintError(err.Error())
+			continue
+		}
+		return ips, nil
+	}
+}
+
+// DetectServerIP returns the server's public IP for the client examples of
+// a user allowed to run a SOCKS proxy, or "" when the tunnel type has no
+// SOCKS examples or detection fails.
+func DetectServerIP(tunnelType tunneluser.TunnelType) string {
+	if tunnelType == tunneluser.TunnelTypeForward {
+		return ""
+	}
+	ip, err := tunneluser.GetServerPublicIP()
+	if err != nil {
+		return ""
+	}
+	return ip
+}
+
+// PromptServer asks for the server's hostname or IP used in client examples,
+// pre-filled with detected when not empty. An empty result means the user
+// skipped the prompt.
+func PromptServer(detected string) (string, error) {
+	description := "Server hostname or IP for connection examples (press Enter to skip)"
+	if detected != "" {
+		description = fmt.Sprintf("Detected server IP: %s. Change it if clients connect through another address (clear to skip)", detected)
+	}
+	server, err := RunInput(tui.InputConfig{
+		Title:       "Server Address",
+		Description: description,
+		Value:       detected,
+	})
+	if errors.Is(err, ErrCancelled) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(server), nil
+}
+
+// PromptHomeDir offers a user-owned home directory for file transfers.
+// Most tunnel users need no home, so callers only ask when the operator
+// chose advanced options. An empty path means the default home.
+func PromptHomeDir(username string) (string, error) {
+	createHome, err := RunConfirm(tui.ConfirmConfig{
+		Title:       "Create an SFTP home directory?",
+		Description: "A writable home directory owned by the user, for file transfers (not chrooted)",
+	})
+	if err != nil || !createHome {
+		return "", err
+	}
+
+	for {
+		home, err := RunInput(tui.InputConfig{
+			Title:       "Home Directory",
+			Description: "Absolute path of the home directory",
+			Value:       "/home/" + username,
+		})
+		if err != nil {
+			return "", err
+		}
+		home = strings.TrimSpace(home)
+		if !filepath.IsAbs(home) {
+			tui.PrintError("home directory must be an absolute path")
+			continue
+		}
+		return home, nil
+	}
+}
+
+// PromptTOTP asks whether a password user also needs a TOTP code. It is
+// only asked when pam_google_authenticator is installed.
+func PromptTOTP() (bool, error) {
+	if !tunneluser.TOTPAvailable() {
+		return false, nil
+	}
+	return RunConfirm(tui.ConfirmConfig{
+		Title:       "Require a TOTP code (two-factor)?",
+		Description: "Login asks for the password and then a code from an authenticator app",
+	})
+}
+
+// PrintClientUsage prints example client commands for the user, limited to
+// the forwarding its tunnel type allows. A server address in info adds a
+// ready-to-run test command.
+func PrintClientUsage(info *tunneluser.CreatedUserInfo) {
+	host := info.Server
+	if host == "" {
+		host = "<server>"
+	}
+	if info.AuthMode == tunneluser.AuthModeSFTP {
+		fmt.Println()
+		fmt.Println("Client usage:")
+		fmt.Printf("  sftp %s@%s    # File transfer only (write to uploads/)\n", info.Username, host)
+		return
+	}
+	keyArg := ""
+	if info.AuthMode == tunneluser.AuthModeKey {
+		keyArg = "-i <private_key> "
+	}
+
+	tunnelType := info.TunnelType
+	if tunnelType == "" {
+		tunnelType = tunneluser.TunnelTypeAny
+	}
+	showSOCKS := tunnelType != tunneluser.TunnelTypeForward
+	showForward := tunnelType != tunneluser.TunnelTypeSOCKS
+
 	fmt.Println()
 	fmt.Println("Client usage:")
-	if authMode == tunneluser.AuthModeKey {
-		fmt.Printf("  ssh -D 1080 -N -i <private_key> %s@<server>    # SOCKS proxy\n", username)
-		fmt.Printf("  ssh -L 8080:target:80 -N -i <private_key> %s@<server>  # Local forward\n", username)
-	} else {
-		fmt.Printf("  ssh -D 1080 -N %s@<server>    # SOCKS proxy\n", username)
-		fmt.Printf("  ssh -L 8080:target:80 -N %s@<server>  # Local forward\n", username)
+	if showSOCKS {
+		fmt.Printf("  ssh -D 1080 -N %s%s@%s    # SOCKS proxy\n", keyArg, info.Username, host)
+	}
+	if showForward {
+		if len(info.PermitOpen) == 0 {
+			fmt.Printf("  ssh -L 8080:target:80 -N %s%s@%s  # Local forward\n", keyArg, info.Username, host)
+		}
+		for i, dest := range info.PermitOpen {
+			fmt.Printf("  ssh -L %d:%s -N %s%s@%s  # Local forward\n", 8080+i, strings.Replace(dest, ":*", ":<port>", 1), keyArg, info.Username, host)
+		}
+	}
+
+	if info.SFTP {
+		fmt.Printf("  sftp %s%s@%s    # File transfer (write to upload/)\n", keyArg, info.Username, host)
+	}
+
+	if info.PasswordChangeRequired {
+		fmt.Println()
+		tui.PrintWarning("The password is expired: the first connection must be a terminal login without -N,")
+		fmt.Printf("  ssh %s@%s    # Asks for the current and a new password, then disconnects\n", info.Username, host)
+		fmt.Println("  Tunnels work once the password has been changed.")
+	}
+
+	if info.TOTPSecret != "" {
+		fmt.Println()
+		tui.PrintBox("TOTP Secret (save this now!)", []string{
+			tui.Code(info.TOTPSecret),
+			info.TOTPURL,
+			"Login asks for the password, then the verification code",
+		})
+		printCredentialQR(info.TOTPURL)
 	}
+
+	if info.Server == "" {
+		return
+	}
+
+	port := osdetect.DetectSSHPort()
+	portArg := ""
+	if port != "22" {
+		portArg = "-p " + port + " "
+	}
+
+	testForward := "-D 1080"
+	if !showSOCKS && len(info.PermitOpen) > 0 {
+		testForward = "-L 8080:" + strings.Replace(info.PermitOpen[0], ":*", ":<port>", 1)
+	}
+
+	fmt.Println()
+	fmt.Println("Test from another terminal:")
+	fmt.Printf("  nc -z %s %s && echo \"Port %s is reachable\"\n", info.Server, port, port)
+	fmt.Printf("  ssh -o StrictHostKeyChecking=no %s%s%s -N %s@%s\n", portArg, keyArg, testForward, info.Username, info.Server)
 }
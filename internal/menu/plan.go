@@ -0,0 +1,42 @@
+package menu
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+)
+
+// FormatDeletePlan renders what deleting a user removes, one item per line.
+func FormatDeletePlan(plan tunneluser.Plan) []string {
+	state := ""
+	if plan.Disabled {
+		state = ", disabled"
+	}
+	lines := []string{
+		fmt.Sprintf("System account: %s (uid %s, %s auth%s)", plan.Username, plan.UID, plan.AuthMode, state),
+		"Group memberships: " + orNone(strings.Join(plan.Groups, ", ")),
+		"Key file: " + orNone(plan.KeyFile),
+		"Per-user sshd config: " + orNone(plan.UserConfig),
+	}
+	if plan.SFTPHome != "" {
+		lines = append(lines, "SFTP home (removed only if empty): "+plan.SFTPHome)
+	}
+	lines = append(lines, "Deny file entries: "+orNone(strings.Join(plan.DenyFiles, ", ")))
+	if len(plan.Processes) == 0 {
+		lines = append(lines, "Active sessions: none")
+	} else {
+		lines = append(lines, fmt.Sprintf("Active sessions to be killed: %d", len(plan.Processes)))
+		for _, p := range plan.Processes {
+			lines = append(lines, "  "+p)
+		}
+	}
+	return lines
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
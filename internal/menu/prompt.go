@@ -0,0 +1,82 @@
+package menu
+
+import (
+	"errors"
+	"os"
+
+	"github.com/mattn/go-isatty"
+	"github.com/net2share/go-corelib/tui"
+)
+
+// ErrNotInteractive is returned by the prompt helpers when stdin is not a
+// terminal, e.g. under cron or in a pipe.
+var ErrNotInteractive = errors.New("interactive input required; pass flags instead")
+
+// RequireTerminal returns ErrNotInteractive unless stdin is a terminal.
+func RequireTerminal() error {
+	if !isatty.IsTerminal(os.Stdin.Fd()) {
+		return ErrNotInteractive
+	}
+	return nil
+}
+
+// RunMenu shows a menu and returns the selected value. Esc, q and Ctrl-C,
+// like choosing an option whose value is empty (e.g. "Back"), return
+// ErrCancelled.
+func RunMenu(cfg tui.MenuConfig) (string, error) {
+	if err := RequireTerminal(); err != nil {
+		return "", err
+	}
+	choice, err := tui.RunMenu(cfg)
+	if err != nil {
+		return "", err
+	}
+	if choice == "" {
+		return "", ErrCancelled
+	}
+	return choice, nil
+}
+
+// RunConfirm asks a yes/no question. Unlike tui.RunConfirm it tells "No"
+// apart from cancelling, which returns ErrCancelled.
+func RunConfirm(cfg tui.ConfirmConfig) (bool, error) {
+	if cfg.Affirmative == "" {
+		cfg.Affirmative = "Yes"
+	}
+	if cfg.Negative == "" {
+		cfg.Negative = "No"
+	}
+	selected := 0
+	if !cfg.Default {
+		selected = 1
+	}
+
+	choice, err := RunMenu(tui.MenuConfig{
+		Title:       cfg.Title,
+		Description: cfg.Description,
+		Options: []tui.MenuOption{
+			{Label: cfg.Affirmative, Value: "yes"},
+			{Label: cfg.Negative, Value: "no"},
+		},
+		Selected: selected,
+	})
+	if err != nil {
+		return false, err
+	}
+	return choice == "yes", nil
+}
+
+// RunInput asks for a line of text. Cancelling returns ErrCancelled.
+func RunInput(cfg tui.InputConfig) (string, error) {
+	if err := RequireTerminal(); err != nil {
+		return "", err
+	}
+	value, ok, err := tui.RunInput(cfg)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrCancelled
+	}
+	return value, nil
+}
@@ -0,0 +1,70 @@
+package menu
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/mattn/go-isatty"
+	"github.com/net2share/go-corelib/osdetect"
+	"github.com/net2share/go-corelib/tui"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// ShowQR makes credential output (generated passwords, TOTP secrets) also
+// print a scannable QR code. Set by the --qr flag.
+var ShowQR bool
+
+// PrintQR prints text as a QR code drawn with half-block characters. It
+// prints nothing when stdout is not a terminal, where a QR code would only
+// be noise.
+func PrintQR(text string) {
+	if !isatty.IsTerminal(os.Stdout.Fd()) {
+		return
+	}
+	qr, err := qrcode.New(text, qrcode.Medium)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to render QR code: %v\n", err)
+		return
+	}
+	fmt.Print(qr.ToSmallString(false))
+}
+
+// PrintConnectionQR prints a QR code of the user's connection profile for
+// mobile SSH clients, see tunneluser.GenerateConnectionQR. Like PrintQR it
+// prints nothing when stdout is not a terminal.
+func PrintConnectionQR(info *tunneluser.CreatedUserInfo) {
+	if !isatty.IsTerminal(os.Stdout.Fd()) {
+		return
+	}
+	port, err := strconv.Atoi(osdetect.DetectSSHPort())
+	if err != nil {
+		port = 22
+	}
+	qr, err := tunneluser.GenerateConnectionQR(info.Username, info.Server, port, info.AuthMode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: no connection QR code: %v\n", err)
+		return
+	}
+	fmt.Println()
+	fmt.Println("Connection profile (scan with a mobile SSH client):")
+	fmt.Print(qr)
+	if info.AuthMode == tunneluser.AuthModeKey {
+		fmt.Println("Add the private key to the imported profile by hand.")
+	}
+}
+
+// PrintGeneratedPassword shows a generated password, with a QR code when
+// ShowQR is set.
+func PrintGeneratedPassword(password string) {
+	tui.PrintBox("Generated Password (save this now!)", []string{tui.Code(password)})
+	printCredentialQR(password)
+}
+
+// printCredentialQR prints a QR code for text when ShowQR is set.
+func printCredentialQR(text string) {
+	if ShowQR {
+		PrintQR(text)
+	}
+}
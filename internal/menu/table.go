@@ -0,0 +1,32 @@
+package menu
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+)
+
+// FormatUserTable renders users as aligned table rows, header first.
+func FormatUserTable(users []tunneluser.UserDetails) []string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "USERNAME\tAUTH\tSTATUS\tEXPIRES\tKEYS\tNOTE")
+	for _, u := range users {
+		expires := "never"
+		if u.ExpiresAt != nil {
+			expires = u.ExpiresAt.Format("2006-01-02")
+		} else if u.Status == tunneluser.StatusUnknown {
+			expires = "-"
+		}
+		keys := "-"
+		if u.AuthMode == tunneluser.AuthModeKey {
+			keys = fmt.Sprint(u.KeyCount)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", u.Username, u.AuthMode, u.Status, expires, keys, u.Note)
+	}
+	w.Flush()
+	return strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+}
@@ -2,13 +2,14 @@ package main
 
 import "github.com/net2share/sshtun-user/cmd"
 
-// Version and BuildTime are set at build time.
+// Version, BuildTime and Commit are set at build time.
 var (
 	version   = "dev"
 	buildTime = "unknown"
+	commit    = "unknown"
 )
 
 func main() {
-	cmd.SetVersionInfo(version, buildTime)
+	cmd.SetVersionInfo(version, buildTime, commit)
 	cmd.Execute()
 }
@@ -0,0 +1,129 @@
+// Package cli exposes sshtun-user's interactive user management to programs
+// that embed it, such as dnstm.
+package cli
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/net2share/go-corelib/osdetect"
+	"github.com/net2share/sshtun-user/internal/menu"
+	"github.com/net2share/sshtun-user/pkg/container"
+	"github.com/net2share/sshtun-user/pkg/fail2ban"
+	"github.com/net2share/sshtun-user/pkg/operations"
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+)
+
+// EmbedOptions customizes the embedded menu: its title, which entries are
+// offered and callbacks run after users are created or deleted.
+type EmbedOptions = menu.EmbedOptions
+
+// HealthReport is the result of HealthCheck.
+type HealthReport = operations.HealthReport
+
+// ShowUserManagementMenu runs the interactive tunnel user menu inside the
+// host program. Hosts that manage sshd themselves should pass
+// AllowUninstall: false.
+func ShowUserManagementMenu(opts EmbedOptions) error {
+	return menu.RunEmbeddedWithOptions(opts)
+}
+
+// ConfigureCLI applies the sshd hardening described by opts and creates the
+// tunnel groups, like the configure command without prompting: empty group
+// names are those of tunneluser, opts.SkipDenyFiles is passed to
+// tunneluser.SetSkipDenyFiles, and unless opts.NoFail2ban fail2ban is set up
+// with its default policy, which a container skips. Fail2ban problems are
+// printed as warnings, as sshd is already configured by then.
+func ConfigureCLI(opts sshdconfig.Options) error {
+	opts = applyOptions(opts)
+	if err := sshdconfig.Configure(opts); err != nil {
+		return err
+	}
+	if err := tunneluser.EnsureGroups(); err != nil {
+		return err
+	}
+	if opts.NoFail2ban || container.IsContainer() {
+		return nil
+	}
+	osInfo, _ := osdetect.Detect()
+	return menu.SetupFail2ban(osInfo, fail2ban.DefaultOptions(), false)
+}
+
+// applyOptions returns opts with empty group names set to those of
+// tunneluser, after applying the settings tunneluser keeps itself.
+func applyOptions(opts sshdconfig.Options) sshdconfig.Options {
+	tunneluser.SetSkipDenyFiles(opts.SkipDenyFiles)
+	if opts.PasswordGroup == "" {
+		opts.PasswordGroup = tunneluser.GroupPasswordAuth
+	}
+	if opts.KeyGroup == "" {
+		opts.KeyGroup = tunneluser.GroupKeyAuth
+	}
+	if opts.SFTPGroup == "" {
+		opts.SFTPGroup = tunneluser.GroupSFTP
+	}
+	return opts
+}
+
+// HealthCheck reports whether the tunnel subsystem is ready. See
+// operations.HealthCheck.
+func HealthCheck() (HealthReport, error) {
+	return operations.HealthCheck()
+}
+
+// UserCount returns the number of tunnel users, e.g. to hide menu entries
+// that need at least one.
+func UserCount() (int, error) {
+	users, err := tunneluser.List()
+	if err != nil {
+		return 0, err
+	}
+	return len(users), nil
+}
+
+// GroupsHaveUsers reports whether any account, managed or not, is still in
+// a tunnel group. See tunneluser.GroupsHaveUsers.
+func GroupsHaveUsers() (bool, error) {
+	return tunneluser.GroupsHaveUsers()
+}
+
+// SetUserKey replaces a tunnel user's public key without prompting,
+// switching a password user to key auth and updating the AuthorizedKeysFile
+// directive. It prints nothing; problems the update only warned about, such
+// as a directive that could not be written, are returned as an error.
+func SetUserKey(username, pubkey string) error {
+	return silently(func() (*operations.UpdateResult, error) {
+		return operations.SetUserKey(username, pubkey)
+	})
+}
+
+// SetUserPassword sets a tunnel user's password without prompting,
+// switching a key user to password auth. Like SetUserKey it prints nothing.
+func SetUserPassword(username, password string) error {
+	return silently(func() (*operations.UpdateResult, error) {
+		return operations.SetUserPassword(username, password)
+	})
+}
+
+// silently runs an update with the progress messages of tunneluser and
+// sshdconfig discarded, and turns its warnings into an error.
+func silently(update func() (*operations.UpdateResult, error)) error {
+	userOut, sshdOut := tunneluser.Output(), sshdconfig.Output()
+	tunneluser.SetOutput(io.Discard)
+	sshdconfig.SetOutput(io.Discard)
+	defer func() {
+		tunneluser.SetOutput(userOut)
+		sshdconfig.SetOutput(sshdOut)
+	}()
+
+	result, err := update()
+	if err != nil {
+		return err
+	}
+	if len(result.Warnings) > 0 {
+		return fmt.Errorf("updated '%s', but %s", result.Username, strings.Join(result.Warnings, "; "))
+	}
+	return nil
+}
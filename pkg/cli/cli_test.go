@@ -0,0 +1,26 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+)
+
+func TestApplyOptionsSkipDenyFiles(t *testing.T) {
+	previous := tunneluser.SkipDenyFiles
+	t.Cleanup(func() { tunneluser.SetSkipDenyFiles(previous) })
+
+	opts := applyOptions(sshdconfig.Options{SkipDenyFiles: true})
+	if !tunneluser.SkipDenyFiles {
+		t.Error("SkipDenyFiles not applied to tunneluser")
+	}
+	if opts.PasswordGroup != tunneluser.GroupPasswordAuth || opts.KeyGroup != tunneluser.GroupKeyAuth || opts.SFTPGroup != tunneluser.GroupSFTP {
+		t.Errorf("group names %s, %s, %s, want tunneluser's", opts.PasswordGroup, opts.KeyGroup, opts.SFTPGroup)
+	}
+
+	applyOptions(sshdconfig.Options{})
+	if tunneluser.SkipDenyFiles {
+		t.Error("SkipDenyFiles still set after options without it")
+	}
+}
@@ -0,0 +1,49 @@
+// Package container detects whether sshtun-user runs inside a container.
+package container
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+// cgroupMarkers appear in /proc/1/cgroup when PID 1 runs in a container.
+var cgroupMarkers = []string{"docker", "kubepods", "containerd", "libpod", "lxc"}
+
+var (
+	detectOnce  sync.Once
+	isContainer bool
+)
+
+// IsContainer reports whether the process runs inside a container such as
+// Docker, Podman or Kubernetes. The result is detected once and cached.
+func IsContainer() bool {
+	detectOnce.Do(func() {
+		isContainer = detect()
+	})
+	return isContainer
+}
+
+func detect() bool {
+	for _, marker := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(marker); err == nil {
+			return true
+		}
+	}
+
+	if os.Getenv("container") != "" {
+		return true
+	}
+
+	data, err := os.ReadFile("/proc/1/cgroup")
+	if err != nil {
+		return false
+	}
+	cgroup := string(data)
+	for _, marker := range cgroupMarkers {
+		if strings.Contains(cgroup, marker) {
+			return true
+		}
+	}
+	return false
+}
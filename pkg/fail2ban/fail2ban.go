@@ -2,18 +2,183 @@
 package fail2ban
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
 
 	"github.com/net2share/go-corelib/osdetect"
+	"github.com/net2share/sshtun-user/pkg/container"
+	"github.com/net2share/sshtun-user/pkg/paths"
 )
 
 // JailConfigPath is the path to the fail2ban jail configuration.
 const JailConfigPath = "/etc/fail2ban/jail.d/sshtunnel.conf"
 
-// jailContent contains the fail2ban jail configuration.
-const jailContent = `# fail2ban jail for SSH tunnel server
+// JailName is the name of the jail in JailConfigPath.
+const JailName = "sshtunnel"
+
+// FilterDir holds the fail2ban filter definitions.
+const FilterDir = "/etc/fail2ban/filter.d"
+
+// sshFilters are the SSH filter names shipped by fail2ban packages, in
+// order of preference.
+var sshFilters = []string{"sshd", "ssh", "sshd-aggressive", "ssh-aggressive"}
+
+// ErrNoSSHFilter is returned by DetectSSHFilter when fail2ban has no SSH
+// filter, so a jail would fail to load.
+var ErrNoSSHFilter = errors.New("no fail2ban SSH filter found")
+
+// generatedHeader marks jail files written by sshtun-user.
+const generatedHeader = "# Generated by sshtun-user"
+
+// ErrCustomJail is returned when the jail file exists but was not written by
+// sshtun-user and Options.Overwrite is not set.
+var ErrCustomJail = errors.New("existing fail2ban jail was not written by sshtun-user")
+
+// Options controls the ban policy written to the jail.
+// Zero values are replaced by the corresponding DefaultOptions value.
+type Options struct {
+	MaxRetry  int      // Failures within FindTime before a ban
+	BanTime   string   // Initial ban duration in fail2ban syntax (e.g. 1h, 30m, -1 for permanent)
+	IgnoreIPs []string // Addresses or CIDR ranges that are never banned
+	Ports     []string // sshd ports to block ("ssh" or numbers); detected by SetupWithOptions, otherwise "ssh"
+	Backend   string   // Log backend (auto, systemd, polling, pyinotify); detected by SetupWithOptions, otherwise "auto"
+	Filter    string   // fail2ban filter name; detected by SetupWithOptions, otherwise "sshd"
+	Overwrite bool     // Replace a jail file not written by sshtun-user
+}
+
+// DefaultOptions returns the default ban policy.
+func DefaultOptions() Options {
+	return Options{
+		MaxRetry: 5,
+		BanTime:  "1h",
+	}
+}
+
+// backends are the fail2ban log backends Options.Backend accepts.
+var backends = []string{"auto", "systemd", "polling", "pyinotify"}
+
+// authLogs are the files sshd logs to through syslog on Debian and Red Hat
+// based systems.
+var authLogs = []string{"/var/log/auth.log", "/var/log/secure"}
+
+// DetectBackend returns "systemd" on systemd hosts without a syslog auth
+// log, where sshd only logs to the journal and the "auto" backend finds no
+// file to watch, and "auto" otherwise.
+func DetectBackend() string {
+	if !osdetect.HasSystemd() {
+		return "auto"
+	}
+	for _, log := range authLogs {
+		if _, err := os.Stat(paths.Join(log)); err == nil {
+			return "auto"
+		}
+	}
+	return "systemd"
+}
+
+// DetectPorts returns the sshd port set in sshd_config, as "ssh" for the
+// default port 22. Callers adding ports in sshd drop-ins append them.
+func DetectPorts() []string {
+	port := osdetect.DetectSSHPort()
+	if port == "22" {
+		port = "ssh"
+	}
+	return []string{port}
+}
+
+// DetectSSHFilter returns the first SSH filter in FilterDir, as a .conf or
+// .local file, preferring sshd over ssh and the normal filters over their
+// aggressive variants. The error wraps ErrNoSSHFilter if there is none.
+func DetectSSHFilter() (string, error) {
+	for _, name := range sshFilters {
+		for _, ext := range []string{".conf", ".local"} {
+			if _, err := os.Stat(paths.Join(filepath.Join(FilterDir, name+ext))); err == nil {
+				return name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w in %s", ErrNoSSHFilter, paths.Join(FilterDir))
+}
+
+// detect fills Ports and Backend from the running system when unset.
+func (o Options) detect() Options {
+	if len(o.Ports) == 0 {
+		o.Ports = DetectPorts()
+	}
+	if o.Backend == "" {
+		o.Backend = DetectBackend()
+	}
+	return o
+}
+
+// banTimePattern matches fail2ban durations such as 3600, 1h, 1h30m or -1.
+var banTimePattern = regexp.MustCompile(`^(-1|(\d+[smhdw]?)+)$`)
+
+// withDefaults returns a copy of the options with zero values replaced by defaults.
+func (o Options) withDefaults() Options {
+	d := DefaultOptions()
+	if o.MaxRetry == 0 {
+		o.MaxRetry = d.MaxRetry
+	}
+	if o.BanTime == "" {
+		o.BanTime = d.BanTime
+	}
+	if len(o.Ports) == 0 {
+		o.Ports = []string{"ssh"}
+	}
+	if o.Backend == "" {
+		o.Backend = "auto"
+	}
+	if o.Filter == "" {
+		o.Filter = "sshd"
+	}
+	return o
+}
+
+// filterPattern matches fail2ban filter names.
+var filterPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Validate checks the options for values fail2ban would reject.
+func (o Options) Validate() error {
+	if o.MaxRetry < 0 {
+		return fmt.Errorf("invalid maxretry %d", o.MaxRetry)
+	}
+	if o.BanTime != "" && !banTimePattern.MatchString(o.BanTime) {
+		return fmt.Errorf("invalid bantime %q: use seconds or a duration like 30m, 1h or 1d", o.BanTime)
+	}
+	for _, ip := range o.IgnoreIPs {
+		if err := ValidateIgnoreIP(ip); err != nil {
+			return err
+		}
+	}
+	for _, port := range o.Ports {
+		if port == "ssh" {
+			continue
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid port %q: must be ssh or a number between 1 and 65535", port)
+		}
+	}
+	if o.Backend != "" && !slices.Contains(backends, o.Backend) {
+		return fmt.Errorf("invalid backend %q: must be one of %s", o.Backend, strings.Join(backends, ", "))
+	}
+	if o.Filter != "" && !filterPattern.MatchString(o.Filter) {
+		return fmt.Errorf("invalid filter %q", o.Filter)
+	}
+	return nil
+}
+
+// jailTemplate contains the fail2ban jail configuration.
+var jailTemplate = template.Must(template.New("jail").Funcs(template.FuncMap{"join": strings.Join}).Parse(`# fail2ban jail for SSH tunnel server
 # Generated by sshtun-user
 #
 # Protects against brute-force attacks on tunnel user accounts
@@ -21,24 +186,32 @@ const jailContent = `# fail2ban jail for SSH tunnel server
 
 [sshtunnel]
 enabled = true
-port = ssh
-filter = sshd
-# Use systemd journal on modern systems, fallback to log file
-backend = auto
-# Ban for 1 hour after 5 failures within 10 minutes
-maxretry = 5
+port = {{join .Ports ","}}
+filter = {{.Filter}}
+# systemd reads the journal, for hosts without /var/log/auth.log or /var/log/secure
+backend = {{.Backend}}
+# Ban for {{.BanTime}} after {{.MaxRetry}} failures within 10 minutes
+maxretry = {{.MaxRetry}}
 findtime = 10m
-bantime = 1h
+bantime = {{.BanTime}}
 # Progressive ban: repeat offenders get longer bans
 bantime.increment = true
 bantime.factor = 2
 bantime.maxtime = 1w
+{{- if .IgnoreIPs}}
+# Never ban these addresses
+ignoreip = 127.0.0.1/8 ::1{{range .IgnoreIPs}} {{.}}{{end}}
+{{- end}}
 # Action: ban IP via firewall (iptables/nftables auto-detected)
 banaction = auto
-`
+`))
 
-// IsInstalled checks if fail2ban is installed.
+// IsInstalled checks if fail2ban is installed. It always reports false in
+// containers, where fail2ban can't manage the host firewall.
 func IsInstalled() bool {
+	if container.IsContainer() {
+		return false
+	}
 	_, err := exec.LookPath("fail2ban-client")
 	return err == nil
 }
@@ -68,18 +241,73 @@ func Install(osInfo *osdetect.OSInfo) error {
 	return nil
 }
 
-// Configure creates the fail2ban jail configuration.
-func Configure() error {
+// IsJailConfigured reports whether a jail file exists at JailConfigPath,
+// whether or not sshtun-user wrote it.
+func IsJailConfigured() bool {
+	_, err := os.Stat(paths.Join(JailConfigPath))
+	return err == nil
+}
+
+// GetJailConfig returns the contents of the jail file.
+func GetJailConfig() (string, error) {
+	data, err := os.ReadFile(paths.Join(JailConfigPath))
+	if err != nil {
+		return "", fmt.Errorf("failed to read jail config: %w", err)
+	}
+	return string(data), nil
+}
+
+// Configure creates the fail2ban jail configuration and reports whether the
+// file changed. A jail file written by someone else is left alone with
+// ErrCustomJail unless opts.Overwrite is set.
+func Configure(opts Options) (bool, error) {
+	if err := opts.Validate(); err != nil {
+		return false, err
+	}
+	content := RenderJail(opts)
+
+	if existing, err := GetJailConfig(); err == nil {
+		if existing == content {
+			return false, nil
+		}
+		if !strings.Contains(existing, generatedHeader) && !opts.Overwrite {
+			return false, fmt.Errorf("%w: %s", ErrCustomJail, paths.Join(JailConfigPath))
+		}
+	}
+
 	// Create jail.d directory if it doesn't exist
-	if err := os.MkdirAll("/etc/fail2ban/jail.d", 0755); err != nil {
-		return fmt.Errorf("failed to create jail.d directory: %w", err)
+	if err := os.MkdirAll(filepath.Dir(paths.Join(JailConfigPath)), 0755); err != nil {
+		return false, fmt.Errorf("failed to create jail.d directory: %w", err)
 	}
 
 	// Write jail configuration
-	if err := os.WriteFile(JailConfigPath, []byte(jailContent), 0644); err != nil {
-		return fmt.Errorf("failed to write jail config: %w", err)
+	if err := os.WriteFile(paths.Join(JailConfigPath), []byte(content), 0644); err != nil {
+		return false, fmt.Errorf("failed to write jail config: %w", err)
 	}
 
+	return true, nil
+}
+
+// RenderJail returns the jail file Configure writes for opts, with zero
+// values replaced by defaults and no system detection.
+func RenderJail(opts Options) string {
+	var buf bytes.Buffer
+	// Options always satisfies the template, so Execute can't fail
+	jailTemplate.Execute(&buf, opts.withDefaults())
+	return buf.String()
+}
+
+// ValidateJailConfig checks the fail2ban configuration, including jailFile,
+// with fail2ban-client --test, so a broken jail isn't loaded. fail2ban can
+// only test its whole configuration, not a single file.
+func ValidateJailConfig(jailFile string) error {
+	if _, err := os.Stat(jailFile); err != nil {
+		return fmt.Errorf("failed to read jail config: %w", err)
+	}
+	output, err := exec.Command("fail2ban-client", "--test").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("fail2ban configuration test failed: %w\n%s", err, strings.TrimSpace(string(output)))
+	}
 	return nil
 }
 
@@ -108,43 +336,159 @@ func Reload() error {
 	return nil
 }
 
+// IsActive reports whether the fail2ban service is running. A service that
+// is installed but stopped, failed or masked reports false; an error means
+// the state couldn't be queried at all.
+func IsActive() (bool, error) {
+	output, err := exec.Command("systemctl", "is-active", "fail2ban").Output()
+	state := strings.TrimSpace(string(output))
+	if state == "" {
+		if err == nil {
+			err = fmt.Errorf("empty output")
+		}
+		return false, fmt.Errorf("failed to query fail2ban service state: %w", err)
+	}
+	return state == "active", nil
+}
+
 // IsJailActive checks if the sshtunnel jail is active.
 func IsJailActive() bool {
-	err := exec.Command("fail2ban-client", "status", "sshtunnel").Run()
+	err := exec.Command("fail2ban-client", "status", JailName).Run()
 	return err == nil
 }
 
 // Remove removes the fail2ban jail configuration.
 func Remove() error {
-	return os.Remove(JailConfigPath)
+	return os.Remove(paths.Join(JailConfigPath))
 }
 
-// SetupWithFeedback installs, configures, and reloads fail2ban with user feedback.
+// SetupWithFeedback installs, configures, and reloads fail2ban with user
+// feedback, using the default ban policy.
 func SetupWithFeedback(osInfo *osdetect.OSInfo) error {
+	return SetupWithOptions(osInfo, DefaultOptions())
+}
+
+// SetupWithOptions installs, configures, and reloads fail2ban with user
+// feedback, using the given ban policy.
+func SetupWithOptions(osInfo *osdetect.OSInfo, opts Options) error {
+	detectFilter := opts.Filter == ""
+	opts = opts.detect().withDefaults()
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	if container.IsContainer() {
+		fmt.Println("Running in a container, skipping fail2ban")
+		return nil
+	}
+
 	// Install if needed
 	if err := Install(osInfo); err != nil {
 		fmt.Printf("Warning: Could not install fail2ban: %v\n", err)
 		return nil
 	}
 
-	// Configure
-	if err := Configure(); err != nil {
+	// The filter files come with the package, so look for them after install
+	if detectFilter {
+		filter, err := DetectSSHFilter()
+		if err != nil {
+			fmt.Printf("Warning: %v; skipping fail2ban jail setup\n", err)
+			return nil
+		}
+		opts.Filter = filter
+	}
+
+	// Configure, reloading only if the jail changed or fail2ban is stopped
+	previous, previousErr := GetJailConfig()
+	changed, err := Configure(opts)
+	if err != nil {
 		return err
 	}
+	if changed {
+		if err := ValidateJailConfig(paths.Join(JailConfigPath)); err != nil {
+			// Put back what was there, so fail2ban keeps loading
+			if previousErr == nil {
+				os.WriteFile(paths.Join(JailConfigPath), []byte(previous), 0644)
+			} else {
+				Remove()
+			}
+			return err
+		}
+	}
+	if running, _ := IsActive(); changed || !running {
+		if err := Reload(); err != nil {
+			return err
+		}
+	} else {
+		fmt.Println("fail2ban jail already up to date")
+	}
 
-	// Reload
-	if err := Reload(); err != nil {
+	// Verify the service actually came up; a masked or failed unit would
+	// otherwise leave sshd unprotected without any sign of it
+	active, err := IsActive()
+	if err != nil {
 		return err
 	}
+	if !active {
+		return fmt.Errorf("fail2ban is configured but its service is not running; check 'systemctl status fail2ban'")
+	}
 
 	// Verify jail is active
 	if IsJailActive() {
 		fmt.Println("fail2ban jail 'sshtunnel' is active")
-		fmt.Println("  - Ban after: 5 failed attempts in 10 minutes")
-		fmt.Println("  - Ban duration: 1 hour (doubles for repeat offenders, max 1 week)")
+		fmt.Printf("  - Ban after: %d failed attempts in 10 minutes\n", opts.MaxRetry)
+		fmt.Printf("  - Ban duration: %s (doubles for repeat offenders, max 1 week)\n", opts.BanTime)
+		fmt.Printf("  - Ports: %s, log backend: %s, filter: %s\n", strings.Join(opts.Ports, ", "), opts.Backend, opts.Filter)
+		if len(opts.IgnoreIPs) > 0 {
+			fmt.Printf("  - Never banned: %s\n", strings.Join(opts.IgnoreIPs, ", "))
+		}
 	} else {
 		fmt.Println("Warning: fail2ban jail may not be active yet (will activate on next restart)")
 	}
 
 	return nil
 }
+
+// JailStatus holds the counters reported by fail2ban for the sshtunnel jail.
+type JailStatus struct {
+	CurrentlyFailed int
+	TotalFailed     int
+	CurrentlyBanned int
+	TotalBanned     int
+	BannedIPs       []string
+}
+
+// GetJailStatus returns the current status of the sshtunnel jail.
+func GetJailStatus() (*JailStatus, error) {
+	output, err := exec.Command("fail2ban-client", "status", JailName).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get jail status: %w", err)
+	}
+	return parseJailStatus(string(output)), nil
+}
+
+// parseJailStatus parses the output of "fail2ban-client status <jail>".
+func parseJailStatus(output string) *JailStatus {
+	status := &JailStatus{}
+	for _, line := range strings.Split(output, "\n") {
+		// Lines look like "   |- Currently banned:	2"
+		key, value, ok := strings.Cut(strings.TrimLeft(line, " |-`"), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "Currently failed":
+			status.CurrentlyFailed, _ = strconv.Atoi(value)
+		case "Total failed":
+			status.TotalFailed, _ = strconv.Atoi(value)
+		case "Currently banned":
+			status.CurrentlyBanned, _ = strconv.Atoi(value)
+		case "Total banned":
+			status.TotalBanned, _ = strconv.Atoi(value)
+		case "Banned IP list":
+			status.BannedIPs = strings.Fields(value)
+		}
+	}
+	return status
+}
@@ -0,0 +1,45 @@
+package fail2ban
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestRenderJail(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{name: "defaults", opts: Options{}},
+		{name: "custom", opts: Options{
+			MaxRetry:  3,
+			BanTime:   "1d",
+			IgnoreIPs: []string{"192.0.2.10", "2001:db8::/32"},
+			Ports:     []string{"22", "2222"},
+			Backend:   "systemd",
+			Filter:    "sshd-aggressive",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := RenderJail(tt.opts)
+			golden := filepath.Join("testdata", "jail-"+tt.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("RenderJail differs from %s:\n%s", golden, got)
+			}
+		})
+	}
+}
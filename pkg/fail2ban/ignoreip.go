@@ -0,0 +1,146 @@
+package fail2ban
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/net2share/sshtun-user/pkg/paths"
+)
+
+// defaultIgnoreIPs are always on the jail's ignoreip line: loopback is
+// never banned.
+var defaultIgnoreIPs = []string{"127.0.0.1/8", "::1"}
+
+// ignoreIPPattern matches the ignoreip line of a jail file.
+var ignoreIPPattern = regexp.MustCompile(`(?m)^[ \t]*ignoreip[ \t]*=(.*)$`)
+
+// jailSectionPattern matches the header of the sshtunnel jail.
+var jailSectionPattern = regexp.MustCompile(`(?m)^[ \t]*\[sshtunnel\][ \t]*$`)
+
+// sectionPattern matches any section header.
+var sectionPattern = regexp.MustCompile(`(?m)^[ \t]*\[`)
+
+// jailSection returns the start and end of the body of the [sshtunnel]
+// section in a jail file, so settings of other jails or [DEFAULT] are left
+// alone. ok is false without the section.
+func jailSection(content string) (start, end int, ok bool) {
+	loc := jailSectionPattern.FindStringIndex(content)
+	if loc == nil {
+		return 0, 0, false
+	}
+	start, end = loc[1], len(content)
+	if next := sectionPattern.FindStringIndex(content[start:]); next != nil {
+		end = start + next[0]
+	}
+	return start, end, true
+}
+
+// ValidateIgnoreIP checks that ip is an IP address or CIDR range.
+func ValidateIgnoreIP(ip string) error {
+	if net.ParseIP(ip) != nil {
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(ip); err != nil {
+		return fmt.Errorf("invalid ignoreip %q: must be an IP address or CIDR range", ip)
+	}
+	return nil
+}
+
+// ParseIgnoreIPs splits a comma-separated list of addresses and CIDR
+// ranges, as typed at a prompt, and validates each. An empty list yields
+// nil.
+func ParseIgnoreIPs(list string) ([]string, error) {
+	var ips []string
+	for _, ip := range strings.Split(list, ",") {
+		if ip = strings.TrimSpace(ip); ip == "" {
+			continue
+		}
+		if err := ValidateIgnoreIP(ip); err != nil {
+			return nil, err
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// IgnoreIPs returns the addresses on the ignoreip line of the installed
+// jail, without the loopback defaults, or nil without a jail or line.
+func IgnoreIPs() []string {
+	content, err := GetJailConfig()
+	if err != nil {
+		return nil
+	}
+	start, end, ok := jailSection(content)
+	if !ok {
+		return nil
+	}
+	m := ignoreIPPattern.FindStringSubmatch(content[start:end])
+	if m == nil {
+		return nil
+	}
+	var ips []string
+	for _, ip := range strings.Fields(m[1]) {
+		if !slices.Contains(defaultIgnoreIPs, ip) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// AppendIgnoreIPs adds addresses to the ignoreip line of the installed jail,
+// or adds the line below the [sshtunnel] header, leaving the rest of the
+// file as it is. Addresses already listed are skipped. It works on jails
+// not written by sshtun-user too; configure rewrites its own jail from
+// Options.IgnoreIPs, so pass them there to keep them. Call Reload to apply
+// the change.
+func AppendIgnoreIPs(ips []string) error {
+	for _, ip := range ips {
+		if err := ValidateIgnoreIP(ip); err != nil {
+			return err
+		}
+	}
+	content, err := GetJailConfig()
+	if err != nil {
+		return err
+	}
+
+	start, end, ok := jailSection(content)
+	if !ok {
+		return fmt.Errorf("no [sshtunnel] section in %s", JailConfigPath)
+	}
+	var updated string
+	if loc := ignoreIPPattern.FindStringSubmatchIndex(content[start:end]); loc != nil {
+		for i := range loc {
+			loc[i] += start
+		}
+		listed := strings.Fields(content[loc[2]:loc[3]])
+		line := strings.TrimRight(content[loc[0]:loc[1]], " \t")
+		for _, ip := range ips {
+			if !slices.Contains(listed, ip) {
+				line += " " + ip
+				listed = append(listed, ip)
+			}
+		}
+		updated = content[:loc[0]] + line + content[loc[1]:]
+	} else {
+		var listed []string
+		for _, ip := range append(slices.Clone(defaultIgnoreIPs), ips...) {
+			if !slices.Contains(listed, ip) {
+				listed = append(listed, ip)
+			}
+		}
+		updated = content[:start] + "\nignoreip = " + strings.Join(listed, " ") + content[start:]
+	}
+	if updated == content {
+		return nil
+	}
+
+	if err := os.WriteFile(paths.Join(JailConfigPath), []byte(updated), 0644); err != nil {
+		return fmt.Errorf("failed to write jail config: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+// Package firewall restricts the sshd port to an allow-list of client
+// addresses with nftables or iptables.
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/net2share/go-corelib/osdetect"
+	"github.com/net2share/sshtun-user/pkg/container"
+	"github.com/net2share/sshtun-user/pkg/paths"
+)
+
+// ScriptPath holds the commands that install the allow-list, run again at
+// boot by the UnitName service, since kernel firewall rules don't survive a
+// reboot.
+const ScriptPath = "/etc/sshtun-user/firewall.sh"
+
+// UnitName is the systemd service that restores the allow-list at boot.
+const UnitName = "sshtun-user-firewall.service"
+
+// unitPath is where the UnitName service is installed.
+const unitPath = "/etc/systemd/system/" + UnitName
+
+// Names of the nftables table and the iptables chain holding the rules.
+// Nothing else is touched, so removing them restores the previous firewall.
+const (
+	nftTable      = "sshtun_user"
+	iptablesChain = "SSHTUN-USER"
+)
+
+// Backend is the firewall tool the rules are written for.
+type Backend string
+
+const (
+	BackendNone     Backend = ""
+	BackendNftables Backend = "nftables"
+	BackendIptables Backend = "iptables"
+)
+
+// ErrNoBackend is returned when neither nft nor iptables is installed.
+var ErrNoBackend = errors.New("no supported firewall found (nft or iptables)")
+
+// ErrLockout is returned when the allow-list would block the SSH session
+// running sshtun-user.
+var ErrLockout = errors.New("allow-list does not include this SSH session's address")
+
+// Options controls the allow-list.
+type Options struct {
+	Sources []string // Client addresses or CIDR ranges allowed to reach sshd
+	Ports   []int    // sshd ports to restrict (default: the port in sshd_config)
+}
+
+// DetectBackend returns nftables if nft is installed, else iptables if
+// iptables is, else BackendNone. iptables on current distributions is
+// often a front end to nftables; both work.
+func DetectBackend() Backend {
+	if _, err := exec.LookPath("nft"); err == nil {
+		return BackendNftables
+	}
+	if _, err := exec.LookPath("iptables"); err == nil {
+		return BackendIptables
+	}
+	return BackendNone
+}
+
+// DetectPorts returns the sshd port set in sshd_config.
+func DetectPorts() []int {
+	port, err := strconv.Atoi(osdetect.DetectSSHPort())
+	if err != nil {
+		port = 22
+	}
+	return []int{port}
+}
+
+// Validate checks the sources and ports.
+func (o Options) Validate() error {
+	if len(o.Sources) == 0 {
+		return fmt.Errorf("the allow-list needs at least one source address")
+	}
+	for _, s := range o.Sources {
+		if _, err := parseSource(s); err != nil {
+			return err
+		}
+	}
+	for _, p := range o.Ports {
+		if p < 1 || p > 65535 {
+			return fmt.Errorf("invalid port %d: must be between 1 and 65535", p)
+		}
+	}
+	return nil
+}
+
+// parseSource parses an address or CIDR range into a network.
+func parseSource(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 32
+		if ip.To4() == nil {
+			bits = 128
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source %q: must be an IP address or CIDR range", s)
+	}
+	return network, nil
+}
+
+// splitSources separates IPv4 and IPv6 sources, which the firewalls match
+// separately.
+func splitSources(sources []string) (v4, v6 []string) {
+	for _, s := range sources {
+		if network, err := parseSource(s); err == nil && network.IP.To4() == nil {
+			v6 = append(v6, s)
+		} else {
+			v4 = append(v4, s)
+		}
+	}
+	return v4, v6
+}
+
+// CheckLockout returns ErrLockout when sshtun-user runs in an SSH session
+// whose client address none of the sources cover.
+func CheckLockout(sources []string) error {
+	fields := strings.Fields(os.Getenv("SSH_CLIENT"))
+	if len(fields) == 0 {
+		return nil
+	}
+	client := net.ParseIP(fields[0])
+	if client == nil {
+		return nil
+	}
+	for _, s := range sources {
+		if network, err := parseSource(s); err == nil && network.Contains(client) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w (%s); add it to the allow-list", ErrLockout, client)
+}
+
+// AllowSSHFrom restricts the sshd port in sshd_config to the given sources.
+func AllowSSHFrom(sources []string) error {
+	return AllowSSHFromWithOptions(Options{Sources: sources})
+}
+
+// AllowSSHFromWithOptions makes the sshd ports reachable only from
+// opts.Sources and loopback, replacing a previous allow-list. It refuses
+// with ErrLockout if the current SSH session would be cut off. Without a
+// supported firewall, or in a container, it prints a warning and does
+// nothing. The rules are restored at boot on systemd hosts.
+func AllowSSHFromWithOptions(opts Options) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if len(opts.Ports) == 0 {
+		opts.Ports = DetectPorts()
+	}
+	if err := CheckLockout(opts.Sources); err != nil {
+		return err
+	}
+
+	if container.IsContainer() {
+		fmt.Println("Running in a container, skipping the firewall allow-list")
+		return nil
+	}
+	backend := DetectBackend()
+	if backend == BackendNone {
+		fmt.Printf("Warning: %v; sshd stays reachable from everywhere\n", ErrNoBackend)
+		return nil
+	}
+
+	script := renderScript(backend, opts)
+	if err := os.MkdirAll(filepath.Dir(paths.Join(ScriptPath)), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(ScriptPath), err)
+	}
+	if err := os.WriteFile(paths.Join(ScriptPath), []byte(script), 0700); err != nil {
+		return fmt.Errorf("failed to write firewall script: %w", err)
+	}
+
+	removeRules()
+	if output, err := exec.Command("sh", paths.Join(ScriptPath)).CombinedOutput(); err != nil {
+		removeRules()
+		return fmt.Errorf("failed to apply firewall rules: %w\n%s", err, strings.TrimSpace(string(output)))
+	}
+
+	if osdetect.HasSystemd() {
+		if err := os.WriteFile(paths.Join(unitPath), []byte(unit), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", unitPath, err)
+		}
+		exec.Command("systemctl", "daemon-reload").Run()
+		if err := exec.Command("systemctl", "enable", UnitName).Run(); err != nil {
+			fmt.Printf("Warning: failed to enable %s; the allow-list won't survive a reboot: %v\n", UnitName, err)
+		}
+	}
+
+	fmt.Printf("sshd port %s reachable only from %s (%s)\n", joinPorts(opts.Ports, ", "), strings.Join(opts.Sources, ", "), backend)
+	return nil
+}
+
+// IsConfigured reports whether an allow-list was installed.
+func IsConfigured() bool {
+	_, err := os.Stat(paths.Join(ScriptPath))
+	return err == nil
+}
+
+// Remove removes the allow-list rules of both backends, the boot service
+// and the script. It does nothing if no allow-list was installed.
+func Remove() error {
+	if !IsConfigured() {
+		return nil
+	}
+	removeRules()
+	if _, err := os.Stat(paths.Join(unitPath)); err == nil {
+		exec.Command("systemctl", "disable", UnitName).Run()
+		if err := os.Remove(paths.Join(unitPath)); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", unitPath, err)
+		}
+		exec.Command("systemctl", "daemon-reload").Run()
+	}
+	if err := os.Remove(paths.Join(ScriptPath)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", ScriptPath, err)
+	}
+	return nil
+}
+
+// removeRules deletes the nftables table and the iptables chains and the
+// INPUT rules jumping to them, ignoring what isn't there.
+func removeRules() {
+	if _, err := exec.LookPath("nft"); err == nil {
+		if exec.Command("nft", "list", "table", "inet", nftTable).Run() == nil {
+			exec.Command("nft", "delete", "table", "inet", nftTable).Run()
+		}
+	}
+	for _, tool := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			continue
+		}
+		output, err := exec.Command(tool, "-S", "INPUT").Output()
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			args := strings.Fields(line)
+			if len(args) > 2 && args[0] == "-A" && strings.HasSuffix(line, "-j "+iptablesChain) {
+				args[0] = "-D"
+				exec.Command(tool, args...).Run()
+			}
+		}
+		exec.Command(tool, "-F", iptablesChain).Run()
+		exec.Command(tool, "-X", iptablesChain).Run()
+	}
+}
+
+// renderScript returns the shell script that installs the rules.
+func renderScript(backend Backend, opts Options) string {
+	v4, v6 := splitSources(opts.Sources)
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n# Generated by sshtun-user. Do not edit: 'sshtun-user uninstall config' removes it.\n")
+	b.WriteString("# Allows the sshd ports only from the configured sources and loopback.\n")
+
+	switch backend {
+	case BackendNftables:
+		ports := joinPorts(opts.Ports, ", ")
+		fmt.Fprintf(&b, "nft -f - <<'EOF'\ntable inet %s {\n", nftTable)
+		b.WriteString("\tchain input {\n\t\ttype filter hook input priority -10; policy accept;\n")
+		b.WriteString("\t\tiif lo accept\n")
+		if len(v4) > 0 {
+			fmt.Fprintf(&b, "\t\ttcp dport { %s } ip saddr { %s } accept\n", ports, strings.Join(v4, ", "))
+		}
+		if len(v6) > 0 {
+			fmt.Fprintf(&b, "\t\ttcp dport { %s } ip6 saddr { %s } accept\n", ports, strings.Join(v6, ", "))
+		}
+		fmt.Fprintf(&b, "\t\ttcp dport { %s } drop\n\t}\n}\nEOF\n", ports)
+
+	case BackendIptables:
+		ports := joinPorts(opts.Ports, ",")
+		for _, family := range []struct {
+			tool    string
+			sources []string
+		}{{"iptables", v4}, {"ip6tables", v6}} {
+			if family.tool == "ip6tables" {
+				b.WriteString("command -v ip6tables >/dev/null || exit 0\n")
+			}
+			fmt.Fprintf(&b, "%s -N %s\n", family.tool, iptablesChain)
+			fmt.Fprintf(&b, "%s -A %s -i lo -j RETURN\n", family.tool, iptablesChain)
+			for _, s := range family.sources {
+				fmt.Fprintf(&b, "%s -A %s -s %s -j RETURN\n", family.tool, iptablesChain, s)
+			}
+			fmt.Fprintf(&b, "%s -A %s -j DROP\n", family.tool, iptablesChain)
+			fmt.Fprintf(&b, "%s -I INPUT -p tcp -m multiport --dports %s -j %s\n", family.tool, ports, iptablesChain)
+		}
+	}
+	return b.String()
+}
+
+// joinPorts formats ports as a list with sep.
+func joinPorts(ports []int, sep string) string {
+	s := make([]string, len(ports))
+	for i, p := range ports {
+		s[i] = strconv.Itoa(p)
+	}
+	return strings.Join(s, sep)
+}
+
+// unit runs ScriptPath once at boot, before the network comes up.
+const unit = `# Generated by sshtun-user
+[Unit]
+Description=sshtun-user SSH allow-list
+Wants=network-pre.target
+Before=network-pre.target
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=/bin/sh ` + ScriptPath + `
+
+[Install]
+WantedBy=multi-user.target
+`
@@ -0,0 +1,144 @@
+// Package metrics exposes tunnel user and fail2ban state as Prometheus metrics.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/net2share/sshtun-user/pkg/fail2ban"
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	usersTotalDesc = prometheus.NewDesc(
+		"sshtunnel_users_total",
+		"Number of tunnel users by authentication mode.",
+		[]string{"auth_mode"}, nil,
+	)
+	usersLockedDesc = prometheus.NewDesc(
+		"sshtunnel_users_locked",
+		"Number of password tunnel users whose password is locked.",
+		nil, nil,
+	)
+	usersMaxDesc = prometheus.NewDesc(
+		"sshtunnel_users_max",
+		"Maximum number of tunnel users allowed (omitted when unlimited).",
+		nil, nil,
+	)
+	configAppliedDesc = prometheus.NewDesc(
+		"sshtunnel_config_applied",
+		"Whether the sshd hardening configuration is applied (1) or not (0).",
+		nil, nil,
+	)
+	usersExpiringDesc = prometheus.NewDesc(
+		"sshtunnel_users_expiring",
+		"Number of tunnel users whose account expires within the window (including expired).",
+		[]string{"within"}, nil,
+	)
+	fail2banActiveDesc = prometheus.NewDesc(
+		"sshtunnel_fail2ban_active",
+		"Whether the fail2ban service is running (1) or not (0). Omitted when fail2ban is not installed.",
+		nil, nil,
+	)
+	bannedIPsDesc = prometheus.NewDesc(
+		"sshtunnel_fail2ban_banned_ips",
+		"Number of IPs currently banned by the sshtunnel fail2ban jail.",
+		nil, nil,
+	)
+)
+
+// expiringWindow is the window reported by sshtunnel_users_expiring.
+const expiringWindow = 7 * 24 * time.Hour
+
+// collector gathers fresh values on every scrape. It only reads state.
+type collector struct{}
+
+// Describe implements prometheus.Collector.
+func (collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- usersTotalDesc
+	ch <- usersLockedDesc
+	ch <- usersMaxDesc
+	ch <- usersExpiringDesc
+	ch <- configAppliedDesc
+	ch <- fail2banActiveDesc
+	ch <- bannedIPsDesc
+}
+
+// Collect implements prometheus.Collector.
+// Values that cannot be read (e.g. /etc/shadow without root) are omitted.
+func (collector) Collect(ch chan<- prometheus.Metric) {
+	configured := 0.0
+	if sshdconfig.IsConfigured() {
+		configured = 1
+	}
+	ch <- prometheus.MustNewConstMetric(configAppliedDesc, prometheus.GaugeValue, configured)
+
+	if tunneluser.MaxUsers > 0 {
+		ch <- prometheus.MustNewConstMetric(usersMaxDesc, prometheus.GaugeValue, float64(tunneluser.MaxUsers))
+	}
+
+	if users, err := tunneluser.List(); err == nil {
+		counts := map[tunneluser.AuthMode]int{
+			tunneluser.AuthModePassword: 0,
+			tunneluser.AuthModeKey:      0,
+			tunneluser.AuthModeSFTP:     0,
+		}
+		locked := 0
+		lockedKnown := true
+		for _, u := range users {
+			counts[u.AuthMode]++
+			if u.AuthMode != tunneluser.AuthModePassword {
+				continue
+			}
+			isLocked, err := tunneluser.IsPasswordLocked(u.Username)
+			if err != nil {
+				lockedKnown = false
+				continue
+			}
+			if isLocked {
+				locked++
+			}
+		}
+		for mode, n := range counts {
+			ch <- prometheus.MustNewConstMetric(usersTotalDesc, prometheus.GaugeValue, float64(n), string(mode))
+		}
+		if lockedKnown {
+			ch <- prometheus.MustNewConstMetric(usersLockedDesc, prometheus.GaugeValue, float64(locked))
+		}
+	}
+
+	if expiring, err := tunneluser.ExpiringWithin(expiringWindow); err == nil {
+		ch <- prometheus.MustNewConstMetric(usersExpiringDesc, prometheus.GaugeValue, float64(len(expiring)), "7d")
+	}
+
+	if fail2ban.IsInstalled() {
+		if active, err := fail2ban.IsActive(); err == nil {
+			value := 0.0
+			if active {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(fail2banActiveDesc, prometheus.GaugeValue, value)
+		}
+	}
+
+	if status, err := fail2ban.GetJailStatus(); err == nil {
+		ch <- prometheus.MustNewConstMetric(bannedIPsDesc, prometheus.GaugeValue, float64(status.CurrentlyBanned))
+	}
+}
+
+// Handler returns an HTTP handler serving the metrics in Prometheus text format.
+func Handler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector{})
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// ListenAndServe starts an HTTP server exposing /metrics on addr.
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,294 @@
+package operations
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/net2share/sshtun-user/pkg/container"
+	"github.com/net2share/sshtun-user/pkg/fail2ban"
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+)
+
+// ErrUnhealthy is returned by HealthCheck when a required check fails.
+var ErrUnhealthy = errors.New("tunnel subsystem is not healthy")
+
+// HealthCheckResult is the outcome of one health check.
+type HealthCheckResult struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Required bool   `json:"required"`         // A failure makes the report unhealthy
+	Detail   string `json:"detail,omitempty"` // Why the check failed, or a note
+}
+
+// HealthReport aggregates the health checks of the tunnel subsystem.
+type HealthReport struct {
+	Healthy bool                `json:"healthy"`
+	Checks  []HealthCheckResult `json:"checks"`
+}
+
+// HealthCheckOptions controls HealthCheckWithOptions.
+type HealthCheckOptions struct {
+	FailFast bool // Stop after the first failed required check
+}
+
+// HealthCheck verifies that tunnel users can log in: sshd is configured,
+// running and its config is valid and unchanged, once there are users the
+// tunnel groups exist, once there are key users the AuthorizedKeysFile
+// directive is in place, every user has a usable credential, no Match block
+// keeps the terminal granted for a finished password change and fail2ban
+// runs if its jail is installed. It prints nothing and changes nothing. The
+// report is always filled in; the error wraps ErrUnhealthy and names the
+// failed required checks.
+func HealthCheck() (HealthReport, error) {
+	return HealthCheckWithOptions(HealthCheckOptions{})
+}
+
+// HealthCheckWithOptions is HealthCheck with options. With FailFast the
+// report ends at the first failed required check.
+func HealthCheckWithOptions(opts HealthCheckOptions) (HealthReport, error) {
+	var report HealthReport
+	for _, check := range healthChecks {
+		result := check()
+		report.Checks = append(report.Checks, result)
+		if opts.FailFast && result.Required && !result.OK {
+			break
+		}
+	}
+
+	var failed []string
+	for _, c := range report.Checks {
+		if c.Required && !c.OK {
+			failed = append(failed, c.Name)
+		}
+	}
+	report.Healthy = len(failed) == 0
+	if !report.Healthy {
+		return report, fmt.Errorf("%w: %s failed", ErrUnhealthy, strings.Join(failed, ", "))
+	}
+	return report, nil
+}
+
+// healthChecks are run by HealthCheckWithOptions, in order.
+var healthChecks = []func() HealthCheckResult{
+	checkConfigured,
+	checkSSHDRunning,
+	checkSSHDConfig,
+	checkApplied,
+	checkDrift,
+	checkGroups,
+	checkKeyDirective,
+	checkKeyPermissions,
+	checkOrphanedKeys,
+	checkAuthModeConflicts,
+	checkUserVersions,
+	checkBanner,
+	checkCredentials,
+	checkTTYGrants,
+	checkFail2ban,
+}
+
+// result builds a HealthCheckResult.
+func result(name string, ok, required bool, detail string) HealthCheckResult {
+	return HealthCheckResult{Name: name, OK: ok, Required: required, Detail: detail}
+}
+
+func checkConfigured() HealthCheckResult {
+	if !sshdconfig.IsConfigured() {
+		return result("configured", false, true, "run 'sshtun-user configure'")
+	}
+	return result("configured", true, true, "")
+}
+
+func checkSSHDRunning() HealthCheckResult {
+	if !sshdconfig.IsRunning() {
+		return result("sshd_running", false, true, "sshd is not running")
+	}
+	return result("sshd_running", true, true, "")
+}
+
+func checkSSHDConfig() HealthCheckResult {
+	if err := sshdconfig.CheckConfig(); err != nil {
+		return result("sshd_config", false, true, err.Error())
+	}
+	return result("sshd_config", true, true, "")
+}
+
+func checkApplied() HealthCheckResult {
+	applied, err := sshdconfig.DropInsApplied()
+	if err != nil {
+		return result("sshd_applied", false, true, err.Error())
+	}
+	if !applied {
+		return result("sshd_applied", false, true, "sshd -T doesn't show the settings of "+sshdconfig.ManagedFilePath()+"; check the Include directive")
+	}
+	return result("sshd_applied", true, true, "")
+}
+
+func checkDrift() HealthCheckResult {
+	if drift := sshdconfig.CheckDrift(tunneluser.GroupPasswordAuth, tunneluser.GroupSFTP, tunneluser.GroupKeyAuth); len(drift) > 0 {
+		return result("sshd_drift", false, true, strings.Join(drift, "; "))
+	}
+	return result("sshd_drift", true, true, "")
+}
+
+// checkGroups fails for missing tunnel groups. Hosts configured by older
+// versions only got them with the first user, so until a group has members
+// the check is not required.
+func checkGroups() HealthCheckResult {
+	hasUsers, err := tunneluser.GroupsHaveUsers()
+	required := err != nil || hasUsers
+	if missing := tunneluser.MissingGroups(); len(missing) > 0 {
+		return result("groups", false, required, "missing: "+strings.Join(missing, ", "))
+	}
+	return result("groups", true, required, "")
+}
+
+func checkKeyDirective() HealthCheckResult {
+	keyUser := ""
+	if users, err := tunneluser.ListByAuthMode(tunneluser.AuthModeKey); err == nil && len(users) > 0 {
+		keyUser = tunneluser.SystemName(users[0].Username)
+	}
+	keyUsers := keyUser != ""
+	switch {
+	case tunneluser.KeyStorage == tunneluser.KeyStoragePerUser && sshdconfig.HasAuthorizedKeysDirective():
+		return result("key_directive", !keyUsers, true, sshdconfig.AuthorizedKeysDirective()+" in "+sshdconfig.ManagedFilePath()+" hides ~/.ssh/authorized_keys")
+	case tunneluser.KeyStorage == tunneluser.KeyStoragePerUser:
+		return result("key_directive", true, true, "not needed with per-user key storage")
+	case sshdconfig.HasAuthorizedKeysDirective() && keyUsers:
+		// The directive is in place; make sure no other Match block wins
+		if err := sshdconfig.CheckEffectiveAuthorizedKeysFile(keyUser); err != nil {
+			return result("key_directive", false, true, err.Error())
+		}
+		return result("key_directive", true, true, "")
+	case sshdconfig.HasAuthorizedKeysDirective():
+		return result("key_directive", true, true, "")
+	case keyUsers:
+		return result("key_directive", false, true, sshdconfig.AuthorizedKeysDirective()+" missing from "+sshdconfig.ManagedFilePath())
+	}
+	return result("key_directive", true, true, "not needed until the first key user is created")
+}
+
+func checkKeyPermissions() HealthCheckResult {
+	anomalies, err := tunneluser.AuditKeyFilePermissions()
+	if err != nil {
+		return result("key_permissions", false, true, err.Error())
+	}
+	if len(anomalies) > 0 {
+		return result("key_permissions", false, true, strings.Join(anomalies, "; ")+"; run 'sshtun-user repair'")
+	}
+	return result("key_permissions", true, true, "")
+}
+
+// checkOrphanedKeys reports key files left by users removed outside
+// sshtun-user. They grant nothing, so the check is not required.
+func checkOrphanedKeys() HealthCheckResult {
+	orphaned, err := tunneluser.FindOrphanedKeyFiles()
+	if err != nil {
+		return result("orphaned_keys", false, false, err.Error())
+	}
+	if len(orphaned) > 0 {
+		return result("orphaned_keys", false, false, strings.Join(orphaned, ", ")+"; run 'sshtun-user repair'")
+	}
+	return result("orphaned_keys", true, false, "")
+}
+
+// checkAuthModeConflicts fails for users in more than one tunnel group,
+// whom sshd gives the settings of each.
+func checkAuthModeConflicts() HealthCheckResult {
+	conflicts, err := tunneluser.FindConflicts()
+	if err != nil {
+		return result("auth_mode_conflicts", false, true, err.Error())
+	}
+	if len(conflicts) > 0 {
+		names := make([]string, len(conflicts))
+		for i, c := range conflicts {
+			names[i] = c.String()
+		}
+		return result("auth_mode_conflicts", false, true, strings.Join(names, ", ")+"; run 'sshtun-user repair'")
+	}
+	return result("auth_mode_conflicts", true, true, "")
+}
+
+// checkUserVersions notes users created by an older sshtun-user, whose key
+// options or comment may predate the current conventions. It is not
+// required: such users still log in.
+func checkUserVersions() HealthCheckResult {
+	outdated, err := tunneluser.OutdatedUsers()
+	if err != nil {
+		return result("user_versions", false, false, err.Error())
+	}
+	if len(outdated) > 0 {
+		names := make([]string, len(outdated))
+		for i, u := range outdated {
+			version := u.CreatedByVersion
+			if version == "" {
+				version = "unknown version"
+			}
+			names[i] = fmt.Sprintf("%s (%s)", u.Username, version)
+		}
+		return result("user_versions", false, false, "created by an older version: "+strings.Join(names, ", ")+"; run 'sshtun-user migrate'")
+	}
+	return result("user_versions", true, false, "")
+}
+
+// checkBanner fails when the drop-in sets a Banner whose file is missing or
+// empty, as sshd then silently shows none.
+func checkBanner() HealthCheckResult {
+	if !sshdconfig.BannerConfigured() {
+		return result("banner", true, true, "no banner configured")
+	}
+	if _, err := sshdconfig.ReadBanner(); err != nil {
+		return result("banner", false, true, err.Error())
+	}
+	return result("banner", true, true, "")
+}
+
+// checkCredentials fails for key users without a key and password users
+// with a locked password. Expired accounts are left to 'expiring'.
+func checkCredentials() HealthCheckResult {
+	users, err := tunneluser.ListDetailed()
+	if err != nil {
+		return result("user_credentials", false, true, err.Error())
+	}
+	var broken []string
+	for _, u := range users {
+		switch u.Status {
+		case tunneluser.StatusLocked, tunneluser.StatusNoKey, tunneluser.StatusUnknown:
+			broken = append(broken, fmt.Sprintf("%s (%s)", u.Username, u.Status))
+		}
+	}
+	if len(broken) > 0 {
+		return result("user_credentials", false, true, strings.Join(broken, ", "))
+	}
+	return result("user_credentials", true, true, "")
+}
+
+// checkTTYGrants fails for users whose Match block still allows a terminal
+// after their first-login password change, see tunneluser.FindStaleTTYGrants.
+func checkTTYGrants() HealthCheckResult {
+	stale, err := tunneluser.FindStaleTTYGrants()
+	if err != nil {
+		return result("tty_grants", false, true, err.Error())
+	}
+	if len(stale) > 0 {
+		return result("tty_grants", false, true, "PermitTTY yes left after the password change: "+strings.Join(stale, ", ")+"; run 'sshtun-user repair'")
+	}
+	return result("tty_grants", true, true, "")
+}
+
+// checkFail2ban is only required once the sshtun-user jail is installed.
+func checkFail2ban() HealthCheckResult {
+	if container.IsContainer() {
+		return result("fail2ban", false, false, "skipped in containers")
+	}
+	required := fail2ban.IsJailConfigured()
+	switch active, err := fail2ban.IsActive(); {
+	case err != nil:
+		return result("fail2ban", false, required, err.Error())
+	case !active:
+		return result("fail2ban", false, required, "fail2ban service is not running")
+	}
+	return result("fail2ban", true, required, "")
+}
@@ -0,0 +1,15 @@
+package operations_test
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/net2share/sshtun-user/pkg/tunneltesting"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+)
+
+func TestMain(m *testing.M) {
+	tunneluser.SetOutput(io.Discard)
+	os.Exit(tunneltesting.Main(m))
+}
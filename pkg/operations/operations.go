@@ -0,0 +1,487 @@
+// Package operations implements the user and configuration workflows shared
+// by the CLI commands and the interactive menu. Functions take explicit
+// inputs, never prompt, and return results instead of printing them; only
+// the progress messages of the underlying packages are written.
+package operations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/user"
+
+	"github.com/net2share/sshtun-user/pkg/firewall"
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+)
+
+var (
+	// ErrUserExists is returned when creating a user that already exists.
+	ErrUserExists = errors.New("user already exists")
+	// ErrUserNotFound is returned when the user does not exist.
+	ErrUserNotFound = errors.New("user does not exist")
+	// ErrNotTunnelUser is returned when the user exists but is not a tunnel user.
+	ErrNotTunnelUser = errors.New("not a tunnel user")
+)
+
+// CreateInput describes a tunnel user to create.
+type CreateInput struct {
+	Username  string
+	AuthMode  tunneluser.AuthMode
+	Password  string // Generated when empty for password auth
+	PublicKey string // Required for key auth
+	KeyLabel  string // Replaces the public key's comment when set
+	Shell     string // Login shell (default: detected nologin shell)
+	Server    string // Server address recorded for client examples
+
+	TunnelType tunneluser.TunnelType // Allowed forwarding (default: any)
+	PermitOpen []string              // Forwarding destinations (host:port)
+	EnableSFTP bool                  // Chrooted SFTP access in addition to tunnels
+	HomeDir    string                // Home directory (default: tunneluser.DefaultHomeDir)
+	CreateHome bool                  // Create HomeDir owned by the user
+	EnableTOTP bool                  // Require a TOTP code after the password
+
+	VerboseLogging bool // LogLevel VERBOSE for this user only
+
+	ForcePasswordChange bool // Expire the password so the first login must change it
+
+	Note string // Description stored in the account comment
+
+	AllowScheduledTasks bool // Don't block cron and at for the user
+}
+
+// UpdateResult describes a credential change.
+type UpdateResult struct {
+	Username     string
+	AuthMode     tunneluser.AuthMode
+	PreviousMode tunneluser.AuthMode
+	Warnings     []string
+}
+
+// Switched reports whether the update changed the user's auth mode.
+func (r *UpdateResult) Switched() bool {
+	return r.PreviousMode != r.AuthMode
+}
+
+// UninstallResult describes what an uninstall removed.
+type UninstallResult struct {
+	DeletedUsers  []string
+	ConfigRemoved bool
+	GroupsRemoved bool
+	Warnings      []string
+}
+
+// CreateUser creates a tunnel user. For password auth without a password a
+// random one is generated and returned in the result.
+func CreateUser(in CreateInput) (*tunneluser.CreatedUserInfo, error) {
+	if in.Username == "" {
+		return nil, fmt.Errorf("username is required")
+	}
+	if tunneluser.Exists(in.Username) {
+		return nil, fmt.Errorf("%w: %s", ErrUserExists, in.Username)
+	}
+	if err := tunneluser.ValidateNote(in.Note); err != nil {
+		return nil, err
+	}
+
+	cfg := &tunneluser.Config{
+		Username:   in.Username,
+		AuthMode:   in.AuthMode,
+		Shell:      in.Shell,
+		TunnelType: in.TunnelType,
+		PermitOpen: in.PermitOpen,
+		EnableSFTP: in.EnableSFTP,
+		HomeDir:    in.HomeDir,
+		CreateHome: in.CreateHome,
+		EnableTOTP: in.EnableTOTP,
+
+		VerboseLogging: in.VerboseLogging,
+
+		ForcePasswordChange: in.ForcePasswordChange,
+
+		Note: in.Note,
+
+		AllowScheduledTasks: in.AllowScheduledTasks,
+	}
+
+	keyWarning := ""
+	switch in.AuthMode {
+	case tunneluser.AuthModeKey:
+		key, err := tunneluser.WithKeyLabel(in.PublicKey, in.KeyLabel)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key format: %w", err)
+		}
+		// Before the account exists, so a rejected key leaves nothing behind
+		if keyWarning, err = tunneluser.CheckKeyPolicyWarnWeak(key); err != nil {
+			return nil, err
+		}
+		cfg.PublicKey = key
+	case tunneluser.AuthModePassword, tunneluser.AuthModeSFTP:
+		cfg.Password = in.Password
+		if cfg.Password == "" {
+			generated, err := tunneluser.GeneratePassword()
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate password: %w", err)
+			}
+			cfg.Password = generated
+		}
+	default:
+		return nil, fmt.Errorf("invalid auth mode: %q", in.AuthMode)
+	}
+
+	if cfg.Shell == "" {
+		cfg.Shell = tunneluser.DetectNologinShell()
+	}
+
+	if err := tunneluser.Create(cfg); err != nil {
+		return nil, err
+	}
+
+	info := &tunneluser.CreatedUserInfo{
+		Username:   tunneluser.SystemName(cfg.Username),
+		AuthMode:   cfg.AuthMode,
+		Password:   cfg.Password,
+		PublicKey:  cfg.PublicKey,
+		Shell:      cfg.Shell,
+		TunnelType: cfg.TunnelType,
+		PermitOpen: cfg.PermitOpen,
+		SFTP:       cfg.EnableSFTP || cfg.AuthMode == tunneluser.AuthModeSFTP,
+		Server:     in.Server,
+		TOTPSecret: cfg.TOTPSecret,
+
+		PasswordChangeRequired: cfg.ForcePasswordChange,
+		Note:                   in.Note,
+	}
+	if cfg.TOTPSecret != "" {
+		info.TOTPURL = tunneluser.TOTPURL(cfg.Username, in.Server, cfg.TOTPSecret)
+	}
+	if u, err := user.Lookup(info.Username); err == nil {
+		info.HomeDir = u.HomeDir
+	}
+
+	if keyWarning != "" {
+		info.Warnings = append(info.Warnings, keyWarning)
+	}
+	if cfg.AuthMode == tunneluser.AuthModeKey {
+		if err := syncKeyDirective(); err != nil {
+			info.Warnings = append(info.Warnings, "could not update AuthorizedKeysFile directive: "+err.Error())
+		}
+	} else if sshdconfig.PasswordAuthDisabled() {
+		info.Warnings = append(info.Warnings, "password authentication is disabled globally; only members of "+tunneluser.GroupPasswordAuth+" and "+tunneluser.GroupSFTP+" can log in with a password")
+	}
+
+	return info, nil
+}
+
+// SetUserPassword sets a tunnel user's password, switching them to password
+// auth if needed. SFTP-only users keep their mode.
+func SetUserPassword(username, password string) (*UpdateResult, error) {
+	return SetUserPasswordWithOptions(username, password, tunneluser.SwitchOptions{})
+}
+
+// SetUserPasswordWithOptions is SetUserPassword with options to keep the key
+// file when the user is switched to password auth.
+func SetUserPasswordWithOptions(username, password string, opts tunneluser.SwitchOptions) (*UpdateResult, error) {
+	if password == "" {
+		return nil, fmt.Errorf("password is required")
+	}
+	current, err := requireTunnelUser(username)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tunneluser.SetPassword(username, password); err != nil {
+		return nil, fmt.Errorf("failed to set password: %w", err)
+	}
+	if current == tunneluser.AuthModeSFTP {
+		return &UpdateResult{
+			Username:     tunneluser.SystemName(username),
+			AuthMode:     current,
+			PreviousMode: current,
+		}, nil
+	}
+	if current != tunneluser.AuthModePassword {
+		if err := tunneluser.SwitchAuthModeWithOptions(username, tunneluser.AuthModePassword, opts); err != nil {
+			return nil, fmt.Errorf("failed to switch auth mode: %w", err)
+		}
+	}
+
+	result := &UpdateResult{
+		Username:     tunneluser.SystemName(username),
+		AuthMode:     tunneluser.AuthModePassword,
+		PreviousMode: current,
+	}
+	// The new password ends a pending forced change
+	if _, err := tunneluser.RevokeStaleTTYGrant(username); err != nil {
+		result.Warnings = append(result.Warnings, "could not remove PermitTTY yes: "+err.Error())
+	}
+	return result, nil
+}
+
+// SetUserKey replaces a tunnel user's public key, switching them to key auth
+// if needed.
+func SetUserKey(username, publicKey string) (*UpdateResult, error) {
+	return SetUserKeyWithOptions(username, publicKey, tunneluser.SwitchOptions{})
+}
+
+// SetUserKeyWithOptions is SetUserKey with options to keep the password
+// usable when the user is switched to key auth.
+func SetUserKeyWithOptions(username, publicKey string, opts tunneluser.SwitchOptions) (*UpdateResult, error) {
+	if err := tunneluser.ValidatePublicKey(publicKey); err != nil && !errors.Is(err, tunneluser.ErrWeakRSAKey) {
+		return nil, fmt.Errorf("invalid public key format: %w", err)
+	}
+	keyWarning, err := tunneluser.CheckKeyPolicyWarnWeak(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	current, err := requireTunnelUser(username)
+	if err != nil {
+		return nil, err
+	}
+	if current == tunneluser.AuthModeSFTP {
+		return nil, fmt.Errorf("SFTP-only user '%s' authenticates with a password", username)
+	}
+
+	if err := tunneluser.SetupSSHKey(username, publicKey); err != nil {
+		return nil, fmt.Errorf("failed to set SSH key: %w", err)
+	}
+	if current != tunneluser.AuthModeKey {
+		if err := tunneluser.SwitchAuthModeWithOptions(username, tunneluser.AuthModeKey, opts); err != nil {
+			return nil, fmt.Errorf("failed to switch auth mode: %w", err)
+		}
+	}
+
+	result := &UpdateResult{
+		Username:     tunneluser.SystemName(username),
+		AuthMode:     tunneluser.AuthModeKey,
+		PreviousMode: current,
+	}
+	if keyWarning != "" {
+		result.Warnings = append(result.Warnings, keyWarning)
+	}
+	if tunneluser.HasTOTP(username) {
+		// Key users authenticate with publickey only
+		if err := tunneluser.DisableTOTP(username); err != nil {
+			result.Warnings = append(result.Warnings, "could not disable TOTP: "+err.Error())
+		}
+	}
+	if _, err := tunneluser.RevokeStaleTTYGrant(username); err != nil {
+		result.Warnings = append(result.Warnings, "could not remove PermitTTY yes: "+err.Error())
+	}
+	if err := syncKeyDirective(); err != nil {
+		result.Warnings = append(result.Warnings, "could not update AuthorizedKeysFile directive: "+err.Error())
+	}
+	return result, nil
+}
+
+// RepairKeyDirective restores the AuthorizedKeysFile directive expected by
+// tunneluser.KeyStorage, reloading sshd, and reports whether it changed
+// anything. In per-user mode a directive found in the key auth config is
+// removed instead.
+func RepairKeyDirective() (bool, error) {
+	if tunneluser.KeyStorage != tunneluser.KeyStoragePerUser {
+		return sshdconfig.RepairAuthorizedKeysDirective()
+	}
+	if !sshdconfig.HasAuthorizedKeysDirective() {
+		return false, nil
+	}
+	if err := sshdconfig.RemoveAuthorizedKeysDirective(); err != nil {
+		return false, fmt.Errorf("failed to remove AuthorizedKeysFile directive: %w", err)
+	}
+	return true, nil
+}
+
+// RepairKeyFilePermissions resets the ownership and mode of the key
+// directory and key files to root:root 0755/0644 where they differ, and
+// returns what it changed. sshd ignores key files others can write to.
+func RepairKeyFilePermissions() ([]string, error) {
+	fixed, err := tunneluser.FixKeyFilePermissions()
+	if err != nil {
+		return fixed, fmt.Errorf("failed to repair key file permissions: %w", err)
+	}
+	return fixed, nil
+}
+
+// RemoveOrphanedKeyFiles removes the key files of accounts that no longer
+// exist, e.g. after a manual userdel, and returns their paths.
+func RemoveOrphanedKeyFiles() ([]string, error) {
+	removed, err := tunneluser.RemoveOrphanedKeyFiles()
+	if err != nil {
+		return removed, fmt.Errorf("failed to remove orphaned key files: %w", err)
+	}
+	return removed, nil
+}
+
+// FixAuthModeConflicts keeps each user in more than one tunnel group only in
+// the group matching their credentials. It returns what it changed and the
+// users it couldn't decide for.
+func FixAuthModeConflicts() ([]string, []tunneluser.Conflict, error) {
+	fixed, unresolved, err := tunneluser.FixConflicts()
+	if err != nil {
+		return fixed, unresolved, fmt.Errorf("failed to fix auth mode conflicts: %w", err)
+	}
+	return fixed, unresolved, nil
+}
+
+// RevokeStaleTTYGrants removes PermitTTY yes from the Match blocks of users
+// who have changed their expired password since, and returns those users.
+func RevokeStaleTTYGrants() ([]string, error) {
+	revoked, err := tunneluser.RevokeStaleTTYGrants()
+	if err != nil {
+		return revoked, fmt.Errorf("failed to revoke stale terminal grants: %w", err)
+	}
+	return revoked, nil
+}
+
+// MigrateUsers re-applies the current key options, key storage layout and
+// comment format to all tunnel users, see tunneluser.Migrate. With dryRun
+// it only reports what would change.
+func MigrateUsers(dryRun bool) ([]tunneluser.MigrateResult, error) {
+	results, err := tunneluser.MigrateAll(dryRun)
+	if err != nil {
+		return results, fmt.Errorf("failed to migrate users: %w", err)
+	}
+	return results, nil
+}
+
+// syncKeyDirective adds the AuthorizedKeysFile directive for central key
+// storage, or removes it in per-user mode so sshd reads ~/.ssh/authorized_keys.
+func syncKeyDirective() error {
+	if tunneluser.KeyStorage == tunneluser.KeyStoragePerUser {
+		return sshdconfig.RemoveAuthorizedKeysDirective()
+	}
+	return sshdconfig.AddAuthorizedKeysDirective()
+}
+
+// DeleteUser deletes a tunnel user.
+func DeleteUser(username string) error {
+	if !tunneluser.IsTunnelUser(username) {
+		return fmt.Errorf("%w: %s", ErrNotTunnelUser, username)
+	}
+	if err := tunneluser.Delete(username); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	return nil
+}
+
+// UninstallUsers deletes all tunnel users and their leftover files. progress,
+// which may be nil, is called after each user.
+func UninstallUsers(progress tunneluser.ProgressFunc) (*UninstallResult, error) {
+	result := &UninstallResult{}
+	deleted, err := tunneluser.DeleteAllUsersWithProgress(context.Background(), progress)
+	result.DeletedUsers = deleted
+	cleanup(result)
+	return result, err
+}
+
+// UninstallMatchingUsers deletes the tunnel users whose username matches the
+// regular expression pattern, and their leftover files. Other users are
+// kept. progress, which may be nil, is called after each user.
+func UninstallMatchingUsers(pattern string, progress tunneluser.ProgressFunc) (*UninstallResult, error) {
+	result := &UninstallResult{}
+	deleted, err := tunneluser.DeleteMatchingUsersWithProgress(context.Background(), pattern, progress)
+	result.DeletedUsers = deleted
+	cleanup(result)
+	return result, err
+}
+
+// UninstallConfig removes the sshd configuration and tunnel groups. It
+// refuses to run while tunnel users still exist.
+func UninstallConfig() (*UninstallResult, error) {
+	hasUsers, _ := tunneluser.GroupsHaveUsers()
+	if hasUsers {
+		return nil, fmt.Errorf("cannot remove configuration: tunnel users still exist")
+	}
+
+	result := &UninstallResult{}
+	removeConfig(result)
+	cleanup(result)
+	return result, nil
+}
+
+// UninstallConfigOptions controls UninstallConfigWithOptions.
+type UninstallConfigOptions struct {
+	// Force removes the configuration and groups even while the tunnel
+	// groups have members, removing those members from the groups first
+	// (tunneluser.DeleteGroupsForce). Their accounts are kept.
+	Force bool
+}
+
+// UninstallConfigWithOptions is UninstallConfig with options.
+func UninstallConfigWithOptions(opts UninstallConfigOptions) (*UninstallResult, error) {
+	if !opts.Force {
+		return UninstallConfig()
+	}
+
+	result := &UninstallResult{}
+	removeConfigWith(result, func() error { return tunneluser.DeleteGroupsForce(true) })
+	cleanup(result)
+	return result, nil
+}
+
+// UninstallAll deletes all tunnel users, then removes the sshd configuration
+// and tunnel groups. Failures are collected as warnings so that as much as
+// possible is removed. progress, which may be nil, is called after each user.
+func UninstallAll(progress tunneluser.ProgressFunc) (*UninstallResult, error) {
+	result := &UninstallResult{}
+
+	deleted, err := tunneluser.DeleteAllUsersWithProgress(context.Background(), progress)
+	result.DeletedUsers = deleted
+	if err != nil {
+		result.Warnings = append(result.Warnings, "some users could not be deleted: "+err.Error())
+	}
+
+	if sshdconfig.IsConfigured() {
+		removeConfig(result)
+	}
+	cleanup(result)
+	tunneluser.CleanupStaleDenyEntries()
+	return result, nil
+}
+
+// requireTunnelUser checks that the user exists and is a tunnel user, and
+// returns their current auth mode.
+func requireTunnelUser(username string) (tunneluser.AuthMode, error) {
+	if !tunneluser.Exists(username) {
+		return "", fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	mode, err := tunneluser.GetAuthMode(username)
+	if err != nil && !errors.Is(err, tunneluser.ErrAmbiguousAuthMode) {
+		return "", fmt.Errorf("%w: %s", ErrNotTunnelUser, username)
+	}
+	return mode, nil
+}
+
+func removeConfig(result *UninstallResult) {
+	removeConfigWith(result, tunneluser.DeleteGroups)
+}
+
+// removeConfigWith is removeConfig with deleteGroups removing the groups.
+func removeConfigWith(result *UninstallResult, deleteGroups func() error) {
+	if err := sshdconfig.RemoveAndReload(); err != nil {
+		result.Warnings = append(result.Warnings, "sshd config removal: "+err.Error())
+	} else {
+		result.ConfigRemoved = true
+	}
+
+	if err := tunneluser.RemovePAMConfig(); err != nil {
+		result.Warnings = append(result.Warnings, "PAM cleanup: "+err.Error())
+	}
+
+	if err := firewall.Remove(); err != nil {
+		result.Warnings = append(result.Warnings, "firewall allow-list removal: "+err.Error())
+	}
+
+	if err := deleteGroups(); err != nil {
+		result.Warnings = append(result.Warnings, "group removal: "+err.Error())
+	} else {
+		result.GroupsRemoved = true
+	}
+}
+
+func cleanup(result *UninstallResult) {
+	if err := tunneluser.CleanupAuthorizedKeysDir(); err != nil {
+		result.Warnings = append(result.Warnings, "authorized keys cleanup: "+err.Error())
+	}
+	tunneluser.CleanupTunnelDenyFiles(result.DeletedUsers)
+}
@@ -0,0 +1,324 @@
+package operations_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/net2share/sshtun-user/pkg/operations"
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+	"github.com/net2share/sshtun-user/pkg/tunneltesting"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+)
+
+// rsaKey returns an ssh-rsa public key line with a freshly generated modulus
+// of the given size.
+func rsaKey(t *testing.T, bits int) string {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blob []byte
+	for _, field := range [][]byte{
+		[]byte("ssh-rsa"),
+		// mpints, with a leading zero byte so they stay positive
+		append([]byte{0}, big.NewInt(int64(priv.E)).Bytes()...),
+		append([]byte{0}, priv.N.Bytes()...),
+	} {
+		blob = binary.BigEndian.AppendUint32(blob, uint32(len(field)))
+		blob = append(blob, field...)
+	}
+	return "ssh-rsa " + base64.StdEncoding.EncodeToString(blob) + " test"
+}
+
+// createUser creates a tunnel user through operations.CreateUser.
+func createUser(t *testing.T, username string, mode tunneluser.AuthMode) *tunneluser.CreatedUserInfo {
+	t.Helper()
+	in := operations.CreateInput{Username: username, AuthMode: mode}
+	if mode == tunneluser.AuthModeKey {
+		in.PublicKey = tunneltesting.TestKey
+	}
+	info, err := operations.CreateUser(in)
+	if err != nil {
+		t.Fatalf("CreateUser(%s): %v", username, err)
+	}
+	return info
+}
+
+func TestCreateUserGeneratesPassword(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+
+	info := createUser(t, "alice", tunneluser.AuthModePassword)
+	if info.Password == "" {
+		t.Error("no password generated")
+	}
+	if info.Username != tunneluser.SystemName("alice") || info.AuthMode != tunneluser.AuthModePassword {
+		t.Errorf("CreateUser = %s (%s), want %s (password)", info.Username, info.AuthMode, tunneluser.SystemName("alice"))
+	}
+	fs.AssertUserExists(t, "alice")
+	fs.AssertInGroup(t, "alice", tunneluser.GroupPasswordAuth)
+}
+
+func TestCreateUserWithKey(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+
+	info := createUser(t, "bob", tunneluser.AuthModeKey)
+	if info.Password != "" {
+		t.Errorf("key user got password %q", info.Password)
+	}
+	fs.AssertInGroup(t, "bob", tunneluser.GroupKeyAuth)
+	if _, err := os.Stat(fs.KeyFile("bob")); err != nil {
+		t.Errorf("key file not created: %v", err)
+	}
+}
+
+func TestCreateUserRejects(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+	createUser(t, "alice", tunneluser.AuthModePassword)
+
+	tests := []struct {
+		name    string
+		in      operations.CreateInput
+		wantErr error
+	}{
+		{name: "existing user", in: operations.CreateInput{Username: "alice", AuthMode: tunneluser.AuthModePassword}, wantErr: operations.ErrUserExists},
+		{name: "no username", in: operations.CreateInput{AuthMode: tunneluser.AuthModePassword}},
+		{name: "invalid key", in: operations.CreateInput{Username: "bob", AuthMode: tunneluser.AuthModeKey, PublicKey: "not a key"}},
+		{name: "invalid mode", in: operations.CreateInput{Username: "bob", AuthMode: "token"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := operations.CreateUser(tt.in)
+			if err == nil || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+				t.Errorf("CreateUser = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+	fs.AssertUserNotExists(t, "bob")
+}
+
+func TestSetUserPasswordSwitchesKeyUser(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+	createUser(t, "bob", tunneluser.AuthModeKey)
+
+	result, err := operations.SetUserPassword("bob", "new password")
+	if err != nil {
+		t.Fatalf("SetUserPassword: %v", err)
+	}
+	if !result.Switched() || result.PreviousMode != tunneluser.AuthModeKey || result.AuthMode != tunneluser.AuthModePassword {
+		t.Errorf("SetUserPassword = %+v, want switch from key to password", result)
+	}
+	fs.AssertInGroup(t, "bob", tunneluser.GroupPasswordAuth)
+	if _, err := os.Stat(fs.KeyFile("bob")); !os.IsNotExist(err) {
+		t.Errorf("key file still present (err %v)", err)
+	}
+}
+
+func TestSetUserPasswordKeepsMode(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+	createUser(t, "alice", tunneluser.AuthModePassword)
+
+	result, err := operations.SetUserPassword("alice", "new password")
+	if err != nil {
+		t.Fatalf("SetUserPassword: %v", err)
+	}
+	if result.Switched() {
+		t.Errorf("SetUserPassword switched %s from %s", result.Username, result.PreviousMode)
+	}
+}
+
+func TestSetUserKeySwitchesPasswordUser(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+	createUser(t, "alice", tunneluser.AuthModePassword)
+
+	result, err := operations.SetUserKey("alice", tunneltesting.TestKey)
+	if err != nil {
+		t.Fatalf("SetUserKey: %v", err)
+	}
+	if !result.Switched() || result.AuthMode != tunneluser.AuthModeKey {
+		t.Errorf("SetUserKey = %+v, want switch from password to key", result)
+	}
+	fs.AssertInGroup(t, "alice", tunneluser.GroupKeyAuth)
+	if _, err := os.Stat(fs.KeyFile("alice")); err != nil {
+		t.Errorf("key file not created: %v", err)
+	}
+	if locked, err := tunneluser.IsPasswordLocked("alice"); err != nil || !locked {
+		t.Errorf("IsPasswordLocked = %v, %v; want true", locked, err)
+	}
+}
+
+func TestRSAKeyBelowPolicyRefused(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+	createUser(t, "alice", tunneluser.AuthModePassword)
+	broken := rsaKey(t, 1024)
+
+	// create --pubkey and update --pubkey go through these
+	if _, err := operations.CreateUser(operations.CreateInput{Username: "bob", AuthMode: tunneluser.AuthModeKey, PublicKey: broken}); !errors.Is(err, tunneluser.ErrKeyTooShort) {
+		t.Errorf("CreateUser(1024-bit key) = %v, want %v", err, tunneluser.ErrKeyTooShort)
+	}
+	fs.AssertUserNotExists(t, "bob")
+	if _, err := operations.SetUserKeyWithOptions("alice", broken, tunneluser.SwitchOptions{}); !errors.Is(err, tunneluser.ErrKeyTooShort) {
+		t.Errorf("SetUserKeyWithOptions(1024-bit key) = %v, want %v", err, tunneluser.ErrKeyTooShort)
+	}
+	if _, err := os.Stat(fs.KeyFile("alice")); !os.IsNotExist(err) {
+		t.Errorf("key file written for a refused key: %v", err)
+	}
+}
+
+func TestRSAKeyBelowStrictSizeWarns(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+	createUser(t, "alice", tunneluser.AuthModePassword)
+	key := rsaKey(t, tunneluser.DefaultMinRSABits)
+
+	info, err := operations.CreateUser(operations.CreateInput{Username: "bob", AuthMode: tunneluser.AuthModeKey, PublicKey: key})
+	if err != nil {
+		t.Fatalf("CreateUser(%d-bit key): %v", tunneluser.DefaultMinRSABits, err)
+	}
+	if len(info.Warnings) == 0 {
+		t.Errorf("CreateUser(%d-bit key) gave no warning", tunneluser.DefaultMinRSABits)
+	}
+
+	result, err := operations.SetUserKey("alice", key)
+	if err != nil {
+		t.Fatalf("SetUserKey(%d-bit key): %v", tunneluser.DefaultMinRSABits, err)
+	}
+	if len(result.Warnings) == 0 {
+		t.Errorf("SetUserKey(%d-bit key) gave no warning", tunneluser.DefaultMinRSABits)
+	}
+}
+
+func TestSetCredentialRequiresTunnelUser(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+	fs.AddUser("mallory", "users")
+
+	if _, err := operations.SetUserPassword("nobody", "pw"); !errors.Is(err, operations.ErrUserNotFound) {
+		t.Errorf("SetUserPassword(unknown user) = %v, want %v", err, operations.ErrUserNotFound)
+	}
+	if _, err := operations.SetUserKey("mallory", tunneltesting.TestKey); !errors.Is(err, operations.ErrNotTunnelUser) {
+		t.Errorf("SetUserKey(non-tunnel user) = %v, want %v", err, operations.ErrNotTunnelUser)
+	}
+}
+
+func TestUninstallUsers(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+	createUser(t, "alice", tunneluser.AuthModePassword)
+	createUser(t, "bob", tunneluser.AuthModeKey)
+
+	result, err := operations.UninstallUsers(nil)
+	if err != nil {
+		t.Fatalf("UninstallUsers: %v", err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if !slices.Contains(result.DeletedUsers, tunneluser.SystemName(name)) {
+			t.Errorf("DeletedUsers = %v, missing %s", result.DeletedUsers, tunneluser.SystemName(name))
+		}
+		fs.AssertUserNotExists(t, name)
+	}
+	if _, err := os.Stat(fs.KeyFile("bob")); !os.IsNotExist(err) {
+		t.Errorf("key file still present (err %v)", err)
+	}
+}
+
+func TestUninstallMatchingUsers(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+	createUser(t, "team-a1", tunneluser.AuthModePassword)
+	createUser(t, "team-a2", tunneluser.AuthModeKey)
+	createUser(t, "team-b1", tunneluser.AuthModePassword)
+
+	result, err := operations.UninstallMatchingUsers("^team-a", nil)
+	if err != nil {
+		t.Fatalf("UninstallMatchingUsers: %v", err)
+	}
+	if len(result.DeletedUsers) != 2 {
+		t.Errorf("DeletedUsers = %v, want the two team-a users", result.DeletedUsers)
+	}
+	fs.AssertUserNotExists(t, "team-a1")
+	fs.AssertUserNotExists(t, "team-a2")
+	fs.AssertUserExists(t, "team-b1")
+}
+
+func TestUninstallConfigRefusesWithUsers(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+	createUser(t, "alice", tunneluser.AuthModePassword)
+
+	if _, err := operations.UninstallConfig(); err == nil {
+		t.Error("UninstallConfig succeeded while a tunnel user exists")
+	}
+	fs.AssertUserExists(t, "alice")
+}
+
+func TestUninstallAllWithoutConfig(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+	createUser(t, "alice", tunneluser.AuthModePassword)
+
+	// Without a managed drop-in the sshd config and groups are left alone,
+	// so neither sshd nor the firewall is touched
+	result, err := operations.UninstallAll(nil)
+	if err != nil {
+		t.Fatalf("UninstallAll: %v", err)
+	}
+	if len(result.DeletedUsers) != 1 || result.ConfigRemoved {
+		t.Errorf("UninstallAll = %+v, want alice deleted and no config removed", result)
+	}
+	fs.AssertUserNotExists(t, "alice")
+}
+
+// healthCheck returns the named check of a full health check.
+func healthCheck(t *testing.T, name string) operations.HealthCheckResult {
+	t.Helper()
+	report, _ := operations.HealthCheck()
+	for _, c := range report.Checks {
+		if c.Name == name {
+			return c
+		}
+	}
+	t.Fatalf("health check %s not run", name)
+	return operations.HealthCheckResult{}
+}
+
+func TestHealthCheckGroupsWithoutUsers(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+	// A configured host whose groups were never created
+	if err := os.MkdirAll(filepath.Dir(sshdconfig.ManagedFilePath()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(sshdconfig.ManagedFilePath(), []byte("# test\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := healthCheck(t, "groups"); c.OK || c.Required {
+		t.Errorf("groups check without users = %+v, want failed but not required", c)
+	}
+	if err := tunneluser.EnsureGroups(); err != nil {
+		t.Fatalf("EnsureGroups: %v", err)
+	}
+	if c := healthCheck(t, "groups"); !c.OK {
+		t.Errorf("groups check after EnsureGroups = %+v", c)
+	}
+	createUser(t, "alice", tunneluser.AuthModePassword)
+	if c := healthCheck(t, "groups"); !c.OK || !c.Required {
+		t.Errorf("groups check with a user = %+v, want passed and required", c)
+	}
+}
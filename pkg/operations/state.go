@@ -0,0 +1,140 @@
+package operations
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/net2share/sshtun-user/pkg/fail2ban"
+	"github.com/net2share/sshtun-user/pkg/paths"
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+)
+
+// DefaultStateFile is where the CLI records the state after every change.
+const DefaultStateFile = "/var/lib/sshtun-user/state.json"
+
+// StateFile is the machine-readable record of what sshtun-user applied, for
+// orchestration tools that need to know whether to run it again.
+type StateFile struct {
+	ConfiguredAt       *time.Time            `json:"configured_at,omitempty"` // When the sshd drop-ins were last written
+	SSHDConfigHash     string                `json:"sshd_config_hash"`        // See sshdconfig.ConfigHash
+	Users              []tunneluser.UserInfo `json:"users"`
+	Fail2banConfigured bool                  `json:"fail2ban_configured"`
+	UpdatedAt          time.Time             `json:"updated_at"`
+}
+
+// CurrentState collects the state of the system as it is now.
+func CurrentState() (*StateFile, error) {
+	state := &StateFile{
+		Users:              []tunneluser.UserInfo{},
+		Fail2banConfigured: fail2ban.IsJailConfigured(),
+		UpdatedAt:          time.Now().UTC(),
+	}
+	if info, err := os.Stat(sshdconfig.ManagedFilePath()); err == nil {
+		t := info.ModTime().UTC()
+		state.ConfiguredAt = &t
+	}
+
+	hash, err := sshdconfig.ConfigHash()
+	if err != nil {
+		return nil, err
+	}
+	state.SSHDConfigHash = hash
+
+	users, err := tunneluser.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	for _, u := range users {
+		state.Users = append(state.Users, tunneluser.UserInfo{Username: u.Username, AuthMode: u.AuthMode, UID: u.UID, GID: u.GID})
+	}
+	sort.Slice(state.Users, func(i, j int) bool {
+		return state.Users[i].Username < state.Users[j].Username
+	})
+	return state, nil
+}
+
+// WriteStateFile records the current state at path, creating its directory
+// if needed. The file is replaced atomically.
+func WriteStateFile(path string) error {
+	state, err := CurrentState()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	path = paths.Join(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
+
+// ReadStateFile reads a state file written by WriteStateFile.
+func ReadStateFile(path string) (*StateFile, error) {
+	data, err := os.ReadFile(paths.Join(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	var state StateFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	return &state, nil
+}
+
+// Drift lists how current differs from the recorded state, ignoring
+// UpdatedAt. It is empty when nothing changed.
+func (s *StateFile) Drift(current *StateFile) []string {
+	var drift []string
+	if s.SSHDConfigHash != current.SSHDConfigHash {
+		drift = append(drift, "sshd drop-in files changed")
+	}
+	if s.Fail2banConfigured != current.Fail2banConfigured {
+		drift = append(drift, fmt.Sprintf("fail2ban jail configured: was %t, now %t", s.Fail2banConfigured, current.Fail2banConfigured))
+	}
+
+	recorded := make(map[string]tunneluser.AuthMode)
+	for _, u := range s.Users {
+		recorded[u.Username] = u.AuthMode
+	}
+	var added []string
+	for _, u := range current.Users {
+		mode, ok := recorded[u.Username]
+		switch {
+		case !ok:
+			added = append(added, u.Username)
+		case mode != u.AuthMode:
+			drift = append(drift, fmt.Sprintf("user %s: auth mode was %s, now %s", u.Username, mode, u.AuthMode))
+		}
+		delete(recorded, u.Username)
+	}
+	var removed []string
+	for name := range recorded {
+		removed = append(removed, name)
+	}
+	sort.Strings(removed)
+	if len(added) > 0 {
+		drift = append(drift, "users added: "+strings.Join(added, ", "))
+	}
+	if len(removed) > 0 {
+		drift = append(drift, "users removed: "+strings.Join(removed, ", "))
+	}
+	return drift
+}
@@ -0,0 +1,33 @@
+// Package paths maps the system paths used by sshtun-user onto an optional
+// root directory, so the tool can run against a scratch tree in tests.
+package paths
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// RootDir prefixes every system file path when non-empty. It is meant for
+// testing only; production setups must leave it empty.
+var RootDir string
+
+// SetRootDir sets RootDir. An empty path disables the prefix.
+func SetRootDir(dir string) error {
+	if dir == "" {
+		RootDir = ""
+		return nil
+	}
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("config directory must be an absolute path: %s", dir)
+	}
+	RootDir = filepath.Clean(dir)
+	return nil
+}
+
+// Join returns path below RootDir, or path unchanged when RootDir is empty.
+func Join(path string) string {
+	if RootDir == "" {
+		return path
+	}
+	return filepath.Join(RootDir, path)
+}
@@ -0,0 +1,112 @@
+// Package report renders human-readable overviews of what sshtun-user set
+// up on a host.
+package report
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/net2share/go-corelib/osdetect"
+	"github.com/net2share/go-corelib/tui"
+	"github.com/net2share/sshtun-user/pkg/container"
+	"github.com/net2share/sshtun-user/pkg/fail2ban"
+	"github.com/net2share/sshtun-user/pkg/firewall"
+	"github.com/net2share/sshtun-user/pkg/operations"
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+)
+
+// GenerateSummary returns a boxed summary of the setup recorded in state,
+// e.g. from operations.CurrentState: sshd hardening, fail2ban, the tunnel
+// users by auth mode, where keys are stored, the sshd ports and what to do
+// next. Settings the state doesn't record, such as the ports, are read from
+// the system.
+func GenerateSummary(state *operations.StateFile) string {
+	return tui.TitleStyle.Render("Setup summary") + "\n" + tui.BoxStyle.Render(strings.Join(SummaryLines(state), "\n"))
+}
+
+// SummaryLines returns the lines of GenerateSummary without the box.
+func SummaryLines(state *operations.StateFile) []string {
+	lines := []string{"sshd hardening:  " + hardeningStatus(state)}
+	lines = append(lines, "fail2ban:        "+fail2banStatus(state))
+	if firewall.IsConfigured() {
+		lines = append(lines, "Allow-list:      installed ("+firewall.ScriptPath+")")
+	}
+	lines = append(lines,
+		"Tunnel users:    "+userCounts(state.Users),
+		"Authorized keys: "+keyLocation(),
+		"sshd ports:      "+strings.Join(sshdPorts(), ", "),
+		"",
+		"Next steps:",
+	)
+	for _, step := range nextSteps(state) {
+		lines = append(lines, "  - "+step)
+	}
+	return lines
+}
+
+// hardeningStatus describes whether the managed drop-in is installed.
+func hardeningStatus(state *operations.StateFile) string {
+	if state.ConfiguredAt == nil {
+		return "not configured"
+	}
+	return fmt.Sprintf("applied (%s, %s)", sshdconfig.ManagedFilePath(), state.ConfiguredAt.Local().Format("2006-01-02 15:04"))
+}
+
+// fail2banStatus describes the jail and whether fail2ban runs it.
+func fail2banStatus(state *operations.StateFile) string {
+	switch {
+	case container.IsContainer():
+		return "skipped in a container"
+	case !state.Fail2banConfigured:
+		return "not configured"
+	case fail2ban.IsJailActive():
+		return fmt.Sprintf("jail '%s' active", fail2ban.JailName)
+	}
+	return fmt.Sprintf("jail '%s' configured, not active", fail2ban.JailName)
+}
+
+// userCounts formats the number of users of each auth mode.
+func userCounts(users []tunneluser.UserInfo) string {
+	counts := make(map[tunneluser.AuthMode]int)
+	for _, u := range users {
+		counts[u.AuthMode]++
+	}
+	return fmt.Sprintf("%d (%d password, %d key, %d sftp)", len(users),
+		counts[tunneluser.AuthModePassword], counts[tunneluser.AuthModeKey], counts[tunneluser.AuthModeSFTP])
+}
+
+// keyLocation names where key users' public keys are stored.
+func keyLocation() string {
+	if tunneluser.KeyStorage == tunneluser.KeyStoragePerUser {
+		return "~/.ssh/authorized_keys of each user"
+	}
+	return tunneluser.AuthorizedKeysDir
+}
+
+// sshdPorts returns the port from sshd_config and the one configure added.
+func sshdPorts() []string {
+	ports := []string{osdetect.DetectSSHPort()}
+	if port := sshdconfig.InstalledDirectives()["Port"]; port != "" && port != ports[0] {
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// nextSteps suggests what to do after the setup in state.
+func nextSteps(state *operations.StateFile) []string {
+	if state.ConfiguredAt == nil {
+		return []string{"Apply the sshd hardening with 'sshtun-user configure'"}
+	}
+	var steps []string
+	if len(state.Users) == 0 {
+		steps = append(steps, "Create your first user with 'sshtun-user create <name>'")
+	} else {
+		steps = append(steps, "Add users with 'sshtun-user create <name>', see them with 'sshtun-user list'")
+	}
+	if !state.Fail2banConfigured && !container.IsContainer() {
+		steps = append(steps, "Enable brute-force protection with 'sshtun-user configure --force --fail2ban'")
+	}
+	steps = append(steps, "Check the setup at any time with 'sshtun-user health-check'")
+	return steps
+}
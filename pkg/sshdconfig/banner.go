@@ -0,0 +1,90 @@
+package sshdconfig
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/net2share/sshtun-user/pkg/paths"
+)
+
+// BannerPath is where Configure writes the login banner of
+// Options.BannerText or Options.BannerFile.
+const BannerPath = "/etc/ssh/sshtunnel-banner.txt"
+
+// bannerPattern matches a Banner directive in the managed drop-in.
+var bannerPattern = regexp.MustCompile(`(?m)^[ \t]*Banner[ \t]+\S`)
+
+// bannerPath returns BannerPath below paths.RootDir.
+func bannerPath() string {
+	return paths.Join(BannerPath)
+}
+
+// HasBanner reports whether the options set a login banner.
+func (o Options) HasBanner() bool {
+	return o.BannerText != "" || o.BannerFile != ""
+}
+
+// bannerContent returns the banner text of the options, read from
+// BannerFile if set, ending with a newline.
+func (o Options) bannerContent() (string, error) {
+	content := o.BannerText
+	if o.BannerFile != "" {
+		data, err := os.ReadFile(o.BannerFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read banner file: %w", err)
+		}
+		content = string(data)
+	}
+	if strings.TrimSpace(content) == "" {
+		return "", fmt.Errorf("banner is empty")
+	}
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return content, nil
+}
+
+// writeBanner writes the banner of the options to BannerPath, or removes a
+// banner left from an earlier run if they set none.
+func writeBanner(o Options) error {
+	if !o.HasBanner() {
+		return removeBanner()
+	}
+	content, err := o.bannerContent()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(bannerPath(), []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", bannerPath(), err)
+	}
+	return nil
+}
+
+// removeBanner deletes the banner file written by Configure.
+func removeBanner() error {
+	if err := os.Remove(bannerPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", bannerPath(), err)
+	}
+	return nil
+}
+
+// BannerConfigured reports whether the managed drop-in sets a Banner.
+func BannerConfigured() bool {
+	data, err := os.ReadFile(ManagedFilePath())
+	return err == nil && bannerPattern.Match(data)
+}
+
+// ReadBanner returns the content of the banner file. It is an error if the
+// file is missing or empty, as sshd then shows no banner.
+func ReadBanner() (string, error) {
+	data, err := os.ReadFile(bannerPath())
+	if err != nil {
+		return "", fmt.Errorf("failed to read banner: %w", err)
+	}
+	if strings.TrimSpace(string(data)) == "" {
+		return "", fmt.Errorf("%s is empty", bannerPath())
+	}
+	return string(data), nil
+}
@@ -0,0 +1,76 @@
+package sshdconfig
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// sshdCandidates are checked in order when sshd is not found in $PATH.
+// Non-root shells often lack the sbin directories in $PATH.
+var sshdCandidates = []string{"/usr/sbin/sshd", "/usr/bin/sshd", "/sbin/sshd"}
+
+var (
+	sshdBinary string // set by SetSSHDBinary
+
+	detectOnce   sync.Once
+	detectedSSHD string
+	detectErr    error
+)
+
+// SetSSHDBinary overrides the sshd binary used for sshd -t and sshd -T.
+// An empty path restores automatic detection.
+func SetSSHDBinary(path string) error {
+	if path == "" {
+		sshdBinary = ""
+		return nil
+	}
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("sshd binary must be an absolute path: %s", path)
+	}
+	sshdBinary = filepath.Clean(path)
+	return nil
+}
+
+// FindSSHD returns the path of the sshd binary: the SetSSHDBinary
+// override if set, otherwise the first of $PATH and the usual install
+// locations that holds an executable. The detected path is cached.
+func FindSSHD() (string, error) {
+	if sshdBinary != "" {
+		if !isExecutable(sshdBinary) {
+			return "", fmt.Errorf("sshd binary %s is not an executable file", sshdBinary)
+		}
+		return sshdBinary, nil
+	}
+	detectOnce.Do(func() {
+		if path, err := exec.LookPath("sshd"); err == nil {
+			detectedSSHD = path
+			return
+		}
+		for _, path := range sshdCandidates {
+			if isExecutable(path) {
+				detectedSSHD = path
+				return
+			}
+		}
+		detectErr = errors.New("sshd binary not found (is openssh-server installed? otherwise set --sshd-binary)")
+	})
+	return detectedSSHD, detectErr
+}
+
+// sshdCommand builds an exec.Cmd running sshd with the given arguments.
+func sshdCommand(args ...string) (*exec.Cmd, error) {
+	path, err := FindSSHD()
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command(path, args...), nil
+}
+
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0
+}
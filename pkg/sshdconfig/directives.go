@@ -0,0 +1,67 @@
+package sshdconfig
+
+import (
+	"os"
+	"strings"
+
+	"github.com/net2share/sshtun-user/pkg/paths"
+)
+
+// GetIntendedDirectives returns the global directives Configure writes for
+// opts, keyed by keyword as written in the drop-in, e.g.
+// "MaxAuthTries": "3". Zero options are replaced by their defaults, as in
+// Configure. Nothing is written, so tests can assert on the result; with
+// several Port lines, see Configure, the added port is the one returned.
+// The Match blocks are left out; see MatchBlockDirectives.
+func GetIntendedDirectives(opts Options) map[string]string {
+	return intendedBlocks(opts)[""]
+}
+
+// MatchBlockDirectives returns the directives of the Match Group block
+// Configure writes for group, or nil if opts has no block for it.
+func MatchBlockDirectives(opts Options, group string) map[string]string {
+	return intendedBlocks(opts)[group]
+}
+
+// intendedBlocks renders the managed drop-in for opts and splits it into
+// the directives of each block: "" for the global part and the group name
+// for each Match Group block.
+func intendedBlocks(opts Options) map[string]map[string]string {
+	// The template only reads plain fields, so rendering can't fail
+	opts = opts.withDefaults()
+	content, _ := render(managedConfigTemplate, managedConfigData{Options: opts, Ports: listenPorts(opts, paths.Join(opts.DropInDir))})
+	return parseBlocks(content)
+}
+
+// InstalledDirectives returns the global directives of the managed drop-in
+// as it is on disk, keyed like GetIntendedDirectives, or nil if Configure
+// hasn't written it.
+func InstalledDirectives() map[string]string {
+	data, err := os.ReadFile(ManagedFilePath())
+	if err != nil {
+		return nil
+	}
+	return parseBlocks(string(data))[""]
+}
+
+// parseBlocks splits drop-in content into the directives of each block, as
+// described for intendedBlocks.
+func parseBlocks(content string) map[string]map[string]string {
+	blocks := map[string]map[string]string{"": {}}
+	current := blocks[""]
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keyword, value, _ := strings.Cut(line, " ")
+		if keyword == "Match" {
+			group := strings.TrimPrefix(value, "Group ")
+			current = map[string]string{}
+			blocks[group] = current
+			continue
+		}
+		current[keyword] = strings.TrimSpace(value)
+	}
+	return blocks
+}
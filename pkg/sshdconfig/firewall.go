@@ -0,0 +1,248 @@
+package sshdconfig
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// FirewallStatus is what CheckFirewallRules found out about an SSH port.
+type FirewallStatus struct {
+	Tool             string // Active firewall: ufw, firewalld or iptables; empty if none
+	PortOpen         bool   // Whether new connections to the port are let through
+	SuggestedCommand string // Command that opens the port, empty when it is open
+}
+
+// CheckFirewallRules checks whether the active local firewall lets new TCP
+// connections reach port. ufw and firewalld are checked first, since they
+// manage iptables rules of their own, then plain iptables. The check is a
+// heuristic for the usual rule shapes: rules restricted by source address,
+// interface or connection state are ignored, and jumps to other chains are
+// not followed. Nothing is changed; the suggested command is for the admin
+// to run.
+func CheckFirewallRules(port int) (FirewallStatus, error) {
+	if port < 1 || port > 65535 {
+		return FirewallStatus{}, fmt.Errorf("invalid port %d: must be between 1 and 65535", port)
+	}
+	for _, check := range []func(int) (FirewallStatus, bool, error){checkUFW, checkFirewalld, checkIptables} {
+		status, active, err := check(port)
+		if err != nil || active {
+			return status, err
+		}
+	}
+	return FirewallStatus{PortOpen: true}, nil
+}
+
+// firewallOutput runs a firewall tool in the C locale and returns its
+// output. A tool that isn't installed returns "" and no error.
+func firewallOutput(name string, args ...string) (string, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return "", nil
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s failed: %w", name, strings.Join(args, " "), err)
+	}
+	return string(output), nil
+}
+
+// checkUFW checks the rules of an active ufw, which apply in order, falling
+// back to the default incoming policy.
+func checkUFW(port int) (FirewallStatus, bool, error) {
+	output, err := firewallOutput("ufw", "status", "verbose")
+	if err != nil || !strings.Contains(output, "Status: active") {
+		return FirewallStatus{}, false, err
+	}
+	status := FirewallStatus{
+		Tool:             "ufw",
+		PortOpen:         strings.Contains(output, "allow (incoming)"),
+		SuggestedCommand: fmt.Sprintf("ufw allow %d/tcp", port),
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		i := slices.IndexFunc(fields, func(f string) bool {
+			return f == "ALLOW" || f == "LIMIT" || f == "DENY" || f == "REJECT"
+		})
+		// Only rules for a port from anywhere: "22/tcp ALLOW IN Anywhere"
+		if i != 1 || !slices.Contains(fields[i:], "Anywhere") {
+			continue
+		}
+		if !ufwRuleMatches(fields[0], port) {
+			continue
+		}
+		status.PortOpen = fields[1] == "ALLOW" || fields[1] == "LIMIT"
+		break
+	}
+	if status.PortOpen {
+		status.SuggestedCommand = ""
+	}
+	return status, true, nil
+}
+
+// ufwRuleMatches reports whether the "To" column of a ufw rule, e.g.
+// "22/tcp", "80,443/tcp", "6000:6007/tcp" or "OpenSSH", covers TCP port.
+func ufwRuleMatches(to string, port int) bool {
+	if to == "OpenSSH" {
+		return port == 22
+	}
+	spec, proto, _ := strings.Cut(to, "/")
+	if proto != "" && proto != "tcp" {
+		return false
+	}
+	return portListMatches(spec, port)
+}
+
+// checkFirewalld checks the services and ports of firewalld's default
+// zone.
+func checkFirewalld(port int) (FirewallStatus, bool, error) {
+	if _, err := exec.LookPath("firewall-cmd"); err != nil {
+		return FirewallStatus{}, false, nil
+	}
+	// firewall-cmd --state exits non-zero when firewalld isn't running
+	if exec.Command("firewall-cmd", "--state").Run() != nil {
+		return FirewallStatus{}, false, nil
+	}
+	output, err := firewallOutput("firewall-cmd", "--list-all")
+	if err != nil {
+		return FirewallStatus{}, true, err
+	}
+	status := FirewallStatus{Tool: "firewalld"}
+
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		values := strings.Fields(value)
+		switch key {
+		case "target":
+			if slices.Contains(values, "ACCEPT") {
+				status.PortOpen = true
+			}
+		case "services":
+			if port == 22 && slices.Contains(values, "ssh") {
+				status.PortOpen = true
+			}
+		case "ports":
+			for _, v := range values {
+				spec, proto, _ := strings.Cut(v, "/")
+				if proto == "tcp" && portListMatches(spec, port) {
+					status.PortOpen = true
+				}
+			}
+		}
+	}
+	if !status.PortOpen {
+		status.SuggestedCommand = fmt.Sprintf("firewall-cmd --permanent --add-port=%d/tcp && firewall-cmd --reload", port)
+	}
+	return status, true, nil
+}
+
+// checkIptables walks the INPUT chain in order: the first rule that applies
+// to every new TCP connection to port decides, else the chain policy. An
+// INPUT chain with no rules and an ACCEPT policy counts as no firewall.
+func checkIptables(port int) (FirewallStatus, bool, error) {
+	output, err := firewallOutput("iptables", "-S", "INPUT")
+	if err != nil || output == "" {
+		return FirewallStatus{}, false, err
+	}
+	status := FirewallStatus{Tool: "iptables"}
+	decided, hasRules := false, false
+
+	for _, line := range strings.Split(output, "\n") {
+		args := strings.Fields(line)
+		if len(args) < 3 {
+			continue
+		}
+		switch args[0] {
+		case "-P":
+			if !decided {
+				status.PortOpen = args[2] == "ACCEPT"
+			}
+		case "-A":
+			hasRules = true
+			if decided {
+				continue
+			}
+			if target, ok := iptablesRuleTarget(args[2:], port); ok {
+				status.PortOpen = target == "ACCEPT"
+				decided = true
+			}
+		}
+	}
+	if !hasRules && status.PortOpen {
+		return FirewallStatus{PortOpen: true}, false, nil
+	}
+	if !status.PortOpen {
+		status.SuggestedCommand = fmt.Sprintf("iptables -I INPUT -p tcp --dport %d -j ACCEPT", port)
+	}
+	return status, true, nil
+}
+
+// iptablesRuleTarget returns the target of an iptables rule, given as the
+// arguments after "-A INPUT", if it is ACCEPT, DROP or REJECT and applies
+// to every new TCP connection to port.
+func iptablesRuleTarget(args []string, port int) (string, bool) {
+	target := ""
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		value := ""
+		if i+1 < len(args) {
+			value = args[i+1]
+		}
+		switch arg {
+		case "-p":
+			if value != "tcp" && value != "all" {
+				return "", false
+			}
+			i++
+		case "-m":
+			if value != "tcp" && value != "multiport" {
+				return "", false
+			}
+			i++
+		case "--dport", "--dports", "--destination-port", "--destination-ports":
+			if !portListMatches(value, port) {
+				return "", false
+			}
+			i++
+		case "-j":
+			target = value
+			i++
+		default:
+			// Conditions this check doesn't evaluate, e.g. -s or --ctstate
+			return "", false
+		}
+	}
+	switch target {
+	case "ACCEPT", "DROP", "REJECT":
+		return target, true
+	}
+	return "", false
+}
+
+// portListMatches reports whether a comma-separated list of ports and ranges
+// ("6000:6007" or "6000-6007") contains port.
+func portListMatches(list string, port int) bool {
+	for _, item := range strings.Split(list, ",") {
+		low, high, isRange := strings.Cut(item, ":")
+		if !isRange {
+			low, high, isRange = strings.Cut(item, "-")
+		}
+		if !isRange {
+			high = low
+		}
+		lo, err1 := strconv.Atoi(low)
+		hi, err2 := strconv.Atoi(high)
+		if err1 == nil && err2 == nil && lo <= port && port <= hi {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package sshdconfig
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LogLevel values written by Configure when Options.LogLevel is empty.
+// fail2ban needs VERBOSE: sshd only logs failed key authentication there.
+const (
+	DefaultLogLevel    = "VERBOSE"
+	NoFail2banLogLevel = "INFO"
+)
+
+// logLevels are the LogLevel values sshd accepts.
+var logLevels = []string{"QUIET", "FATAL", "ERROR", "INFO", "VERBOSE", "DEBUG", "DEBUG1", "DEBUG2", "DEBUG3"}
+
+// Options controls the sshd configuration written by Configure.
+// Zero values are replaced by the corresponding DefaultOptions value.
+type Options struct {
+	Port                int    // Additional sshd listen port, next to 22 or the ports set in sshd_config (0 adds none)
+	ClientAliveInterval int    // Seconds between keepalive probes
+	ClientAliveCountMax int    // Unanswered probes before disconnecting
+	LoginGraceTime      int    // Seconds allowed to complete authentication
+	MaxAuthTries        int    // Authentication attempts per connection
+	MaxStartups         string // Unauthenticated connection limit as start:rate:full
+	DropInDir           string // Directory for the generated drop-in files; only DropInDir is supported
+	PasswordGroup       string // Group matched for password-authenticated tunnel users
+	KeyGroup            string // Group matched for key-authenticated tunnel users
+	SFTPGroup           string // Group matched for SFTP-only users
+	GatewayPorts        bool   // Allow remote forwards reachable from other hosts (security risk)
+	DisablePasswordAuth bool   // Disable password auth for everyone except the password group
+	NoFail2ban          bool   // Skip fail2ban installation/configuration
+	LogLevel            string // sshd LogLevel (default DefaultLogLevel, or NoFail2banLogLevel with NoFail2ban)
+	BannerText          string // Login banner written to BannerPath
+	BannerFile          string // File whose content is copied to BannerPath, instead of BannerText
+	SkipDenyFiles       bool   // Leave cron/at allow and deny files alone (applied by cli.ConfigureCLI)
+}
+
+// DefaultOptions returns the default hardening options.
+func DefaultOptions() Options {
+	return Options{
+		ClientAliveInterval: 30,
+		ClientAliveCountMax: 3,
+		LoginGraceTime:      15,
+		MaxAuthTries:        3,
+		MaxStartups:         "50:30:100",
+		DropInDir:           DropInDir,
+		PasswordGroup:       "sshtunnel-password",
+		KeyGroup:            "sshtunnel-key",
+		SFTPGroup:           "sshtunnel-sftp",
+	}
+}
+
+// withDefaults returns a copy of the options with zero values replaced by defaults.
+func (o Options) withDefaults() Options {
+	d := DefaultOptions()
+	if o.ClientAliveInterval == 0 {
+		o.ClientAliveInterval = d.ClientAliveInterval
+	}
+	if o.ClientAliveCountMax == 0 {
+		o.ClientAliveCountMax = d.ClientAliveCountMax
+	}
+	if o.LoginGraceTime == 0 {
+		o.LoginGraceTime = d.LoginGraceTime
+	}
+	if o.MaxAuthTries == 0 {
+		o.MaxAuthTries = d.MaxAuthTries
+	}
+	if o.MaxStartups == "" {
+		o.MaxStartups = d.MaxStartups
+	}
+	if o.DropInDir == "" {
+		o.DropInDir = d.DropInDir
+	}
+	if o.PasswordGroup == "" {
+		o.PasswordGroup = d.PasswordGroup
+	}
+	if o.KeyGroup == "" {
+		o.KeyGroup = d.KeyGroup
+	}
+	if o.SFTPGroup == "" {
+		o.SFTPGroup = d.SFTPGroup
+	}
+	if o.LogLevel == "" {
+		o.LogLevel = DefaultLogLevel
+		if o.NoFail2ban {
+			o.LogLevel = NoFail2banLogLevel
+		}
+	}
+	o.LogLevel = strings.ToUpper(o.LogLevel)
+	return o
+}
+
+// Validate checks the options for out-of-range values.
+func (o Options) Validate() error {
+	if o.Port < 0 || o.Port > 65535 {
+		return fmt.Errorf("invalid port %d: must be between 1 and 65535, or 0 to add none", o.Port)
+	}
+	if o.ClientAliveInterval < 0 {
+		return fmt.Errorf("invalid client alive interval %d", o.ClientAliveInterval)
+	}
+	if o.ClientAliveCountMax < 0 {
+		return fmt.Errorf("invalid client alive count max %d", o.ClientAliveCountMax)
+	}
+	if o.LoginGraceTime < 0 {
+		return fmt.Errorf("invalid login grace time %d", o.LoginGraceTime)
+	}
+	if o.MaxAuthTries < 0 {
+		return fmt.Errorf("invalid max auth tries %d", o.MaxAuthTries)
+	}
+	if o.MaxStartups != "" {
+		if err := validateMaxStartups(o.MaxStartups); err != nil {
+			return err
+		}
+	}
+	// The other functions of this package, and so create, uninstall and
+	// health-check, only look for the drop-ins in DropInDir
+	if o.DropInDir != "" && filepath.Clean(o.DropInDir) != DropInDir {
+		return fmt.Errorf("unsupported drop-in directory %s: only %s is supported", o.DropInDir, DropInDir)
+	}
+	if o.BannerText != "" && o.BannerFile != "" {
+		return fmt.Errorf("banner text and banner file can't both be set")
+	}
+	if o.LogLevel != "" && !validLogLevel(o.LogLevel) {
+		return fmt.Errorf("invalid log level %q: must be one of %s", o.LogLevel, strings.Join(logLevels, ", "))
+	}
+	return nil
+}
+
+// maxStartupsPattern matches the start:rate:full form of MaxStartups.
+var maxStartupsPattern = regexp.MustCompile(`^(\d+):(\d+):(\d+)$`)
+
+// validateMaxStartups checks a start:rate:full value: sshd starts refusing
+// rate percent of unauthenticated connections above start, and all of them
+// at full.
+func validateMaxStartups(value string) error {
+	m := maxStartupsPattern.FindStringSubmatch(value)
+	if m == nil {
+		return fmt.Errorf("invalid max startups %q: must be start:rate:full, e.g. 50:30:100", value)
+	}
+	start, _ := strconv.Atoi(m[1])
+	rate, _ := strconv.Atoi(m[2])
+	full, _ := strconv.Atoi(m[3])
+	if start >= full {
+		return fmt.Errorf("invalid max startups %q: start must be less than full", value)
+	}
+	if rate < 1 || rate > 100 {
+		return fmt.Errorf("invalid max startups %q: rate must be between 1 and 100", value)
+	}
+	return nil
+}
+
+// validLogLevel reports whether sshd accepts level, in any case.
+func validLogLevel(level string) bool {
+	for _, l := range logLevels {
+		if strings.EqualFold(level, l) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package sshdconfig
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Reconfigure rewrites the drop-ins of an existing configuration from the
+// current template, e.g. after upgrading sshtun-user, and returns how the
+// managed drop-in and the global auth drop-in changed as diff lines
+// ("--- file", "+++ file", then "-old" and "+new" lines). The previous
+// files are saved with includeBackupSuffix first; sshd only includes
+// *.conf, so the copies are not loaded. Like Configure, it validates
+// the result with sshd -t and restores the previous files if that fails.
+func Reconfigure(opts Options) ([]string, error) {
+	dir := optionsDropInDir(opts)
+	files := []string{managedFilePath(dir), globalAuthConfigPath(dir)}
+	before := snapshotFiles(files...)
+	for _, f := range files {
+		if data := before[f]; data != nil {
+			if err := os.WriteFile(backupPath(f), data, 0644); err != nil {
+				return nil, fmt.Errorf("failed to back up %s: %w", f, err)
+			}
+		}
+	}
+
+	if err := Configure(opts); err != nil {
+		return nil, err
+	}
+
+	after := snapshotFiles(files...)
+	var diff []string
+	for _, f := range files {
+		if lines := diffLines(string(before[f]), string(after[f])); len(lines) > 0 {
+			diff = append(diff, "--- "+f, "+++ "+f)
+			diff = append(diff, lines...)
+		}
+	}
+	return diff, nil
+}
+
+// backupPath returns where Reconfigure saves a copy of a drop-in.
+func backupPath(file string) string {
+	return file + includeBackupSuffix
+}
+
+// diffLines returns the lines removed from old ("-") and added in new
+// ("+"), in order, from a longest common subsequence of the lines.
+// Unchanged lines are left out; the drop-ins are short enough that the
+// changed directives read well on their own.
+func diffLines(old, new string) []string {
+	a, b := splitLines(old), splitLines(new)
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "-"+a[i])
+			i++
+		default:
+			diff = append(diff, "+"+b[j])
+			j++
+		}
+	}
+	return diff
+}
+
+// splitLines splits content into lines without the final newline.
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
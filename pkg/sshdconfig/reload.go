@@ -0,0 +1,130 @@
+package sshdconfig
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/net2share/sshtun-user/pkg/container"
+)
+
+// sshUnitNames are the systemd unit names used for sshd by the supported
+// distributions (Debian/Ubuntu use ssh, most others sshd).
+var sshUnitNames = []string{"ssh", "sshd", "openssh-server"}
+
+// ReloadSSHD makes sshd pick up configuration changes.
+//
+// With socket activation (ssh.socket, the default on Ubuntu 22.10+), the
+// listening ports come from the socket unit, which a generator derives from
+// sshd_config on daemon-reload; reloading the service alone would leave a
+// changed Port without effect, and starting the service would conflict with
+// the socket. In containers, where sshd usually isn't managed by systemd,
+// the running daemon is sent SIGHUP instead.
+func ReloadSSHD() error {
+	if container.IsContainer() {
+		return signalReload()
+	}
+
+	service := findUnit(".service")
+	if socket := findUnit(".socket"); socket != "" && unitActive(socket) {
+		return reloadSocketActivated(socket, service)
+	}
+
+	if service == "" {
+		return fmt.Errorf("could not find SSH service (tried: %s)", strings.Join(sshUnitNames, ", "))
+	}
+
+	if unitActive(service) {
+		return reloadService(service)
+	}
+
+	// Service exists but not active, try to start it
+	if err := exec.Command("systemctl", "start", service).Run(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", service, err)
+	}
+	return nil
+}
+
+// IsRunning reports whether sshd accepts connections: its service or
+// socket unit is active, or an sshd process exists (e.g. in containers).
+func IsRunning() bool {
+	if !container.IsContainer() {
+		for _, suffix := range []string{".service", ".socket"} {
+			if unit := findUnit(suffix); unit != "" && unitActive(unit) {
+				return true
+			}
+		}
+	}
+	// pgrep exits 1 when nothing matches
+	return exec.Command("pgrep", "-x", "sshd").Run() == nil
+}
+
+// findUnit returns the first sshd unit with the given suffix that exists,
+// or an empty string.
+func findUnit(suffix string) string {
+	for _, name := range sshUnitNames {
+		unit := name + suffix
+		// systemctl cat fails only for units that don't exist
+		if exec.Command("systemctl", "cat", unit).Run() == nil {
+			return unit
+		}
+	}
+	return ""
+}
+
+// unitActive reports whether a systemd unit is active.
+func unitActive(unit string) bool {
+	return exec.Command("systemctl", "is-active", "--quiet", unit).Run() == nil
+}
+
+// reloadService reloads a running sshd service, restarting it if reload fails.
+func reloadService(service string) error {
+	if err := exec.Command("systemctl", "reload", service).Run(); err != nil {
+		if err := exec.Command("systemctl", "restart", service).Run(); err != nil {
+			return fmt.Errorf("failed to reload/restart %s: %w", service, err)
+		}
+	}
+	return nil
+}
+
+// reloadSocketActivated regenerates and restarts the sshd socket so changed
+// listen ports apply, then reloads the service if a connection has already
+// started it. Per-connection (Accept=yes) sshd instances read the config on
+// every connection and need nothing else.
+func reloadSocketActivated(socket, service string) error {
+	if err := exec.Command("systemctl", "daemon-reload").Run(); err != nil {
+		return fmt.Errorf("failed to reload systemd units: %w", err)
+	}
+	if err := exec.Command("systemctl", "restart", socket).Run(); err != nil {
+		return fmt.Errorf("failed to restart %s: %w", socket, err)
+	}
+	if service != "" && unitActive(service) {
+		return reloadService(service)
+	}
+	return nil
+}
+
+// sshdPidFiles are the usual locations of the listening sshd's PID file.
+var sshdPidFiles = []string{"/run/sshd.pid", "/var/run/sshd.pid"}
+
+// signalReload sends SIGHUP to the listening sshd so it re-reads its config.
+// Per-connection sshd processes are left alone.
+func signalReload() error {
+	for _, pidFile := range sshdPidFiles {
+		data, err := os.ReadFile(pidFile)
+		if err != nil {
+			continue
+		}
+		pid := strings.TrimSpace(string(data))
+		if err := exec.Command("kill", "-HUP", pid).Run(); err == nil {
+			return nil
+		}
+	}
+
+	// No usable PID file: the oldest sshd process is the listener
+	if err := exec.Command("pkill", "-HUP", "-o", "-x", "sshd").Run(); err != nil {
+		return fmt.Errorf("failed to signal sshd: %w", err)
+	}
+	return nil
+}
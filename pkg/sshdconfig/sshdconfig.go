@@ -2,35 +2,174 @@
 package sshdconfig
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
+
+	"github.com/net2share/sshtun-user/pkg/paths"
 )
 
-// Configuration file paths.
+// out receives progress messages. Change it with SetOutput.
+var out io.Writer = os.Stdout
+
+// SetOutput redirects progress messages, e.g. to io.Discard for quiet or
+// machine-readable output.
+func SetOutput(w io.Writer) {
+	out = w
+}
+
+// Output returns the writer progress messages go to.
+func Output() io.Writer {
+	return out
+}
+
+// MainConfig is the path to the main sshd configuration file.
+const MainConfig = "/etc/ssh/sshd_config"
+
+// DropInDir is the standard sshd_config.d directory holding the generated
+// drop-in files.
+const DropInDir = "/etc/ssh/sshd_config.d"
+
+// Drop-in file names.
+//
+// The managed file sorts after the per-user files (userConfigPrefix), so
+// their Match User blocks are read before the Match Group blocks.
 const (
-	MainConfig         = "/etc/ssh/sshd_config"
-	DropInDir          = "/etc/ssh/sshd_config.d"
-	BaseConfig         = "/etc/ssh/sshd_config.d/99-tunnel-base.conf"
-	PasswordAuthConfig = "/etc/ssh/sshd_config.d/99-tunnel-password.conf"
-	KeyAuthConfig      = "/etc/ssh/sshd_config.d/99-tunnel-key.conf"
+	globalAuthConfigName = "00-sshtunnel-global-auth.conf"
+	managedFileName      = "99-tunnel.conf"
 )
 
-// baseConfigContent contains the base hardening configuration.
-const baseConfigContent = `# Hardened SSH config for tunnel server
-# Generated by sshtun-user
+// legacyFileNames are the drop-ins written by versions that split the
+// configuration over several files. Configure and Remove delete them.
+var legacyFileNames = []string{
+	"99-tunnel-base.conf",
+	"99-tunnel-password.conf",
+	"99-tunnel-key.conf",
+}
+
+// ToolVersion is written to the header of the generated drop-ins.
+var ToolVersion = "dev"
+
+// GlobalAuthConfigPath returns the path of the drop-in that disables password
+// auth globally (Options.DisablePasswordAuth).
+func GlobalAuthConfigPath() string {
+	return globalAuthConfigPath(dropInDir())
+}
+
+// ManagedFilePath returns the path of the drop-in holding the hardening
+// settings and the Match blocks of both tunnel groups.
+func ManagedFilePath() string {
+	return managedFilePath(dropInDir())
+}
+
+// globalAuthConfigPath returns the path of the global auth drop-in in dir.
+func globalAuthConfigPath(dir string) string {
+	return filepath.Join(dir, globalAuthConfigName)
+}
+
+// managedFilePath returns the path of the managed drop-in in dir.
+func managedFilePath(dir string) string {
+	return filepath.Join(dir, managedFileName)
+}
+
+// legacyFiles returns the paths of legacyFileNames in DropInDir.
+func legacyFiles() []string {
+	return legacyFilesIn(dropInDir())
+}
+
+// legacyFilesIn returns the paths of legacyFileNames in dir.
+func legacyFilesIn(dir string) []string {
+	var files []string
+	for _, name := range legacyFileNames {
+		files = append(files, filepath.Join(dir, name))
+	}
+	return files
+}
+
+// dropInDir returns DropInDir below paths.RootDir.
+func dropInDir() string {
+	return paths.Join(DropInDir)
+}
+
+// optionsDropInDir returns the drop-in directory of opts below
+// paths.RootDir, DropInDir if opts doesn't set one.
+func optionsDropInDir(opts Options) string {
+	return paths.Join(opts.withDefaults().DropInDir)
+}
+
+// ensureDropInDir creates DropInDir if it is missing, see ensureDropInDirAt.
+func ensureDropInDir() error {
+	return ensureDropInDirAt(dropInDir())
+}
+
+// ensureDropInDirAt creates the drop-in directory dir if it is missing, as
+// on minimal images whose sshd_config has no Include. A new directory gets
+// mode 0755 regardless of the umask and, when running as root, root
+// ownership, as sshd expects; an existing one is left alone.
+func ensureDropInDirAt(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create drop-in directory %s: %w", dir, err)
+	}
+	if err := os.Chmod(dir, 0755); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %w", dir, err)
+	}
+	if os.Geteuid() == 0 {
+		if err := os.Chown(dir, 0, 0); err != nil {
+			return fmt.Errorf("failed to set owner of %s: %w", dir, err)
+		}
+	}
+	fmt.Fprintf(out, "Created drop-in directory %s\n", dir)
+	return nil
+}
+
+// mainConfig returns MainConfig below paths.RootDir.
+func mainConfig() string {
+	return paths.Join(MainConfig)
+}
+
+// SFTPChrootDirectory is the ChrootDirectory of SFTP-only users. sshd
+// requires it and its parents to be owned by root and not group or world
+// writable.
+const SFTPChrootDirectory = "/home/%u"
+
+// managedConfigTemplate contains the base hardening configuration followed
+// by the Match blocks of the password, SFTP and key groups. The key group
+// comes last: AddAuthorizedKeysDirective adds to the last Match Group block.
+var managedConfigTemplate = template.Must(template.New("managed").Parse(`# Hardened SSH config for tunnel server
+{{- if .Ports}}
+
+# === Listen Ports ===
+# Port lines replace sshd's default of 22, so 22 is listed as well when no
+# other sshd config file sets a Port
+{{- range .Ports}}
+Port {{.}}
+{{- end}}
+{{- end}}
 
 # === Connection Handling ===
 TCPKeepAlive no
-ClientAliveInterval 30
-ClientAliveCountMax 3
-LoginGraceTime 15
-MaxAuthTries 3
+ClientAliveInterval {{.ClientAliveInterval}}
+ClientAliveCountMax {{.ClientAliveCountMax}}
+LoginGraceTime {{.LoginGraceTime}}
+MaxAuthTries {{.MaxAuthTries}}
 MaxSessions 10
-# Rate limit: accept 50 freely, then drop 30% randomly, hard cap at 100
-MaxStartups 50:30:100
+# Rate limit unauthenticated connections (start:rate:full): above start drop
+# rate% randomly, refuse all at full
+MaxStartups {{.MaxStartups}}
 
 # === Crypto Hardening ===
 KexAlgorithms curve25519-sha256,curve25519-sha256@libssh.org
@@ -55,164 +194,605 @@ PermitTunnel no
 GatewayPorts no
 
 # === Logging (important for shared credentials scenarios) ===
-LogLevel VERBOSE
-`
+LogLevel {{.LogLevel}}
 
-// passwordAuthConfigContent contains the password auth group configuration.
-const passwordAuthConfigContent = `# Password-based tunnel user restrictions
-# Generated by sshtun-user
+# === Password-based tunnel user restrictions ===
 
-Match Group sshtunnel-password
+Match Group {{.PasswordGroup}}
     # Allow password auth for these tunnel users
     PasswordAuthentication yes
     PubkeyAuthentication no
+{{- if .GatewayPorts}}
+    # Allow -R (remote) forwards, bound on all interfaces (GatewayPorts)
+    AllowTcpForwarding yes
+    GatewayPorts yes
+{{- else}}
     # Only allow -L (local) and -D (SOCKS), block -R (remote)
     AllowTcpForwarding local
+{{- end}}
     # No interactive terminal
     PermitTTY no
     # Kill any command execution attempt (tunnels still work with ssh -N)
     ForceCommand /usr/sbin/nologin
     # Limit concurrent sessions per user
     MaxSessions 3
-`
+    # Log failed logins in detail (fail2ban needs VERBOSE for key auth failures)
+    LogLevel {{.LogLevel}}
+{{- if .HasBanner}}
+    # Warning banner shown before authentication
+    Banner ` + BannerPath + `
+{{- end}}
 
-// keyAuthConfigContent contains the key auth group configuration.
-const keyAuthConfigContent = `# Key-based tunnel user restrictions
-# Generated by sshtun-user
+# === SFTP-only user restrictions ===
 
-Match Group sshtunnel-key
+Match Group {{.SFTPGroup}}
+    # Password authentication, file transfer only
+    PasswordAuthentication yes
+    PubkeyAuthentication no
+    # No tunnels of any kind
+    AllowTcpForwarding no
+    # No interactive terminal
+    PermitTTY no
+    # Jailed to the root-owned home directory
+    ChrootDirectory ` + SFTPChrootDirectory + `
+    ForceCommand internal-sftp
+    # Limit concurrent sessions per user
+    MaxSessions 3
+    # Log failed logins in detail
+    LogLevel {{.LogLevel}}
+{{- if .HasBanner}}
+    # Warning banner shown before authentication
+    Banner ` + BannerPath + `
+{{- end}}
+
+# === Key-based tunnel user restrictions ===
+
+Match Group {{.KeyGroup}}
     # Key-only authentication
     PasswordAuthentication no
     PubkeyAuthentication yes
+{{- if .GatewayPorts}}
+    # Allow -R (remote) forwards, bound on all interfaces (GatewayPorts)
+    AllowTcpForwarding yes
+    GatewayPorts yes
+{{- else}}
     # Only allow -L (local) and -D (SOCKS), block -R (remote)
     AllowTcpForwarding local
+{{- end}}
     # No interactive terminal
     PermitTTY no
     # Kill any command execution attempt (tunnels still work with ssh -N)
     ForceCommand /usr/sbin/nologin
     # Limit concurrent sessions per user
     MaxSessions 3
+    # Log failed logins in detail (fail2ban needs VERBOSE for key auth failures)
+    LogLevel {{.LogLevel}}
+{{- if .HasBanner}}
+    # Warning banner shown before authentication
+    Banner ` + BannerPath + `
+{{- end}}
+`))
+
+// managedConfigData is what managedConfigTemplate renders: the options and
+// the ports of the Port lines.
+type managedConfigData struct {
+	Options
+	Ports []int
+}
+
+// portPattern matches an active Port directive; sshd keywords are
+// case-insensitive.
+var portPattern = regexp.MustCompile(`(?mi)^[ \t]*Port[ \t]+(\d+)`)
+
+// listenPorts returns the ports for the Port lines of the managed drop-in in
+// dir: none without opts.Port, else opts.Port unless another sshd config
+// file already sets it. Any Port line replaces sshd's default port, so when
+// no other file sets one, 22 comes first; otherwise adding a port would stop
+// sshd listening on 22 and lock out everyone connecting there.
+func listenPorts(opts Options, dir string) []int {
+	if opts.Port == 0 {
+		return nil
+	}
+	existing := configuredPorts(dir)
+	var ports []int
+	if len(existing) == 0 && opts.Port != 22 {
+		ports = append(ports, 22)
+	}
+	if !slices.Contains(existing, opts.Port) {
+		ports = append(ports, opts.Port)
+	}
+	return ports
+}
+
+// configuredPorts returns the ports set by Port lines in sshd_config and in
+// the drop-ins in dir other than the managed one.
+func configuredPorts(dir string) []int {
+	files := []string{mainConfig()}
+	dropIns, _ := filepath.Glob(filepath.Join(dir, "*.conf"))
+	for _, f := range dropIns {
+		if f != managedFilePath(dir) {
+			files = append(files, f)
+		}
+	}
+	var ports []int
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		for _, m := range portPattern.FindAllSubmatch(data, -1) {
+			if port, err := strconv.Atoi(string(m[1])); err == nil && !slices.Contains(ports, port) {
+				ports = append(ports, port)
+			}
+		}
+	}
+	return ports
+}
+
+// globalAuthConfig disables password auth outside the Match blocks.
+//
+// sshd keeps the first value it reads for a keyword, so a global setting only
+// takes effect if no earlier file sets it; hence the 00- prefix, which sorts
+// before distribution drop-ins like 50-cloud-init.conf. Match blocks are
+// re-evaluated per connection and override global values, so the password
+// group block can still enable passwords for password tunnel users.
+const globalAuthConfig = `# Global authentication hardening for tunnel server
+#
+# Passwords are disabled for everyone; the Match Group blocks in
+# ` + managedFileName + ` re-enable them for password and SFTP-only users only.
+PasswordAuthentication no
 `
 
-// EnsureIncludeDirective ensures the Include directive is present in sshd_config.
+// Markers delimiting the content of the generated drop-ins.
+const (
+	beginMarker = "# BEGIN sshtun-user managed configuration"
+	endMarker   = "# END sshtun-user managed configuration"
+)
+
+// markManaged wraps the content of a generated drop-in in begin and end
+// markers and a header naming the tool version, so it can be told apart
+// from settings added by hand.
+func markManaged(content string) string {
+	return beginMarker + "\n" +
+		"# Generated by sshtun-user " + ToolVersion + ". Do not edit: configure rewrites\n" +
+		"# this file and 'sshtun-user uninstall config' removes it.\n" +
+		content +
+		endMarker + "\n"
+}
+
+// EnsureIncludeDirective ensures the Include directive for DropInDir is present in sshd_config.
 func EnsureIncludeDirective() error {
-	data, err := os.ReadFile(MainConfig)
+	return ensureIncludeDirective(dropInDir())
+}
+
+// ensureIncludeDirective ensures sshd_config includes the drop-in directory
+// dir.
+func ensureIncludeDirective(dir string) error {
+	data, err := os.ReadFile(mainConfig())
 	if err != nil {
 		return fmt.Errorf("failed to read sshd_config: %w", err)
 	}
 
-	// Check if Include directive for sshd_config.d is present
-	pattern := regexp.MustCompile(`(?m)^Include.*/etc/ssh/sshd_config\.d/`)
-	if pattern.Match(data) {
+	// Check if Include directive for the drop-in directory is present
+	if includePatternFor(dir).Match(data) {
 		return nil // Already present
 	}
 
-	fmt.Println("Warning: sshd_config.d not included in sshd_config")
-	fmt.Println("Adding Include directive...")
+	// Create the directory first, so sshd never includes a missing one
+	if err := ensureDropInDirAt(dir); err != nil {
+		return err
+	}
 
-	// Prepend Include directive
-	newContent := "Include /etc/ssh/sshd_config.d/*.conf\n" + string(data)
-	if err := os.WriteFile(MainConfig, []byte(newContent), 0644); err != nil {
-		return fmt.Errorf("failed to update sshd_config: %w", err)
+	fmt.Fprintf(out, "Warning: %s not included in sshd_config\n", dir)
+	fmt.Fprintln(out, "Adding Include directive...")
+
+	// Keep the first original around; later runs find the directive
+	backup := mainConfig() + includeBackupSuffix
+	if _, err := os.Stat(backup); os.IsNotExist(err) {
+		if err := os.WriteFile(backup, data, 0644); err != nil {
+			return fmt.Errorf("failed to back up sshd_config: %w", err)
+		}
+		fmt.Fprintf(out, "Backup of sshd_config saved to %s\n", backup)
 	}
 
-	// Ensure drop-in directory exists
-	if err := os.MkdirAll(DropInDir, 0755); err != nil {
-		return fmt.Errorf("failed to create drop-in directory: %w", err)
+	// Prepend Include directive: it must come before any Match block
+	newContent := "Include " + dir + "/*.conf\n" + string(data)
+	if err := os.WriteFile(mainConfig(), []byte(newContent), 0644); err != nil {
+		return fmt.Errorf("failed to update sshd_config: %w", err)
 	}
 
 	return nil
 }
 
-// Configure writes all sshd configuration files.
-func Configure() error {
+// includeBackupSuffix names the copy of sshd_config saved before
+// EnsureIncludeDirective changes it, and the drop-in copies saved by
+// Reconfigure.
+const includeBackupSuffix = ".sshtun-user.bak"
+
+// includePattern matches an active Include directive for DropInDir.
+func includePattern() *regexp.Regexp {
+	return includePatternFor(dropInDir())
+}
+
+// includePatternFor matches an active Include directive for the drop-in
+// directory dir. sshd keywords are case-insensitive.
+func includePatternFor(dir string) *regexp.Regexp {
+	return regexp.MustCompile(`(?mi)^[ \t]*Include[ \t]+.*` + regexp.QuoteMeta(dir) + `/`)
+}
+
+// sshdDefaultMaxStartups is sshd's own MaxStartups, which can't tell
+// whether the managed drop-in is read.
+const sshdDefaultMaxStartups = "10:30:100"
+
+// appliedMarkers returns settings from the managed drop-in that sshd
+// defaults and distributions don't use, as printed by sshd -T. MaxStartups
+// is read back from the installed drop-in, since Options.MaxStartups
+// changes it.
+func appliedMarkers() map[string]string {
+	markers := map[string]string{
+		"ipqos":        "cs0 cs0",
+		"tcpkeepalive": "no",
+	}
+	if v := InstalledDirectives()["MaxStartups"]; v != "" && v != sshdDefaultMaxStartups {
+		markers["maxstartups"] = v
+	}
+	return markers
+}
+
+// DropInsApplied reports whether sshd actually reads the managed drop-in,
+// by looking for its settings in the effective configuration (sshd -T).
+// It is false when sshd_config lacks a working Include for DropInDir, so
+// the hardening would silently not apply. One matching setting is enough,
+// since other sshd config files may override the rest.
+func DropInsApplied() (bool, error) {
+	settings, err := effectiveSettings()
+	if err != nil {
+		return false, err
+	}
+	for keyword, value := range appliedMarkers() {
+		if settings[keyword] == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CheckDrift returns how the installed configuration differs from what
+// Configure writes for the given tunnel groups, in the order of their Match
+// blocks (password, SFTP, key), e.g. after hand edits: a missing drop-in or
+// Include directive, or a Match block for another group. Settings inside the
+// blocks are not compared.
+func CheckDrift(groups ...string) []string {
+	var drift []string
+	if data, err := os.ReadFile(ManagedFilePath()); err != nil {
+		drift = append(drift, ManagedFilePath()+" is missing")
+	} else {
+		if !bytes.HasPrefix(data, []byte(beginMarker)) || !bytes.Contains(data, []byte(endMarker)) {
+			drift = append(drift, ManagedFilePath()+" lost its sshtun-user markers")
+		}
+		var found []string
+		for _, m := range matchGroupPattern.FindAll(data, -1) {
+			found = append(found, strings.TrimPrefix(strings.TrimSpace(string(m)), "Match Group "))
+		}
+		if strings.Join(found, " ") != strings.Join(groups, " ") {
+			drift = append(drift, fmt.Sprintf("%s does not match groups %s", ManagedFilePath(), strings.Join(groups, ", ")))
+		}
+	}
+	for _, f := range legacyFiles() {
+		if _, err := os.Stat(f); err == nil {
+			drift = append(drift, f+" is left from an older version")
+		}
+	}
+	if data, err := os.ReadFile(mainConfig()); err != nil || !includePattern().Match(data) {
+		drift = append(drift, mainConfig()+" does not include "+dropInDir())
+	}
+	return drift
+}
+
+// render executes a configuration template with the given options.
+func render(tmpl *template.Template, data any) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render %s config: %w", tmpl.Name(), err)
+	}
+	return buf.String(), nil
+}
+
+// Configure writes the managed drop-in (and the global auth drop-in if
+// requested) using the given options, replacing drop-ins left by older
+// versions. An AuthorizedKeysFile directive in the drop-in being replaced
+// is kept. With opts.Port, sshd keeps listening on 22 when no other sshd
+// config file sets a Port, see listenPorts. If sshd -t rejects the result,
+// the previous files are restored.
+func Configure(opts Options) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	opts = opts.withDefaults()
+	dir := paths.Join(opts.DropInDir)
+	managedFile, globalAuthFile, legacy := managedFilePath(dir), globalAuthConfigPath(dir), legacyFilesIn(dir)
+	if opts.HasBanner() {
+		// Fail before anything is written
+		if _, err := opts.bannerContent(); err != nil {
+			return err
+		}
+	}
+
 	// Ensure Include directive is present
-	if err := EnsureIncludeDirective(); err != nil {
+	if err := ensureIncludeDirective(dir); err != nil {
 		return err
 	}
 
 	// Ensure drop-in directory exists
-	if err := os.MkdirAll(DropInDir, 0755); err != nil {
-		return fmt.Errorf("failed to create drop-in directory: %w", err)
+	if err := ensureDropInDirAt(dir); err != nil {
+		return err
 	}
 
-	// Write configuration files
-	configs := []struct {
-		path    string
-		content string
-	}{
-		{BaseConfig, baseConfigContent},
-		{PasswordAuthConfig, passwordAuthConfigContent},
-		{KeyAuthConfig, keyAuthConfigContent},
+	content, err := render(managedConfigTemplate, managedConfigData{Options: opts, Ports: listenPorts(opts, dir)})
+	if err != nil {
+		return err
+	}
+	content = markManaged(content)
+	// Keep the key directive of a drop-in being rewritten, e.g. by
+	// configure --force, so key users can still log in
+	if previous, err := os.ReadFile(managedFile); err == nil && authorizedKeysPattern.Match(previous) {
+		if content, err = withAuthorizedKeysDirective(content); err != nil {
+			return err
+		}
 	}
 
-	for _, cfg := range configs {
-		if err := os.WriteFile(cfg.path, []byte(cfg.content), 0644); err != nil {
-			return fmt.Errorf("failed to write %s: %w", cfg.path, err)
+	previous := snapshotFiles(append([]string{managedFile, globalAuthFile, bannerPath()}, legacy...)...)
+	if err := writeBanner(opts); err != nil {
+		return err
+	}
+	if err := os.WriteFile(managedFile, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", managedFile, err)
+	}
+	for _, f := range legacy {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", f, err)
 		}
 	}
 
+	if opts.DisablePasswordAuth {
+		if err := os.WriteFile(globalAuthFile, []byte(markManaged(globalAuthConfig)), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", globalAuthFile, err)
+		}
+	} else if err := os.Remove(globalAuthFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", globalAuthFile, err)
+	}
+
 	// Validate configuration
 	if err := Validate(); err != nil {
-		// Remove configs on validation failure
-		Remove()
+		// Put back what was there before, which removes new files
+		previous.restore()
 		return err
 	}
 
+	for _, warning := range CheckConflicts(opts) {
+		fmt.Fprintf(out, "Warning: %s\n", warning)
+	}
+	if applied, err := DropInsApplied(); err == nil && !applied {
+		fmt.Fprintf(out, "Warning: sshd ignores %s, so the hardening does not apply.\n", managedFile)
+		fmt.Fprintf(out, "  Add 'Include %s/*.conf' near the top of %s, before any Match block.\n", dir, mainConfig())
+	}
+
 	// Reload sshd
-	if err := Reload(); err != nil {
-		fmt.Printf("Warning: failed to reload sshd: %v\n", err)
+	if err := ReloadSSHD(); err != nil {
+		fmt.Fprintf(out, "Warning: failed to reload sshd: %v\n", err)
+	}
+
+	fmt.Fprintln(out, "sshd hardening applied:")
+	fmt.Fprintf(out, "  - Hardening and tunnel group rules: %s\n", managedFile)
+	if opts.DisablePasswordAuth {
+		fmt.Fprintf(out, "  - Password auth disabled globally: %s\n", globalAuthFile)
+	}
+	if opts.LogLevel == "VERBOSE" {
+		fmt.Fprintln(out, "  - Verbose logging enabled for fail2ban compatibility")
+	}
+	if opts.HasBanner() {
+		fmt.Fprintf(out, "  - Login banner: %s\n", bannerPath())
+	}
+
+	return nil
+}
+
+// fileSnapshot holds the content of files before a change, nil for files
+// that didn't exist.
+type fileSnapshot map[string][]byte
+
+// snapshotFiles records the current content of the given files.
+func snapshotFiles(files ...string) fileSnapshot {
+	s := make(fileSnapshot)
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			data = nil
+		}
+		s[f] = data
+	}
+	return s
+}
+
+// restore puts the recorded content back and removes files that didn't
+// exist, ignoring errors: it only runs after another failure.
+func (s fileSnapshot) restore() {
+	for f, data := range s {
+		if data == nil {
+			os.Remove(f)
+		} else {
+			os.WriteFile(f, data, 0644)
+		}
+	}
+}
+
+// CheckConflicts returns warnings about settings from other sshd config
+// files that defeat opts. sshd keeps the first value it reads for a keyword,
+// so a line in sshd_config above the Include silently wins over ours.
+func CheckConflicts(opts Options) []string {
+	var warnings []string
+	if opts.DisablePasswordAuth {
+		if value, err := EffectiveSetting("passwordauthentication"); err == nil && value != "no" {
+			warnings = append(warnings, fmt.Sprintf("PasswordAuthentication is still %q globally; another sshd config file sets it before %s", value, globalAuthConfigPath(optionsDropInDir(opts))))
+		}
+	}
+	// QUIET, FATAL and ERROR hide the authentication failures fail2ban
+	// matches, even with VERBOSE in the Match blocks
+	if value, err := EffectiveSetting("loglevel"); err == nil {
+		switch strings.ToUpper(value) {
+		case "QUIET", "FATAL", "ERROR":
+			warnings = append(warnings, fmt.Sprintf("LogLevel is %s globally; failed logins are not logged, so fail2ban can't ban attackers", strings.ToUpper(value)))
+		}
+	}
+	return warnings
+}
+
+// authorizedKeysDir is the directory referenced by the AuthorizedKeysFile directive.
+var authorizedKeysDir = "/etc/ssh/authorized_keys.d"
+
+// matchGroupPattern matches the Match Group line of a group drop-in.
+var matchGroupPattern = regexp.MustCompile(`(?m)^Match Group .*$`)
+
+// authorizedKeysPattern matches an existing AuthorizedKeysFile directive line.
+var authorizedKeysPattern = regexp.MustCompile(`(?m)^[ \t]*AuthorizedKeysFile[ \t]+.*$`)
+
+// authorizedKeysLinePattern matches the directive line with its newline.
+var authorizedKeysLinePattern = regexp.MustCompile(`(?m)^[ \t]*AuthorizedKeysFile[ \t]+.*\n?`)
+
+// SetAuthorizedKeysDir sets the directory referenced by the AuthorizedKeysFile directive.
+// Use tunneluser.SetAuthorizedKeysDir to keep the key files and directive in sync.
+func SetAuthorizedKeysDir(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("authorized keys directory must be an absolute path: %s", path)
 	}
+	authorizedKeysDir = filepath.Clean(path)
+	return nil
+}
+
+// AuthorizedKeysDirective returns the AuthorizedKeysFile directive for the key auth group.
+func AuthorizedKeysDirective() string {
+	return "AuthorizedKeysFile " + authorizedKeysFile()
+}
 
-	fmt.Println("sshd hardening applied:")
-	fmt.Printf("  - Base config: %s\n", BaseConfig)
-	fmt.Printf("  - Password auth: %s\n", PasswordAuthConfig)
-	fmt.Printf("  - Key auth: %s\n", KeyAuthConfig)
+// authorizedKeysFile returns the AuthorizedKeysFile value for key users.
+func authorizedKeysFile() string {
+	return filepath.Join(authorizedKeysDir, "%u")
+}
 
+// CheckEffectiveAuthorizedKeysFile asks sshd which AuthorizedKeysFile it
+// uses for username, a key user, and returns an error if it isn't the
+// configured key directory, e.g. because an earlier Match block wins.
+func CheckEffectiveAuthorizedKeysFile(username string) error {
+	value, err := EffectiveUserSetting(username, "authorizedkeysfile")
+	if err != nil {
+		return err
+	}
+	if value != authorizedKeysFile() {
+		return fmt.Errorf("sshd uses AuthorizedKeysFile %s for %s, want %s", value, username, authorizedKeysFile())
+	}
 	return nil
 }
 
-// AddAuthorizedKeysDirective adds the AuthorizedKeysFile directive to key auth config.
+// AddAuthorizedKeysDirective adds the AuthorizedKeysFile directive to the key
+// group's Match block.
+// An existing directive pointing at a different directory is replaced.
 func AddAuthorizedKeysDirective() error {
-	data, err := os.ReadFile(KeyAuthConfig)
+	data, err := os.ReadFile(ManagedFilePath())
 	if err != nil {
 		return err
 	}
 
-	if strings.Contains(string(data), "AuthorizedKeysFile.*authorized_keys.d") {
+	content, err := withAuthorizedKeysDirective(string(data))
+	if err != nil {
+		return err
+	}
+	if content == string(data) {
 		return nil // Already present
 	}
 
-	// Add directive after Match Group line
-	content := strings.Replace(
-		string(data),
-		"Match Group sshtunnel-key",
-		"Match Group sshtunnel-key\n    AuthorizedKeysFile /etc/ssh/authorized_keys.d/%u",
-		1,
-	)
+	if err := os.WriteFile(ManagedFilePath(), []byte(content), 0644); err != nil {
+		return err
+	}
+
+	return ReloadSSHD()
+}
+
+// withAuthorizedKeysDirective returns drop-in content with the
+// AuthorizedKeysFile directive in the key group's Match block, replacing one
+// pointing at a different directory.
+func withAuthorizedKeysDirective(data string) (string, error) {
+	directive := AuthorizedKeysDirective()
+	if existing := authorizedKeysPattern.FindString(data); existing != "" {
+		if strings.TrimSpace(existing) == directive {
+			return data, nil
+		}
+		return authorizedKeysPattern.ReplaceAllLiteralString(data, "    "+directive), nil
+	}
+	// Add directive after the last Match Group line, the key group's
+	locs := matchGroupPattern.FindAllStringIndex(data, -1)
+	if locs == nil {
+		return "", fmt.Errorf("no Match Group block found in the managed drop-in")
+	}
+	loc := locs[len(locs)-1]
+	return data[:loc[1]] + "\n    " + directive + data[loc[1]:], nil
+}
+
+// RepairAuthorizedKeysDirective re-adds the AuthorizedKeysFile directive
+// if it was removed or changed, e.g. by editing the managed drop-in by hand,
+// and reloads sshd. It reports whether anything was changed.
+func RepairAuthorizedKeysDirective() (bool, error) {
+	if !IsConfigured() {
+		return false, fmt.Errorf("sshd is not configured. Run 'sshtun-user configure' first")
+	}
+	if HasAuthorizedKeysDirective() {
+		return false, nil
+	}
+	if err := AddAuthorizedKeysDirective(); err != nil {
+		return false, fmt.Errorf("failed to restore AuthorizedKeysFile directive: %w", err)
+	}
+	return true, nil
+}
+
+// RemoveAuthorizedKeysDirective removes the AuthorizedKeysFile directive
+// from the key group's Match block, so sshd falls back to ~/.ssh/authorized_keys.
+func RemoveAuthorizedKeysDirective() error {
+	data, err := os.ReadFile(ManagedFilePath())
+	if err != nil {
+		return err
+	}
+	if !authorizedKeysPattern.Match(data) {
+		return nil // Not present
+	}
 
-	if err := os.WriteFile(KeyAuthConfig, []byte(content), 0644); err != nil {
+	content := authorizedKeysLinePattern.ReplaceAllLiteralString(string(data), "")
+	if err := os.WriteFile(ManagedFilePath(), []byte(content), 0644); err != nil {
 		return err
 	}
 
-	return Reload()
+	return ReloadSSHD()
+}
+
+// hostKeys are the host keys EnsureHostKeys generates, below paths.RootDir.
+var hostKeys = []struct {
+	keyType string
+	path    string
+}{
+	{"rsa", "/etc/ssh/ssh_host_rsa_key"},
+	{"ecdsa", "/etc/ssh/ssh_host_ecdsa_key"},
+	{"ed25519", "/etc/ssh/ssh_host_ed25519_key"},
 }
 
-// EnsureHostKeys generates SSH host keys if they don't exist.
+// EnsureHostKeys generates SSH host keys if they don't exist. With a
+// paths.RootDir they are created below it, like every other file.
 func EnsureHostKeys() error {
-	keyTypes := []struct {
-		keyType string
-		path    string
-	}{
-		{"rsa", "/etc/ssh/ssh_host_rsa_key"},
-		{"ecdsa", "/etc/ssh/ssh_host_ecdsa_key"},
-		{"ed25519", "/etc/ssh/ssh_host_ed25519_key"},
-	}
-
-	for _, k := range keyTypes {
-		if _, err := os.Stat(k.path); os.IsNotExist(err) {
-			fmt.Printf("Generating %s host key...\n", k.keyType)
-			cmd := exec.Command("ssh-keygen", "-t", k.keyType, "-f", k.path, "-N", "")
+	for _, k := range hostKeys {
+		path := paths.Join(k.path)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+			}
+			fmt.Fprintf(out, "Generating %s host key...\n", k.keyType)
+			cmd := exec.Command("ssh-keygen", "-t", k.keyType, "-f", path, "-N", "")
 			if err := cmd.Run(); err != nil {
 				return fmt.Errorf("failed to generate %s host key: %w", k.keyType, err)
 			}
@@ -228,74 +808,202 @@ func Validate() error {
 		return err
 	}
 
-	cmd := exec.Command("sshd", "-t", "-f", MainConfig)
+	if err := CheckConfig(); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "sshd config valid, reloading...")
+	return nil
+}
+
+// CheckConfig runs sshd -t without generating missing host keys or printing
+// anything, for read-only health checks.
+func CheckConfig() error {
+	args := []string{"-t", "-f", mainConfig()}
+	if paths.RootDir != "" {
+		// sshd would look for the host keys outside the root
+		for _, k := range hostKeys {
+			args = append(args, "-h", paths.Join(k.path))
+		}
+	}
+	cmd, err := sshdCommand(args...)
+	if err != nil {
+		return err
+	}
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("invalid sshd config: %s", string(output))
+		return fmt.Errorf("invalid sshd config: %s", strings.TrimSpace(string(output)))
 	}
-	fmt.Println("sshd config valid, reloading...")
 	return nil
 }
 
-// Reload reloads the sshd service.
-func Reload() error {
-	// Try to find the correct service name
-	services := []string{"sshd", "ssh", "openssh-server"}
+// HasAuthorizedKeysDirective reports whether the managed drop-in contains
+// the AuthorizedKeysFile directive for the current keys directory.
+func HasAuthorizedKeysDirective() bool {
+	data, err := os.ReadFile(ManagedFilePath())
+	if err != nil {
+		return false
+	}
+	existing := authorizedKeysPattern.Find(data)
+	return existing != nil && strings.TrimSpace(string(existing)) == AuthorizedKeysDirective()
+}
 
-	for _, svc := range services {
-		// Check if service unit exists (is-enabled returns 0 for enabled, 1 for disabled, but both mean it exists)
-		err := exec.Command("systemctl", "cat", svc).Run()
-		if err != nil {
-			continue // Service doesn't exist, try next
-		}
+// EffectiveSetting returns the global value sshd uses for a keyword, as
+// reported by sshd -T (lowercase keyword).
+func EffectiveSetting(keyword string) (string, error) {
+	settings, err := effectiveSettings()
+	if err != nil {
+		return "", err
+	}
+	value, ok := settings[keyword]
+	if !ok {
+		return "", fmt.Errorf("%s not found in sshd -T output", keyword)
+	}
+	return value, nil
+}
 
-		// Service exists, check if it's active
-		if exec.Command("systemctl", "is-active", "--quiet", svc).Run() == nil {
-			// Service is active, reload it
-			if err := exec.Command("systemctl", "reload", svc).Run(); err != nil {
-				// Reload failed, try restart
-				if err := exec.Command("systemctl", "restart", svc).Run(); err != nil {
-					return fmt.Errorf("failed to reload/restart %s: %w", svc, err)
-				}
+// EffectiveUserSetting returns the value sshd uses for a keyword when
+// username logs in from localhost, with Match blocks applied.
+func EffectiveUserSetting(username, keyword string) (string, error) {
+	settings, err := effectiveSettings("-C", "user="+username+",host=localhost,addr=127.0.0.1")
+	if err != nil {
+		return "", err
+	}
+	value, ok := settings[keyword]
+	if !ok {
+		return "", fmt.Errorf("%s not found in sshd -T output", keyword)
+	}
+	return value, nil
+}
+
+// effectiveSettings returns the sshd configuration printed by sshd -T,
+// keyed by lowercase keyword. args are passed on, e.g. a -C connection spec.
+func effectiveSettings(args ...string) (map[string]string, error) {
+	cmd, err := sshdCommand(append([]string{"-T", "-f", mainConfig()}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read effective sshd config: %w", err)
+	}
+	settings := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, ok := strings.Cut(line, " ")
+		if ok {
+			if _, seen := settings[key]; !seen {
+				settings[key] = strings.TrimSpace(value)
 			}
-			return nil
 		}
+	}
+	return settings, nil
+}
+
+// PasswordAuthDisabled reports whether password auth is disabled globally
+// by this tool (Options.DisablePasswordAuth).
+func PasswordAuthDisabled() bool {
+	_, err := os.Stat(GlobalAuthConfigPath())
+	return err == nil
+}
 
-		// Service exists but not active, try to start it
-		if err := exec.Command("systemctl", "start", svc).Run(); err != nil {
-			return fmt.Errorf("failed to start %s: %w", svc, err)
+// Remove removes the sshd configuration files created by this tool: the
+// managed drop-in, the global auth drop-in, per-user drop-ins, those left
+// by older versions and the login banner. Other files in DropInDir are
+// never touched.
+func Remove() error {
+	files, err := ListManagedFiles()
+	if err != nil {
+		return err
+	}
+	// Copies saved by Reconfigure go too
+	files = append(files, backupPath(ManagedFilePath()), backupPath(GlobalAuthConfigPath()))
+	for _, f := range files {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", f, err)
 		}
-		return nil
 	}
+	return removeBanner()
+}
 
-	return fmt.Errorf("could not find SSH service (tried: sshd, ssh, openssh-server)")
+// managedFilePatterns match the drop-in files written by this tool.
+var managedFilePatterns = append([]string{
+	managedFileName,
+	globalAuthConfigName,
+	userConfigPrefix + "*.conf",
+}, legacyFileNames...)
+
+// ListManagedFiles returns the drop-in files in DropInDir managed by this tool.
+func ListManagedFiles() ([]string, error) {
+	seen := make(map[string]bool)
+	var files []string
+	for _, pattern := range managedFilePatterns {
+		matches, err := filepath.Glob(filepath.Join(dropInDir(), pattern))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list drop-in files: %w", err)
+		}
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				files = append(files, m)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
 }
 
-// Remove removes all sshd configuration files created by this tool.
-func Remove() error {
-	files := []string{BaseConfig, PasswordAuthConfig, KeyAuthConfig}
+// ConfigHash returns a SHA-256 over the names and contents of the managed
+// drop-in files, so a change to any of them changes the hash. It returns ""
+// when no managed file exists.
+func ConfigHash() (string, error) {
+	files, err := ListManagedFiles()
+	if err != nil || len(files) == 0 {
+		return "", err
+	}
+	h := sha256.New()
 	for _, f := range files {
-		os.Remove(f)
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", f, err)
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", filepath.Base(f), len(data))
+		h.Write(data)
 	}
-	return nil
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-// RemoveAndReload removes all sshd configuration files and reloads sshd.
+// RemoveAndReload removes all managed sshd configuration files and reloads sshd.
 func RemoveAndReload() error {
 	if err := Remove(); err != nil {
 		return err
 	}
 
 	// Reload sshd to apply changes
-	if err := Reload(); err != nil {
+	if err := ReloadSSHD(); err != nil {
 		return fmt.Errorf("config files removed but failed to reload sshd: %w", err)
 	}
 
 	return nil
 }
 
-// IsConfigured checks if sshd hardening has been applied.
+// IsConfigured checks if sshd hardening has been applied. Drop-ins written
+// by older versions don't count, so configure can replace them.
 func IsConfigured() bool {
-	_, err := os.Stat(BaseConfig)
+	_, err := os.Stat(ManagedFilePath())
 	return err == nil
 }
+
+// HasMatchGroup reports whether the managed drop-in has a Match block for
+// group, e.g. the SFTP group, which configurations written by older versions
+// lack.
+func HasMatchGroup(group string) bool {
+	data, err := os.ReadFile(ManagedFilePath())
+	if err != nil {
+		return false
+	}
+	for _, m := range matchGroupPattern.FindAll(data, -1) {
+		if strings.TrimPrefix(strings.TrimSpace(string(m)), "Match Group ") == group {
+			return true
+		}
+	}
+	return false
+}
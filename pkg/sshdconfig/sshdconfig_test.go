@@ -0,0 +1,254 @@
+package sshdconfig
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/net2share/sshtun-user/pkg/paths"
+)
+
+// useRoot makes paths.RootDir a fresh temporary directory holding
+// sshd_config with the given content, until the test ends.
+func useRoot(t *testing.T, sshdConfig string) string {
+	t.Helper()
+	root := t.TempDir()
+	previous := paths.RootDir
+	t.Cleanup(func() { paths.RootDir = previous })
+	if err := paths.SetRootDir(root); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, paths.Join(MainConfig), sshdConfig)
+	return root
+}
+
+// writeFile writes content to path, creating its directory.
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenPorts(t *testing.T) {
+	tests := []struct {
+		name       string
+		sshdConfig string
+		dropIn     string // Another drop-in's content, if not empty
+		managed    string // The managed drop-in's content, if not empty
+		port       int
+		want       []int
+	}{
+		{name: "no port added", sshdConfig: "", port: 0, want: nil},
+		{name: "default port kept", sshdConfig: "#Port 22\n", port: 2222, want: []int{22, 2222}},
+		{name: "port in sshd_config", sshdConfig: "Port 2200\n", port: 2222, want: []int{2222}},
+		{name: "lower-case keyword", sshdConfig: "  port 2200\n", port: 2222, want: []int{2222}},
+		{name: "port in other drop-in", dropIn: "Port 443\n", port: 2222, want: []int{2222}},
+		{name: "port already set", sshdConfig: "Port 2222\n", port: 2222, want: nil},
+		{name: "adding 22", sshdConfig: "", port: 22, want: []int{22}},
+		{name: "managed drop-in ignored", managed: "Port 22\nPort 2200\n", port: 2222, want: []int{22, 2222}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useRoot(t, tt.sshdConfig)
+			dir := paths.Join(DropInDir)
+			if tt.dropIn != "" {
+				writeFile(t, filepath.Join(dir, "50-other.conf"), tt.dropIn)
+			}
+			if tt.managed != "" {
+				writeFile(t, managedFilePath(dir), tt.managed)
+			}
+			got := listenPorts(Options{Port: tt.port}, dir)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("listenPorts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManagedConfigKeepsDefaultPort(t *testing.T) {
+	useRoot(t, "# No Port line\n")
+	opts := DefaultOptions()
+	opts.Port = 2222
+	content, err := render(managedConfigTemplate, managedConfigData{Options: opts, Ports: listenPorts(opts, paths.Join(DropInDir))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(content, "\nPort 22\nPort 2222\n") {
+		t.Errorf("managed drop-in does not list ports 22 and 2222:\n%s", content)
+	}
+}
+
+func TestValidatePort(t *testing.T) {
+	for _, port := range []int{0, 1, 65535} {
+		if err := (Options{Port: port}).Validate(); err != nil {
+			t.Errorf("Validate(Port %d) = %v", port, err)
+		}
+	}
+	for _, port := range []int{-1, 65536} {
+		if err := (Options{Port: port}).Validate(); err == nil || !strings.Contains(err.Error(), "or 0") {
+			t.Errorf("Validate(Port %d) = %v, want an error mentioning 0", port, err)
+		}
+	}
+}
+
+func TestCustomDropInDirRefused(t *testing.T) {
+	useRoot(t, "")
+	for _, dir := range []string{"", DropInDir, DropInDir + "/"} {
+		if err := (Options{DropInDir: dir}).Validate(); err != nil {
+			t.Errorf("Validate(DropInDir %q) = %v", dir, err)
+		}
+	}
+
+	custom := "/etc/ssh/tunnel.d"
+	opts := DefaultOptions()
+	opts.DropInDir = custom
+	if err := Configure(opts); err == nil || !strings.Contains(err.Error(), "unsupported drop-in directory") {
+		t.Fatalf("Configure(DropInDir %s) = %v, want it refused", custom, err)
+	}
+	if _, err := os.Stat(paths.Join(custom)); !os.IsNotExist(err) {
+		t.Errorf("Configure created %s: %v", custom, err)
+	}
+	if IsConfigured() {
+		t.Error("IsConfigured after a refused Configure")
+	}
+	if files, err := ListManagedFiles(); err != nil || len(files) != 0 {
+		t.Errorf("ListManagedFiles() = %v, %v after a refused Configure", files, err)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	useRoot(t, "Include /etc/ssh/sshd_config.d/*.conf\n")
+	dir := paths.Join(DropInDir)
+	managed := []string{
+		ManagedFilePath(),
+		GlobalAuthConfigPath(),
+		UserConfigPath("alice"),
+		UserConfigPath("bob"),
+		backupPath(ManagedFilePath()),
+		filepath.Join(dir, legacyFileNames[0]),
+		bannerPath(),
+	}
+	unrelated := []string{
+		filepath.Join(dir, "50-cloud-init.conf"),
+		filepath.Join(dir, "99-sshtunnel-user-notes.txt"),
+		paths.Join(MainConfig),
+	}
+	for _, f := range append(managed, unrelated...) {
+		writeFile(t, f, "# test\n")
+	}
+
+	if err := Remove(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range managed {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", f)
+		}
+	}
+	for _, f := range unrelated {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("%s was removed: %v", f, err)
+		}
+	}
+	if files, err := ListManagedFiles(); err != nil || len(files) != 0 {
+		t.Errorf("ListManagedFiles() = %v, %v after Remove", files, err)
+	}
+}
+
+func TestEnsureIncludeDirectiveCreatesDropInDir(t *testing.T) {
+	useRoot(t, "Port 22\n")
+	dir := paths.Join(DropInDir)
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("drop-in directory exists before the test: %v", err)
+	}
+	// The mode must not depend on the umask
+	umask := syscall.Umask(0077)
+	t.Cleanup(func() { syscall.Umask(umask) })
+	previous := Output()
+	t.Cleanup(func() { SetOutput(previous) })
+	SetOutput(io.Discard)
+
+	if err := EnsureIncludeDirective(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatalf("drop-in directory not created: %v", err)
+	}
+	if !info.IsDir() || info.Mode().Perm() != 0755 {
+		t.Errorf("drop-in directory mode = %v, want a directory with 0755", info.Mode())
+	}
+	data, err := os.ReadFile(paths.Join(MainConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "Include "+dir+"/*.conf\n") {
+		t.Errorf("sshd_config does not start with the Include directive:\n%s", data)
+	}
+}
+
+func TestAppliedMarkersFollowMaxStartups(t *testing.T) {
+	tests := []struct {
+		maxStartups string
+		want        string // Marker expected, "" for none
+	}{
+		{maxStartups: "", want: "50:30:100"},
+		{maxStartups: "20:50:60", want: "20:50:60"},
+		{maxStartups: sshdDefaultMaxStartups, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.maxStartups, func(t *testing.T) {
+			useRoot(t, "")
+			opts := DefaultOptions()
+			if tt.maxStartups != "" {
+				opts.MaxStartups = tt.maxStartups
+			}
+			content, err := render(managedConfigTemplate, managedConfigData{Options: opts.withDefaults()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, ManagedFilePath(), content)
+
+			got, ok := appliedMarkers()["maxstartups"]
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("maxstartups marker = %q (set %v), want %q", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestIntendedDirectives(t *testing.T) {
+	useRoot(t, "")
+	opts := DefaultOptions()
+	global := GetIntendedDirectives(opts)
+	if global["MaxStartups"] != "50:30:100" || global["LogLevel"] != DefaultLogLevel {
+		t.Errorf("default MaxStartups %q, LogLevel %q", global["MaxStartups"], global["LogLevel"])
+	}
+	block := MatchBlockDirectives(opts, opts.PasswordGroup)
+	if block["AllowTcpForwarding"] != "local" || block["GatewayPorts"] != "" {
+		t.Errorf("default password block: AllowTcpForwarding %q, GatewayPorts %q", block["AllowTcpForwarding"], block["GatewayPorts"])
+	}
+
+	opts.MaxStartups = "10:50:20"
+	opts.NoFail2ban = true
+	opts.GatewayPorts = true
+	global = GetIntendedDirectives(opts)
+	if global["MaxStartups"] != "10:50:20" || global["LogLevel"] != NoFail2banLogLevel {
+		t.Errorf("custom MaxStartups %q, LogLevel %q", global["MaxStartups"], global["LogLevel"])
+	}
+	block = MatchBlockDirectives(opts, "sshtunnel-password")
+	if block["AllowTcpForwarding"] != "yes" || block["GatewayPorts"] != "yes" {
+		t.Errorf("GatewayPorts password block: AllowTcpForwarding %q, GatewayPorts %q", block["AllowTcpForwarding"], block["GatewayPorts"])
+	}
+	if MatchBlockDirectives(opts, "no-such-group") != nil {
+		t.Error("MatchBlockDirectives returned directives for an unknown group")
+	}
+}
@@ -0,0 +1,148 @@
+package sshdconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// userConfigPrefix prefixes per-user drop-ins. It sorts before the group
+// drop-ins so that sshd, which keeps the first value it sees for each
+// keyword, applies per-user settings over the group defaults.
+const userConfigPrefix = "99-sshtunnel-user-"
+
+// UserOptions holds per-user sshd settings written to a Match User block.
+type UserOptions struct {
+	Username   string
+	PermitOpen []string // Allowed forwarding destinations (host:port); empty allows any
+	SFTP       bool     // Chrooted SFTP access to the user's home directory
+	TOTP       bool     // Password plus TOTP code through PAM keyboard-interactive
+
+	PasswordChange bool // Allow a terminal so the first login can change an expired password
+	VerboseLogging bool // LogLevel VERBOSE for this user only, e.g. for forensics
+}
+
+// empty reports whether the options contain no per-user settings.
+func (o UserOptions) empty() bool {
+	return len(o.PermitOpen) == 0 && !o.SFTP && !o.TOTP && !o.PasswordChange && !o.VerboseLogging
+}
+
+// userConfigTemplate contains a per-user Match block.
+var userConfigTemplate = template.Must(template.New("user").Parse(`# Per-user tunnel restrictions for {{.Username}}
+# Generated by sshtun-user
+
+Match User {{.Username}}
+{{- if .PermitOpen}}
+    # Restrict forwarding to these destinations
+    PermitOpen{{range .PermitOpen}} {{.}}{{end}}
+{{- end}}
+{{- if .TOTP}}
+    # Password and TOTP code, both asked by PAM (pam_google_authenticator)
+    PasswordAuthentication no
+    KbdInteractiveAuthentication yes
+    AuthenticationMethods keyboard-interactive
+{{- end}}
+{{- if .PasswordChange}}
+    # sshd runs passwd for an expired password, which needs a terminal;
+    # ForceCommand still blocks any other command
+    PermitTTY yes
+{{- end}}
+{{- if .VerboseLogging}}
+    # Log key fingerprints and forwarding requests of this user; the
+    # global log level is unchanged
+    LogLevel VERBOSE
+{{- end}}
+{{- if .SFTP}}
+    # SFTP only, jailed to the home directory (tunnels still work)
+    ForceCommand internal-sftp
+    ChrootDirectory %h
+{{- end}}
+`))
+
+// UserConfigPath returns the path of the per-user drop-in for username.
+func UserConfigPath(username string) string {
+	return filepath.Join(dropInDir(), userConfigPrefix+username+".conf")
+}
+
+// WriteUserConfig writes the per-user drop-in and reloads sshd if it changed,
+// reporting whether it did. Options without any settings remove the drop-in.
+// If sshd -t rejects the new drop-in, the previous one is put back.
+func WriteUserConfig(opts UserOptions) (bool, error) {
+	if opts.Username == "" {
+		return false, fmt.Errorf("username is required")
+	}
+	if opts.empty() {
+		return RemoveUserConfig(opts.Username)
+	}
+
+	content, err := render(userConfigTemplate, opts)
+	if err != nil {
+		return false, err
+	}
+
+	path := UserConfigPath(opts.Username)
+	if existing, err := os.ReadFile(path); err == nil && string(existing) == content {
+		return false, nil
+	}
+
+	if err := ensureDropInDir(); err != nil {
+		return false, err
+	}
+	previous := snapshotFiles(path)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		return false, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	if err := Validate(); err != nil {
+		previous.restore()
+		return false, fmt.Errorf("invalid per-user config for '%s': %w", opts.Username, err)
+	}
+	return true, ReloadSSHD()
+}
+
+// RemoveUserConfig removes the per-user drop-in, reloading sshd if one
+// existed, and reports whether it did.
+func RemoveUserConfig(username string) (bool, error) {
+	path := UserConfigPath(username)
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+	return true, ReloadSSHD()
+}
+
+// ReadUserConfig returns the per-user settings for username. A missing
+// drop-in yields empty options.
+func ReadUserConfig(username string) (UserOptions, error) {
+	opts := UserOptions{Username: username}
+	data, err := os.ReadFile(UserConfigPath(username))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return opts, nil
+		}
+		return opts, fmt.Errorf("failed to read per-user config: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "PermitOpen":
+			opts.PermitOpen = fields[1:]
+		case "ForceCommand":
+			opts.SFTP = fields[1] == "internal-sftp"
+		case "AuthenticationMethods":
+			opts.TOTP = fields[1] == "keyboard-interactive"
+		case "PermitTTY":
+			opts.PasswordChange = fields[1] == "yes"
+		case "LogLevel":
+			opts.VerboseLogging = fields[1] == "VERBOSE"
+		}
+	}
+	return opts, nil
+}
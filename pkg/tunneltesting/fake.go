@@ -0,0 +1,549 @@
+package tunneltesting
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit statuses of the shadow-utils commands the fakes imitate.
+const (
+	exitUsage    = 2
+	exitNotFound = 6 // useradd/usermod/userdel: user or group doesn't exist
+	exitInUse    = 8 // groupdel: group is a user's primary group
+	exitExists   = 9 // useradd/groupadd: name already taken
+)
+
+// firstID is the first UID and GID the fakes hand out.
+const firstID = 1000
+
+// fakeCmd runs a fake command against the account databases below root.
+type fakeCmd struct {
+	root   string
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	expireNew bool // chpasswd leaves passwords expired
+}
+
+// run runs a fake command and returns its exit status.
+func (c *fakeCmd) run(name string, args []string) int {
+	var err error
+	status := 1
+	switch name {
+	case "useradd":
+		status, err = c.useradd(args)
+	case "usermod":
+		status, err = c.usermod(args)
+	case "userdel":
+		status, err = c.userdel(args)
+	case "groupadd":
+		status, err = c.groupadd(args)
+	case "groupdel":
+		status, err = c.groupdel(args)
+	case "gpasswd":
+		status, err = c.gpasswd(args)
+	case "chpasswd":
+		status, err = c.chpasswd()
+	case "chage":
+		status, err = c.chage(args)
+	case "getent":
+		status, err = c.getent(args)
+	case "pgrep", "pkill":
+		return 1 // No processes
+	default:
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(c.stderr, "%s: %v\n", name, err)
+		if status == 0 {
+			status = 1
+		}
+	}
+	return status
+}
+
+func (c *fakeCmd) useradd(args []string) (int, error) {
+	opts, name, err := parseArgs(args, "--shell", "-s", "--home-dir", "-d", "--gid", "-g", "--comment", "-c", "--groups", "-G")
+	if err != nil {
+		return exitUsage, err
+	}
+	passwd, err := c.read("passwd")
+	if err != nil {
+		return 1, err
+	}
+	if findEntry(passwd, name) >= 0 {
+		return exitExists, fmt.Errorf("user '%s' already exists", name)
+	}
+	groups, err := c.read("group")
+	if err != nil {
+		return 1, err
+	}
+
+	gid := opts.get("--gid", "-g")
+	if gid == "" {
+		gid = nextID(groups, 2)
+		groups = append(groups, []string{name, "x", gid, ""})
+	} else if i := findGroup(groups, gid); i >= 0 {
+		gid = groups[i][2]
+	} else {
+		return exitNotFound, fmt.Errorf("group '%s' does not exist", gid)
+	}
+	if list := opts.get("--groups", "-G"); list != "" {
+		if status, err := setSupplementary(groups, name, strings.Split(list, ","), false); err != nil {
+			return status, err
+		}
+	}
+
+	home := opts.get("--home-dir", "-d")
+	if home == "" {
+		home = "/home/" + name
+	}
+	shell := opts.get("--shell", "-s")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	passwd = append(passwd, []string{name, "x", nextID(passwd, 2), gid, opts.get("--comment", "-c"), home, shell})
+	if opts.has("--create-home", "-m") {
+		if err := os.MkdirAll(filepath.Join(c.root, home), 0755); err != nil {
+			return 1, err
+		}
+	}
+
+	shadow, err := c.read("shadow")
+	if err != nil {
+		return 1, err
+	}
+	shadow = append(shadow, []string{name, "!", today(), "0", "99999", "7", "", "", ""})
+	return c.write(map[string][][]string{"passwd": passwd, "group": groups, "shadow": shadow})
+}
+
+func (c *fakeCmd) usermod(args []string) (int, error) {
+	opts, name, err := parseArgs(args, "--comment", "-c", "--home", "-d", "--shell", "-s", "--gid", "-g", "--groups", "-G", "-aG")
+	if err != nil {
+		return exitUsage, err
+	}
+	dbs, err := c.readAll()
+	if err != nil {
+		return 1, err
+	}
+	u := findEntry(dbs["passwd"], name)
+	if u < 0 {
+		return exitNotFound, fmt.Errorf("user '%s' does not exist", name)
+	}
+	entry := dbs["passwd"][u]
+
+	if v, ok := opts["--comment"]; ok {
+		entry[4] = v
+	} else if v, ok := opts["-c"]; ok {
+		entry[4] = v
+	}
+	if v := opts.get("--home", "-d"); v != "" {
+		entry[5] = v
+	}
+	if v := opts.get("--shell", "-s"); v != "" {
+		entry[6] = v
+	}
+	if v := opts.get("--gid", "-g"); v != "" {
+		g := findGroup(dbs["group"], v)
+		if g < 0 {
+			return exitNotFound, fmt.Errorf("group '%s' does not exist", v)
+		}
+		entry[3] = dbs["group"][g][2]
+	}
+	if v := opts.get("-aG"); v != "" {
+		if status, err := setSupplementary(dbs["group"], name, strings.Split(v, ","), false); err != nil {
+			return status, err
+		}
+	} else if v := opts.get("--groups", "-G"); v != "" {
+		if status, err := setSupplementary(dbs["group"], name, strings.Split(v, ","), !opts.has("--append", "-a")); err != nil {
+			return status, err
+		}
+	}
+
+	if s := findEntry(dbs["shadow"], name); s >= 0 {
+		hash := dbs["shadow"][s][1]
+		switch {
+		case opts.has("--lock", "-L") && !strings.HasPrefix(hash, "!"):
+			dbs["shadow"][s][1] = "!" + hash
+		case opts.has("--unlock", "-U"):
+			dbs["shadow"][s][1] = strings.TrimPrefix(hash, "!")
+		}
+	}
+	return c.write(dbs)
+}
+
+func (c *fakeCmd) userdel(args []string) (int, error) {
+	_, name, err := parseArgs(args)
+	if err != nil {
+		return exitUsage, err
+	}
+	dbs, err := c.readAll()
+	if err != nil {
+		return 1, err
+	}
+	u := findEntry(dbs["passwd"], name)
+	if u < 0 {
+		return exitNotFound, fmt.Errorf("user '%s' does not exist", name)
+	}
+	dbs["passwd"] = slices.Delete(dbs["passwd"], u, u+1)
+	if s := findEntry(dbs["shadow"], name); s >= 0 {
+		dbs["shadow"] = slices.Delete(dbs["shadow"], s, s+1)
+	}
+	setSupplementary(dbs["group"], name, nil, true)
+	return c.write(dbs)
+}
+
+func (c *fakeCmd) groupadd(args []string) (int, error) {
+	_, name, err := parseArgs(args)
+	if err != nil {
+		return exitUsage, err
+	}
+	groups, err := c.read("group")
+	if err != nil {
+		return 1, err
+	}
+	if findEntry(groups, name) >= 0 {
+		return exitExists, fmt.Errorf("group '%s' already exists", name)
+	}
+	groups = append(groups, []string{name, "x", nextID(groups, 2), ""})
+	return c.write(map[string][][]string{"group": groups})
+}
+
+func (c *fakeCmd) groupdel(args []string) (int, error) {
+	_, name, err := parseArgs(args)
+	if err != nil {
+		return exitUsage, err
+	}
+	dbs, err := c.readAll()
+	if err != nil {
+		return 1, err
+	}
+	g := findEntry(dbs["group"], name)
+	if g < 0 {
+		return exitNotFound, fmt.Errorf("group '%s' does not exist", name)
+	}
+	for _, u := range dbs["passwd"] {
+		if u[3] == dbs["group"][g][2] {
+			return exitInUse, fmt.Errorf("cannot remove the primary group of user '%s'", u[0])
+		}
+	}
+	dbs["group"] = slices.Delete(dbs["group"], g, g+1)
+	return c.write(dbs)
+}
+
+// gpasswd supports -a (add) and -d (delete) of a single member.
+func (c *fakeCmd) gpasswd(args []string) (int, error) {
+	if len(args) != 3 || (args[0] != "-a" && args[0] != "-d") {
+		return exitUsage, fmt.Errorf("usage: gpasswd -a|-d user group")
+	}
+	member, name := args[1], args[2]
+	groups, err := c.read("group")
+	if err != nil {
+		return 1, err
+	}
+	g := findEntry(groups, name)
+	if g < 0 {
+		return 3, fmt.Errorf("group '%s' does not exist", name)
+	}
+	members := splitMembers(groups[g][3])
+	i := slices.Index(members, member)
+	switch {
+	case args[0] == "-a" && i < 0:
+		members = append(members, member)
+	case args[0] == "-d" && i < 0:
+		return 3, fmt.Errorf("user '%s' is not a member of '%s'", member, name)
+	case args[0] == "-d":
+		members = slices.Delete(members, i, i+1)
+	}
+	groups[g][3] = strings.Join(members, ",")
+	return c.write(map[string][][]string{"group": groups})
+}
+
+// chpasswd stores a SHA-256 of each password read from stdin. The hash
+// only has to be stable and not start with "!". The last change is today,
+// or 0 (expired) with expireNew.
+func (c *fakeCmd) chpasswd() (int, error) {
+	shadow, err := c.read("shadow")
+	if err != nil {
+		return 1, err
+	}
+	scanner := bufio.NewScanner(c.stdin)
+	for scanner.Scan() {
+		name, password, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		s := findEntry(shadow, name)
+		if s < 0 {
+			return 1, fmt.Errorf("user '%s' does not exist", name)
+		}
+		sum := sha256.Sum256([]byte(password))
+		shadow[s][1] = "$fake$" + hex.EncodeToString(sum[:])
+		shadow[s][2] = today()
+		if c.expireNew {
+			shadow[s][2] = "0"
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 1, err
+	}
+	return c.write(map[string][][]string{"shadow": shadow})
+}
+
+// chage supports -d (last change), -E (account expiry) and -l.
+func (c *fakeCmd) chage(args []string) (int, error) {
+	opts, name, err := parseArgs(args, "-d", "--lastday", "-E", "--expiredate")
+	if err != nil {
+		return exitUsage, err
+	}
+	shadow, err := c.read("shadow")
+	if err != nil {
+		return 1, err
+	}
+	s := findEntry(shadow, name)
+	if s < 0 {
+		return 1, fmt.Errorf("user '%s' does not exist in /etc/shadow", name)
+	}
+
+	if opts.has("-l", "--list") {
+		expires := "never"
+		if days, err := strconv.Atoi(shadow[s][7]); err == nil {
+			expires = time.Unix(int64(days)*86400, 0).UTC().Format("Jan 02, 2006")
+		}
+		fmt.Fprintf(c.stdout, "Account expires\t\t\t\t\t\t: %s\n", expires)
+		return 0, nil
+	}
+	for field, keys := range map[int][]string{2: {"-d", "--lastday"}, 7: {"-E", "--expiredate"}} {
+		v := opts.get(keys...)
+		if v == "" {
+			continue
+		}
+		days, err := parseDays(v)
+		if err != nil {
+			return exitUsage, err
+		}
+		shadow[s][field] = days
+	}
+	return c.write(map[string][][]string{"shadow": shadow})
+}
+
+// getent prints the entries for the keys, or all entries, of the group or
+// passwd database. It exits 2 when a key isn't found.
+func (c *fakeCmd) getent(args []string) (int, error) {
+	if len(args) == 0 || (args[0] != "group" && args[0] != "passwd") {
+		return 1, fmt.Errorf("unsupported database")
+	}
+	entries, err := c.read(args[0])
+	if err != nil {
+		return 1, err
+	}
+	if len(args) == 1 {
+		for _, e := range entries {
+			fmt.Fprintln(c.stdout, strings.Join(e, ":"))
+		}
+		return 0, nil
+	}
+	status := 0
+	for _, key := range args[1:] {
+		i := findEntry(entries, key)
+		if args[0] == "group" && i < 0 {
+			i = findGroup(entries, key)
+		}
+		if i < 0 {
+			status = 2
+			continue
+		}
+		fmt.Fprintln(c.stdout, strings.Join(entries[i], ":"))
+	}
+	return status, nil
+}
+
+// read reads the account database name ("passwd", "group" or "shadow").
+func (c *fakeCmd) read(name string) ([][]string, error) {
+	return readDB(filepath.Join(c.root, "etc", name))
+}
+
+// readAll reads all account databases.
+func (c *fakeCmd) readAll() (map[string][][]string, error) {
+	dbs := make(map[string][][]string)
+	for _, name := range []string{"passwd", "group", "shadow"} {
+		entries, err := c.read(name)
+		if err != nil {
+			return nil, err
+		}
+		dbs[name] = entries
+	}
+	return dbs, nil
+}
+
+// write writes account databases and returns the exit status for a
+// command whose changes they are.
+func (c *fakeCmd) write(dbs map[string][][]string) (int, error) {
+	for name, entries := range dbs {
+		var b strings.Builder
+		for _, e := range entries {
+			b.WriteString(strings.Join(e, ":") + "\n")
+		}
+		if err := os.WriteFile(filepath.Join(c.root, "etc", name), []byte(b.String()), 0644); err != nil {
+			return 1, err
+		}
+	}
+	return 0, nil
+}
+
+// readDB reads a colon-separated account database.
+func readDB(path string) ([][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries [][]string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			entries = append(entries, strings.Split(line, ":"))
+		}
+	}
+	return entries, nil
+}
+
+// findEntry returns the index of the entry named name, or -1.
+func findEntry(entries [][]string, name string) int {
+	return slices.IndexFunc(entries, func(e []string) bool { return e[0] == name })
+}
+
+// findGroup returns the index of a group given by name or GID, or -1.
+func findGroup(groups [][]string, nameOrGID string) int {
+	if i := findEntry(groups, nameOrGID); i >= 0 {
+		return i
+	}
+	return slices.IndexFunc(groups, func(e []string) bool { return len(e) > 2 && e[2] == nameOrGID })
+}
+
+// nextID returns one more than the largest ID in field, at least firstID.
+func nextID(entries [][]string, field int) string {
+	next := firstID
+	for _, e := range entries {
+		if len(e) > field {
+			if id, err := strconv.Atoi(e[field]); err == nil && id >= next {
+				next = id + 1
+			}
+		}
+	}
+	return strconv.Itoa(next)
+}
+
+// setSupplementary adds member to groups, first removing it from all
+// groups with replace.
+func setSupplementary(groups [][]string, member string, names []string, replace bool) (int, error) {
+	for _, name := range names {
+		if findGroup(groups, name) < 0 {
+			return exitNotFound, fmt.Errorf("group '%s' does not exist", name)
+		}
+	}
+	for _, g := range groups {
+		members := splitMembers(g[3])
+		i := slices.Index(members, member)
+		switch {
+		case slices.Contains(names, g[0]) && i < 0:
+			members = append(members, member)
+		case replace && !slices.Contains(names, g[0]) && i >= 0:
+			members = slices.Delete(members, i, i+1)
+		}
+		g[3] = strings.Join(members, ",")
+	}
+	return 0, nil
+}
+
+// splitMembers splits a group's member list.
+func splitMembers(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+// today returns the current day as days since the epoch, as in /etc/shadow.
+func today() string {
+	return strconv.FormatInt(time.Now().Unix()/86400, 10)
+}
+
+// parseDays converts a chage date (YYYY-MM-DD, a day count or -1) to the
+// /etc/shadow representation.
+func parseDays(v string) (string, error) {
+	if v == "-1" {
+		return "", nil
+	}
+	if _, err := strconv.Atoi(v); err == nil {
+		return v, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return "", fmt.Errorf("invalid date '%s'", v)
+	}
+	return strconv.FormatInt(t.Unix()/86400, 10), nil
+}
+
+// options holds the flags of a fake command: those with values and
+// switches, which map to "".
+type options map[string]string
+
+// get returns the value of the first of keys that is set.
+func (o options) get(keys ...string) string {
+	for _, k := range keys {
+		if v, ok := o[k]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// has reports whether any of keys is set.
+func (o options) has(keys ...string) bool {
+	for _, k := range keys {
+		if _, ok := o[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseArgs splits args into options and the final name operand. Flags in
+// withValue take the next argument; other flags are switches.
+func parseArgs(args []string, withValue ...string) (options, string, error) {
+	opts := make(options)
+	var operands []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			operands = append(operands, arg)
+			continue
+		}
+		if k, v, ok := strings.Cut(arg, "="); ok && strings.HasPrefix(arg, "--") {
+			opts[k] = v
+			continue
+		}
+		if slices.Contains(withValue, arg) {
+			if i+1 >= len(args) {
+				return nil, "", fmt.Errorf("option %s requires a value", arg)
+			}
+			opts[arg] = args[i+1]
+			i++
+			continue
+		}
+		opts[arg] = ""
+	}
+	if len(operands) != 1 {
+		return nil, "", fmt.Errorf("expected one name, got %d", len(operands))
+	}
+	return opts, operands[0], nil
+}
@@ -0,0 +1,230 @@
+// Package tunneltesting runs tunneluser against a fake system, so tests can
+// create, change and delete tunnel users without root.
+//
+// A FakeSystem keeps /etc/passwd, /etc/group and /etc/shadow in a temporary
+// directory that also serves as paths.RootDir, so authorized_keys.d, the
+// sshd drop-ins and the other files tunneluser writes end up there too.
+// Install points tunneluser's CommandExecutor at fake versions of useradd,
+// usermod, userdel, groupadd, groupdel, gpasswd, chpasswd, chage and getent
+// that edit those files. They run in the test binary itself, so the test
+// package must call Main from TestMain:
+//
+//	func TestMain(m *testing.M) { os.Exit(tunneltesting.Main(m)) }
+//
+// Commands without a fake (chown, pkill, ...) succeed without doing
+// anything; pgrep finds no processes. sshd itself is not faked, so
+// functions that validate or reload sshd still need a real one.
+//
+// Tests inside package tunneluser can't import this package; use an
+// external tunneluser_test package.
+package tunneltesting
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/net2share/sshtun-user/pkg/paths"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+)
+
+// helperArg marks a test binary started as a fake command, expiringArg one
+// started for a FakeSystem with ExpireNewPasswords set.
+const (
+	helperArg   = "-tunneltesting.fake"
+	expiringArg = "-tunneltesting.fake-expiring"
+)
+
+// TestKey is a valid public key for key users.
+const TestKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDx4rxRwPmcDDCQJvnU85fC84FIY0xBjUrM6FQrXBkQw test"
+
+// FakeSystem is a scratch system with its own account databases.
+type FakeSystem struct {
+	Root string // Root of the scratch tree, removed when the test ends
+
+	// ExpireNewPasswords makes chpasswd leave passwords expired (last
+	// change 0), like systems whose PAM or login.defs defaults force a
+	// change of passwords set by an administrator.
+	ExpireNewPasswords bool
+
+	t testing.TB
+}
+
+// New creates a fake system holding only root's account. The tunnel groups
+// don't exist yet; tunneluser.EnsureGroups or AddUser create them.
+func New(t testing.TB) *FakeSystem {
+	t.Helper()
+	f := &FakeSystem{Root: t.TempDir(), t: t}
+	files := map[string]string{
+		"passwd": "root:x:0:0:root:/root:/bin/bash\n",
+		"group":  "root:x:0:\n",
+		"shadow": "root:*:19000:0:99999:7:::\n",
+	}
+	if err := os.MkdirAll(filepath.Join(f.Root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(f.Root, "etc", name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return f
+}
+
+// Install makes tunneluser use the fake system until the test ends: it sets
+// paths.RootDir, tunneluser.PasswdFile, GroupFile and ShadowFile, and
+// tunneluser.CommandExecutor. Tests using it must not run in parallel.
+func (f *FakeSystem) Install() {
+	f.t.Helper()
+	rootDir := paths.RootDir
+	executor := tunneluser.CommandExecutor
+	passwd, group, shadow := tunneluser.PasswdFile, tunneluser.GroupFile, tunneluser.ShadowFile
+	f.t.Cleanup(func() {
+		paths.RootDir = rootDir
+		tunneluser.CommandExecutor = executor
+		tunneluser.PasswdFile, tunneluser.GroupFile, tunneluser.ShadowFile = passwd, group, shadow
+		tunneluser.DefaultCache.Invalidate()
+	})
+
+	if err := paths.SetRootDir(f.Root); err != nil {
+		f.t.Fatal(err)
+	}
+	tunneluser.PasswdFile = f.file("passwd")
+	tunneluser.GroupFile = f.file("group")
+	tunneluser.ShadowFile = f.file("shadow")
+	tunneluser.CommandExecutor = f.command
+	tunneluser.DefaultCache.Invalidate()
+}
+
+// command starts the test binary as the fake version of a command. The
+// root is passed as an argument because callers may replace cmd.Env.
+func (f *FakeSystem) command(name string, arg ...string) *exec.Cmd {
+	marker := helperArg
+	if f.ExpireNewPasswords {
+		marker = expiringArg
+	}
+	return exec.Command(os.Args[0], append([]string{marker, f.Root, name}, arg...)...)
+}
+
+// Main runs the tests, or a fake command when the test binary was started
+// by an installed FakeSystem, and returns the exit code for TestMain to
+// pass to os.Exit.
+func Main(m *testing.M) int {
+	if len(os.Args) > 3 && (os.Args[1] == helperArg || os.Args[1] == expiringArg) {
+		c := &fakeCmd{root: os.Args[2], stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr, expireNew: os.Args[1] == expiringArg}
+		return c.run(os.Args[3], os.Args[4:])
+	}
+	return m.Run()
+}
+
+// AddUser creates an account with group as its primary group, creating the
+// group if needed, as useradd does for tunnel users. username gets
+// tunneluser.UserPrefix like other tunneluser arguments. For the tunnel
+// groups the comment records the matching auth mode.
+func (f *FakeSystem) AddUser(username, group string) {
+	f.t.Helper()
+	username = tunneluser.SystemName(username)
+	if _, ok := f.find("group", group); !ok {
+		f.run(nil, "groupadd", group)
+	}
+	args := []string{"--system", "--shell", "/usr/sbin/nologin", "--home-dir", "/nonexistent", "--gid", group}
+	modes := map[string]tunneluser.AuthMode{
+		tunneluser.GroupPasswordAuth: tunneluser.AuthModePassword,
+		tunneluser.GroupKeyAuth:      tunneluser.AuthModeKey,
+		tunneluser.GroupSFTP:         tunneluser.AuthModeSFTP,
+	}
+	if mode, ok := modes[group]; ok {
+		args = append(args, "--comment", tunneluser.UserComment{Mode: mode}.Format())
+	}
+	f.run(nil, "useradd", append(args, username)...)
+}
+
+// SetPassword sets a user's password as chpasswd would.
+func (f *FakeSystem) SetPassword(username, password string) {
+	f.t.Helper()
+	f.run(strings.NewReader(tunneluser.SystemName(username)+":"+password+"\n"), "chpasswd")
+}
+
+// KeyFile returns the path of username's central key file. username gets
+// tunneluser.UserPrefix like other tunneluser arguments.
+func (f *FakeSystem) KeyFile(username string) string {
+	return filepath.Join(f.Root, tunneluser.AuthorizedKeysDir, tunneluser.SystemName(username))
+}
+
+// AssertUserExists fails the test if the account of username doesn't exist.
+func (f *FakeSystem) AssertUserExists(t testing.TB, username string) {
+	t.Helper()
+	if _, ok := f.find("passwd", tunneluser.SystemName(username)); !ok {
+		t.Errorf("user %s does not exist", tunneluser.SystemName(username))
+	}
+}
+
+// AssertUserNotExists fails the test if the account of username exists.
+func (f *FakeSystem) AssertUserNotExists(t testing.TB, username string) {
+	t.Helper()
+	if _, ok := f.find("passwd", tunneluser.SystemName(username)); ok {
+		t.Errorf("user %s exists", tunneluser.SystemName(username))
+	}
+}
+
+// AssertGroupNotExists fails the test if group exists.
+func (f *FakeSystem) AssertGroupNotExists(t testing.TB, group string) {
+	t.Helper()
+	if _, ok := f.find("group", group); ok {
+		t.Errorf("group %s exists", group)
+	}
+}
+
+// AssertInGroup fails the test unless username's account has group as its
+// primary group or is a supplementary member of it.
+func (f *FakeSystem) AssertInGroup(t testing.TB, username, group string) {
+	t.Helper()
+	account := tunneluser.SystemName(username)
+	g, ok := f.find("group", group)
+	if !ok {
+		t.Errorf("group %s does not exist", group)
+		return
+	}
+	if slices.Contains(strings.Split(g[3], ","), account) {
+		return
+	}
+	if u, ok := f.find("passwd", account); !ok || u[3] != g[2] {
+		t.Errorf("user %s is not in group %s", account, group)
+	}
+}
+
+// file returns the path of an account database.
+func (f *FakeSystem) file(name string) string {
+	return filepath.Join(f.Root, "etc", name)
+}
+
+// find returns the fields of the entry for name in an account database.
+func (f *FakeSystem) find(db, name string) ([]string, bool) {
+	f.t.Helper()
+	entries, err := readDB(f.file(db))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	i := findEntry(entries, name)
+	if i < 0 {
+		return nil, false
+	}
+	return entries[i], true
+}
+
+// run runs a fake command in-process and fails the test if it fails.
+func (f *FakeSystem) run(stdin *strings.Reader, name string, args ...string) {
+	f.t.Helper()
+	var stderr bytes.Buffer
+	c := &fakeCmd{root: f.Root, stdin: strings.NewReader(""), stdout: &bytes.Buffer{}, stderr: &stderr, expireNew: f.ExpireNewPasswords}
+	if stdin != nil {
+		c.stdin = stdin
+	}
+	if status := c.run(name, args); status != 0 {
+		f.t.Fatalf("%s %s: exit status %d: %s", name, strings.Join(args, " "), status, strings.TrimSpace(stderr.String()))
+	}
+}
@@ -0,0 +1,46 @@
+package tunneluser
+
+import (
+	"sync"
+	"time"
+)
+
+// Cache holds the result of List for a limited time, so callers that ask
+// repeatedly (menu redraws, monitoring loops) don't re-read /etc/group and
+// /etc/passwd on every call. Create, Reconcile, Delete, SwitchAuthMode,
+// DeleteGroups and a change of SetGroupNames invalidate DefaultCache. Changes made by other processes
+// show up once the cached result is older than maxAge.
+type Cache struct {
+	mu      sync.Mutex
+	users   []UserInfo
+	fetched time.Time
+}
+
+// DefaultCache is the cache invalidated by this package's write operations.
+var DefaultCache = &Cache{}
+
+// List returns the cached tunnel users if they were read less than maxAge
+// ago, and calls List otherwise. The returned slice is a copy.
+func (c *Cache) List(maxAge time.Duration) ([]UserInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.fetched.IsZero() || time.Since(c.fetched) >= maxAge {
+		users, err := List()
+		if err != nil {
+			return nil, err
+		}
+		c.users = users
+		c.fetched = time.Now()
+	}
+	return append([]UserInfo(nil), c.users...), nil
+}
+
+// Invalidate drops the cached result, so the next List reads the system
+// files again.
+func (c *Cache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users = nil
+	c.fetched = time.Time{}
+}
@@ -0,0 +1,183 @@
+package tunneluser
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// MaxNoteLength is the longest note SetNote and Create accept.
+const MaxNoteLength = 200
+
+const (
+	commentPrefix  = "SSH tunnel only"
+	commentCreated = "created "
+	commentNote    = "note="
+	commentVersion = "sshtun-user-v"
+	commentDate    = "2006-01-02"
+)
+
+// UserComment is the information sshtun-user keeps in the comment (GECOS)
+// field of /etc/passwd, e.g.
+//
+//	SSH tunnel only (password); created 2026-10-16; sshtun-user-v1.4.0; note=alice's phone
+//
+// Users created by older versions only have the first part, or lack the
+// version.
+type UserComment struct {
+	Mode    AuthMode
+	Created time.Time // Zero when not recorded
+	Version string    // sshtun-user version that created or last migrated the user, without "v"
+	Note    string
+}
+
+// ValidateNote checks that a note can be stored in the comment field, which
+// must not contain ':' or line breaks.
+func ValidateNote(note string) error {
+	if len(note) > MaxNoteLength {
+		return fmt.Errorf("note is longer than %d characters", MaxNoteLength)
+	}
+	if strings.Contains(note, ":") {
+		return fmt.Errorf("note must not contain ':'")
+	}
+	if strings.IndexFunc(note, unicode.IsControl) >= 0 {
+		return fmt.Errorf("note must not contain control characters")
+	}
+	return nil
+}
+
+// Format encodes the comment for the GECOS field. ParseComment reverses it.
+// The note is written last so it may contain the '; ' separator.
+func (c UserComment) Format() string {
+	s := fmt.Sprintf("%s (%s)", commentPrefix, c.Mode)
+	if !c.Created.IsZero() {
+		s += "; " + commentCreated + c.Created.Format(commentDate)
+	}
+	if v := strings.TrimPrefix(c.Version, "v"); v != "" {
+		s += "; " + commentVersion + v
+	}
+	if note := strings.TrimSpace(c.Note); note != "" {
+		s += "; " + commentNote + note
+	}
+	return s
+}
+
+// ParseComment decodes a GECOS field written by UserComment.Format. Fields
+// it doesn't recognize are ignored, so comments set by hand or by older
+// versions parse as far as possible.
+func ParseComment(gecos string) UserComment {
+	var c UserComment
+	rest := gecos
+	for rest != "" {
+		field := rest
+		if strings.HasPrefix(field, commentNote) {
+			c.Note = strings.TrimPrefix(field, commentNote)
+			break
+		}
+		if i := strings.Index(rest, "; "); i >= 0 {
+			field, rest = rest[:i], rest[i+2:]
+		} else {
+			rest = ""
+		}
+
+		switch {
+		case strings.HasPrefix(field, commentPrefix+" (") && strings.HasSuffix(field, ")"):
+			c.Mode = AuthMode(strings.TrimSuffix(strings.TrimPrefix(field, commentPrefix+" ("), ")"))
+		case strings.HasPrefix(field, commentVersion):
+			c.Version = strings.TrimPrefix(field, commentVersion)
+		case strings.HasPrefix(field, commentCreated):
+			if t, err := time.Parse(commentDate, strings.TrimPrefix(field, commentCreated)); err == nil {
+				c.Created = t
+			}
+		}
+	}
+	return c
+}
+
+// ReadComment returns the parsed comment field of a user.
+func ReadComment(username string) (UserComment, error) {
+	return readComment(SystemName(username))
+}
+
+// readComment is ReadComment for an account name.
+func readComment(username string) (UserComment, error) {
+	gecos, err := passwdField(username, 4)
+	if err != nil {
+		return UserComment{}, err
+	}
+	return ParseComment(gecos), nil
+}
+
+// SetNote replaces the note in a tunnel user's comment, keeping the other
+// fields. An empty note removes it.
+func SetNote(username, note string) error {
+	return setNote(SystemName(username), note)
+}
+
+// setNote is SetNote for an account name.
+func setNote(username, note string) error {
+	if err := ValidateNote(note); err != nil {
+		return err
+	}
+	if err := checkNotPrivileged(username); err != nil {
+		return err
+	}
+	c, err := readComment(username)
+	if err != nil {
+		return err
+	}
+	c.Note = note
+	if c.Mode == "" {
+		if c.Mode, err = getAuthMode(username); err != nil && !errors.Is(err, ErrAmbiguousAuthMode) {
+			return err
+		}
+	}
+	return writeComment(username, c)
+}
+
+// setCommentMode records a new auth mode in the user's comment, keeping the
+// creation date and note. Comments not written by sshtun-user are left alone.
+func setCommentMode(username string, mode AuthMode) error {
+	c, err := readComment(username)
+	if err != nil {
+		return err
+	}
+	if c.Mode == "" || c.Mode == mode {
+		return nil
+	}
+	c.Mode = mode
+	return writeComment(username, c)
+}
+
+func writeComment(username string, c UserComment) error {
+	if err := CommandExecutor("usermod", "--comment", c.Format(), username).Run(); err != nil {
+		return fmt.Errorf("failed to set comment: %w", err)
+	}
+	return nil
+}
+
+// passwdField returns field i (0-based) of a user's /etc/passwd entry.
+func passwdField(username string, i int) (string, error) {
+	file, err := os.Open(PasswdFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Format: username:password:UID:GID:GECOS:home:shell
+		parts, ok := dbFields(scanner.Text(), 7)
+		if ok && parts[0] == username {
+			return parts[i], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("user '%s' not found in /etc/passwd", username)
+}
@@ -0,0 +1,80 @@
+package tunneluser_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/net2share/sshtun-user/pkg/tunneltesting"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+)
+
+func TestCommentRoundTrip(t *testing.T) {
+	created := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		comment tunneluser.UserComment
+	}{
+		{name: "mode only", comment: tunneluser.UserComment{Mode: tunneluser.AuthModeKey}},
+		{name: "all fields", comment: tunneluser.UserComment{Mode: tunneluser.AuthModePassword, Created: created, Version: "1.4.0", Note: "alice's phone"}},
+		{name: "separator in note", comment: tunneluser.UserComment{Mode: tunneluser.AuthModeSFTP, Created: created, Note: "team a; created 2020-01-01; sshtun-user-v0.1"}},
+		{name: "field prefix in note", comment: tunneluser.UserComment{Mode: tunneluser.AuthModeKey, Version: "2.0.0", Note: "note=x, y=z"}},
+		{name: "non-ASCII note", comment: tunneluser.UserComment{Mode: tunneluser.AuthModePassword, Note: "Zoë's téléphone — 電話 📱"}},
+		{name: "note without other fields", comment: tunneluser.UserComment{Mode: tunneluser.AuthModeKey, Note: "vpn, backup"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tunneluser.ValidateNote(tt.comment.Note); err != nil {
+				t.Fatalf("ValidateNote(%q): %v", tt.comment.Note, err)
+			}
+			gecos := tt.comment.Format()
+			if strings.ContainsAny(gecos, ":\n") {
+				t.Fatalf("Format() = %q, which breaks /etc/passwd", gecos)
+			}
+			if got := tunneluser.ParseComment(gecos); got != tt.comment {
+				t.Errorf("ParseComment(%q) = %+v, want %+v", gecos, got, tt.comment)
+			}
+		})
+	}
+}
+
+func TestParseCommentNormalizes(t *testing.T) {
+	tests := []struct {
+		gecos string
+		want  tunneluser.UserComment
+	}{
+		{gecos: "SSH tunnel only (password)", want: tunneluser.UserComment{Mode: tunneluser.AuthModePassword}},
+		{gecos: "SSH tunnel only (key); created not-a-date; owner", want: tunneluser.UserComment{Mode: tunneluser.AuthModeKey}},
+		{gecos: "Alice Example,,,", want: tunneluser.UserComment{}},
+		{gecos: "", want: tunneluser.UserComment{}},
+	}
+	for _, tt := range tests {
+		if got := tunneluser.ParseComment(tt.gecos); got != tt.want {
+			t.Errorf("ParseComment(%q) = %+v, want %+v", tt.gecos, got, tt.want)
+		}
+	}
+	// Format drops a "v" prefix and surrounding spaces in the note
+	c := tunneluser.UserComment{Mode: tunneluser.AuthModeKey, Version: "v1.2.3", Note: "  laptop  "}
+	want := tunneluser.UserComment{Mode: tunneluser.AuthModeKey, Version: "1.2.3", Note: "laptop"}
+	if got := tunneluser.ParseComment(c.Format()); got != want {
+		t.Errorf("ParseComment(%q) = %+v, want %+v", c.Format(), got, want)
+	}
+}
+
+func TestSetNoteRoundTrip(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+	createUser(t, "alice", tunneluser.AuthModePassword)
+
+	note := "Zoë; téléphone 電話"
+	if err := tunneluser.SetNote("alice", note); err != nil {
+		t.Fatalf("SetNote: %v", err)
+	}
+	c, err := tunneluser.ReadComment("alice")
+	if err != nil {
+		t.Fatalf("ReadComment: %v", err)
+	}
+	if c.Note != note || c.Mode != tunneluser.AuthModePassword {
+		t.Errorf("ReadComment = %+v, want note %q and password mode", c, note)
+	}
+}
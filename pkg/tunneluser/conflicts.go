@@ -0,0 +1,163 @@
+package tunneluser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// ErrAmbiguousAuthMode is returned by GetAuthMode for a user in more than
+// one tunnel group, e.g. after a manual gpasswd -a. sshd applies the Match
+// blocks of all of them, so such a user may log in other than intended.
+var ErrAmbiguousAuthMode = errors.New("user is in more than one tunnel group")
+
+// warnOut receives warnings about users in more than one tunnel group. It is
+// stderr so List's callers can print machine-readable output to stdout.
+var warnOut io.Writer = os.Stderr
+
+// authModeOrder is the precedence of the tunnel groups: a user in several
+// counts as the first.
+var authModeOrder = []AuthMode{AuthModePassword, AuthModeKey, AuthModeSFTP}
+
+// Conflict is a user in more than one tunnel group.
+type Conflict struct {
+	Username string     `json:"username"` // Without UserPrefix, as in UserInfo
+	Modes    []AuthMode `json:"modes"`    // In order of precedence, see GetAuthMode
+}
+
+// String formats the conflict as "username (mode, mode)".
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s (%s)", c.Username, joinModes(c.Modes))
+}
+
+// FindConflicts returns the users in the UserPrefix namespace that are in
+// more than one tunnel group.
+func FindConflicts() ([]Conflict, error) {
+	members := make(map[AuthMode][]string)
+	for _, mode := range authModeOrder {
+		users, err := groupUsers(groupForMode(mode))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %s users: %w", mode, err)
+		}
+		members[mode] = users
+	}
+	return findConflicts(members), nil
+}
+
+// findConflicts returns the users whose accounts are listed for more than
+// one mode in members, in the order they first appear.
+func findConflicts(members map[AuthMode][]string) []Conflict {
+	var order []string
+	modes := make(map[string][]AuthMode)
+	for _, mode := range authModeOrder {
+		for _, account := range members[mode] {
+			username, ok := LogicalName(account)
+			if !ok {
+				continue
+			}
+			if _, ok := modes[username]; !ok {
+				order = append(order, username)
+			}
+			// A user can be listed twice for a group, as member and by GID
+			if n := len(modes[username]); n == 0 || modes[username][n-1] != mode {
+				modes[username] = append(modes[username], mode)
+			}
+		}
+	}
+
+	var conflicts []Conflict
+	for _, username := range order {
+		if len(modes[username]) > 1 {
+			conflicts = append(conflicts, Conflict{Username: username, Modes: modes[username]})
+		}
+	}
+	return conflicts
+}
+
+// warnConflicts prints a warning for each conflict to warnOut.
+func warnConflicts(conflicts []Conflict) {
+	for _, c := range conflicts {
+		fmt.Fprintf(warnOut, "Warning: user '%s' is in more than one tunnel group (%s), treated as %s; run 'sshtun-user repair'\n",
+			c.Username, joinModes(c.Modes), c.Modes[0])
+	}
+}
+
+// authModes returns the modes of all tunnel groups username is in, in order
+// of precedence.
+func authModes(username string) []AuthMode {
+	var modes []AuthMode
+	for _, mode := range authModeOrder {
+		if in, _ := isInGroup(username, groupForMode(mode)); in {
+			modes = append(modes, mode)
+		}
+	}
+	return modes
+}
+
+// credentialMode returns the auth mode a user's credentials point to: key
+// when they have a key file and no usable password in /etc/shadow, password
+// for the reverse. It returns "" when they have both or neither.
+func credentialMode(username string) AuthMode {
+	hasKey := existingKeyFile(username) != ""
+	hash, err := shadowHash(username)
+	hasPassword := err == nil && hash != "" && !strings.HasPrefix(hash, "!") && !strings.HasPrefix(hash, "*")
+	switch {
+	case hasKey && !hasPassword:
+		return AuthModeKey
+	case hasPassword && !hasKey:
+		return AuthModePassword
+	}
+	return ""
+}
+
+// FixConflicts keeps each user in more than one tunnel group only in the
+// group matching their credentials, see credentialMode, and returns what it
+// changed. Users whose credentials don't settle it, e.g. a password user
+// who is also in the SFTP group, are returned as unresolved and left alone.
+// Running it again changes nothing.
+func FixConflicts() (fixed []string, unresolved []Conflict, err error) {
+	defer DefaultCache.Invalidate()
+
+	conflicts, err := FindConflicts()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, c := range conflicts {
+		account := SystemName(c.Username)
+		if err := checkNotPrivileged(account); err != nil {
+			unresolved = append(unresolved, c)
+			continue
+		}
+		keep := credentialMode(account)
+		// An SFTP-only user has a password too, so the credentials can't
+		// tell password and SFTP apart
+		if !slices.Contains(c.Modes, keep) || (keep == AuthModePassword && slices.Contains(c.Modes, AuthModeSFTP)) {
+			unresolved = append(unresolved, c)
+			continue
+		}
+
+		if err := moveToGroup(account, groupForMode(keep)); err != nil {
+			return fixed, unresolved, err
+		}
+		var removed []string
+		for _, mode := range c.Modes {
+			if mode != keep {
+				removed = append(removed, groupForMode(mode))
+			}
+		}
+		fixed = append(fixed, fmt.Sprintf("%s: kept in %s, removed from %s", c.Username, groupForMode(keep), strings.Join(removed, ", ")))
+	}
+	return fixed, unresolved, nil
+}
+
+// joinModes formats auth modes as a list.
+func joinModes(modes []AuthMode) string {
+	s := make([]string, len(modes))
+	for i, m := range modes {
+		s[i] = string(m)
+	}
+	return strings.Join(s, ", ")
+}
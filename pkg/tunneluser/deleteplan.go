@@ -0,0 +1,97 @@
+package tunneluser
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/net2share/sshtun-user/pkg/paths"
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+)
+
+// Plan describes what Delete would remove for a user. Paths are only set
+// for files that exist.
+type Plan struct {
+	Username   string   `json:"username"`
+	UID        string   `json:"uid"`
+	AuthMode   AuthMode `json:"auth_mode"`
+	Disabled   bool     `json:"disabled"`              // See IsDisabled
+	Groups     []string `json:"groups"`                // Tunnel groups the user is removed from
+	KeyFile    string   `json:"key_file,omitempty"`    // Public key file
+	UserConfig string   `json:"user_config,omitempty"` // Per-user sshd drop-in
+	SFTPHome   string   `json:"sftp_home,omitempty"`   // Removed only if empty
+	DenyFiles  []string `json:"deny_files,omitempty"`  // cron/at deny files listing the user
+	Processes  []string `json:"processes,omitempty"`   // Processes killed, e.g. tunnel sessions ("pid command")
+}
+
+// DeletePlan returns what Delete would remove for username without changing
+// anything. It fails where Delete would, e.g. for non-tunnel or admin users.
+func DeletePlan(username string) (Plan, error) {
+	username = SystemName(username)
+	plan := Plan{Username: username}
+
+	mode, err := getAuthMode(username)
+	if err != nil && !errors.Is(err, ErrAmbiguousAuthMode) {
+		return plan, err
+	}
+	plan.AuthMode = mode
+
+	if err := checkNotPrivileged(username); err != nil {
+		return plan, err
+	}
+
+	if u, err := lookupUser(username); err == nil {
+		plan.UID = u.Uid
+	}
+	plan.Disabled, _ = isDisabled(username, mode)
+
+	for _, group := range tunnelGroups() {
+		if in, _ := isInGroup(username, group); in {
+			plan.Groups = append(plan.Groups, group)
+		}
+	}
+
+	if path := existingKeyFile(username); path != "" {
+		plan.KeyFile = path
+	}
+	if path := sshdconfig.UserConfigPath(username); fileExists(path) {
+		plan.UserConfig = path
+	}
+	if path := filepath.Join(sftpRoot(), username); fileExists(path) {
+		plan.SFTPHome = path
+	}
+
+	for _, files := range scheduledTaskFiles {
+		if SkipDenyFiles {
+			break
+		}
+		data, err := os.ReadFile(paths.Join(files.deny))
+		if err != nil {
+			continue
+		}
+		for _, line := range splitLines(string(data)) {
+			if line == username {
+				plan.DenyFiles = append(plan.DenyFiles, paths.Join(files.deny))
+				break
+			}
+		}
+	}
+
+	// pgrep exits 1 when nothing matches
+	if output, err := CommandExecutor("pgrep", "-a", "-u", username).Output(); err == nil {
+		for _, line := range splitLines(string(output)) {
+			if line = strings.TrimSpace(line); line != "" {
+				plan.Processes = append(plan.Processes, line)
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+// fileExists reports whether path exists.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
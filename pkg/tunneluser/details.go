@@ -0,0 +1,123 @@
+package tunneluser
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// UserStatus summarizes whether a tunnel user can currently log in.
+type UserStatus string
+
+const (
+	StatusActive  UserStatus = "active"
+	StatusLocked  UserStatus = "locked"  // Password auth user with a locked password
+	StatusExpired UserStatus = "expired" // Account expiry date has passed
+	StatusNoKey   UserStatus = "no-key"  // Key auth user without any public key
+	StatusUnknown UserStatus = "unknown" // State could not be read (e.g. not root)
+)
+
+// UserDetails extends UserInfo with the state shown by `list`.
+type UserDetails struct {
+	UserInfo
+	Status   UserStatus `json:"status"`
+	KeyCount int        `json:"key_count"`
+	Keys     []KeyInfo  `json:"keys,omitempty"`
+	Created  *time.Time `json:"created,omitempty"` // From the account comment; unset for older users
+	Note     string     `json:"note,omitempty"`
+}
+
+// ListDetailed returns all tunnel users with their status, expiry date and
+// public keys. Fields that can't be read are left empty and the
+// status is StatusUnknown.
+func ListDetailed() ([]UserDetails, error) {
+	return ListDetailedByAuthMode("")
+}
+
+// ListDetailedByAuthMode is ListDetailed for the users ListByAuthMode
+// returns.
+func ListDetailedByAuthMode(mode AuthMode) ([]UserDetails, error) {
+	users, err := ListByAuthMode(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	details := make([]UserDetails, 0, len(users))
+	for _, u := range users {
+		account := SystemName(u.Username)
+		d := UserDetails{UserInfo: u, Status: StatusActive}
+		d.KeyCount = countKeys(account)
+		d.Keys, _ = keyFingerprints(account)
+		if c, err := readComment(account); err == nil {
+			d.Note = c.Note
+			if !c.Created.IsZero() {
+				d.Created = &c.Created
+			}
+		}
+
+		expires, ok, err := accountExpiry(account)
+		switch {
+		case err != nil:
+			d.Status = StatusUnknown
+		case ok:
+			d.ExpiresAt = &expires
+			if expires.Before(time.Now()) {
+				d.Status = StatusExpired
+			}
+		}
+
+		if d.Status == StatusActive {
+			switch disabled, err := isDisabled(account, u.AuthMode); {
+			case err != nil:
+				d.Status = StatusUnknown
+			case disabled && u.AuthMode == AuthModeKey:
+				d.Status = StatusNoKey
+			case disabled:
+				d.Status = StatusLocked
+			}
+		}
+
+		details = append(details, d)
+	}
+	return details, nil
+}
+
+// IsDisabled reports whether a tunnel user can't log in with the credential
+// of their auth mode: password and SFTP-only users whose password is locked
+// ("!" prefix in /etc/shadow, as set by usermod -L), key users without a
+// public key. A "*" placeholder, as some tools give new accounts without a
+// password, is not a lock and isn't reported. Account expiry is not
+// considered; see AccountExpiry. Reading /etc/shadow requires root.
+func IsDisabled(username string) (bool, error) {
+	username = SystemName(username)
+	mode, err := getAuthMode(username)
+	if err != nil && !errors.Is(err, ErrAmbiguousAuthMode) {
+		return false, err
+	}
+	return isDisabled(username, mode)
+}
+
+// isDisabled is IsDisabled for a user whose auth mode is known.
+func isDisabled(username string, mode AuthMode) (bool, error) {
+	if mode == AuthModeKey {
+		return countKeys(username) == 0, nil
+	}
+	return isPasswordLocked(username)
+}
+
+// countKeys returns the number of public keys in the user's key file.
+func countKeys(username string) int {
+	data, err := os.ReadFile(existingKeyFile(username))
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			n++
+		}
+	}
+	return n
+}
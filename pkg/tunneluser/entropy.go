@@ -0,0 +1,42 @@
+package tunneluser
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// MinEntropyBits is the kernel entropy estimate below which
+// CheckEntropyAvailable reports low entropy.
+const MinEntropyBits = 256
+
+// entropyAvailFile holds the kernel's entropy estimate in bits.
+const entropyAvailFile = "/proc/sys/kernel/random/entropy_avail"
+
+// ErrLowEntropy is returned by CheckEntropyAvailable when the kernel's
+// entropy estimate is below MinEntropyBits.
+var ErrLowEntropy = errors.New("low entropy")
+
+// EntropyAdvice explains how to fix low entropy.
+const EntropyAdvice = "random number generation may block or stall; install haveged or rng-tools to feed the kernel entropy pool"
+
+// CheckEntropyAvailable reads the kernel's entropy estimate and returns an
+// error wrapping ErrLowEntropy if it is below MinEntropyBits, e.g. on a
+// busy VM during boot. It returns nil if the estimate can't be read, as in
+// some containers.
+func CheckEntropyAvailable() error {
+	data, err := os.ReadFile(entropyAvailFile)
+	if err != nil {
+		return nil
+	}
+	bits, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil
+	}
+	if bits < MinEntropyBits {
+		return fmt.Errorf("%w: %d bits available, %d recommended", ErrLowEntropy, bits, MinEntropyBits)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package tunneluser
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// chageDateLayout is the date format of `chage -l` in the C locale.
+const chageDateLayout = "Jan 02, 2006"
+
+// AccountExpiry returns the account expiry date of a user as reported by
+// `chage -l`. The boolean is false when the account never expires.
+func AccountExpiry(username string) (time.Time, bool, error) {
+	return accountExpiry(SystemName(username))
+}
+
+// accountExpiry is AccountExpiry for an account name.
+func accountExpiry(username string) (time.Time, bool, error) {
+	cmd := CommandExecutor("chage", "-l", username)
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	output, err := cmd.Output()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to read expiry for '%s': %w", username, err)
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(key) != "Account expires" {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if value == "never" {
+			return time.Time{}, false, nil
+		}
+		expires, err := time.ParseInLocation(chageDateLayout, value, time.Local)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("failed to parse expiry %q: %w", value, err)
+		}
+		return expires, true, nil
+	}
+	return time.Time{}, false, fmt.Errorf("no account expiry in chage output for '%s'", username)
+}
+
+// ExpiringWithin returns the tunnel users whose accounts expire within d from
+// now, including accounts that have already expired, soonest first. Users
+// without an expiry date are excluded. Reading expiry requires root.
+func ExpiringWithin(d time.Duration) ([]UserInfo, error) {
+	users, err := List()
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(d)
+	var expiring []UserInfo
+	for _, u := range users {
+		expires, ok, err := accountExpiry(SystemName(u.Username))
+		if err != nil {
+			return nil, err
+		}
+		if !ok || expires.After(deadline) {
+			continue
+		}
+		u.ExpiresAt = &expires
+		expiring = append(expiring, u)
+	}
+
+	sort.Slice(expiring, func(i, j int) bool {
+		return expiring[i].ExpiresAt.Before(*expiring[j].ExpiresAt)
+	})
+	return expiring, nil
+}
+
+// DefaultExpiryWarningDays is how many days ahead state --summary warns
+// about expiring accounts.
+const DefaultExpiryWarningDays = 7
+
+// GetExpiringUsers returns the tunnel users whose accounts expire within the
+// given number of days, as ExpiringWithin does.
+func GetExpiringUsers(withinDays int) ([]UserInfo, error) {
+	if withinDays < 0 {
+		return nil, fmt.Errorf("invalid number of days %d: must not be negative", withinDays)
+	}
+	return ExpiringWithin(time.Duration(withinDays) * 24 * time.Hour)
+}
+
+// SetExpiry sets the account expiry date of a tunnel user. The date must be
+// in the future.
+func SetExpiry(username string, expires time.Time) error {
+	return setExpiry(SystemName(username), expires)
+}
+
+// setExpiry is SetExpiry for an account name.
+func setExpiry(username string, expires time.Time) error {
+	if !isTunnelUser(username) {
+		return fmt.Errorf("user '%s' is not a tunnel user", username)
+	}
+	if err := checkNotPrivileged(username); err != nil {
+		return err
+	}
+	if !expires.After(time.Now()) {
+		return fmt.Errorf("expiry date %s is not in the future", expires.Format("2006-01-02"))
+	}
+
+	if err := CommandExecutor("chage", "-E", expires.Format("2006-01-02"), username).Run(); err != nil {
+		return fmt.Errorf("failed to set expiry: %w", err)
+	}
+	return nil
+}
+
+// ExtendExpiry pushes a tunnel user's expiry date back by d, counting from the
+// current expiry if it is still in the future and from now otherwise. It
+// returns the new expiry date.
+func ExtendExpiry(username string, d time.Duration) (time.Time, error) {
+	username = SystemName(username)
+	if d <= 0 {
+		return time.Time{}, fmt.Errorf("extension must be positive")
+	}
+
+	base := time.Now()
+	if current, ok, err := accountExpiry(username); err != nil {
+		return time.Time{}, err
+	} else if ok && current.After(base) {
+		base = current
+	}
+
+	expires := base.Add(d)
+	if err := setExpiry(username, expires); err != nil {
+		return time.Time{}, err
+	}
+	return expires, nil
+}
@@ -0,0 +1,64 @@
+package tunneluser
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DefaultHomeDir is the home directory of tunnel users without a real home.
+const DefaultHomeDir = "/nonexistent"
+
+// homeDir returns the home directory a user should have.
+func homeDir(cfg *Config) string {
+	switch {
+	case cfg.AuthMode == AuthModeSFTP:
+		return sftpOnlyHome(cfg.Username)
+	case cfg.HomeDir != "":
+		return cfg.HomeDir
+	case cfg.EnableSFTP:
+		return filepath.Join(sftpRoot(), cfg.Username)
+	case needsPerUserHome(cfg):
+		return filepath.Join(perUserHomeRoot(), cfg.Username)
+	}
+	return DefaultHomeDir
+}
+
+// validateHome checks the home directory settings of cfg.
+func validateHome(cfg *Config) error {
+	if cfg.HomeDir != "" && !filepath.IsAbs(cfg.HomeDir) {
+		return fmt.Errorf("home directory must be an absolute path: %s", cfg.HomeDir)
+	}
+	if cfg.CreateHome {
+		if cfg.HomeDir == "" || cfg.HomeDir == DefaultHomeDir {
+			return fmt.Errorf("creating a home directory requires a home directory path")
+		}
+		if cfg.EnableSFTP {
+			// The SFTP chroot must stay root-owned
+			return fmt.Errorf("a user-owned home directory can't be combined with SFTP access")
+		}
+	}
+	return nil
+}
+
+// setupHomeDir makes the user the owner of their home directory, readable
+// only by them and their group.
+func setupHomeDir(cfg *Config) error {
+	home := homeDir(cfg)
+	if err := os.MkdirAll(home, 0750); err != nil {
+		return fmt.Errorf("failed to create home directory: %w", err)
+	}
+	if err := CommandExecutor("chown", "-R", cfg.Username+":", home).Run(); err != nil {
+		return fmt.Errorf("failed to set home directory ownership: %w", err)
+	}
+	if err := os.Chmod(home, 0750); err != nil {
+		return fmt.Errorf("failed to set home directory permissions: %w", err)
+	}
+	// Keep per-user keys root-owned, see setupPerUserKeyDir
+	if fileExists(perUserKeyFile(home)) {
+		if err := CommandExecutor("chown", "-R", "root:root", filepath.Join(home, ".ssh")).Run(); err != nil {
+			return fmt.Errorf("failed to set ~/.ssh ownership: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package tunneluser
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Modes required for the central key layout: sshd ignores key files that
+// are writable by anyone but root.
+const (
+	keyDirMode  os.FileMode = 0755
+	keyFileMode os.FileMode = 0644
+)
+
+// AuditKeyFilePermissions checks that AuthorizedKeysDir and every file in
+// it is owned by root:root, with mode 0755 for the directory and 0644 for
+// the files, as SetupSSHKey leaves them. It returns one line per anomaly;
+// a missing directory has none.
+func AuditKeyFilePermissions() ([]string, error) {
+	return auditKeyFiles(false)
+}
+
+// FixKeyFilePermissions resets the ownership and mode of everything
+// AuditKeyFilePermissions reports and returns what it changed.
+func FixKeyFilePermissions() ([]string, error) {
+	return auditKeyFiles(true)
+}
+
+// auditKeyFiles implements AuditKeyFilePermissions, fixing each anomaly
+// when fix is set.
+func auditKeyFiles(fix bool) ([]string, error) {
+	keysDir := authorizedKeysDir()
+	info, err := os.Lstat(keysDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", keysDir, err)
+	}
+	if !info.IsDir() {
+		return []string{keysDir + " is not a directory"}, nil
+	}
+
+	var anomalies []string
+	check := func(path string, info os.FileInfo, want os.FileMode) error {
+		problem := ""
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && (stat.Uid != 0 || stat.Gid != 0) {
+			problem = fmt.Sprintf("owned by %d:%d, want root:root", stat.Uid, stat.Gid)
+		}
+		if mode := info.Mode().Perm(); mode != want {
+			if problem != "" {
+				problem += ", "
+			}
+			problem += fmt.Sprintf("mode %04o, want %04o", mode, want)
+		}
+		if problem == "" {
+			return nil
+		}
+		anomalies = append(anomalies, path+": "+problem)
+		if !fix {
+			return nil
+		}
+		if err := os.Chown(path, 0, 0); err != nil {
+			return fmt.Errorf("failed to set ownership of %s: %w", path, err)
+		}
+		if err := os.Chmod(path, want); err != nil {
+			return fmt.Errorf("failed to set mode of %s: %w", path, err)
+		}
+		return nil
+	}
+
+	if err := check(keysDir, info, keyDirMode); err != nil {
+		return anomalies, err
+	}
+	entries, err := os.ReadDir(keysDir)
+	if err != nil {
+		return anomalies, fmt.Errorf("failed to read %s: %w", keysDir, err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(keysDir, entry.Name())
+		info, err := os.Lstat(path)
+		if err != nil {
+			return anomalies, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if !info.Mode().IsRegular() {
+			// Not something chown/chmod can make acceptable; report only
+			anomalies = append(anomalies, path+": not a regular file")
+			continue
+		}
+		if err := check(path, info, keyFileMode); err != nil {
+			return anomalies, err
+		}
+	}
+	return anomalies, nil
+}
@@ -0,0 +1,104 @@
+package tunneluser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultKeyOptions allows port forwarding and nothing else: "restrict"
+// disables every feature, "port-forwarding" re-enables just that.
+const DefaultKeyOptions = "restrict,port-forwarding"
+
+// KeyOptions is the authorized_keys options list written in front of tunnel
+// user keys. Change it with SetKeyOptions. Options beyond the default can
+// widen what key users may do (e.g. "pty" or "agent-forwarding"); sshd's
+// Match blocks still apply on top.
+var KeyOptions = DefaultKeyOptions
+
+// keyOptionFlags are the authorized_keys options that take no value.
+var keyOptionFlags = map[string]bool{
+	"restrict": true, "cert-authority": true,
+	"agent-forwarding": true, "no-agent-forwarding": true,
+	"port-forwarding": true, "no-port-forwarding": true,
+	"pty": true, "no-pty": true,
+	"user-rc": true, "no-user-rc": true,
+	"X11-forwarding": true, "no-X11-forwarding": true,
+	"no-touch-required": true, "verify-required": true,
+}
+
+// keyOptionValues are the authorized_keys options written as name="value".
+var keyOptionValues = map[string]bool{
+	"command": true, "environment": true, "expiry-time": true, "from": true,
+	"permitlisten": true, "permitopen": true, "principals": true, "tunnel": true,
+}
+
+// SetKeyOptions sets the options written in front of tunnel user keys.
+// Existing key files are rewritten the next time the user's key is set.
+func SetKeyOptions(opts string) error {
+	if err := ValidateKeyOptions(opts); err != nil {
+		return err
+	}
+	KeyOptions = opts
+	return nil
+}
+
+// ValidateKeyOptions checks a comma-separated authorized_keys options list
+// against the options sshd knows, so a typo such as "port-forwardig" is
+// rejected instead of making sshd ignore the key.
+func ValidateKeyOptions(opts string) error {
+	if opts == "" {
+		return fmt.Errorf("key options must not be empty (default %q)", DefaultKeyOptions)
+	}
+	tokens, err := splitKeyOptions(opts)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		name, value, hasValue := strings.Cut(token, "=")
+		switch {
+		case keyOptionFlags[name] && !hasValue:
+		case keyOptionValues[name] && hasValue:
+			if len(value) < 2 || !strings.HasPrefix(value, `"`) || !strings.HasSuffix(value, `"`) {
+				return fmt.Errorf("invalid key option %q: value must be double-quoted", token)
+			}
+		case keyOptionValues[name]:
+			return fmt.Errorf("invalid key option %q: needs a value, e.g. %s=\"...\"", token, name)
+		case keyOptionFlags[name]:
+			return fmt.Errorf("invalid key option %q: takes no value", token)
+		default:
+			return fmt.Errorf("unknown key option %q", name)
+		}
+	}
+	return nil
+}
+
+// splitKeyOptions splits an options list on commas outside double quotes.
+func splitKeyOptions(opts string) ([]string, error) {
+	var tokens []string
+	var current strings.Builder
+	quoted := false
+	for _, r := range opts {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			current.WriteRune(r)
+		case r == ',' && !quoted:
+			tokens = append(tokens, current.String())
+			current.Reset()
+		case (r == ' ' || r == '\t') && !quoted:
+			return nil, fmt.Errorf("invalid key options %q: whitespace outside quotes", opts)
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("invalid key options %q: unterminated quote", opts)
+	}
+	tokens = append(tokens, current.String())
+	for _, token := range tokens {
+		if token == "" {
+			return nil, fmt.Errorf("invalid key options %q: empty option", opts)
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,140 @@
+package tunneluser
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+)
+
+// DefaultMinRSABits is the smallest RSA modulus accepted by default.
+const DefaultMinRSABits = 3072
+
+// RSA sizes below which ValidatePublicKey and ValidatePublicKeyStrict report
+// ErrWeakRSAKey. 1024-bit RSA is considered broken.
+const (
+	MinRSABits       = 2048
+	StrictMinRSABits = 4096
+)
+
+// DefaultAllowedKeyTypes are the key types accepted by default. ssh-dss is
+// left out: DSA keys are limited to 1024 bits and OpenSSH disables them.
+var DefaultAllowedKeyTypes = []string{
+	"ssh-ed25519",
+	"ecdsa-sha2-nistp256",
+	"ecdsa-sha2-nistp384",
+	"ecdsa-sha2-nistp521",
+	"ssh-rsa",
+}
+
+var (
+	// ErrKeyTypeNotAllowed is returned for a key whose type the policy forbids.
+	ErrKeyTypeNotAllowed = errors.New("key type not allowed")
+	// ErrKeyTooShort is returned for an RSA key below KeyPolicy.MinRSABits.
+	ErrKeyTooShort = errors.New("key too short")
+	// ErrWeakRSAKey is returned by ValidatePublicKey for an RSA key below
+	// MinRSABits, and by ValidatePublicKeyStrict below StrictMinRSABits.
+	ErrWeakRSAKey = errors.New("weak RSA key")
+)
+
+// KeyPolicy restricts the public keys SetupSSHKey installs.
+type KeyPolicy struct {
+	AllowedTypes []string // Key types accepted, as in the first field of a key line
+	MinRSABits   int      // Minimum ssh-rsa modulus size in bits
+}
+
+// DefaultKeyPolicy returns the policy used unless SetKeyPolicy changes it.
+func DefaultKeyPolicy() KeyPolicy {
+	return KeyPolicy{
+		AllowedTypes: slices.Clone(DefaultAllowedKeyTypes),
+		MinRSABits:   DefaultMinRSABits,
+	}
+}
+
+// CurrentKeyPolicy is the policy new keys are checked against. Change it
+// with SetKeyPolicy. Keys already installed are not checked again.
+var CurrentKeyPolicy = DefaultKeyPolicy()
+
+// SetKeyPolicy validates and sets CurrentKeyPolicy.
+func SetKeyPolicy(p KeyPolicy) error {
+	if len(p.AllowedTypes) == 0 {
+		return fmt.Errorf("allowed key types must not be empty (default %s)", strings.Join(DefaultAllowedKeyTypes, ","))
+	}
+	for _, t := range p.AllowedTypes {
+		if !keyTypePattern.MatchString(t) {
+			return fmt.Errorf("unknown key type %q", t)
+		}
+	}
+	if p.MinRSABits < 1024 {
+		return fmt.Errorf("minimum RSA key size must be at least 1024 bits, got %d", p.MinRSABits)
+	}
+	CurrentKeyPolicy = KeyPolicy{AllowedTypes: slices.Clone(p.AllowedTypes), MinRSABits: p.MinRSABits}
+	return nil
+}
+
+// Check reports whether a public key line satisfies the policy. The error
+// wraps ErrKeyTypeNotAllowed or ErrKeyTooShort and names the offending
+// property.
+func (p KeyPolicy) Check(publicKey string) error {
+	keyType, data, _, err := splitPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(p.AllowedTypes, keyType) {
+		return fmt.Errorf("%w: %s (allowed: %s)", ErrKeyTypeNotAllowed, keyType, strings.Join(p.AllowedTypes, ", "))
+	}
+	if keyType == "ssh-rsa" {
+		raw, _ := base64.StdEncoding.DecodeString(data)
+		bits, err := rsaKeyBits(raw)
+		if err != nil {
+			return err
+		}
+		if bits < p.MinRSABits {
+			return fmt.Errorf("%w: RSA key has %d bits, at least %d required", ErrKeyTooShort, bits, p.MinRSABits)
+		}
+	}
+	return nil
+}
+
+// CheckKeyPolicy checks a public key line against CurrentKeyPolicy.
+func CheckKeyPolicy(publicKey string) error {
+	return CurrentKeyPolicy.Check(publicKey)
+}
+
+// CheckKeyPolicyWarnWeak is CheckKeyPolicy for callers that warn about keys
+// ValidatePublicKeyStrict would reject. A key violating CurrentKeyPolicy is
+// still an error; a key that satisfies it but is an RSA key below
+// StrictMinRSABits, or a DSA key, is accepted and the returned warning
+// describes it.
+func CheckKeyPolicyWarnWeak(publicKey string) (warning string, err error) {
+	if err := CheckKeyPolicy(publicKey); err != nil {
+		return "", err
+	}
+	if err := ValidatePublicKeyStrict(publicKey); errors.Is(err, ErrWeakRSAKey) || errors.Is(err, ErrKeyTypeNotAllowed) {
+		return err.Error(), nil
+	}
+	return "", nil
+}
+
+// rsaKeyBits returns the modulus size of an ssh-rsa key blob, which holds
+// the type name, the public exponent and the modulus as SSH strings.
+func rsaKeyBits(blob []byte) (int, error) {
+	var fields [3][]byte
+	for i := range fields {
+		if len(blob) < 4 {
+			return 0, fmt.Errorf("invalid public key data: truncated RSA key")
+		}
+		n := binary.BigEndian.Uint32(blob)
+		if uint64(len(blob)-4) < uint64(n) {
+			return 0, fmt.Errorf("invalid public key data: truncated RSA key")
+		}
+		fields[i], blob = blob[4:4+n], blob[4+n:]
+	}
+	if string(fields[0]) != "ssh-rsa" {
+		return 0, fmt.Errorf("invalid public key data: key type mismatch")
+	}
+	return new(big.Int).SetBytes(fields[2]).BitLen(), nil
+}
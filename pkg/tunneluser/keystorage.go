@@ -0,0 +1,139 @@
+package tunneluser
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/net2share/sshtun-user/pkg/paths"
+)
+
+// KeyStorageMode selects where tunnel user public keys are stored.
+type KeyStorageMode string
+
+const (
+	// KeyStorageCentral keeps keys in AuthorizedKeysDir, which the key
+	// group's sshd Match block points at with an AuthorizedKeysFile directive.
+	KeyStorageCentral KeyStorageMode = "central"
+	// KeyStoragePerUser keeps keys in each user's ~/.ssh/authorized_keys,
+	// where sshd looks by default, for systems where the directive can't be
+	// added.
+	KeyStoragePerUser KeyStorageMode = "peruser"
+)
+
+// KeyStorage is where keys of key users are written. Change it with
+// SetKeyStorage. Delete removes keys from both layouts.
+var KeyStorage = KeyStorageCentral
+
+// PerUserHomeRoot holds the home directories created for key users in
+// per-user mode that have neither a home directory nor SFTP access.
+var PerUserHomeRoot = "/home"
+
+// ParseKeyStorageMode parses a key storage mode name.
+func ParseKeyStorageMode(s string) (KeyStorageMode, error) {
+	switch mode := KeyStorageMode(s); mode {
+	case KeyStorageCentral, KeyStoragePerUser:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid key storage %q: must be %s or %s", s, KeyStorageCentral, KeyStoragePerUser)
+}
+
+// SetKeyStorage sets where keys of key users are written.
+func SetKeyStorage(mode string) error {
+	parsed, err := ParseKeyStorageMode(mode)
+	if err != nil {
+		return err
+	}
+	KeyStorage = parsed
+	return nil
+}
+
+// perUserHomeRoot returns PerUserHomeRoot below paths.RootDir.
+func perUserHomeRoot() string {
+	return paths.Join(PerUserHomeRoot)
+}
+
+// needsPerUserHome reports whether cfg needs a home directory for its
+// ~/.ssh/authorized_keys.
+func needsPerUserHome(cfg *Config) bool {
+	return KeyStorage == KeyStoragePerUser && cfg.AuthMode == AuthModeKey
+}
+
+// lookupHome returns a user's home directory from the passwd database.
+func lookupHome(username string) string {
+	u, err := lookupUser(username)
+	if err != nil || u.HomeDir == DefaultHomeDir {
+		return ""
+	}
+	return u.HomeDir
+}
+
+// perUserKeyFile returns the ~/.ssh/authorized_keys path of a home
+// directory, or "" without a home.
+func perUserKeyFile(home string) string {
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "authorized_keys")
+}
+
+// setupPerUserKeyDir creates the user's home and ~/.ssh for the key file.
+// Both stay root-owned unless the user owns their home (CreateHome), and
+// ~/.ssh is always root-owned like the central key files, so users can't
+// rewrite their key options. sshd accepts root-owned key paths.
+func setupPerUserKeyDir(home string) error {
+	if _, err := os.Stat(home); os.IsNotExist(err) {
+		if err := os.MkdirAll(home, 0755); err != nil {
+			return fmt.Errorf("failed to create home directory: %w", err)
+		}
+		if err := CommandExecutor("chown", "root:root", home).Run(); err != nil {
+			return fmt.Errorf("failed to set home directory ownership: %w", err)
+		}
+	}
+	sshDir := filepath.Join(home, ".ssh")
+	if err := os.MkdirAll(sshDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", sshDir, err)
+	}
+	if err := os.Chmod(sshDir, 0755); err != nil {
+		return fmt.Errorf("failed to set %s permissions: %w", sshDir, err)
+	}
+	if err := CommandExecutor("chown", "-R", "root:root", sshDir).Run(); err != nil {
+		return fmt.Errorf("failed to set %s ownership: %w", sshDir, err)
+	}
+	return nil
+}
+
+// ensurePerUserHome returns the user's home directory, moving a user
+// without one to a new home below PerUserHomeRoot.
+func ensurePerUserHome(username string) (string, error) {
+	if home := lookupHome(username); home != "" {
+		return home, nil
+	}
+	home := filepath.Join(perUserHomeRoot(), username)
+	if err := CommandExecutor("usermod", "--home", home, username).Run(); err != nil {
+		return "", fmt.Errorf("failed to set home directory: %w", err)
+	}
+	return home, nil
+}
+
+// removePerUserKeys removes the ~/.ssh/authorized_keys of a home directory
+// and ~/.ssh itself if that leaves it empty.
+func removePerUserKeys(home string) error {
+	path := perUserKeyFile(home)
+	if path == "" {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove SSH key file: %w", err)
+	}
+	os.Remove(filepath.Dir(path))
+	return nil
+}
+
+// removePerUserHome removes a deleted user's home if it was created below
+// PerUserHomeRoot for their keys and is empty.
+func removePerUserHome(username, home string) {
+	if home != "" && home == filepath.Join(perUserHomeRoot(), username) {
+		os.Remove(home)
+	}
+}
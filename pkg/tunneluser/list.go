@@ -2,123 +2,266 @@ package tunneluser
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"os/user"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/net2share/sshtun-user/pkg/paths"
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
 )
 
 // UserInfo represents a tunnel user with their authentication mode.
 type UserInfo struct {
-	Username string
-	AuthMode AuthMode
+	Username string   `json:"username"` // Without UserPrefix; the account is SystemName(Username)
+	AuthMode AuthMode `json:"auth_mode"`
+	UID      int      `json:"uid"` // Numeric IDs, for matching kernel audit and firewall logs
+	GID      int      `json:"gid"`
+	// CreatedByVersion is the sshtun-user version recorded in the account
+	// comment; empty for users created before versions were recorded
+	CreatedByVersion string     `json:"created_by_version,omitempty"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"` // Set by ExpiringWithin and ListDetailed
 }
 
-// List returns all users that are members of tunnel groups.
+// List returns all users that are members of tunnel groups. With a
+// UserPrefix, only users in that namespace are returned, under their
+// logical names. A user in more
+// than one tunnel group is listed once, with the mode GetAuthMode returns,
+// and reported in a warning on stderr.
 func List() ([]UserInfo, error) {
-	var users []UserInfo
-	seen := make(map[string]bool)
-
-	// Get members of both tunnel groups (supplementary membership)
-	passwordUsers, err := getGroupMembers(GroupPasswordAuth)
-	if err != nil && !os.IsNotExist(err) {
+	passwordUsers, err := groupUsers(GroupPasswordAuth)
+	if err != nil {
 		return nil, fmt.Errorf("failed to get password auth users: %w", err)
 	}
-
-	keyUsers, err := getGroupMembers(GroupKeyAuth)
-	if err != nil && !os.IsNotExist(err) {
+	keyUsers, err := groupUsers(GroupKeyAuth)
+	if err != nil {
 		return nil, fmt.Errorf("failed to get key auth users: %w", err)
 	}
 
-	// Also get users whose primary group is a tunnel group
-	primaryPasswordUsers, _ := getUsersWithPrimaryGroup(GroupPasswordAuth)
-	primaryKeyUsers, _ := getUsersWithPrimaryGroup(GroupKeyAuth)
+	sftpUsers, err := groupUsers(GroupSFTP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get SFTP-only users: %w", err)
+	}
 
-	// Merge supplementary and primary group members
-	passwordUsers = append(passwordUsers, primaryPasswordUsers...)
-	keyUsers = append(keyUsers, primaryKeyUsers...)
+	warnConflicts(findConflicts(map[AuthMode][]string{
+		AuthModePassword: passwordUsers,
+		AuthModeKey:      keyUsers,
+		AuthModeSFTP:     sftpUsers,
+	}))
 
-	// Add password auth users
-	for _, username := range passwordUsers {
-		if seen[username] {
-			continue
+	seen := make(map[string]bool)
+	users := appendUsers(nil, passwordUsers, AuthModePassword, seen)
+	users = appendUsers(users, keyUsers, AuthModeKey, seen)
+	return appendUsers(users, sftpUsers, AuthModeSFTP, seen), nil
+}
+
+// ListByAuthMode returns the tunnel users with the given auth mode, reading
+// only the groups needed for it. An empty mode lists every user, like List.
+// As with GetAuthMode, a user in both groups counts as a password user.
+func ListByAuthMode(mode AuthMode) ([]UserInfo, error) {
+	switch mode {
+	case "":
+		return List()
+	case AuthModePassword:
+		passwordUsers, err := groupUsers(GroupPasswordAuth)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get password auth users: %w", err)
 		}
-		seen[username] = true
-		users = append(users, UserInfo{
-			Username: username,
-			AuthMode: AuthModePassword,
-		})
+		return appendUsers(nil, passwordUsers, AuthModePassword, make(map[string]bool)), nil
+	case AuthModeKey:
+		keyUsers, err := groupUsers(GroupKeyAuth)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get key auth users: %w", err)
+		}
+		seen := make(map[string]bool)
+		if len(keyUsers) > 0 {
+			passwordUsers, err := groupUsers(GroupPasswordAuth)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get password auth users: %w", err)
+			}
+			for _, username := range passwordUsers {
+				seen[username] = true
+			}
+		}
+		return appendUsers(nil, keyUsers, AuthModeKey, seen), nil
+	case AuthModeSFTP:
+		// Users in another tunnel group as well count for that group
+		all, err := List()
+		if err != nil {
+			return nil, err
+		}
+		var users []UserInfo
+		for _, u := range all {
+			if u.AuthMode == AuthModeSFTP {
+				users = append(users, u)
+			}
+		}
+		return users, nil
+	default:
+		return nil, fmt.Errorf("invalid auth mode %q: must be key, password or sftp", mode)
 	}
+}
 
-	// Add key auth users
-	for _, username := range keyUsers {
-		if seen[username] {
+// groupUsers returns the supplementary members of a tunnel group followed by
+// the users with it as primary group. A missing /etc/group yields no users.
+func groupUsers(group string) ([]string, error) {
+	members, err := getGroupMembers(group)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	primary, _ := getUsersWithPrimaryGroup(group)
+	return append(members, primary...), nil
+}
+
+// appendUsers appends the accounts in the UserPrefix namespace not yet in
+// seen to users with the given auth mode, under their logical name, and
+// marks them as seen.
+func appendUsers(users []UserInfo, accounts []string, mode AuthMode, seen map[string]bool) []UserInfo {
+	for _, account := range accounts {
+		username, ok := LogicalName(account)
+		if seen[account] || !ok {
 			continue
 		}
-		seen[username] = true
-		users = append(users, UserInfo{
-			Username: username,
-			AuthMode: AuthModeKey,
-		})
+		seen[account] = true
+		info := UserInfo{Username: username, AuthMode: mode}
+		info.UID, info.GID = lookupIDs(account)
+		if c, err := readComment(account); err == nil {
+			info.CreatedByVersion = c.Version
+		}
+		users = append(users, info)
+	}
+	return users
+}
+
+// GetUser returns a single tunnel user with its auth mode and numeric IDs.
+// A user in more than one tunnel group gets the mode GetAuthMode returns.
+func GetUser(username string) (UserInfo, error) {
+	account := SystemName(username)
+	mode, err := getAuthMode(account)
+	if err != nil && !errors.Is(err, ErrAmbiguousAuthMode) {
+		return UserInfo{}, err
 	}
+	info := UserInfo{Username: username, AuthMode: mode}
+	info.UID, info.GID = lookupIDs(account)
+	if c, err := readComment(account); err == nil {
+		info.CreatedByVersion = c.Version
+	}
+	return info, nil
+}
 
-	return users, nil
+// lookupIDs returns a user's UID and primary GID, or -1 for IDs that can't
+// be read.
+func lookupIDs(username string) (uid, gid int) {
+	uid, gid = -1, -1
+	u, err := lookupUser(username)
+	if err != nil {
+		return uid, gid
+	}
+	if n, err := strconv.Atoi(u.Uid); err == nil {
+		uid = n
+	}
+	if n, err := strconv.Atoi(u.Gid); err == nil {
+		gid = n
+	}
+	return uid, gid
 }
 
 // GetAuthMode returns the authentication mode for a specific user.
-// Returns an error if the user is not in any tunnel group.
+// Returns an error if the user is not in any tunnel group. For a user in
+// more than one tunnel group it returns the mode that takes precedence
+// (password, then key, then SFTP) together with an error wrapping
+// ErrAmbiguousAuthMode that names all of them.
 func GetAuthMode(username string) (AuthMode, error) {
-	inPassword, _ := isInGroup(username, GroupPasswordAuth)
-	if inPassword {
-		return AuthModePassword, nil
-	}
+	return getAuthMode(SystemName(username))
+}
 
-	inKey, _ := isInGroup(username, GroupKeyAuth)
-	if inKey {
-		return AuthModeKey, nil
+// getAuthMode is GetAuthMode for an account name.
+func getAuthMode(username string) (AuthMode, error) {
+	modes := authModes(username)
+	switch len(modes) {
+	case 0:
+		return "", fmt.Errorf("user '%s' is not a tunnel user", username)
+	case 1:
+		return modes[0], nil
 	}
-
-	return "", fmt.Errorf("user '%s' is not a tunnel user", username)
+	return modes[0], fmt.Errorf("%w: '%s' has auth modes %s; run 'sshtun-user repair'", ErrAmbiguousAuthMode, username, joinModes(modes))
 }
 
-// IsTunnelUser checks if a user is a tunnel user (member of any tunnel group).
+// IsTunnelUser checks if a user is a tunnel user (member of any tunnel group)
+// in the UserPrefix namespace.
 func IsTunnelUser(username string) bool {
-	_, err := GetAuthMode(username)
-	return err == nil
+	return isTunnelUser(SystemName(username))
+}
+
+// isTunnelUser is IsTunnelUser for an account name.
+func isTunnelUser(username string) bool {
+	_, err := getAuthMode(username)
+	return err == nil || errors.Is(err, ErrAmbiguousAuthMode)
 }
 
-// Delete removes a tunnel user and cleans up all related files.
+// Delete removes a tunnel user and cleans up all related files. Root and
+// admin users are refused with ErrRefusingPrivilegedUser.
 // This includes:
 // - Removing user from tunnel groups
+// - Ending the user's active sessions (userdel refuses while they run)
 // - Deleting the system user
 // - Removing SSH key file from /etc/ssh/authorized_keys.d/<username>
+// - Removing the TOTP secret, if any
+// - Removing the home directory of an SFTP-only user if it holds no files
 // - Removing from cron.deny and at.deny
 func Delete(username string) error {
+	username = SystemName(username)
+	defer DefaultCache.Invalidate()
+
 	// Verify user is a tunnel user
-	if !IsTunnelUser(username) {
+	if !isTunnelUser(username) {
 		return fmt.Errorf("user '%s' is not a tunnel user", username)
 	}
 
+	if err := checkNotPrivileged(username); err != nil {
+		return err
+	}
+	mode, _ := getAuthMode(username)
+
 	// Remove from tunnel groups
-	for _, group := range []string{GroupPasswordAuth, GroupKeyAuth} {
-		exec.Command("gpasswd", "-d", username, group).Run()
+	for _, group := range tunnelGroups() {
+		CommandExecutor("gpasswd", "-d", username, group).Run()
 	}
 
+	// End active tunnel sessions; pkill exits 1 when there are none
+	CommandExecutor("pkill", "-KILL", "-u", username).Run()
+
+	// The home is needed to find per-user keys once the account is gone
+	home := lookupHome(username)
+
 	// Delete system user
-	cmd := exec.Command("userdel", username)
+	cmd := CommandExecutor("userdel", username)
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to delete user: %w", err)
 	}
 
-	// Remove SSH key file if it exists
-	authKeysFile := filepath.Join(AuthorizedKeysDir, username)
-	if _, err := os.Stat(authKeysFile); err == nil {
-		if err := os.Remove(authKeysFile); err != nil {
-			return fmt.Errorf("failed to remove SSH key file: %w", err)
-		}
+	// Remove SSH key files in either layout if they exist
+	if err := removeCentralKeyFile(username); err != nil {
+		return err
 	}
+	if err := removePerUserKeys(home); err != nil {
+		return err
+	}
+	removePerUserHome(username, home)
+
+	// Remove per-user sshd settings and an empty SFTP home
+	if _, err := sshdconfig.RemoveUserConfig(username); err != nil {
+		return err
+	}
+	removeSFTPHome(username)
+	if mode == AuthModeSFTP {
+		removeSFTPOnlyHome(username)
+	}
+	removeTOTP(username)
 
 	// Remove from deny files
 	removeFromDenyFiles(username)
@@ -126,62 +269,99 @@ func Delete(username string) error {
 	return nil
 }
 
-// getGroupMembers returns all members of a group by parsing /etc/group.
+// dbFields splits a line of /etc/passwd, /etc/group or /etc/shadow into
+// its trimmed fields. It rejects blank and comment lines, NIS compat
+// entries (+ or -) and lines with fewer than n fields, and tolerates CRLF
+// line endings.
+func dbFields(line string, n int) ([]string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == '+' || line[0] == '-' {
+		return nil, false
+	}
+	fields := strings.Split(line, ":")
+	if len(fields) < n {
+		return nil, false
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if fields[0] == "" {
+		return nil, false
+	}
+	return fields, true
+}
+
+// getGroupMembers returns all members of a group from /etc/group, or from
+// NSS for a group defined elsewhere (see lookupGroupEntry).
 // This only returns supplementary group members, not users with this as primary group.
 func getGroupMembers(groupName string) ([]string, error) {
-	file, err := os.Open("/etc/group")
+	entry, _, err := lookupGroupEntry(groupName)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	if entry.Members == nil {
+		return []string{}, nil
+	}
+	return entry.Members, nil
+}
 
-	scanner := bufio.NewScanner(file)
+// parseGroupEntry finds a group in /etc/group content. found is false if it
+// isn't there. Blank entries in the member list, e.g. from a trailing comma,
+// are skipped; a group without members has an empty list.
+func parseGroupEntry(r io.Reader, groupName string) (groupEntry, bool, error) {
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		line := scanner.Text()
 		// Format: group_name:password:GID:user_list
-		parts := strings.Split(line, ":")
-		if len(parts) < 4 {
+		parts, ok := dbFields(scanner.Text(), 4)
+		if !ok || parts[0] != groupName {
 			continue
 		}
 
-		if parts[0] == groupName {
-			userList := parts[3]
-			if userList == "" {
-				return []string{}, nil
+		members := []string{}
+		for _, member := range strings.Split(parts[3], ",") {
+			if member = strings.TrimSpace(member); member != "" {
+				members = append(members, member)
 			}
-			return strings.Split(userList, ","), nil
 		}
+		return groupEntry{GID: parts[2], Members: members}, true, nil
 	}
 
-	return []string{}, scanner.Err()
+	return groupEntry{}, false, scanner.Err()
 }
 
-// getUsersWithPrimaryGroup returns all users whose primary group is the specified group.
+// getUsersWithPrimaryGroup returns all users whose primary group is the
+// specified group, from /etc/passwd or, for a group only known to NSS, from
+// getent passwd.
 func getUsersWithPrimaryGroup(groupName string) ([]string, error) {
-	// Get the GID of the group
-	g, err := user.LookupGroup(groupName)
+	entry, found, err := lookupGroupEntry(groupName)
 	if err != nil {
 		return nil, err
 	}
+	if !found {
+		return nil, user.UnknownGroupError(groupName)
+	}
+	if entry.NSS {
+		return getentUsersWithGID(entry.GID)
+	}
 
 	// Parse /etc/passwd to find users with this GID
-	file, err := os.Open("/etc/passwd")
+	file, err := os.Open(PasswdFile)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
+	return parseUsersWithGID(file, entry.GID)
+}
 
-	var users []string
-	scanner := bufio.NewScanner(file)
+// parseUsersWithGID returns the users with the given primary GID from
+// /etc/passwd content, or an empty list if there are none.
+func parseUsersWithGID(r io.Reader, gid string) ([]string, error) {
+	users := []string{}
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		line := scanner.Text()
 		// Format: username:password:UID:GID:GECOS:home:shell
-		parts := strings.Split(line, ":")
-		if len(parts) < 4 {
-			continue
-		}
-
-		if parts[3] == g.Gid {
+		parts, ok := dbFields(scanner.Text(), 4)
+		if ok && parts[3] == gid {
 			users = append(users, parts[0])
 		}
 	}
@@ -189,6 +369,16 @@ func getUsersWithPrimaryGroup(groupName string) ([]string, error) {
 	return users, scanner.Err()
 }
 
+// onlyInGroup reports whether group is the only tunnel group of a user.
+func onlyInGroup(username, group string) bool {
+	for _, g := range tunnelGroups() {
+		if in, _ := isInGroup(username, g); in != (g == group) {
+			return false
+		}
+	}
+	return true
+}
+
 // isInGroup checks if a user is a member of a specific group.
 // This checks both supplementary group membership and primary group.
 func isInGroup(username, groupName string) (bool, error) {
@@ -213,42 +403,56 @@ func isInGroup(username, groupName string) (bool, error) {
 
 // isPrimaryGroup checks if a group is the user's primary group.
 func isPrimaryGroup(username, groupName string) (bool, error) {
-	// Get user info
-	u, err := user.Lookup(username)
+	gid, err := lookupUserGID(username)
 	if err != nil {
 		return false, err
 	}
 
-	// Get group info
-	g, err := user.LookupGroup(groupName)
+	entry, found, err := lookupGroupEntry(groupName)
 	if err != nil {
 		return false, err
 	}
+	if !found {
+		return false, user.UnknownGroupError(groupName)
+	}
 
-	return u.Gid == g.Gid, nil
+	return gid == entry.GID, nil
 }
 
 // removeFromDenyFiles removes a username from cron.deny and at.deny files.
 func removeFromDenyFiles(username string) {
-	for _, denyFile := range []string{"/etc/cron.deny", "/etc/at.deny"} {
-		data, err := os.ReadFile(denyFile)
-		if err != nil {
-			continue
-		}
+	if SkipDenyFiles {
+		return
+	}
+	for _, files := range scheduledTaskFiles {
+		removeLineFromFile(paths.Join(files.deny), username)
+	}
+}
 
-		lines := splitLines(string(data))
-		var newLines []string
-		for _, line := range lines {
-			if line != username {
-				newLines = append(newLines, line)
-			}
-		}
+// removeLineFromFile removes every line equal to value from a file and
+// reports whether the file was modified. Missing files are ignored.
+func removeLineFromFile(path, value string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
 
-		newContent := strings.Join(newLines, "\n")
-		if len(newLines) > 0 && !strings.HasSuffix(newContent, "\n") {
-			newContent += "\n"
+	lines := splitLines(string(data))
+	var newLines []string
+	for _, line := range lines {
+		if line != value {
+			newLines = append(newLines, line)
 		}
+	}
 
-		os.WriteFile(denyFile, []byte(newContent), 0644)
+	if len(newLines) == len(lines) {
+		return false
 	}
+
+	newContent := strings.Join(newLines, "\n")
+	if len(newLines) > 0 && !strings.HasSuffix(newContent, "\n") {
+		newContent += "\n"
+	}
+
+	return os.WriteFile(path, []byte(newContent), 0644) == nil
 }
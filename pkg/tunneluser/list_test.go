@@ -0,0 +1,124 @@
+package tunneluser_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/net2share/sshtun-user/pkg/tunneltesting"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+)
+
+func TestListByAuthMode(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+	fs.AddUser("alice", tunneluser.GroupPasswordAuth)
+	fs.AddUser("bob", tunneluser.GroupKeyAuth)
+	fs.AddUser("carol", tunneluser.GroupKeyAuth)
+	fs.AddUser("dave", tunneluser.GroupSFTP)
+	fs.AddUser("eve", "users")
+	// In both groups, carol counts as a password user
+	add := tunneluser.CommandExecutor("usermod", "-aG", tunneluser.GroupPasswordAuth, tunneluser.SystemName("carol"))
+	if output, err := add.CombinedOutput(); err != nil {
+		t.Fatalf("usermod: %v: %s", err, output)
+	}
+
+	tests := []struct {
+		mode tunneluser.AuthMode
+		want []string
+	}{
+		{mode: tunneluser.AuthModePassword, want: []string{"alice", "carol"}},
+		{mode: tunneluser.AuthModeKey, want: []string{"bob"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			users, err := tunneluser.ListByAuthMode(tt.mode)
+			if err != nil {
+				t.Fatalf("ListByAuthMode: %v", err)
+			}
+			var got []string
+			for _, u := range users {
+				if u.AuthMode != tt.mode {
+					t.Errorf("ListByAuthMode(%s) returned %s with mode %s", tt.mode, u.Username, u.AuthMode)
+				}
+				got = append(got, u.Username)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ListByAuthMode(%s) = %v, want %v", tt.mode, got, tt.want)
+			}
+
+			details, err := tunneluser.ListDetailedByAuthMode(tt.mode)
+			if err != nil {
+				t.Fatalf("ListDetailedByAuthMode: %v", err)
+			}
+			got = got[:0]
+			for _, u := range details {
+				got = append(got, u.Username)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ListDetailedByAuthMode(%s) = %v, want %v", tt.mode, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserPrefixNamespace(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+	t.Cleanup(func() { tunneluser.SetUserPrefix("") })
+
+	if err := tunneluser.SetUserPrefix("team-a"); err == nil {
+		t.Error("SetUserPrefix(team-a) accepted a prefix without a trailing separator")
+	}
+	if err := tunneluser.SetUserPrefix("team-ab-"); err != nil {
+		t.Fatal(err)
+	}
+	fs.AddUser("y", tunneluser.GroupPasswordAuth)
+	if err := tunneluser.SetUserPrefix("team-a-"); err != nil {
+		t.Fatal(err)
+	}
+	fs.AddUser("x", tunneluser.GroupPasswordAuth)
+	fs.AddUser("team-a-x", tunneluser.GroupPasswordAuth)
+
+	if got := tunneluser.SystemName("team-a-x"); got != "team-a-team-a-x" {
+		t.Errorf("SystemName(team-a-x) = %q, want team-a-team-a-x", got)
+	}
+	users, err := tunneluser.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var got []string
+	for _, u := range users {
+		got = append(got, u.Username)
+	}
+	slices.Sort(got)
+	if want := []string{"team-a-x", "x"}; !slices.Equal(got, want) {
+		t.Errorf("List = %v, want %v", got, want)
+	}
+	if name, ok := tunneluser.LogicalName("team-ab-y"); ok {
+		t.Errorf("LogicalName(team-ab-y) = %q, want it outside the team-a- namespace", name)
+	}
+
+	if err := tunneluser.Delete("x"); err != nil {
+		t.Fatalf("Delete(x): %v", err)
+	}
+	fs.AssertUserNotExists(t, "x")
+	fs.AssertUserExists(t, "team-a-x")
+	if !tunneluser.IsTunnelUser("team-a-x") {
+		t.Error("Delete(x) removed team-a-team-a-x")
+	}
+	deleted, err := tunneluser.DeleteAllUsers()
+	if err != nil {
+		t.Fatalf("DeleteAllUsers: %v", err)
+	}
+	if want := []string{"team-a-team-a-x"}; !slices.Equal(deleted, want) {
+		t.Errorf("DeleteAllUsers = %v, want %v", deleted, want)
+	}
+
+	// The other tenant's user is untouched
+	if err := tunneluser.SetUserPrefix("team-ab-"); err != nil {
+		t.Fatal(err)
+	}
+	fs.AssertUserExists(t, "y")
+}
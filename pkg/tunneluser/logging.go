@@ -0,0 +1,38 @@
+package tunneluser
+
+import (
+	"errors"
+
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+)
+
+// SetVerboseLogging turns LogLevel VERBOSE on or off for one tunnel user,
+// for forensics on a single account, through the user's Match User block.
+// The global log level is unchanged. The drop-in is checked with sshd -t
+// before sshd is reloaded. It reports whether anything changed.
+func SetVerboseLogging(username string, enabled bool) (bool, error) {
+	username = SystemName(username)
+	if err := checkNotPrivileged(username); err != nil {
+		return false, err
+	}
+	if _, err := getAuthMode(username); err != nil && !errors.Is(err, ErrAmbiguousAuthMode) {
+		return false, err
+	}
+	opts, err := sshdconfig.ReadUserConfig(username)
+	if err != nil {
+		return false, err
+	}
+	if opts.VerboseLogging == enabled {
+		return false, nil
+	}
+	opts.VerboseLogging = enabled
+	// Drop a terminal grant left from a finished password change
+	opts.PasswordChange = opts.PasswordChange && ttyGrantNeeded(username)
+	return sshdconfig.WriteUserConfig(opts)
+}
+
+// VerboseLogging reports whether LogLevel VERBOSE is set for the user.
+func VerboseLogging(username string) bool {
+	opts, err := sshdconfig.ReadUserConfig(SystemName(username))
+	return err == nil && opts.VerboseLogging
+}
@@ -0,0 +1,220 @@
+package tunneluser
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+)
+
+// MigrateResult is what Migrate changed, or would change, for one user.
+type MigrateResult struct {
+	Username string   `json:"username"`
+	Changes  []string `json:"changes"`
+	Warnings []string `json:"warnings,omitempty"` // Problems migrate can't fix, e.g. a user in several tunnel groups
+}
+
+// currentVersion returns the running sshtun-user version, without "v".
+func currentVersion() string {
+	return strings.TrimPrefix(sshdconfig.ToolVersion, "v")
+}
+
+// createdByVersion returns the version Create records for cfg.
+func createdByVersion(cfg *Config) string {
+	if cfg.CreatedByVersion != "" {
+		return strings.TrimPrefix(cfg.CreatedByVersion, "v")
+	}
+	return currentVersion()
+}
+
+// IsOlderVersion reports whether a user created by version predates the
+// running sshtun-user. A user without a recorded version counts as older.
+// Development builds, whose version isn't a release number, flag no one.
+func IsOlderVersion(version string) bool {
+	current, ok := parseVersion(currentVersion())
+	if !ok {
+		return false
+	}
+	v, ok := parseVersion(strings.TrimPrefix(version, "v"))
+	if !ok {
+		return true
+	}
+	for i := range v {
+		if v[i] != current[i] {
+			return v[i] < current[i]
+		}
+	}
+	return false
+}
+
+// parseVersion parses a "major.minor.patch" release number, ignoring a
+// pre-release or build suffix such as "-rc1".
+func parseVersion(s string) ([3]int, bool) {
+	var v [3]int
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+// OutdatedUsers returns the tunnel users created by an older sshtun-user,
+// see IsOlderVersion.
+func OutdatedUsers() ([]UserInfo, error) {
+	users, err := List()
+	if err != nil {
+		return nil, err
+	}
+	var outdated []UserInfo
+	for _, u := range users {
+		if IsOlderVersion(u.CreatedByVersion) {
+			outdated = append(outdated, u)
+		}
+	}
+	return outdated, nil
+}
+
+// MigrateAll applies Migrate to every tunnel user and returns the users it
+// changed or warned about. It stops at the first error.
+func MigrateAll(dryRun bool) ([]MigrateResult, error) {
+	users, err := List()
+	if err != nil {
+		return nil, err
+	}
+	var results []MigrateResult
+	for _, u := range users {
+		result, err := Migrate(u.Username, dryRun)
+		if err != nil {
+			return results, fmt.Errorf("failed to migrate %s: %w", u.Username, err)
+		}
+		if len(result.Changes) > 0 || len(result.Warnings) > 0 {
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// Migrate brings a tunnel user created by an older sshtun-user up to the
+// current conventions: the key file is rewritten with the current
+// KeyOptions in the KeyStorage layout, the comment records the auth mode of
+// the user's tunnel group and the running version. With dryRun nothing is
+// changed and the result lists what would be. A user in several tunnel
+// groups is reported as a warning; repair fixes that. Running it again
+// changes nothing.
+func Migrate(username string, dryRun bool) (MigrateResult, error) {
+	result := MigrateResult{Username: username}
+	username = SystemName(username)
+	if !dryRun {
+		defer DefaultCache.Invalidate()
+	}
+	if err := checkNotPrivileged(username); err != nil {
+		return result, err
+	}
+
+	mode, err := getAuthMode(username)
+	ambiguous := errors.Is(err, ErrAmbiguousAuthMode)
+	if ambiguous {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("in more than one tunnel group (%s); run 'sshtun-user repair'", joinModes(authModes(username))))
+	} else if err != nil {
+		return result, err
+	}
+
+	if mode == AuthModeKey {
+		change, err := migrateKeyFile(username, dryRun)
+		if err != nil {
+			return result, err
+		}
+		if change != "" {
+			result.Changes = append(result.Changes, change)
+		}
+	}
+
+	c, err := readComment(username)
+	if err != nil {
+		return result, err
+	}
+	// Comments not written by sshtun-user are left alone
+	if c.Mode == "" {
+		return result, nil
+	}
+	updated := c
+	if !ambiguous {
+		updated.Mode = mode
+	}
+	// Development builds and downgrades keep the recorded version
+	if IsOlderVersion(c.Version) {
+		updated.Version = currentVersion()
+	}
+	if updated.Mode != c.Mode {
+		result.Changes = append(result.Changes, fmt.Sprintf("comment auth mode %s -> %s", c.Mode, mode))
+	}
+	if updated.Version != c.Version {
+		from := c.Version
+		if from == "" {
+			from = "unknown"
+		}
+		result.Changes = append(result.Changes, fmt.Sprintf("created-by version %s -> %s", from, updated.Version))
+	}
+	if updated != c && !dryRun {
+		if err := writeComment(username, updated); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// migrateKeyFile rewrites a key user's key file with the current KeyOptions
+// in the KeyStorage layout and describes the change, or returns "" when the
+// file is up to date or missing.
+func migrateKeyFile(username string, dryRun bool) (string, error) {
+	path := existingKeyFile(username)
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	var b strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			b.WriteString(line + "\n")
+			continue
+		}
+		b.WriteString(keyFileContent(stripKeyOptions(trimmed)))
+	}
+	content := b.String()
+
+	target := keyFilePath(username)
+	var changes []string
+	if content != string(data) {
+		changes = append(changes, fmt.Sprintf("key options set to %q", KeyOptions))
+	}
+	if target != path {
+		changes = append(changes, fmt.Sprintf("key file moved to %s layout", KeyStorage))
+	}
+	if len(changes) == 0 {
+		return "", nil
+	}
+	if !dryRun {
+		if _, err := writeKeyFile(username, content); err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(changes, ", "), nil
+}
@@ -0,0 +1,92 @@
+package tunneluser
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"os/user"
+)
+
+// On hosts using LDAP or SSSD the tunnel groups and their members may only
+// exist in the directory. /etc/group and /etc/passwd stay the fast path;
+// a group that isn't in /etc/group is looked up with getent(1), which asks
+// NSS, and its primary-group users are then taken from getent passwd.
+
+// groupEntry is the part of a group entry the tunnel group lookups need.
+type groupEntry struct {
+	GID     string
+	Members []string
+	NSS     bool // Found through getent rather than in /etc/group
+}
+
+// lookupGroupEntry finds a group in /etc/group, or through NSS if it isn't
+// there. found is false if the group doesn't exist at all; if /etc/group is
+// missing as well, the error is the one from opening it.
+func lookupGroupEntry(groupName string) (entry groupEntry, found bool, err error) {
+	file, openErr := os.Open(GroupFile)
+	if openErr == nil {
+		entry, found, err = parseGroupEntry(file, groupName)
+		file.Close()
+		if err != nil || found {
+			return entry, found, err
+		}
+	} else if !os.IsNotExist(openErr) {
+		return groupEntry{}, false, openErr
+	}
+
+	out, ok := getent("group", groupName)
+	if !ok {
+		return groupEntry{}, false, openErr
+	}
+	entry, found, err = parseGroupEntry(bytes.NewReader(out), groupName)
+	entry.NSS = true
+	return entry, found, err
+}
+
+// groupExists reports whether a group is defined in /etc/group or NSS.
+func groupExists(groupName string) bool {
+	_, found, _ := lookupGroupEntry(groupName)
+	return found
+}
+
+// lookupUserGID returns the primary GID of a user, falling back to getent
+// passwd for users os/user can't see, e.g. directory users in builds
+// without cgo.
+func lookupUserGID(username string) (string, error) {
+	if u, err := lookupUser(username); err == nil {
+		return u.Gid, nil
+	}
+	out, ok := getent("passwd", username)
+	if !ok {
+		return "", user.UnknownUserError(username)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// Format: username:password:UID:GID:GECOS:home:shell
+		if parts, ok := dbFields(scanner.Text(), 4); ok && parts[0] == username {
+			return parts[3], nil
+		}
+	}
+	return "", user.UnknownUserError(username)
+}
+
+// getentUsersWithGID returns the users with the given primary GID among all
+// passwd entries NSS enumerates.
+func getentUsersWithGID(gid string) ([]string, error) {
+	out, ok := getent("passwd")
+	if !ok {
+		return []string{}, nil
+	}
+	return parseUsersWithGID(bytes.NewReader(out), gid)
+}
+
+// getent runs getent(1) on a database, for the given keys or all entries.
+// ok is false if no entry was found (exit status 2) or getent isn't
+// available.
+func getent(database string, keys ...string) (out []byte, ok bool) {
+	out, err := CommandExecutor("getent", append([]string{database}, keys...)...).Output()
+	if err != nil {
+		return nil, false
+	}
+	return out, true
+}
@@ -0,0 +1,144 @@
+package tunneluser
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// messyGroup is /etc/group content as found in the wild: CRLF line
+// endings, NIS compat entries, comments, blank lines and untidy member
+// lists.
+const messyGroup = "root:x:0:\r\n" +
+	"\r\n" +
+	"# local groups\n" +
+	"+tunnel-pw:::\n" +
+	"-tunnel-key\n" +
+	"tunnel-pw:x:990:alice,,bob, \r\n" +
+	"tunnel-key:x:991:\n" +
+	"tunnel-sftp:x:992: , \n" +
+	"short:x\n" +
+	"+\n"
+
+// messyPasswd is /etc/passwd content in the same style.
+const messyPasswd = "root:x:0:0:root:/root:/bin/bash\r\n" +
+	"+alice::::::\n" +
+	"+@netgroup\n" +
+	"\n" +
+	"alice:x:1001:990:SSH tunnel only (password):/nonexistent:/usr/sbin/nologin\r\n" +
+	"bob:x:1002:991:SSH tunnel only (key):/nonexistent:/usr/sbin/nologin\n" +
+	" carol :x:1003: 990 ::/nonexistent:/usr/sbin/nologin\n" +
+	"broken:x:1004\n" +
+	"+::::::\n"
+
+func TestParseGroupEntry(t *testing.T) {
+	tests := []struct {
+		group     string
+		wantFound bool
+		want      groupEntry
+	}{
+		{group: "tunnel-pw", wantFound: true, want: groupEntry{GID: "990", Members: []string{"alice", "bob"}}},
+		{group: "tunnel-key", wantFound: true, want: groupEntry{GID: "991", Members: []string{}}},
+		{group: "tunnel-sftp", wantFound: true, want: groupEntry{GID: "992", Members: []string{}}},
+		{group: "root", wantFound: true, want: groupEntry{GID: "0", Members: []string{}}},
+		{group: "short", wantFound: false},
+		{group: "+", wantFound: false},
+		{group: "missing", wantFound: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.group, func(t *testing.T) {
+			got, found, err := parseGroupEntry(strings.NewReader(messyGroup), tt.group)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != tt.wantFound || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseGroupEntry(%s) = %+v, %v; want %+v, %v", tt.group, got, found, tt.want, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestParseUsersWithGID(t *testing.T) {
+	tests := []struct {
+		gid  string
+		want []string
+	}{
+		{gid: "990", want: []string{"alice", "carol"}},
+		{gid: "991", want: []string{"bob"}},
+		{gid: "0", want: []string{"root"}},
+		{gid: "992", want: []string{}},
+		{gid: "", want: []string{}},
+	}
+	for _, tt := range tests {
+		got, err := parseUsersWithGID(strings.NewReader(messyPasswd), tt.gid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseUsersWithGID(%q) = %#v, want %#v", tt.gid, got, tt.want)
+		}
+	}
+}
+
+func TestDBFields(t *testing.T) {
+	tests := []struct {
+		line   string
+		n      int
+		want   []string
+		wantOK bool
+	}{
+		{line: "alice:x:1001:990\r", n: 4, want: []string{"alice", "x", "1001", "990"}, wantOK: true},
+		{line: " tunnel-pw : x : 990 : alice , bob ", n: 4, want: []string{"tunnel-pw", "x", "990", "alice , bob"}, wantOK: true},
+		{line: "tunnel-key:x:991:", n: 4, want: []string{"tunnel-key", "x", "991", ""}, wantOK: true},
+		{line: "+alice::::::", n: 7},
+		{line: "-bob", n: 1},
+		{line: "+", n: 1},
+		{line: "# alice:x:1001:990", n: 4},
+		{line: "\r", n: 1},
+		{line: ":x:1001:990", n: 4},
+		{line: "short:x", n: 4},
+	}
+	for _, tt := range tests {
+		got, ok := dbFields(tt.line, tt.n)
+		if ok != tt.wantOK || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("dbFields(%q, %d) = %q, %v; want %q, %v", tt.line, tt.n, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestAccountFilesWithMessyContent(t *testing.T) {
+	useAccountFiles(t, messyPasswd, messyGroup)
+	previousShadow := ShadowFile
+	t.Cleanup(func() { ShadowFile = previousShadow })
+	ShadowFile = filepath.Join(t.TempDir(), "shadow")
+	shadow := "+::::::::\r\n" +
+		"alice:$6$hash:20000:0:99999:7:::\r\n" +
+		" bob :!:0:0:99999:7:::\n"
+	if err := os.WriteFile(ShadowFile, []byte(shadow), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if gecos, err := passwdField("alice", 4); err != nil || gecos != "SSH tunnel only (password)" {
+		t.Errorf("passwdField(alice) = %q, %v", gecos, err)
+	}
+	if shell, err := passwdField("alice", 6); err != nil || shell != "/usr/sbin/nologin" {
+		t.Errorf("passwdField(alice, shell) = %q, %v; want no trailing CR", shell, err)
+	}
+	if u, err := lookupUser("carol"); err != nil || u.Gid != "990" {
+		t.Errorf("lookupUser(carol) = %+v, %v; want GID 990", u, err)
+	}
+	if hash, err := shadowHash("alice"); err != nil || hash != "$6$hash" {
+		t.Errorf("shadowHash(alice) = %q, %v", hash, err)
+	}
+	if locked, err := IsPasswordLocked("bob"); err != nil || !locked {
+		t.Errorf("IsPasswordLocked(bob) = %v, %v; want true", locked, err)
+	}
+	if PasswordChangePending("alice") || !PasswordChangePending("bob") {
+		t.Error("PasswordChangePending misreads the last change field")
+	}
+	if _, err := shadowHash("+"); err == nil {
+		t.Error("shadowHash found the NIS compat entry")
+	}
+}
@@ -1,15 +1,23 @@
 package tunneluser
 
 import (
+	"bufio"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
-	"os/exec"
+	"os"
 	"strings"
+	"time"
 )
 
 // GeneratePassword generates a secure random password (16 chars, alphanumeric).
+// Low entropy only prints an advisory: once the kernel pool is initialized,
+// crypto/rand doesn't need more.
 func GeneratePassword() (string, error) {
+	if err := CheckEntropyAvailable(); err != nil {
+		fmt.Fprintf(out, "Warning: %v; %s\n", err, EntropyAdvice)
+	}
+
 	// Generate 18 bytes of random data
 	b := make([]byte, 18)
 	if _, err := rand.Read(b); err != nil {
@@ -28,13 +36,156 @@ func GeneratePassword() (string, error) {
 	return password, nil
 }
 
-// SetPassword sets the password for a user using chpasswd.
+// SetPassword sets the password for a user using chpasswd and clears any
+// pending forced change, so the password works for tunnel logins.
 func SetPassword(username, password string) error {
-	cmd := exec.Command("chpasswd")
+	return setPassword(SystemName(username), password)
+}
+
+// setPassword is SetPassword for an account name.
+func setPassword(username, password string) error {
+	cmd := CommandExecutor("chpasswd")
 	cmd.Stdin = strings.NewReader(fmt.Sprintf("%s:%s", username, password))
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to set password: %w", err)
 	}
-	fmt.Println("Password configured")
+	// Tunnel users have nologin shells and can never answer a "must
+	// change" prompt, so a PAM or distribution default that expires new
+	// passwords would lock them out. ExpirePassword opts back in.
+	if err := unexpirePassword(username); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "Password configured")
+	return nil
+}
+
+// unexpirePassword clears a pending forced password change by recording
+// today as the last password change (chage -d).
+func unexpirePassword(username string) error {
+	today := time.Now().Format("2006-01-02")
+	if err := CommandExecutor("chage", "-d", today, username).Run(); err != nil {
+		return fmt.Errorf("failed to clear password expiry: %w", err)
+	}
+	return nil
+}
+
+// RotateAllPasswords sets a new generated password for every password auth
+// tunnel user and returns them by username. Key users are skipped. On
+// failure the passwords already changed are returned with the error, so
+// they are not lost.
+func RotateAllPasswords() (map[string]string, error) {
+	users, err := ListByAuthMode(AuthModePassword)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+
+	rotated := make(map[string]string, len(users))
+	var failed []string
+	for _, u := range users {
+		password, err := GeneratePassword()
+		if err == nil {
+			err = SetPassword(u.Username, password)
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", u.Username, err))
+			continue
+		}
+		rotated[u.Username] = password
+	}
+	if len(failed) > 0 {
+		return rotated, fmt.Errorf("some passwords could not be rotated: %s", strings.Join(failed, "; "))
+	}
+	return rotated, nil
+}
+
+// ExpirePassword expires the user's password (chage -d 0), so the next
+// login must choose a new one before anything else is allowed.
+func ExpirePassword(username string) error {
+	return expirePassword(SystemName(username))
+}
+
+// expirePassword is ExpirePassword for an account name.
+func expirePassword(username string) error {
+	if err := CommandExecutor("chage", "-d", "0", username).Run(); err != nil {
+		return fmt.Errorf("failed to expire password: %w", err)
+	}
+	fmt.Fprintln(out, "Password expired: it must be changed at the first login")
+	return nil
+}
+
+// PasswordChangePending reports whether the user's password was expired by
+// ExpirePassword and not changed since (last change field 0 in
+// /etc/shadow). Reading /etc/shadow requires root.
+func PasswordChangePending(username string) bool {
+	return passwordChangePending(SystemName(username))
+}
+
+// passwordChangePending is PasswordChangePending for an account name.
+func passwordChangePending(username string) bool {
+	data, err := os.ReadFile(ShadowFile)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		parts, ok := dbFields(line, 3)
+		if ok && parts[0] == username {
+			return parts[2] == "0"
+		}
+	}
+	return false
+}
+
+// IsPasswordLocked reports whether the user's password is locked in /etc/shadow
+// (hash field prefixed with "!"). Reading /etc/shadow requires root.
+func IsPasswordLocked(username string) (bool, error) {
+	return isPasswordLocked(SystemName(username))
+}
+
+// isPasswordLocked is IsPasswordLocked for an account name.
+func isPasswordLocked(username string) (bool, error) {
+	hash, err := shadowHash(username)
+	if err != nil {
+		return false, err
+	}
+	return strings.HasPrefix(hash, "!"), nil
+}
+
+// unlockPassword unlocks a password locked with usermod -L. A user who never
+// had a password ("!" or "!!" alone) is left locked, as unlocking would leave
+// the account without one.
+func unlockPassword(username string) error {
+	hash, err := shadowHash(username)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(hash, "!") || strings.Trim(hash, "!") == "" || strings.Trim(hash, "!") == "*" {
+		return nil
+	}
+	if err := CommandExecutor("usermod", "-U", username).Run(); err != nil {
+		return fmt.Errorf("failed to unlock password: %w", err)
+	}
 	return nil
 }
+
+// shadowHash returns the password field of the user's /etc/shadow entry.
+// Reading /etc/shadow requires root.
+func shadowHash(username string) (string, error) {
+	file, err := os.Open(ShadowFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Format: username:password:lastchg:min:max:warn:inactive:expire:
+		parts, ok := dbFields(scanner.Text(), 2)
+		if ok && parts[0] == username {
+			return parts[1], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("user '%s' not found in /etc/shadow", username)
+}
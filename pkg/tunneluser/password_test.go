@@ -0,0 +1,61 @@
+package tunneluser_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+	"github.com/net2share/sshtun-user/pkg/tunneltesting"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+)
+
+func TestSetPasswordClearsExpiry(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.ExpireNewPasswords = true
+	fs.Install()
+	createUser(t, "alice", tunneluser.AuthModePassword)
+	if tunneluser.PasswordChangePending("alice") {
+		t.Fatal("password of a new user left expired")
+	}
+
+	if err := tunneluser.ExpirePassword("alice"); err != nil {
+		t.Fatalf("ExpirePassword: %v", err)
+	}
+	if err := tunneluser.SetPassword("alice", "new password"); err != nil {
+		t.Fatalf("SetPassword: %v", err)
+	}
+	if tunneluser.PasswordChangePending("alice") {
+		t.Error("password left expired after SetPassword")
+	}
+}
+
+func TestFindStaleTTYGrants(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+	createUser(t, "alice", tunneluser.AuthModePassword)
+
+	// The Match block applyUserConfig writes while the change is pending
+	path := sshdconfig.UserConfigPath(tunneluser.SystemName("alice"))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("Match User "+tunneluser.SystemName("alice")+"\n    PermitTTY yes\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := tunneluser.ExpirePassword("alice"); err != nil {
+		t.Fatalf("ExpirePassword: %v", err)
+	}
+	if stale, err := tunneluser.FindStaleTTYGrants(); err != nil || len(stale) != 0 {
+		t.Errorf("FindStaleTTYGrants while the change is pending = %v, %v; want none", stale, err)
+	}
+
+	if err := tunneluser.SetPassword("alice", "new password"); err != nil {
+		t.Fatalf("SetPassword: %v", err)
+	}
+	stale, err := tunneluser.FindStaleTTYGrants()
+	if err != nil || !slices.Equal(stale, []string{tunneluser.SystemName("alice")}) {
+		t.Errorf("FindStaleTTYGrants after the change = %v, %v; want [%s]", stale, err, tunneluser.SystemName("alice"))
+	}
+}
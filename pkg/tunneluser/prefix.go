@@ -0,0 +1,54 @@
+package tunneluser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// UserPrefix namespaces tunnel users: the account of user "alice" is
+// UserPrefix+"alice", and List and IsTunnelUser ignore accounts without the
+// prefix. Empty (the default) disables namespacing. Change it with
+// SetUserPrefix.
+var UserPrefix string
+
+// userPrefixPattern matches prefixes that keep the account name valid and
+// end in a separator, so team-a- never matches the accounts of team-ab-.
+var userPrefixPattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]*[-_]$`)
+
+// SetUserPrefix sets the tunnel username prefix. It must end in "-" or "_"
+// (team-a-alice).
+func SetUserPrefix(prefix string) error {
+	if prefix != "" && !userPrefixPattern.MatchString(prefix) {
+		return fmt.Errorf("invalid user prefix %q: must start with a lowercase letter or _, contain only a-z, 0-9, - and _, and end in - or _", prefix)
+	}
+	if prefix != UserPrefix {
+		DefaultCache.Invalidate()
+	}
+	UserPrefix = prefix
+	return nil
+}
+
+// SystemName returns the account name for the logical name username, which
+// is always UserPrefix+username: with the prefix team-a-, "team-a-alice"
+// is the account team-a-team-a-alice, not the account of "alice". Use
+// LogicalName to go from an account name back to the logical name.
+func SystemName(username string) string {
+	return UserPrefix + username
+}
+
+// LogicalName returns the logical name of a system account, the name the
+// exported functions of this package take. ok is false for accounts outside
+// the UserPrefix namespace.
+func LogicalName(account string) (username string, ok bool) {
+	if !hasUserPrefix(account) {
+		return "", false
+	}
+	return strings.TrimPrefix(account, UserPrefix), true
+}
+
+// hasUserPrefix reports whether an account belongs to the UserPrefix
+// namespace.
+func hasUserPrefix(account string) bool {
+	return len(account) > len(UserPrefix) && strings.HasPrefix(account, UserPrefix)
+}
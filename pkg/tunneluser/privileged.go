@@ -0,0 +1,52 @@
+package tunneluser
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"slices"
+)
+
+// ErrRefusingPrivilegedUser is returned when an operation targets root or an
+// administrator, which would risk locking the operator out of the server.
+var ErrRefusingPrivilegedUser = errors.New("refusing to modify privileged user")
+
+// adminGroups are the groups granting sudo rights on common distributions.
+var adminGroups = []string{"sudo", "wheel", "admin"}
+
+// checkNotPrivileged returns ErrRefusingPrivilegedUser if the user has UID 0
+// or belongs to an admin group. Users that don't exist are not privileged,
+// but when the user or their groups can't be looked up the user is refused,
+// since a failed lookup says nothing about their privileges.
+func checkNotPrivileged(username string) error {
+	u, err := lookupUser(username)
+	if err != nil {
+		var unknown user.UnknownUserError
+		if errors.As(err, &unknown) {
+			return nil
+		}
+		return fmt.Errorf("%w: could not look up '%s': %w", ErrRefusingPrivilegedUser, username, err)
+	}
+	if u.Uid == "0" {
+		return fmt.Errorf("%w: '%s' has UID 0", ErrRefusingPrivilegedUser, username)
+	}
+
+	gids, err := lookupGroupIds(u)
+	if err != nil {
+		return fmt.Errorf("%w: could not look up the groups of '%s': %w", ErrRefusingPrivilegedUser, username, err)
+	}
+	for _, name := range adminGroups {
+		g, err := lookupGroup(name)
+		if err != nil {
+			var unknown user.UnknownGroupError
+			if errors.As(err, &unknown) {
+				continue
+			}
+			return fmt.Errorf("%w: could not look up the %s group: %w", ErrRefusingPrivilegedUser, name, err)
+		}
+		if slices.Contains(gids, g.Gid) {
+			return fmt.Errorf("%w: '%s' is in the %s group", ErrRefusingPrivilegedUser, username, name)
+		}
+	}
+	return nil
+}
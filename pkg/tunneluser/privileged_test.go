@@ -0,0 +1,79 @@
+package tunneluser
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useAccountFiles points PasswdFile and GroupFile at scratch files with the
+// given content until the test ends.
+func useAccountFiles(t *testing.T, passwd, group string) {
+	t.Helper()
+	dir := t.TempDir()
+	previousPasswd, previousGroup := PasswdFile, GroupFile
+	t.Cleanup(func() { PasswdFile, GroupFile = previousPasswd, previousGroup })
+	PasswdFile = filepath.Join(dir, "passwd")
+	GroupFile = filepath.Join(dir, "group")
+	for path, content := range map[string]string{PasswdFile: passwd, GroupFile: group} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCheckNotPrivileged(t *testing.T) {
+	passwd := "root:x:0:0:root:/root:/bin/bash\n" +
+		"toor:x:0:1000::/root:/bin/sh\n" +
+		"ops:x:1001:1001::/home/ops:/bin/bash\n" +
+		"dev:x:1002:10::/home/dev:/bin/bash\n" +
+		"tunnel:x:1003:1003::/nonexistent:/usr/sbin/nologin\n"
+	group := "root:x:0:\n" +
+		"wheel:x:10:\n" +
+		"sudo:x:27:admin, ops\n" +
+		"ops:x:1001:\n" +
+		"tunnel:x:1003:\n"
+	useAccountFiles(t, passwd, group)
+
+	tests := []struct {
+		username string
+		refused  bool
+	}{
+		{username: "root", refused: true},
+		{username: "toor", refused: true},    // UID 0 under another name
+		{username: "ops", refused: true},     // Supplementary member of sudo
+		{username: "dev", refused: true},     // Primary group wheel
+		{username: "tunnel", refused: false}, // Ordinary user
+		{username: "nobody", refused: false}, // Doesn't exist
+	}
+	for _, tt := range tests {
+		err := checkNotPrivileged(tt.username)
+		if refused := errors.Is(err, ErrRefusingPrivilegedUser); refused != tt.refused || (!tt.refused && err != nil) {
+			t.Errorf("checkNotPrivileged(%s) = %v, want refused %v", tt.username, err, tt.refused)
+		}
+	}
+}
+
+func TestCheckNotPrivilegedFailsClosed(t *testing.T) {
+	tests := []struct {
+		name string
+		file *string // Account file that goes missing
+	}{
+		{name: "missing passwd", file: &PasswdFile},
+		{name: "missing group", file: &GroupFile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useAccountFiles(t, "tunnel:x:1003:1003::/nonexistent:/usr/sbin/nologin\n", "tunnel:x:1003:\n")
+			if err := os.Remove(*tt.file); err != nil {
+				t.Fatal(err)
+			}
+			err := checkNotPrivileged("tunnel")
+			if !errors.Is(err, ErrRefusingPrivilegedUser) || !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("checkNotPrivileged = %v, want a refusal wrapping the lookup error", err)
+			}
+		})
+	}
+}
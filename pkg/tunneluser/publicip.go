@@ -0,0 +1,49 @@
+package tunneluser
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// publicIPURL returns the caller's public IP address as plain text.
+const publicIPURL = "https://api.ipify.org"
+
+// publicIPTimeout bounds GetServerPublicIP so an offline server doesn't
+// stall user creation.
+const publicIPTimeout = 3 * time.Second
+
+// GetServerPublicIP asks api.ipify.org for the address this server reaches
+// the internet from. Behind NAT this is the router's address, which is what
+// clients connect to.
+func GetServerPublicIP() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), publicIPTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, publicIPURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to detect public IP: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to detect public IP: %s returned %s", publicIPURL, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return "", fmt.Errorf("failed to detect public IP: %w", err)
+	}
+	ip := strings.TrimSpace(string(body))
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("failed to detect public IP: unexpected response %q", ip)
+	}
+	return ip, nil
+}
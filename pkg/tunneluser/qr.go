@@ -0,0 +1,50 @@
+package tunneluser
+
+import (
+	"encoding/json"
+	"fmt"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// ConnectionProfile is the connection data GenerateConnectionQR encodes, for
+// mobile SSH clients that import profiles from a QR code. It never holds a
+// credential: password users get their password in a separate code.
+type ConnectionProfile struct {
+	Host           string   `json:"host"`
+	Port           int      `json:"port"`
+	Username       string   `json:"username"`
+	AuthType       AuthMode `json:"auth_type"`
+	PrivateKeyHint string   `json:"private_key_hint,omitempty"` // Set for key auth
+}
+
+// GenerateConnectionQR returns a QR code of the user's ConnectionProfile as
+// JSON, drawn with Unicode half blocks for printing to a terminal. account
+// is the login name, with UserPrefix, as in CreatedUserInfo.Username.
+func GenerateConnectionQR(account, serverHost string, port int, authMode AuthMode) (string, error) {
+	if serverHost == "" {
+		return "", fmt.Errorf("server host required for the connection QR code")
+	}
+	if port < 1 || port > 65535 {
+		return "", fmt.Errorf("invalid port %d: must be between 1 and 65535", port)
+	}
+	profile := ConnectionProfile{
+		Host:     serverHost,
+		Port:     port,
+		Username: account,
+		AuthType: authMode,
+	}
+	if authMode == AuthModeKey {
+		profile.PrivateKeyHint = "add the private key matching the public key installed for this user"
+	}
+
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return "", err
+	}
+	qr, err := qrcode.New(string(data), qrcode.Medium)
+	if err != nil {
+		return "", fmt.Errorf("failed to render QR code: %w", err)
+	}
+	return qr.ToSmallString(false), nil
+}
@@ -0,0 +1,39 @@
+package tunneluser
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUserQuotaExceeded is returned by Create when MaxUsers tunnel users
+// already exist.
+var ErrUserQuotaExceeded = errors.New("tunnel user quota exceeded")
+
+// MaxUsers caps the number of tunnel users Create allows. 0 means unlimited.
+// Change it with SetMaxUsers.
+var MaxUsers int
+
+// SetMaxUsers sets the tunnel user cap. 0 disables it.
+func SetMaxUsers(n int) error {
+	if n < 0 {
+		return fmt.Errorf("invalid max users %d: must be 0 (unlimited) or more", n)
+	}
+	MaxUsers = n
+	return nil
+}
+
+// checkQuota returns ErrUserQuotaExceeded when another tunnel user would
+// exceed MaxUsers.
+func checkQuota() error {
+	if MaxUsers == 0 {
+		return nil
+	}
+	users, err := List()
+	if err != nil {
+		return fmt.Errorf("failed to count tunnel users: %w", err)
+	}
+	if len(users) >= MaxUsers {
+		return fmt.Errorf("%w: %d of %d users exist", ErrUserQuotaExceeded, len(users), MaxUsers)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package tunneluser
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/net2share/sshtun-user/pkg/paths"
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+)
+
+// SFTPRoot holds the chroot home directories of SFTP-enabled users.
+var SFTPRoot = "/srv/sshtun-sftp"
+
+// sftpRoot returns SFTPRoot below paths.RootDir.
+func sftpRoot() string {
+	return paths.Join(SFTPRoot)
+}
+
+// SFTPOnlyHomeRoot holds the chroot home directories of SFTP-only users
+// (AuthModeSFTP), as set by sshdconfig.SFTPChrootDirectory.
+const SFTPOnlyHomeRoot = "/home"
+
+// Writable directories inside the chroot of SFTP-enabled and SFTP-only users.
+const (
+	sftpUploadDir     = "upload"
+	sftpOnlyUploadDir = "uploads"
+)
+
+// setupSFTPHome creates the user's chroot under SFTPRoot.
+func setupSFTPHome(username string) error {
+	return setupChroot(sftpRoot(), filepath.Join(sftpRoot(), username), sftpUploadDir, username)
+}
+
+// setupSFTPOnlyHome creates the chroot of an SFTP-only user.
+func setupSFTPOnlyHome(username string) error {
+	root := paths.Join(SFTPOnlyHomeRoot)
+	return setupChroot(root, filepath.Join(root, username), sftpOnlyUploadDir, username)
+}
+
+// setupChroot creates a chroot home below root. sshd requires the chroot and
+// its parents to be root-owned and not group/world-writable, so the user
+// only gets write access to the upload directory inside it.
+func setupChroot(root, home, uploadDir, username string) error {
+	if err := os.MkdirAll(home, 0755); err != nil {
+		return fmt.Errorf("failed to create SFTP home: %w", err)
+	}
+	if err := os.Chmod(home, 0755); err != nil {
+		return fmt.Errorf("failed to set SFTP home permissions: %w", err)
+	}
+	if err := CommandExecutor("chown", "root:root", root, home).Run(); err != nil {
+		return fmt.Errorf("failed to set SFTP home ownership: %w", err)
+	}
+
+	upload := filepath.Join(home, uploadDir)
+	if err := os.MkdirAll(upload, 0750); err != nil {
+		return fmt.Errorf("failed to create SFTP upload directory: %w", err)
+	}
+	if err := CommandExecutor("chown", username+":", upload).Run(); err != nil {
+		return fmt.Errorf("failed to set SFTP upload directory ownership: %w", err)
+	}
+	return nil
+}
+
+// removeSFTPHome removes the user's chroot if it holds no files, so uploaded
+// data is never deleted.
+func removeSFTPHome(username string) {
+	home := filepath.Join(sftpRoot(), username)
+	os.Remove(filepath.Join(home, sftpUploadDir))
+	os.Remove(home)
+}
+
+// removeSFTPOnlyHome is removeSFTPHome for an SFTP-only user.
+func removeSFTPOnlyHome(username string) {
+	home := sftpOnlyHome(username)
+	os.Remove(paths.Join(filepath.Join(home, sftpOnlyUploadDir)))
+	os.Remove(paths.Join(home))
+}
+
+// sftpOnlyHome returns the home directory of an SFTP-only user as recorded
+// in /etc/passwd.
+func sftpOnlyHome(username string) string {
+	return filepath.Join(SFTPOnlyHomeRoot, username)
+}
+
+// validateSFTPOnly rejects settings that don't apply to SFTP-only users,
+// which have no tunnels and a fixed chroot home.
+func validateSFTPOnly(cfg *Config) error {
+	switch {
+	case cfg.TunnelType != TunnelTypeAny || len(cfg.PermitOpen) > 0:
+		return fmt.Errorf("SFTP-only users can't forward ports")
+	case cfg.EnableSFTP:
+		return fmt.Errorf("SFTP-only users already have SFTP access")
+	case cfg.HomeDir != "" || cfg.CreateHome:
+		return fmt.Errorf("SFTP-only users always get the chroot %s", sftpOnlyHome(cfg.Username))
+	}
+	// Without its Match block the group would get the global defaults,
+	// which allow forwarding
+	if !sshdconfig.HasMatchGroup(GroupSFTP) {
+		return fmt.Errorf("sshd configuration has no Match block for %s; run 'sshtun-user configure --force'", GroupSFTP)
+	}
+	return nil
+}
@@ -1,57 +1,274 @@
 package tunneluser
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
-)
+	"strings"
 
-const (
-	// AuthorizedKeysDir is where SSH keys are stored for tunnel users.
-	AuthorizedKeysDir = "/etc/ssh/authorized_keys.d"
+	"github.com/net2share/sshtun-user/pkg/paths"
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
 )
 
-// ValidatePublicKey validates an SSH public key format.
+// AuthorizedKeysDir is where SSH keys are stored for tunnel users.
+// Change it with SetAuthorizedKeysDir so the sshd directive stays in sync.
+var AuthorizedKeysDir = "/etc/ssh/authorized_keys.d"
+
+// SetAuthorizedKeysDir sets the directory holding tunnel user keys and the
+// directory referenced by the AuthorizedKeysFile directive written to sshd.
+func SetAuthorizedKeysDir(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("authorized keys directory must be an absolute path: %s", path)
+	}
+	if err := sshdconfig.SetAuthorizedKeysDir(path); err != nil {
+		return err
+	}
+	AuthorizedKeysDir = filepath.Clean(path)
+	return nil
+}
+
+// authorizedKeysDir returns AuthorizedKeysDir below paths.RootDir.
+func authorizedKeysDir() string {
+	return paths.Join(AuthorizedKeysDir)
+}
+
+// centralKeyFile returns the path of a user's key file in AuthorizedKeysDir.
+func centralKeyFile(username string) string {
+	return filepath.Join(authorizedKeysDir(), username)
+}
+
+// keyFilePath returns the path KeyStorage puts a user's key file at. In
+// per-user mode it is "" while the user has no home directory.
+func keyFilePath(username string) string {
+	if KeyStorage == KeyStoragePerUser {
+		return perUserKeyFile(lookupHome(username))
+	}
+	return centralKeyFile(username)
+}
+
+// existingKeyFile returns the user's key file in either layout, preferring
+// the one for KeyStorage, or "" if there is none.
+func existingKeyFile(username string) string {
+	candidates := []string{centralKeyFile(username), perUserKeyFile(lookupHome(username))}
+	if KeyStorage == KeyStoragePerUser {
+		candidates[0], candidates[1] = candidates[1], candidates[0]
+	}
+	for _, path := range candidates {
+		if path != "" && fileExists(path) {
+			return path
+		}
+	}
+	return ""
+}
+
+// keyTypePattern matches the key types accepted by ValidatePublicKey.
+var keyTypePattern = regexp.MustCompile(`^(ssh-rsa|ssh-ed25519|ecdsa-sha2-nistp\d+|ssh-dss)$`)
+
+// KeyInfo describes one public key installed for a user.
+type KeyInfo struct {
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint"`     // SHA256 fingerprint, as printed by ssh-keygen -l
+	Label       string `json:"label,omitempty"` // Trailing comment of the key line
+}
+
+// splitPublicKey splits a public key line into its type, base64 data and
+// optional trailing comment.
+func splitPublicKey(key string) (keyType, data, comment string, err error) {
+	fields := strings.Fields(key)
+	if len(fields) < 2 || !keyTypePattern.MatchString(fields[0]) {
+		return "", "", "", fmt.Errorf("invalid public key format")
+	}
+	if _, err := base64.StdEncoding.DecodeString(fields[1]); err != nil {
+		return "", "", "", fmt.Errorf("invalid public key data: %w", err)
+	}
+	return fields[0], fields[1], strings.Join(fields[2:], " "), nil
+}
+
+// ValidatePublicKey validates an SSH public key format. The trailing comment
+// is optional. An RSA key below MinRSABits yields an error wrapping
+// ErrWeakRSAKey; the key is otherwise well-formed. Whether the key is
+// installed is decided by CheckKeyPolicy.
 func ValidatePublicKey(key string) error {
-	// Match common SSH public key formats
-	pattern := `^(ssh-rsa|ssh-ed25519|ecdsa-sha2-nistp\d+|ssh-dss) `
-	matched, err := regexp.MatchString(pattern, key)
+	return validatePublicKey(key, MinRSABits)
+}
+
+// ValidatePublicKeyStrict is ValidatePublicKey for keys entered in the
+// interactive menu: RSA keys need StrictMinRSABits and DSA keys are
+// rejected with ErrKeyTypeNotAllowed.
+func ValidatePublicKeyStrict(key string) error {
+	keyType, _, _, err := splitPublicKey(key)
 	if err != nil {
-		return fmt.Errorf("failed to validate key: %w", err)
+		return err
+	}
+	if keyType == "ssh-dss" {
+		return fmt.Errorf("%w: ssh-dss (DSA keys are limited to 1024 bits)", ErrKeyTypeNotAllowed)
+	}
+	return validatePublicKey(key, StrictMinRSABits)
+}
+
+// validatePublicKey checks the key format and that an RSA key has at least
+// minBits.
+func validatePublicKey(key string, minBits int) error {
+	keyType, data, _, err := splitPublicKey(key)
+	if err != nil || keyType != "ssh-rsa" {
+		return err
+	}
+	raw, _ := base64.StdEncoding.DecodeString(data)
+	bits, err := rsaKeyBits(raw)
+	if err != nil {
+		return err
 	}
-	if !matched {
-		return fmt.Errorf("invalid public key format")
+	if bits < minBits {
+		return fmt.Errorf("%w: %d bits, fewer than %d", ErrWeakRSAKey, bits, minBits)
 	}
 	return nil
 }
 
-// SetupSSHKey configures an SSH public key for a tunnel user.
+// ValidateKeyLabel checks that a key label fits on a single key line.
+func ValidateKeyLabel(label string) error {
+	if strings.ContainsAny(label, "\r\n\t") {
+		return fmt.Errorf("invalid key label %q: must be a single line", label)
+	}
+	return nil
+}
+
+// WithKeyLabel returns the public key with its comment replaced by label.
+// An empty label keeps the key's own comment.
+func WithKeyLabel(key, label string) (string, error) {
+	keyType, data, comment, err := splitPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	if err := ValidateKeyLabel(label); err != nil {
+		return "", err
+	}
+	if label = strings.TrimSpace(label); label != "" {
+		comment = label
+	}
+	if comment == "" {
+		return keyType + " " + data, nil
+	}
+	return keyType + " " + data + " " + comment, nil
+}
+
+// KeyFingerprints returns the type, fingerprint and label of each public key
+// installed for username. A missing key file yields no keys.
+func KeyFingerprints(username string) ([]KeyInfo, error) {
+	return keyFingerprints(SystemName(username))
+}
+
+// keyFingerprints is KeyFingerprints for an account name.
+func keyFingerprints(username string) ([]KeyInfo, error) {
+	path := existingKeyFile(username)
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	var keys []KeyInfo
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keyType, blob, comment, err := splitPublicKey(stripKeyOptions(line))
+		if err != nil {
+			continue
+		}
+		raw, _ := base64.StdEncoding.DecodeString(blob)
+		sum := sha256.Sum256(raw)
+		keys = append(keys, KeyInfo{
+			Type:        keyType,
+			Fingerprint: "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]),
+			Label:       comment,
+		})
+	}
+	return keys, nil
+}
+
+// SetupSSHKey configures an SSH public key for a tunnel user, in the layout
+// selected by KeyStorage. The key must satisfy CurrentKeyPolicy. A key file
+// in the other layout is removed. In per-user mode a user without a home
+// directory is given one below PerUserHomeRoot.
 func SetupSSHKey(username, publicKey string) error {
-	if err := ValidatePublicKey(publicKey); err != nil {
+	return setupSSHKey(SystemName(username), publicKey)
+}
+
+// setupSSHKey is SetupSSHKey for an account name.
+func setupSSHKey(username, publicKey string) error {
+	if err := CheckKeyPolicy(publicKey); err != nil {
 		return err
 	}
 
-	// Create authorized_keys.d directory
-	if err := os.MkdirAll(AuthorizedKeysDir, 0755); err != nil {
-		return fmt.Errorf("failed to create authorized_keys.d: %w", err)
+	authKeysFile, err := writeKeyFile(username, keyFileContent(publicKey))
+	if err != nil {
+		return err
 	}
+	fmt.Fprintf(out, "SSH public key configured at: %s\n", authKeysFile)
+	return nil
+}
 
-	authKeysFile := filepath.Join(AuthorizedKeysDir, username)
+// writeKeyFile writes the user's key file in the layout selected by
+// KeyStorage, owned by root, removes a key file in the other layout and
+// returns the path written.
+func writeKeyFile(username, content string) (string, error) {
+	var authKeysFile string
+	if KeyStorage == KeyStoragePerUser {
+		home, err := ensurePerUserHome(username)
+		if err != nil {
+			return "", err
+		}
+		if err := setupPerUserKeyDir(home); err != nil {
+			return "", err
+		}
+		authKeysFile = perUserKeyFile(home)
+	} else {
+		// Create authorized_keys.d directory
+		if err := os.MkdirAll(authorizedKeysDir(), 0755); err != nil {
+			return "", fmt.Errorf("failed to create authorized_keys.d: %w", err)
+		}
+		authKeysFile = centralKeyFile(username)
+	}
 
-	// Write the public key with restrictions
-	// "restrict" enables all restrictions, "port-forwarding" re-enables just that
-	content := fmt.Sprintf("restrict,port-forwarding %s\n", publicKey)
 	if err := os.WriteFile(authKeysFile, []byte(content), 0644); err != nil {
-		return fmt.Errorf("failed to write authorized_keys file: %w", err)
+		return "", fmt.Errorf("failed to write authorized_keys file: %w", err)
 	}
 
 	// Set ownership to root
-	if err := exec.Command("chown", "root:root", authKeysFile).Run(); err != nil {
-		return fmt.Errorf("failed to set ownership: %w", err)
+	if err := CommandExecutor("chown", "root:root", authKeysFile).Run(); err != nil {
+		return "", fmt.Errorf("failed to set ownership: %w", err)
 	}
 
-	fmt.Printf("SSH public key configured at: %s\n", authKeysFile)
-	return nil
+	// Drop a key left in the other layout
+	var err error
+	if KeyStorage == KeyStoragePerUser {
+		err = removeCentralKeyFile(username)
+	} else {
+		err = removePerUserKeys(lookupHome(username))
+	}
+	if err != nil {
+		return "", err
+	}
+	return authKeysFile, nil
+}
+
+// stripKeyOptions returns a key line without the options field written by
+// keyFileContent.
+func stripKeyOptions(line string) string {
+	if fields := strings.Fields(line); len(fields) > 0 && !keyTypePattern.MatchString(fields[0]) {
+		return strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+	}
+	return line
+}
+
+// keyFileContent returns the authorized_keys line written for a public key,
+// prefixed with KeyOptions.
+func keyFileContent(publicKey string) string {
+	return fmt.Sprintf("%s %s\n", KeyOptions, publicKey)
 }
@@ -0,0 +1,114 @@
+package tunneluser
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"os/user"
+	"slices"
+	"strings"
+)
+
+// CommandExecutor creates the commands that change accounts and files
+// (useradd, usermod, gpasswd, chpasswd, chage, chown, getent and so on).
+// Tests replace it to run without root; see package tunneltesting.
+var CommandExecutor = exec.Command
+
+const (
+	defaultPasswdFile = "/etc/passwd"
+	defaultGroupFile  = "/etc/group"
+)
+
+// The account databases read directly. Unlike the files below
+// paths.RootDir, they are the real system's unless a test points them at
+// scratch copies, as tunneltesting.FakeSystem does.
+var (
+	PasswdFile = defaultPasswdFile
+	GroupFile  = defaultGroupFile
+	ShadowFile = "/etc/shadow"
+)
+
+// lookupUser is user.Lookup, except that it reads PasswdFile when that was
+// changed from /etc/passwd, since os/user always asks the real system.
+func lookupUser(username string) (*user.User, error) {
+	if PasswdFile == defaultPasswdFile {
+		return user.Lookup(username)
+	}
+
+	file, err := os.Open(PasswdFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Format: username:password:UID:GID:GECOS:home:shell
+		parts, ok := dbFields(scanner.Text(), 7)
+		if ok && parts[0] == username {
+			return &user.User{Uid: parts[2], Gid: parts[3], Username: parts[0], Name: parts[4], HomeDir: parts[5]}, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, user.UnknownUserError(username)
+}
+
+// lookupGroup is user.LookupGroup, except that it reads GroupFile when that
+// was changed from /etc/group. Like lookupUser it doesn't shell out, so a
+// getent that fails for a group without members can't hide the group.
+func lookupGroup(name string) (*user.Group, error) {
+	if GroupFile == defaultGroupFile {
+		return user.LookupGroup(name)
+	}
+
+	file, err := os.Open(GroupFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entry, found, err := parseGroupEntry(file, name)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, user.UnknownGroupError(name)
+	}
+	return &user.Group{Gid: entry.GID, Name: name}, nil
+}
+
+// lookupGroupIds is u.GroupIds, except that it reads GroupFile when that was
+// changed from /etc/group.
+func lookupGroupIds(u *user.User) ([]string, error) {
+	if GroupFile == defaultGroupFile {
+		return u.GroupIds()
+	}
+
+	file, err := os.Open(GroupFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gids := []string{u.Gid}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Format: group_name:password:GID:user_list
+		parts, ok := dbFields(scanner.Text(), 4)
+		if !ok || slices.Contains(gids, parts[2]) {
+			continue
+		}
+		for _, member := range strings.Split(parts[3], ",") {
+			if strings.TrimSpace(member) == u.Username {
+				gids = append(gids, parts[2])
+				break
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return gids, nil
+}
@@ -0,0 +1,211 @@
+package tunneluser
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/net2share/sshtun-user/pkg/paths"
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+)
+
+// ErrTOTPUnavailable is returned when TOTP is requested but the
+// pam_google_authenticator module is not installed.
+var ErrTOTPUnavailable = errors.New("pam_google_authenticator is not installed (install libpam-google-authenticator or google-authenticator)")
+
+// TOTPSecretDir holds the root-owned TOTP secrets of tunnel users. Keeping
+// them out of the users' (nonexistent) homes means users can't read or
+// replace them.
+var TOTPSecretDir = "/var/lib/sshtun-user/totp"
+
+// pamSSHDConfig is the PAM stack sshd authenticates keyboard-interactive
+// logins with.
+const pamSSHDConfig = "/etc/pam.d/sshd"
+
+// pamMarker tags the PAM line managed by sshtun-user.
+const pamMarker = "# sshtun-user TOTP"
+
+// pamModuleGlobs match pam_google_authenticator.so across distributions.
+var pamModuleGlobs = []string{
+	"/lib/security/pam_google_authenticator.so",
+	"/lib64/security/pam_google_authenticator.so",
+	"/usr/lib/security/pam_google_authenticator.so",
+	"/usr/lib64/security/pam_google_authenticator.so",
+	"/lib/*/security/pam_google_authenticator.so",
+	"/usr/lib/*/security/pam_google_authenticator.so",
+}
+
+// TOTPAvailable reports whether the pam_google_authenticator module is installed.
+func TOTPAvailable() bool {
+	for _, pattern := range pamModuleGlobs {
+		if matches, _ := filepath.Glob(pattern); len(matches) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// totpSecretPath returns the path of a user's TOTP secret file.
+func totpSecretPath(username string) string {
+	return filepath.Join(paths.Join(TOTPSecretDir), username)
+}
+
+// HasTOTP reports whether the user has a TOTP secret.
+func HasTOTP(username string) bool {
+	return hasTOTP(SystemName(username))
+}
+
+// hasTOTP is HasTOTP for an account name.
+func hasTOTP(username string) bool {
+	_, err := os.Stat(totpSecretPath(username))
+	return err == nil
+}
+
+// TOTPURL returns the otpauth:// URL authenticator apps import, usually via
+// a QR code. server may be empty.
+func TOTPURL(username, server, secret string) string {
+	username = SystemName(username)
+	account := username
+	if server != "" {
+		account += "@" + server
+	}
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", "sshtun-user")
+	return "otpauth://totp/" + url.PathEscape("sshtun-user:"+account) + "?" + q.Encode()
+}
+
+// checkTOTPSupport returns an error unless TOTP logins can work: the PAM
+// module must be installed and sshd must use PAM.
+func checkTOTPSupport() error {
+	if !TOTPAvailable() {
+		return ErrTOTPUnavailable
+	}
+	if usePAM, err := sshdconfig.EffectiveSetting("usepam"); err == nil && usePAM != "yes" {
+		return fmt.Errorf("TOTP requires UsePAM yes in sshd_config")
+	}
+	return nil
+}
+
+// setupTOTP ensures the PAM line and the user's secret exist. An existing
+// secret is kept; otherwise a new one is generated and returned.
+func setupTOTP(username string) (string, error) {
+	if err := checkTOTPSupport(); err != nil {
+		return "", err
+	}
+	if err := ensurePAMConfig(); err != nil {
+		return "", err
+	}
+	if hasTOTP(username) {
+		return "", nil
+	}
+
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate TOTP secret: %w", err)
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)
+
+	if err := os.MkdirAll(paths.Join(TOTPSecretDir), 0700); err != nil {
+		return "", fmt.Errorf("failed to create TOTP secret directory: %w", err)
+	}
+	// google-authenticator file format: secret, then options
+	content := secret + "\n\" RATE_LIMIT 3 30\n\" WINDOW_SIZE 3\n\" DISALLOW_REUSE\n\" TOTP_AUTH\n"
+	if err := os.WriteFile(totpSecretPath(username), []byte(content), 0400); err != nil {
+		return "", fmt.Errorf("failed to write TOTP secret: %w", err)
+	}
+	fmt.Fprintf(out, "TOTP secret stored at: %s\n", totpSecretPath(username))
+	return secret, nil
+}
+
+// removeTOTP removes the user's TOTP secret and reports whether one existed.
+func removeTOTP(username string) bool {
+	return os.Remove(totpSecretPath(username)) == nil
+}
+
+// pamLine returns the auth line added to the sshd PAM stack. nullok lets
+// users without a secret (everyone but TOTP tunnel users) log in unchanged.
+func pamLine() string {
+	return "auth required pam_google_authenticator.so secret=" + paths.Join(TOTPSecretDir) + "/${USER} user=root nullok " + pamMarker
+}
+
+// ensurePAMConfig adds the TOTP line to the sshd PAM stack after the
+// existing auth lines, so the password is checked before the code.
+func ensurePAMConfig() error {
+	path := paths.Join(pamSSHDConfig)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if strings.Contains(string(data), pamMarker) {
+		return nil
+	}
+
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	insert := len(lines)
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "auth" || (fields[0] == "@include" && len(fields) > 1 && fields[1] == "common-auth") {
+			insert = i + 1
+		}
+	}
+	lines = append(lines[:insert], append([]string{pamLine()}, lines[insert:]...)...)
+
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to update %s: %w", path, err)
+	}
+	fmt.Fprintf(out, "Added pam_google_authenticator to %s\n", path)
+	return nil
+}
+
+// RemovePAMConfig removes the TOTP line from the sshd PAM stack.
+func RemovePAMConfig() error {
+	path := paths.Join(pamSSHDConfig)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if !strings.Contains(string(data), pamMarker) {
+		return nil
+	}
+	var kept []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.Contains(line, pamMarker) {
+			kept = append(kept, line)
+		}
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(kept, "\n")), 0644); err != nil {
+		return fmt.Errorf("failed to update %s: %w", path, err)
+	}
+	return nil
+}
+
+// DisableTOTP removes the user's TOTP secret and the keyboard-interactive
+// requirement from their sshd settings, e.g. after switching to key auth.
+func DisableTOTP(username string) error {
+	username = SystemName(username)
+	removeTOTP(username)
+	opts, err := sshdconfig.ReadUserConfig(username)
+	if err != nil {
+		return err
+	}
+	if !opts.TOTP {
+		return nil
+	}
+	opts.TOTP = false
+	// Drop a terminal grant left from a finished password change
+	opts.PasswordChange = opts.PasswordChange && ttyGrantNeeded(username)
+	_, err = sshdconfig.WriteUserConfig(opts)
+	return err
+}
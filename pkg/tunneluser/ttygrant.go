@@ -0,0 +1,77 @@
+package tunneluser
+
+import (
+	"fmt"
+
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
+)
+
+// ttyGrantNeeded reports whether the user's Match block needs PermitTTY yes:
+// a password user whose forced first-login password change is pending.
+func ttyGrantNeeded(username string) bool {
+	mode, err := getAuthMode(username)
+	return err == nil && mode == AuthModePassword && passwordChangePending(username)
+}
+
+// FindStaleTTYGrants returns the tunnel users whose Match block still
+// allows a terminal (PermitTTY yes) although no first-login password change
+// is pending, e.g. because the user has since changed the expired password.
+// The per-user drop-in wins over the group's PermitTTY no, so the grant
+// stays until the drop-in is rewritten.
+func FindStaleTTYGrants() ([]string, error) {
+	users, err := List()
+	if err != nil {
+		return nil, err
+	}
+	var stale []string
+	for _, u := range users {
+		account := SystemName(u.Username)
+		opts, err := sshdconfig.ReadUserConfig(account)
+		if err != nil {
+			return nil, err
+		}
+		if opts.PasswordChange && !ttyGrantNeeded(account) {
+			stale = append(stale, u.Username)
+		}
+	}
+	return stale, nil
+}
+
+// RevokeStaleTTYGrant removes PermitTTY yes from the user's Match block
+// once no first-login password change is pending, reloading sshd, and
+// reports whether it did.
+func RevokeStaleTTYGrant(username string) (bool, error) {
+	username = SystemName(username)
+	opts, err := sshdconfig.ReadUserConfig(username)
+	if err != nil {
+		return false, err
+	}
+	if !opts.PasswordChange || ttyGrantNeeded(username) {
+		return false, nil
+	}
+	opts.PasswordChange = false
+	if _, err := sshdconfig.WriteUserConfig(opts); err != nil {
+		return false, fmt.Errorf("failed to revoke the terminal of %s: %w", username, err)
+	}
+	return true, nil
+}
+
+// RevokeStaleTTYGrants applies RevokeStaleTTYGrant to the users
+// FindStaleTTYGrants reports and returns the ones it changed.
+func RevokeStaleTTYGrants() ([]string, error) {
+	stale, err := FindStaleTTYGrants()
+	if err != nil {
+		return nil, err
+	}
+	var revoked []string
+	for _, username := range stale {
+		changed, err := RevokeStaleTTYGrant(username)
+		if err != nil {
+			return revoked, err
+		}
+		if changed {
+			revoked = append(revoked, username)
+		}
+	}
+	return revoked, nil
+}
@@ -0,0 +1,60 @@
+package tunneluser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TunnelType describes which kinds of forwarding a user needs.
+type TunnelType string
+
+const (
+	TunnelTypeAny     TunnelType = "any"     // Any local or dynamic forwarding (default)
+	TunnelTypeSOCKS   TunnelType = "socks"   // SOCKS proxy (ssh -D)
+	TunnelTypeForward TunnelType = "forward" // Specific port forwards only (ssh -L)
+	TunnelTypeBoth    TunnelType = "both"    // SOCKS proxy and specific port forwards
+)
+
+// TunnelTypes lists the valid tunnel types.
+var TunnelTypes = []TunnelType{TunnelTypeAny, TunnelTypeSOCKS, TunnelTypeForward, TunnelTypeBoth}
+
+// ParseTunnelType parses a tunnel type name. An empty string means TunnelTypeAny.
+func ParseTunnelType(s string) (TunnelType, error) {
+	if s == "" {
+		return TunnelTypeAny, nil
+	}
+	for _, t := range TunnelTypes {
+		if string(t) == s {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("invalid tunnel type %q: must be one of any, socks, forward, both", s)
+}
+
+// RestrictsDestinations reports whether the type limits forwarding to the
+// configured destinations. sshd can't tell SOCKS and local forwards apart
+// (both open direct-tcpip channels), so only the forward-only type is
+// enforced server-side; the others differ only in the client examples shown.
+func (t TunnelType) RestrictsDestinations() bool {
+	return t == TunnelTypeForward
+}
+
+// ValidatePermitOpen checks that each destination is in host:port form, as
+// accepted by sshd's PermitOpen. The port may be "*".
+func ValidatePermitOpen(destinations []string) error {
+	for _, d := range destinations {
+		i := strings.LastIndex(d, ":")
+		if i <= 0 || i == len(d)-1 {
+			return fmt.Errorf("invalid destination %q: must be host:port", d)
+		}
+		port := d[i+1:]
+		if port == "*" {
+			continue
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid destination %q: bad port", d)
+		}
+	}
+	return nil
+}
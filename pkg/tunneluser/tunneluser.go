@@ -3,38 +3,193 @@ package tunneluser
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
-	"os/user"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/net2share/sshtun-user/pkg/paths"
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
 )
 
+// out receives progress messages. Change it with SetOutput.
+var out io.Writer = os.Stdout
+
+// SetOutput redirects progress messages, e.g. to io.Discard for quiet or
+// machine-readable output.
+func SetOutput(w io.Writer) {
+	out = w
+}
+
+// Output returns the writer progress messages go to.
+func Output() io.Writer {
+	return out
+}
+
 // AuthMode represents the authentication method for a tunnel user.
 type AuthMode string
 
 const (
 	AuthModePassword AuthMode = "password"
 	AuthModeKey      AuthMode = "key"
+	// AuthModeSFTP users log in with a password for file transfer only,
+	// jailed to their home directory, without any tunnels.
+	AuthModeSFTP AuthMode = "sftp"
 )
 
-// Group names for tunnel users.
-const (
+// Group names for tunnel users. Change them with SetGroupNames.
+var (
 	GroupPasswordAuth = "sshtunnel-password"
 	GroupKeyAuth      = "sshtunnel-key"
 )
 
+// GroupSFTP is the group of SFTP-only users. It must match
+// sshdconfig.Options.SFTPGroup.
+var GroupSFTP = "sshtunnel-sftp"
+
+// groupNamePattern matches valid Linux group names.
+var groupNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+// SetGroupNames sets the names of the password and key tunnel groups.
+// The same names must be passed to sshdconfig.Options when configuring sshd.
+func SetGroupNames(passwordGroup, keyGroup string) error {
+	for _, name := range []string{passwordGroup, keyGroup} {
+		if !groupNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid group name: %q", name)
+		}
+	}
+	if passwordGroup == keyGroup {
+		return fmt.Errorf("password and key groups must differ")
+	}
+	if passwordGroup != GroupPasswordAuth || keyGroup != GroupKeyAuth {
+		DefaultCache.Invalidate()
+	}
+	GroupPasswordAuth = passwordGroup
+	GroupKeyAuth = keyGroup
+	return nil
+}
+
+// tunnelGroups returns the names of all tunnel groups.
+func tunnelGroups() []string {
+	return []string{GroupPasswordAuth, GroupKeyAuth, GroupSFTP}
+}
+
+// groupForMode returns the tunnel group of users with the given auth mode.
+func groupForMode(mode AuthMode) string {
+	switch mode {
+	case AuthModeKey:
+		return GroupKeyAuth
+	case AuthModeSFTP:
+		return GroupSFTP
+	}
+	return GroupPasswordAuth
+}
+
 // Config holds the configuration for creating a tunnel user.
 type Config struct {
-	Username  string
+	Username  string // Without UserPrefix; the account is SystemName(Username)
 	AuthMode  AuthMode
 	Password  string // For password auth
 	PublicKey string // For key auth
+	Shell     string // Login shell (default: detected nologin shell)
+
+	TunnelType TunnelType // Allowed forwarding (default: TunnelTypeAny)
+	PermitOpen []string   // Forwarding destinations (host:port) for TunnelTypeForward and TunnelTypeBoth
+
+	EnableSFTP bool // Chrooted SFTP access to a home directory under SFTPRoot
+
+	HomeDir    string // Home directory (default: DefaultHomeDir, or the SFTP chroot)
+	CreateHome bool   // Create HomeDir owned by the user (e.g. for file transfers)
+
+	EnableTOTP bool   // Require a TOTP code after the password (password auth only)
+	TOTPSecret string // Set by Reconcile when it generates a new TOTP secret
+
+	// VerboseLogging sets LogLevel VERBOSE in the user's Match User block,
+	// leaving the global log level alone
+	VerboseLogging bool
+
+	// ForcePasswordChange expires a newly set password, so the user has to
+	// replace it at the first login (password auth only). That login needs a
+	// terminal, so the user's Match block allows one while the change is
+	// pending.
+	ForcePasswordChange bool
+
+	Note string // Free-form description stored in the account comment
+
+	// CreatedByVersion is recorded in the account comment, so users created
+	// under older conventions can be found and migrated (default:
+	// sshdconfig.ToolVersion).
+	CreatedByVersion string
+
+	// AllowScheduledTasks leaves cron and at access alone. By default the
+	// user is blocked from scheduling jobs; see blockScheduledTasks.
+	// Existing blocks are not lifted.
+	AllowScheduledTasks bool
+}
+
+// CreatedUserInfo describes a newly created tunnel user. It is the result
+// shared by every create flow and is safe to serialize as JSON.
+type CreatedUserInfo struct {
+	Username               string     `json:"username"`
+	AuthMode               AuthMode   `json:"auth_mode"`
+	Password               string     `json:"password,omitempty"`   // Set for password auth
+	PublicKey              string     `json:"public_key,omitempty"` // Set for key auth
+	Shell                  string     `json:"shell"`
+	TunnelType             TunnelType `json:"tunnel_type"`
+	PermitOpen             []string   `json:"permit_open,omitempty"`
+	SFTP                   bool       `json:"sftp"`
+	HomeDir                string     `json:"home_dir,omitempty"`
+	Server                 string     `json:"server,omitempty"`                   // Server address used for client examples
+	TOTPSecret             string     `json:"totp_secret,omitempty"`              // Base32 secret for authenticator apps
+	TOTPURL                string     `json:"totp_url,omitempty"`                 // otpauth:// URL, e.g. for a QR code
+	PasswordChangeRequired bool       `json:"password_change_required,omitempty"` // First login must change the password
+	Note                   string     `json:"note,omitempty"`
+	Warnings               []string   `json:"warnings,omitempty"`
+}
+
+// nologinShells lists common nologin locations, in order of preference.
+var nologinShells = []string{
+	"/usr/sbin/nologin",
+	"/sbin/nologin",
+	"/usr/bin/nologin",
+	"/bin/false",
+	"/usr/bin/false",
+}
+
+// DetectNologinShell returns the first nologin shell present on the system,
+// falling back to /bin/false.
+func DetectNologinShell() string {
+	for _, shell := range nologinShells {
+		if err := ValidateShell(shell); err == nil {
+			return shell
+		}
+	}
+	return "/bin/false"
+}
+
+// ValidateShell checks that a shell path is absolute and points to an executable file.
+func ValidateShell(shell string) error {
+	if !filepath.IsAbs(shell) {
+		return fmt.Errorf("shell must be an absolute path: %s", shell)
+	}
+	info, err := os.Stat(shell)
+	if err != nil {
+		return fmt.Errorf("shell %s not found", shell)
+	}
+	if info.IsDir() || info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("shell %s is not executable", shell)
+	}
+	return nil
 }
 
-// EnsureGroups creates the tunnel user groups if they don't exist.
+// EnsureGroups creates the tunnel user groups if they don't exist, locally
+// or through NSS.
 func EnsureGroups() error {
-	for _, group := range []string{GroupPasswordAuth, GroupKeyAuth} {
-		if _, err := user.LookupGroup(group); err != nil {
-			cmd := exec.Command("groupadd", group)
+	for _, group := range tunnelGroups() {
+		if !groupExists(group) {
+			cmd := CommandExecutor("groupadd", group)
 			if err := cmd.Run(); err != nil {
 				return fmt.Errorf("failed to create group %s: %w", group, err)
 			}
@@ -43,81 +198,337 @@ func EnsureGroups() error {
 	return nil
 }
 
-// Exists checks if a user already exists.
+// MissingGroups returns the tunnel groups that don't exist.
+func MissingGroups() []string {
+	var missing []string
+	for _, group := range tunnelGroups() {
+		if !groupExists(group) {
+			missing = append(missing, group)
+		}
+	}
+	return missing
+}
+
+// Exists checks if the account of a user (with UserPrefix) already exists.
 func Exists(username string) bool {
-	_, err := user.Lookup(username)
+	return accountExists(SystemName(username))
+}
+
+// accountExists checks if a system account exists, regardless of UserPrefix.
+func accountExists(account string) bool {
+	_, err := lookupUser(account)
 	return err == nil
 }
 
 // Create creates a new tunnel user with the specified configuration.
+// It fails if the user already exists; use Reconcile to update an existing user.
 func Create(cfg *Config) error {
 	if cfg.Username == "" {
 		return fmt.Errorf("username is required")
 	}
+	account := SystemName(cfg.Username)
 
-	// Ensure groups exist
-	if err := EnsureGroups(); err != nil {
+	if err := checkNotPrivileged(account); err != nil {
 		return err
 	}
 
-	// Determine which group to use
-	userGroup := GroupPasswordAuth
-	if cfg.AuthMode == AuthModeKey {
-		userGroup = GroupKeyAuth
+	if accountExists(account) {
+		return fmt.Errorf("user '%s' already exists", account)
+	}
+
+	if err := checkQuota(); err != nil {
+		return err
+	}
+
+	if _, err := Reconcile(cfg); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "\nUser '%s' configured for tunnel-only access (%s auth)\n", account, cfg.AuthMode)
+	return nil
+}
+
+// Reconcile ensures the user account, group membership, credentials and
+// restrictions match cfg exactly, creating the user if needed. It returns
+// whether anything was changed, which makes it suitable for re-running from
+// configuration management.
+//
+// Password hashes cannot be compared with the desired password, so a
+// non-empty cfg.Password is always applied and reported as a change.
+func Reconcile(cfg *Config) (bool, error) {
+	defer DefaultCache.Invalidate()
+
+	if cfg.Username == "" {
+		return false, fmt.Errorf("username is required")
+	}
+
+	// Work on the account name; cfg.Username stays the name the caller gave
+	username := cfg.Username
+	cfg.Username = SystemName(username)
+	defer func() { cfg.Username = username }()
+
+	if err := checkNotPrivileged(cfg.Username); err != nil {
+		return false, err
 	}
 
-	if Exists(cfg.Username) {
-		// User exists, update group membership
-		fmt.Printf("User '%s' already exists, updating group to %s...\n", cfg.Username, userGroup)
+	shell := cfg.Shell
+	if shell == "" {
+		shell = DetectNologinShell()
+	} else if err := ValidateShell(shell); err != nil {
+		return false, err
+	}
 
-		// Remove from old tunnel groups
-		for _, g := range []string{GroupPasswordAuth, GroupKeyAuth} {
-			exec.Command("gpasswd", "-d", cfg.Username, g).Run()
+	if cfg.TunnelType == "" {
+		cfg.TunnelType = TunnelTypeAny
+	}
+	if _, err := ParseTunnelType(string(cfg.TunnelType)); err != nil {
+		return false, err
+	}
+	if err := ValidatePermitOpen(cfg.PermitOpen); err != nil {
+		return false, err
+	}
+	if cfg.TunnelType.RestrictsDestinations() && len(cfg.PermitOpen) == 0 {
+		return false, fmt.Errorf("tunnel type %s requires at least one destination", cfg.TunnelType)
+	}
+
+	if err := validateHome(cfg); err != nil {
+		return false, err
+	}
+	if cfg.EnableTOTP && cfg.AuthMode != AuthModePassword {
+		return false, fmt.Errorf("TOTP is only supported for password auth users")
+	}
+	if cfg.EnableTOTP {
+		if err := checkTOTPSupport(); err != nil {
+			return false, err
+		}
+	}
+	if cfg.ForcePasswordChange && cfg.AuthMode != AuthModePassword {
+		return false, fmt.Errorf("forcing a password change is only supported for password auth users")
+	}
+	if cfg.AuthMode == AuthModeSFTP {
+		if err := validateSFTPOnly(cfg); err != nil {
+			return false, err
 		}
+	}
+	if err := ValidateNote(cfg.Note); err != nil {
+		return false, err
+	}
 
-		// Add to new group
-		cmd := exec.Command("usermod", "-aG", userGroup, cfg.Username)
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to update user group: %w", err)
+	// Ensure groups exist
+	if err := EnsureGroups(); err != nil {
+		return false, err
+	}
+
+	// Determine which group to use
+	userGroup := groupForMode(cfg.AuthMode)
+
+	changed := false
+	created := false
+
+	if !accountExists(cfg.Username) {
+		createHome := "--no-create-home"
+		if cfg.CreateHome {
+			createHome = "--create-home"
 		}
-	} else {
-		// Create new user
-		cmd := exec.Command("useradd",
+		cmd := CommandExecutor("useradd",
 			"--system",
-			"--shell", "/usr/sbin/nologin",
-			"--no-create-home",
-			"--home-dir", "/nonexistent",
+			"--shell", shell,
+			createHome,
+			"--home-dir", homeDir(cfg),
 			"--gid", userGroup,
-			"--comment", fmt.Sprintf("SSH tunnel only (%s)", cfg.AuthMode),
+			"--comment", UserComment{Mode: cfg.AuthMode, Created: time.Now(), Version: createdByVersion(cfg), Note: cfg.Note}.Format(),
 			cfg.Username,
 		)
 		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to create user: %w", err)
+			return false, fmt.Errorf("failed to create user: %w", err)
+		}
+		fmt.Fprintf(out, "User '%s' created\n", cfg.Username)
+		changed = true
+		created = true
+	} else {
+		// Group membership
+		if !onlyInGroup(cfg.Username, userGroup) {
+			if err := switchAuthMode(cfg.Username, cfg.AuthMode, SwitchOptions{}); err != nil {
+				return false, err
+			}
+			changed = true
+		}
+
+		// Home directory
+		if u, err := lookupUser(cfg.Username); err == nil && u.HomeDir != homeDir(cfg) {
+			if err := CommandExecutor("usermod", "--home", homeDir(cfg), cfg.Username).Run(); err != nil {
+				return false, fmt.Errorf("failed to set home directory: %w", err)
+			}
+			if !cfg.EnableSFTP {
+				removeSFTPHome(cfg.Username)
+			}
+			changed = true
+		}
+
+		// Login shell
+		if current, err := getLoginShell(cfg.Username); err == nil && current != shell {
+			if err := CommandExecutor("usermod", "--shell", shell, cfg.Username).Run(); err != nil {
+				return false, fmt.Errorf("failed to set shell: %w", err)
+			}
+			changed = true
+		}
+
+		// Note; an empty cfg.Note keeps the current one
+		if c, err := readComment(cfg.Username); err == nil && cfg.Note != "" && c.Note != cfg.Note {
+			if err := setNote(cfg.Username, cfg.Note); err != nil {
+				return false, err
+			}
+			changed = true
 		}
-		fmt.Printf("User '%s' created\n", cfg.Username)
 	}
 
 	// Configure authentication
 	if cfg.AuthMode == AuthModeKey {
-		if err := SetupSSHKey(cfg.Username, cfg.PublicKey); err != nil {
-			return err
+		current, _ := os.ReadFile(keyFilePath(cfg.Username))
+		if string(current) != keyFileContent(cfg.PublicKey) {
+			if err := setupSSHKey(cfg.Username, cfg.PublicKey); err != nil {
+				return false, err
+			}
+			changed = true
 		}
 	} else {
-		if err := SetPassword(cfg.Username, cfg.Password); err != nil {
-			return err
+		if created || cfg.Password != "" {
+			if err := setPassword(cfg.Username, cfg.Password); err != nil {
+				return false, err
+			}
+			if cfg.ForcePasswordChange {
+				if err := expirePassword(cfg.Username); err != nil {
+					return false, err
+				}
+			}
+			changed = true
+		}
+		if existingKeyFile(cfg.Username) != "" {
+			if err := removeKeyFile(cfg.Username); err != nil {
+				return false, err
+			}
+			changed = true
 		}
 	}
 
+	if cfg.EnableSFTP {
+		if err := setupSFTPHome(cfg.Username); err != nil {
+			return changed, err
+		}
+	}
+	if cfg.AuthMode == AuthModeSFTP {
+		if err := setupSFTPOnlyHome(cfg.Username); err != nil {
+			return changed, err
+		}
+	}
+	if cfg.CreateHome {
+		if err := setupHomeDir(cfg); err != nil {
+			return changed, err
+		}
+	}
+
+	if cfg.EnableTOTP {
+		secret, err := setupTOTP(cfg.Username)
+		if err != nil {
+			return changed, err
+		}
+		if secret != "" {
+			cfg.TOTPSecret = secret
+			changed = true
+		}
+	} else if removeTOTP(cfg.Username) {
+		changed = true
+	}
+
+	// Per-user sshd settings
+	userChanged, err := applyUserConfig(cfg)
+	if err != nil {
+		return changed, fmt.Errorf("failed to apply per-user sshd settings: %w", err)
+	}
+	if userChanged {
+		changed = true
+	}
+
 	// Block cron/at access
-	blockScheduledTasks(cfg.Username)
+	if !cfg.AllowScheduledTasks && blockScheduledTasks(cfg.Username) {
+		changed = true
+	}
 
-	fmt.Printf("\nUser '%s' configured for tunnel-only access (%s auth)\n", cfg.Username, cfg.AuthMode)
-	return nil
+	return changed, nil
+}
+
+// applyUserConfig writes or removes the user's Match User block to match
+// cfg, keeping settings it doesn't manage, and reports whether it changed.
+func applyUserConfig(cfg *Config) (bool, error) {
+	opts, err := sshdconfig.ReadUserConfig(cfg.Username)
+	if err != nil {
+		return false, err
+	}
+	opts.PermitOpen = nil
+	if cfg.TunnelType.RestrictsDestinations() {
+		opts.PermitOpen = cfg.PermitOpen
+	}
+	opts.SFTP = cfg.EnableSFTP
+	opts.TOTP = cfg.EnableTOTP
+	opts.VerboseLogging = cfg.VerboseLogging
+	opts.PasswordChange = cfg.AuthMode == AuthModePassword && passwordChangePending(cfg.Username)
+	return sshdconfig.WriteUserConfig(opts)
+}
+
+// getLoginShell returns the login shell of a user from /etc/passwd.
+func getLoginShell(username string) (string, error) {
+	return passwdField(username, 6)
+}
+
+// SkipDenyFiles leaves the cron and at allow and deny files alone, for hosts
+// where configuration management owns them. Tunnel users can then schedule
+// jobs unless those files block them. Change it with SetSkipDenyFiles.
+var SkipDenyFiles bool
+
+// SetSkipDenyFiles sets SkipDenyFiles.
+func SetSkipDenyFiles(skip bool) {
+	SkipDenyFiles = skip
+}
+
+// scheduledTaskFiles pairs the allow and deny access files of cron and at
+// with the command users schedule jobs with.
+var scheduledTaskFiles = []struct {
+	command string
+	allow   string
+	deny    string
+}{
+	{"crontab", "/etc/cron.allow", "/etc/cron.deny"},
+	{"at", "/etc/at.allow", "/etc/at.deny"},
 }
 
-// blockScheduledTasks adds the user to cron.deny and at.deny.
-func blockScheduledTasks(username string) {
-	for _, denyFile := range []string{"/etc/cron.deny", "/etc/at.deny"} {
+// blockScheduledTasks prevents the user from scheduling cron/at jobs and
+// reports whether any access file was modified.
+//
+// cron and at use an allow-list model when their .allow file exists: only the
+// users listed there may schedule jobs and the .deny file is ignored. In that
+// case the user is removed from the .allow file, which is the effective block.
+// Otherwise the user is added to the .deny file, creating it if needed.
+//
+// Tools that aren't installed are skipped, so minimal images without cron
+// or at get no access files.
+func blockScheduledTasks(username string) bool {
+	if SkipDenyFiles {
+		return false
+	}
+	changed := false
+	for _, files := range scheduledTaskFiles {
+		if _, err := exec.LookPath(files.command); err != nil {
+			continue
+		}
+		if _, err := os.Stat(paths.Join(files.allow)); err == nil {
+			if removeLineFromFile(paths.Join(files.allow), username) {
+				changed = true
+			}
+			continue
+		}
+
+		denyFile := paths.Join(files.deny)
+
 		// Try to create file if it doesn't exist
 		if _, err := os.Stat(denyFile); os.IsNotExist(err) {
 			if f, err := os.Create(denyFile); err == nil {
@@ -145,9 +556,11 @@ func blockScheduledTasks(username string) {
 			if err == nil {
 				f.WriteString(username + "\n")
 				f.Close()
+				changed = true
 			}
 		}
 	}
+	return changed
 }
 
 func splitLines(s string) []string {
@@ -165,24 +578,110 @@ func splitLines(s string) []string {
 	return lines
 }
 
+// SwitchOptions controls which credential of the previous auth mode
+// SwitchAuthModeWithOptions keeps, e.g. as a fallback during a migration.
+type SwitchOptions struct {
+	PreserveOldKeyFile  bool // Keep the key file when switching to password auth
+	PreserveOldPassword bool // Keep the password usable when switching to key auth
+}
+
 // SwitchAuthMode changes a user's authentication mode by updating their group membership.
+// The credential belonging to the previous mode is revoked so the effective
+// authentication matches the declared mode: switching to password removes the
+// user's key file and unlocks a password locked by an earlier switch,
+// switching to key locks the password. If revoking fails the user is moved
+// back to their previous group. Root and admin users are refused with
+// ErrRefusingPrivilegedUser.
 func SwitchAuthMode(username string, newMode AuthMode) error {
+	return SwitchAuthModeWithOptions(username, newMode, SwitchOptions{})
+}
+
+// SwitchAuthModeWithOptions is SwitchAuthMode with options to keep the
+// previous credential.
+func SwitchAuthModeWithOptions(username string, newMode AuthMode, opts SwitchOptions) error {
+	return switchAuthMode(SystemName(username), newMode, opts)
+}
+
+// switchAuthMode is SwitchAuthModeWithOptions for an account name.
+func switchAuthMode(username string, newMode AuthMode, opts SwitchOptions) error {
+	defer DefaultCache.Invalidate()
+
+	if err := checkNotPrivileged(username); err != nil {
+		return err
+	}
+
 	// Determine target group
-	targetGroup := GroupPasswordAuth
-	if newMode == AuthModeKey {
-		targetGroup = GroupKeyAuth
+	targetGroup := groupForMode(newMode)
+	previousMode, modeErr := getAuthMode(username)
+	if modeErr == nil && previousMode != newMode && (previousMode == AuthModeSFTP || newMode == AuthModeSFTP) {
+		return fmt.Errorf("switching '%s' between SFTP-only and tunnel access is not supported; delete and recreate the user", username)
+	}
+
+	if err := moveToGroup(username, targetGroup); err != nil {
+		return err
+	}
+
+	// Revoke the credential of the previous mode
+	var err error
+	switch {
+	case newMode == AuthModeKey && !opts.PreserveOldPassword:
+		if err = CommandExecutor("usermod", "-L", username).Run(); err != nil {
+			err = fmt.Errorf("failed to lock password: %w", err)
+		}
+	case newMode == AuthModePassword:
+		if !opts.PreserveOldKeyFile {
+			err = removeKeyFile(username)
+		}
+		if err == nil {
+			err = unlockPassword(username)
+		}
+	}
+	if err != nil && modeErr == nil && previousMode != newMode {
+		moveToGroup(username, groupForMode(previousMode))
 	}
+	if err == nil {
+		// The comment only describes the user, so a stale mode is not an error
+		setCommentMode(username, newMode)
+	}
+	return err
+}
 
+// moveToGroup makes group the user's only tunnel group.
+func moveToGroup(username, group string) error {
 	// Remove from both tunnel groups first
-	for _, group := range []string{GroupPasswordAuth, GroupKeyAuth} {
-		exec.Command("gpasswd", "-d", username, group).Run()
+	for _, g := range tunnelGroups() {
+		CommandExecutor("gpasswd", "-d", username, g).Run()
 	}
 
-	// Add to the target group
-	cmd := exec.Command("usermod", "-aG", targetGroup, username)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to add user to group %s: %w", targetGroup, err)
+	// Add to the target group. Users created by this tool have a tunnel group
+	// as their primary group, which gpasswd cannot remove, so move that too.
+	args := []string{"-aG", group, username}
+	for _, g := range tunnelGroups() {
+		if primary, _ := isPrimaryGroup(username, g); primary {
+			args = []string{"-g", group, username}
+			break
+		}
 	}
+	if err := CommandExecutor("usermod", args...).Run(); err != nil {
+		return fmt.Errorf("failed to add user to group %s: %w", group, err)
+	}
+	return nil
+}
 
+// removeKeyFile removes the user's key file from AuthorizedKeysDir and
+// ~/.ssh if present.
+func removeKeyFile(username string) error {
+	if err := removeCentralKeyFile(username); err != nil {
+		return err
+	}
+	return removePerUserKeys(lookupHome(username))
+}
+
+// removeCentralKeyFile removes the user's key file from AuthorizedKeysDir
+// if present.
+func removeCentralKeyFile(username string) error {
+	if err := os.Remove(centralKeyFile(username)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove SSH key file: %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,92 @@
+package tunneluser_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/net2share/sshtun-user/pkg/tunneltesting"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+)
+
+// createUser creates a tunnel user on the installed fake system.
+func createUser(t *testing.T, username string, mode tunneluser.AuthMode) {
+	t.Helper()
+	cfg := &tunneluser.Config{Username: username, AuthMode: mode}
+	if mode == tunneluser.AuthModeKey {
+		cfg.PublicKey = tunneltesting.TestKey
+	} else {
+		cfg.Password = "correct horse battery staple"
+	}
+	if err := tunneluser.Create(cfg); err != nil {
+		t.Fatalf("Create(%s): %v", username, err)
+	}
+}
+
+func TestCreateAndDelete(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+
+	createUser(t, "alice", tunneluser.AuthModePassword)
+	fs.AssertUserExists(t, "alice")
+	fs.AssertInGroup(t, "alice", tunneluser.GroupPasswordAuth)
+
+	if err := tunneluser.Delete("alice"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	fs.AssertUserNotExists(t, "alice")
+}
+
+func TestSwitchAuthModeToPasswordRemovesKeyFile(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+
+	createUser(t, "alice", tunneluser.AuthModeKey)
+	if _, err := os.Stat(fs.KeyFile("alice")); err != nil {
+		t.Fatalf("key file not created: %v", err)
+	}
+	fs.SetPassword("alice", "new password")
+
+	if err := tunneluser.SwitchAuthMode("alice", tunneluser.AuthModePassword); err != nil {
+		t.Fatalf("SwitchAuthMode: %v", err)
+	}
+	if _, err := os.Stat(fs.KeyFile("alice")); !os.IsNotExist(err) {
+		t.Errorf("key file still present after switching to password (err %v)", err)
+	}
+	fs.AssertInGroup(t, "alice", tunneluser.GroupPasswordAuth)
+	if mode, err := tunneluser.GetAuthMode("alice"); err != nil || mode != tunneluser.AuthModePassword {
+		t.Errorf("GetAuthMode = %q, %v; want password", mode, err)
+	}
+}
+
+func TestSwitchAuthModeToKeyLocksPassword(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+
+	createUser(t, "bob", tunneluser.AuthModePassword)
+	if locked, err := tunneluser.IsPasswordLocked("bob"); err != nil || locked {
+		t.Fatalf("IsPasswordLocked before switch = %v, %v; want false", locked, err)
+	}
+
+	if err := tunneluser.SwitchAuthMode("bob", tunneluser.AuthModeKey); err != nil {
+		t.Fatalf("SwitchAuthMode: %v", err)
+	}
+	if locked, err := tunneluser.IsPasswordLocked("bob"); err != nil || !locked {
+		t.Errorf("IsPasswordLocked after switch = %v, %v; want true", locked, err)
+	}
+	fs.AssertInGroup(t, "bob", tunneluser.GroupKeyAuth)
+}
+
+func TestSwitchAuthModeKeepsOldCredentialWhenAsked(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+
+	createUser(t, "carol", tunneluser.AuthModeKey)
+	fs.SetPassword("carol", "new password")
+	opts := tunneluser.SwitchOptions{PreserveOldKeyFile: true}
+	if err := tunneluser.SwitchAuthModeWithOptions("carol", tunneluser.AuthModePassword, opts); err != nil {
+		t.Fatalf("SwitchAuthModeWithOptions: %v", err)
+	}
+	if _, err := os.Stat(fs.KeyFile("carol")); err != nil {
+		t.Errorf("key file removed despite PreserveOldKeyFile: %v", err)
+	}
+}
@@ -1,20 +1,94 @@
 package tunneluser
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
+
+	"github.com/net2share/sshtun-user/pkg/paths"
+	"github.com/net2share/sshtun-user/pkg/sshdconfig"
 )
 
+// ProgressFunc is called after each deletion attempt with the user, the
+// number of attempts so far, the total and the deletion error, if any.
+type ProgressFunc func(username string, done, total int, err error)
+
+// PerUser adapts fn, which only wants each user and its deletion error, to
+// a ProgressFunc, e.g. for a UI that lists the users as they go.
+func PerUser(fn func(username string, err error)) ProgressFunc {
+	return func(username string, _, _ int, err error) {
+		fn(username, err)
+	}
+}
+
+// PrintDeleteProgress prints a counter line per deleted user, e.g.
+// "Deleting users: 3/10 (alice... done)". It is a ProgressFunc.
+func PrintDeleteProgress(username string, done, total int, err error) {
+	if err != nil {
+		fmt.Fprintf(out, "Deleting users: %d/%d (%s... failed: %v)\n", done, total, username, err)
+		return
+	}
+	fmt.Fprintf(out, "Deleting users: %d/%d (%s... done)\n", done, total, username)
+}
+
 // DeleteAllUsers deletes all tunnel users (members of tunnel groups).
-// Returns the list of deleted usernames and any error.
+// Returns the deleted accounts, with UserPrefix, and any error.
 func DeleteAllUsers() ([]string, error) {
+	return DeleteAllUsersWithProgress(context.Background(), nil)
+}
+
+// DeleteAllUsersWithProgress is DeleteAllUsers with a progress callback,
+// which may be nil. Cancelling ctx stops before the next user; the users
+// deleted so far are returned with the context's error.
+func DeleteAllUsersWithProgress(ctx context.Context, progressFn ProgressFunc) ([]string, error) {
 	users, err := List()
 	if err != nil {
 		return nil, fmt.Errorf("failed to list users: %w", err)
 	}
+	return deleteUsers(ctx, users, progressFn)
+}
+
+// MatchingUsers returns the tunnel users whose logical name matches the
+// regular expression pattern.
+func MatchingUsers(pattern string) ([]UserInfo, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+	users, err := List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	var matching []UserInfo
+	for _, u := range users {
+		if re.MatchString(u.Username) {
+			matching = append(matching, u)
+		}
+	}
+	return matching, nil
+}
+
+// DeleteMatchingUsers deletes the tunnel users whose username matches the
+// regular expression pattern, leaving the others alone. It returns the
+// deleted accounts.
+func DeleteMatchingUsers(pattern string) ([]string, error) {
+	return DeleteMatchingUsersWithProgress(context.Background(), pattern, nil)
+}
+
+// DeleteMatchingUsersWithProgress is DeleteMatchingUsers with a context and
+// progress callback, as for DeleteAllUsersWithProgress.
+func DeleteMatchingUsersWithProgress(ctx context.Context, pattern string, progressFn ProgressFunc) ([]string, error) {
+	users, err := MatchingUsers(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return deleteUsers(ctx, users, progressFn)
+}
 
+// deleteUsers deletes users in order, collecting failures.
+func deleteUsers(ctx context.Context, users []UserInfo, progressFn ProgressFunc) ([]string, error) {
 	if len(users) == 0 {
 		return nil, nil
 	}
@@ -22,11 +96,21 @@ func DeleteAllUsers() ([]string, error) {
 	var deleted []string
 	var errors []string
 
-	for _, user := range users {
-		if err := Delete(user.Username); err != nil {
+	for i, user := range users {
+		if err := ctx.Err(); err != nil {
+			return deleted, fmt.Errorf("deleting users interrupted: %w", err)
+		}
+		// Record the UID before it's gone, so log entries that only show the
+		// number can still be traced to the user.
+		fmt.Fprintf(out, "Deleting user '%s' (uid %d)\n", user.Username, user.UID)
+		err := Delete(user.Username)
+		if err != nil {
 			errors = append(errors, fmt.Sprintf("%s: %v", user.Username, err))
 		} else {
-			deleted = append(deleted, user.Username)
+			deleted = append(deleted, SystemName(user.Username))
+		}
+		if progressFn != nil {
+			progressFn(user.Username, i+1, len(users), err)
 		}
 	}
 
@@ -40,7 +124,7 @@ func DeleteAllUsers() ([]string, error) {
 // GroupsHaveUsers checks if the tunnel groups have any members.
 // This checks both supplementary group membership and users with primary group.
 func GroupsHaveUsers() (bool, error) {
-	for _, group := range []string{GroupPasswordAuth, GroupKeyAuth} {
+	for _, group := range tunnelGroups() {
 		// Check supplementary group members
 		members, err := getGroupMembers(group)
 		if err == nil && len(members) > 0 {
@@ -56,9 +140,12 @@ func GroupsHaveUsers() (bool, error) {
 	return false, nil
 }
 
-// DeleteGroups deletes the tunnel groups.
-// Returns error if groups still have members.
+// DeleteGroups deletes the tunnel groups that exist, checked with
+// user.LookupGroup rather than getent, which some hosts make fail for a
+// group without members. Returns error if groups still have members.
 func DeleteGroups() error {
+	defer DefaultCache.Invalidate()
+
 	hasUsers, err := GroupsHaveUsers()
 	if err != nil {
 		return err
@@ -67,13 +154,13 @@ func DeleteGroups() error {
 		return fmt.Errorf("cannot delete groups: tunnel users still exist. Delete users first")
 	}
 
-	for _, group := range []string{GroupPasswordAuth, GroupKeyAuth} {
+	for _, group := range tunnelGroups() {
 		// Check if group exists before trying to delete
-		if _, err := exec.Command("getent", "group", group).Output(); err != nil {
+		if _, err := lookupGroup(group); err != nil {
 			continue // Group doesn't exist
 		}
 
-		cmd := exec.Command("groupdel", group)
+		cmd := CommandExecutor("groupdel", group)
 		if err := cmd.Run(); err != nil {
 			return fmt.Errorf("failed to delete group %s: %w", group, err)
 		}
@@ -82,50 +169,160 @@ func DeleteGroups() error {
 	return nil
 }
 
-// CleanupAuthorizedKeysDir removes the authorized_keys.d directory if empty,
-// or removes only the files for deleted users.
-func CleanupAuthorizedKeysDir() error {
-	// Check if directory exists
-	if _, err := os.Stat(AuthorizedKeysDir); os.IsNotExist(err) {
-		return nil
+// GroupMembers lists the members of each existing tunnel group: supplementary
+// members first, then users with the group as primary group, marked with a
+// "(primary)" suffix. Groups without members are included with an empty list.
+func GroupMembers() (map[string][]string, error) {
+	members := make(map[string][]string)
+	for _, group := range tunnelGroups() {
+		if _, err := lookupGroup(group); err != nil {
+			continue // Group doesn't exist
+		}
+		supplementary, err := getGroupMembers(group)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list members of %s: %w", group, err)
+		}
+		primary, err := getUsersWithPrimaryGroup(group)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list users with primary group %s: %w", group, err)
+		}
+		list := append([]string{}, supplementary...)
+		for _, u := range primary {
+			list = append(list, u+" (primary)")
+		}
+		members[group] = list
 	}
+	return members, nil
+}
 
-	// Read directory contents
-	entries, err := os.ReadDir(AuthorizedKeysDir)
-	if err != nil {
-		return fmt.Errorf("failed to read authorized_keys.d: %w", err)
+// DeleteGroupsForce deletes the tunnel groups even if they still have
+// members, e.g. after accounts were removed by hand and group membership is
+// inconsistent. With removeOrphanedMembers each supplementary member is
+// removed with gpasswd -d first. Accounts are never deleted. groupdel still
+// fails for a group that is some account's primary group.
+//
+// Use DeleteGroups for normal uninstalls.
+func DeleteGroupsForce(removeOrphanedMembers bool) error {
+	defer DefaultCache.Invalidate()
+
+	for _, group := range tunnelGroups() {
+		if _, err := lookupGroup(group); err != nil {
+			continue // Group doesn't exist
+		}
+
+		if removeOrphanedMembers {
+			members, err := getGroupMembers(group)
+			if err != nil {
+				return fmt.Errorf("failed to list members of %s: %w", group, err)
+			}
+			for _, member := range members {
+				if err := CommandExecutor("gpasswd", "-d", member, group).Run(); err != nil {
+					return fmt.Errorf("failed to remove %s from group %s: %w", member, group, err)
+				}
+			}
+		}
+
+		if err := CommandExecutor("groupdel", group).Run(); err != nil {
+			return fmt.Errorf("failed to delete group %s: %w", group, err)
+		}
 	}
 
-	// If empty, remove the directory
-	if len(entries) == 0 {
-		return os.Remove(AuthorizedKeysDir)
+	return nil
+}
+
+// FindOrphanedKeyFiles returns the paths of the key files in the
+// authorized keys directory whose account no longer exists, e.g. after a
+// manual userdel.
+func FindOrphanedKeyFiles() ([]string, error) {
+	keysDir := authorizedKeysDir()
+	entries, err := os.ReadDir(keysDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read authorized_keys.d: %w", err)
 	}
 
-	// Otherwise, just remove files for users that no longer exist
+	var orphaned []string
 	for _, entry := range entries {
 		if entry.IsDir() {
 			continue
 		}
-		username := entry.Name()
-		if !Exists(username) {
-			os.Remove(filepath.Join(AuthorizedKeysDir, username))
+		if !accountExists(entry.Name()) {
+			orphaned = append(orphaned, filepath.Join(keysDir, entry.Name()))
 		}
 	}
+	return orphaned, nil
+}
 
-	// Check again if directory is now empty
-	entries, _ = os.ReadDir(AuthorizedKeysDir)
+// RemoveOrphanedKeyFiles removes the files FindOrphanedKeyFiles reports and
+// returns the ones it removed.
+func RemoveOrphanedKeyFiles() ([]string, error) {
+	orphaned, err := FindOrphanedKeyFiles()
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, path := range orphaned {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+// CleanupAuthorizedKeysDir removes the key files of deleted users, then the
+// authorized_keys.d directory itself once it is empty and no managed sshd
+// drop-in still points at it.
+func CleanupAuthorizedKeysDir() error {
+	// Check if directory exists
+	keysDir := authorizedKeysDir()
+	if _, err := os.Stat(keysDir); os.IsNotExist(err) {
+		return nil
+	}
+
+	// Remove files for users that no longer exist
+	if _, err := RemoveOrphanedKeyFiles(); err != nil {
+		return err
+	}
+
+	// Keep the directory while sshd config referencing it is installed
+	managed, err := sshdconfig.ListManagedFiles()
+	if err != nil {
+		return err
+	}
+	if len(managed) > 0 {
+		return nil
+	}
+
+	entries, _ := os.ReadDir(keysDir)
 	if len(entries) == 0 {
-		return os.Remove(AuthorizedKeysDir)
+		return os.Remove(keysDir)
 	}
 
 	return nil
 }
 
-// CleanupDenyFiles removes all tunnel user entries from cron.deny and at.deny.
-// Since we can't know which entries we added, this removes entries for users
-// that no longer exist on the system.
-func CleanupDenyFiles() {
-	for _, denyFile := range []string{"/etc/cron.deny", "/etc/at.deny"} {
+// CleanupTunnelDenyFiles removes the cron.deny and at.deny entries of the
+// given tunnel accounts, typically those just removed by Delete or
+// DeleteAllUsers. Entries for other users are left alone. Like the other
+// deny file changes, it does nothing with SkipDenyFiles.
+func CleanupTunnelDenyFiles(deletedUsernames []string) {
+	for _, username := range deletedUsernames {
+		removeFromDenyFiles(username)
+	}
+}
+
+// CleanupStaleDenyEntries removes the cron.deny and at.deny entries of every
+// user that no longer exists, including entries an administrator added for
+// non-tunnel users. Only a complete uninstall should call it.
+func CleanupStaleDenyEntries() {
+	if SkipDenyFiles {
+		return
+	}
+	for _, files := range scheduledTaskFiles {
+		denyFile := paths.Join(files.deny)
 		data, err := os.ReadFile(denyFile)
 		if err != nil {
 			continue
@@ -135,7 +332,7 @@ func CleanupDenyFiles() {
 		var newLines []string
 		for _, line := range lines {
 			// Keep the line if it's empty or the user still exists
-			if line == "" || Exists(line) {
+			if line == "" || accountExists(line) {
 				newLines = append(newLines, line)
 			}
 		}
@@ -0,0 +1,76 @@
+package tunneluser_test
+
+import (
+	"context"
+	"os/exec"
+	"slices"
+	"testing"
+
+	"github.com/net2share/sshtun-user/pkg/tunneltesting"
+	"github.com/net2share/sshtun-user/pkg/tunneluser"
+)
+
+// failGetent makes getent fail for every key, as it does on hosts where it
+// exits non-zero for a group without members.
+func failGetent(t *testing.T) {
+	executor := tunneluser.CommandExecutor
+	t.Cleanup(func() { tunneluser.CommandExecutor = executor })
+	tunneluser.CommandExecutor = func(name string, arg ...string) *exec.Cmd {
+		if name == "getent" {
+			return exec.Command("false")
+		}
+		return executor(name, arg...)
+	}
+}
+
+func TestDeleteGroupsRemovesEmptyGroups(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+	if err := tunneluser.EnsureGroups(); err != nil {
+		t.Fatalf("EnsureGroups: %v", err)
+	}
+	failGetent(t)
+
+	if err := tunneluser.DeleteGroups(); err != nil {
+		t.Fatalf("DeleteGroups: %v", err)
+	}
+	for _, group := range []string{tunneluser.GroupPasswordAuth, tunneluser.GroupKeyAuth, tunneluser.GroupSFTP} {
+		fs.AssertGroupNotExists(t, group)
+	}
+}
+
+func TestDeleteGroupsKeepsGroupsWithUsers(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+	createUser(t, "alice", tunneluser.AuthModeKey)
+	if err := tunneluser.EnsureGroups(); err != nil {
+		t.Fatalf("EnsureGroups: %v", err)
+	}
+
+	if err := tunneluser.DeleteGroups(); err == nil {
+		t.Fatal("DeleteGroups succeeded while a tunnel user exists")
+	}
+	fs.AssertInGroup(t, "alice", tunneluser.GroupKeyAuth)
+}
+
+func TestDeleteAllUsersPerUserProgress(t *testing.T) {
+	fs := tunneltesting.New(t)
+	fs.Install()
+	createUser(t, "alice", tunneluser.AuthModeKey)
+	createUser(t, "bob", tunneluser.AuthModePassword)
+
+	var reported []string
+	progress := tunneluser.PerUser(func(username string, err error) {
+		if err != nil {
+			t.Errorf("deleting %s: %v", username, err)
+		}
+		reported = append(reported, username)
+	})
+	if _, err := tunneluser.DeleteAllUsersWithProgress(context.Background(), progress); err != nil {
+		t.Fatalf("DeleteAllUsersWithProgress: %v", err)
+	}
+	slices.Sort(reported)
+	if want := []string{"alice", "bob"}; !slices.Equal(reported, want) {
+		t.Errorf("progress reported %v, want %v", reported, want)
+	}
+}